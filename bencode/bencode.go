@@ -1,10 +1,14 @@
 package bencode
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"slices"
 	"strconv"
 	"strings"
+	"unsafe"
 )
 
 type Bencode any
@@ -14,148 +18,427 @@ type BString string
 type BList []Bencode
 type BMap map[BString]Bencode
 
+// OrderedBMap is a dict that keeps its entries in the order they were
+// decoded, see Options.PreserveOrder. It is encoded in that order too, so a
+// non canonical dict round trips byte for byte.
+type OrderedBMap []KeyValue
+
+type KeyValue struct {
+	Key   BString
+	Value Bencode
+}
+
+// Bytes returns the string's bytes without copying them, so for a BString
+// decoded with ZeroCopy they are the input buffer itself. The result must not
+// be modified, copy it first if it has to be.
+func (s BString) Bytes() []byte {
+	return unsafe.Slice(unsafe.StringData(string(s)), len(s))
+}
+
+// Get returns the value of key, the last one if key is repeated as BMap
+// would keep.
+func (m OrderedBMap) Get(key BString) (Bencode, bool) {
+	for i := len(m) - 1; i >= 0; i -= 1 {
+		if m[i].Key == key {
+			return m[i].Value, true
+		}
+	}
+	return nil, false
+}
+
+var (
+	ErrLimitExceeded = errors.New("decode limit exceeded")
+	ErrEmptyInteger  = errors.New("integer has no digits")
+	ErrNotCanonical  = errors.New("not in canonical form")
+)
+
+// SyntaxError reports malformed input along with the byte offset into the
+// decoded buffer where it was detected. Err is set for the failures callers
+// may want to tell apart with errors.Is.
+type SyntaxError struct {
+	Offset int
+	Msg    string
+	Err    error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at offset %d", e.Msg, e.Offset)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+func syntaxError(offset int, format string, args ...any) error {
+	return &SyntaxError{Offset: offset, Msg: fmt.Sprintf(format, args...)}
+}
+
+const (
+	ctxCheckInterval    = 1024
+	DefaultMaxStringLen = 64 << 20
+)
+
+// Options bounds the work done while decoding, a zero limit means unlimited.
+type Options struct {
+	MaxStringLen     int
+	MaxTotalElements int
+	// ZeroCopy makes decoded BString values alias the input buffer, they are
+	// only valid while the buffer is alive and unmodified.
+	ZeroCopy bool
+	// Lenient accepts input that decodes fine but isn't canonical bencode:
+	// integers with a sign or leading zeros and dict keys out of order or
+	// repeated, the last value winning. Re-encoding such values doesn't give
+	// back the input, so hash the original bytes instead.
+	Lenient bool
+	// PreserveOrder decodes dicts as OrderedBMap instead of BMap.
+	PreserveOrder bool
+}
+
+func DefaultOptions() Options {
+	return Options{MaxStringLen: DefaultMaxStringLen}
+}
+
+// LenientOptions are DefaultOptions accepting non canonical input, for
+// protocol messages where nothing is hashed and peers aren't always strict.
+func LenientOptions() Options {
+	opts := DefaultOptions()
+	opts.Lenient = true
+	return opts
+}
+
+type decoder struct {
+	ctx      context.Context
+	opts     Options
+	elements int
+	// scratch collects the elements of the lists being decoded, nested lists
+	// push theirs on top and are copied out once complete.
+	scratch []Bencode
+}
+
+func newDecoder(ctx context.Context, opts Options) *decoder {
+	return &decoder{ctx: ctx, opts: opts}
+}
+
+func (dec *decoder) countElement() error {
+	dec.elements += 1
+	if dec.opts.MaxTotalElements > 0 && dec.elements > dec.opts.MaxTotalElements {
+		return fmt.Errorf("more than %d elements: %w", dec.opts.MaxTotalElements, ErrLimitExceeded)
+	}
+
+	if dec.elements%ctxCheckInterval != 0 {
+		return nil
+	}
+
+	return dec.ctx.Err()
+}
+
 func Decode(d []byte) (Bencode, int, error) {
+	return newDecoder(context.Background(), DefaultOptions()).decode(d, 0)
+}
+
+func DecodeContext(ctx context.Context, d []byte) (Bencode, int, error) {
+	return newDecoder(ctx, DefaultOptions()).decode(d, 0)
+}
+
+func DecodeWithOptions(ctx context.Context, d []byte, opts Options) (Bencode, int, error) {
+	return newDecoder(ctx, opts).decode(d, 0)
+}
+
+// DecodeAll decodes every value in a buffer of concatenated bencode values.
+func DecodeAll(d []byte) ([]Bencode, error) {
+	dec := newDecoder(context.Background(), DefaultOptions())
+
+	ret := make([]Bencode, 0)
+	for idx := 0; idx < len(d); {
+		value, next, err := dec.decode(d, idx)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, value)
+		idx = next
+	}
+
+	return ret, nil
+}
+
+// The decoder methods take the whole buffer and the index of the value to
+// decode in it, and return the index just past that value. Nothing re-slices
+// d, so offsets in errors are always into the caller's buffer.
+
+func (dec *decoder) decode(d []byte, pos int) (Bencode, int, error) {
 
-	if len(d) == 0 {
-		return nil, 0, fmt.Errorf("got empty value to decode")
+	if pos >= len(d) {
+		return nil, 0, syntaxError(pos, "got empty value to decode")
 	}
 
 	switch {
-	case d[0] == 'i':
-		value, idx, err := DecodeBInt64(d)
+	case d[pos] == 'i':
+		value, next, err := dec.decodeBInt64(d, pos)
 		if err != nil {
 			return nil, 0, err
 		}
 
-		return value, idx, nil
-	case d[0] >= '0' && d[0] <= '9':
-		value, idx, err := DecodeBString(d)
+		return value, next, nil
+	case d[pos] >= '0' && d[pos] <= '9':
+		value, next, err := dec.decodeBString(d, pos)
 		if err != nil {
 			return nil, 0, err
 		}
 
-		return value, idx, nil
-	case d[0] == 'l':
-		value, idx, err := DecodeBList(d)
+		return value, next, nil
+	case d[pos] == 'l':
+		value, next, err := dec.decodeBList(d, pos)
 		if err != nil {
 			return nil, 0, err
 		}
 
-		return value, idx, err
-	case d[0] == 'd':
-		value, idx, err := DecodeBMap(d)
+		return value, next, err
+	case d[pos] == 'd' && dec.opts.PreserveOrder:
+		value, next, err := dec.decodeOrderedBMap(d, pos)
 		if err != nil {
 			return nil, 0, err
 		}
 
-		return value, idx, err
+		return value, next, err
+	case d[pos] == 'd':
+		value, next, err := dec.decodeBMap(d, pos)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return value, next, err
 	default:
-		return nil, 0, fmt.Errorf("invalid first token: %c while decoding", d[0])
+		return nil, 0, syntaxError(pos, "invalid first token: %c while decoding", d[pos])
 	}
 }
 
 func DecodeBInt64(d []byte) (BInt64, int, error) {
-	idx := 1
+	return newDecoder(context.Background(), DefaultOptions()).decodeBInt64(d, 0)
+}
+
+func (dec *decoder) decodeBInt64(d []byte, pos int) (BInt64, int, error) {
+	idx := pos + 1
+
+	if len(d)-pos == 2 && d[idx] == 'e' {
+		return BInt64(0), 0, &SyntaxError{Offset: pos, Msg: ErrEmptyInteger.Error(), Err: ErrEmptyInteger}
+	}
 
-	if len(d) < 3 {
-		return BInt64(0), 0, fmt.Errorf("shortest bint64 is of len 3, buffer len: %v", len(d))
+	if len(d)-pos < 3 {
+		return BInt64(0), 0, syntaxError(pos, "shortest bint64 is of len 3, buffer len: %v", len(d)-pos)
 	}
 
 	for ; idx < len(d) && d[idx] != 'e'; idx += 1 {
 	}
 	if idx == len(d) {
-		return BInt64(0), 0, fmt.Errorf("EOF while decoding int")
+		return BInt64(0), 0, syntaxError(idx, "EOF while decoding int")
 	}
 
-	value, err := strconv.Atoi(string(d[1:idx]))
+	// strconv would take these too but its error doesn't say what's wrong.
+	digits := d[pos+1 : idx]
+	if string(digits) == "" || string(digits) == "-" {
+		return BInt64(0), 0, &SyntaxError{Offset: pos + 1, Msg: ErrEmptyInteger.Error(), Err: ErrEmptyInteger}
+	}
+
+	value, err := strconv.Atoi(string(digits))
 	if err != nil {
-		return BInt64(0), 0, err
+		return BInt64(0), 0, syntaxError(pos+1, "invalid int %q", digits)
 	}
 
-	idx += 1
-	return BInt64(value), idx, nil
+	if !dec.opts.Lenient && strconv.Itoa(value) != string(digits) {
+		return BInt64(0), 0, &SyntaxError{Offset: pos + 1, Msg: fmt.Sprintf("int %q %s", digits, ErrNotCanonical), Err: ErrNotCanonical}
+	}
+
+	return BInt64(value), idx + 1, nil
 }
 
 func DecodeBString(d []byte) (BString, int, error) {
-	idx := 0
+	return newDecoder(context.Background(), DefaultOptions()).decodeBString(d, 0)
+}
+
+func (dec *decoder) decodeBString(d []byte, pos int) (BString, int, error) {
+	idx := pos
 
 	for ; idx < len(d) && d[idx] != ':'; idx += 1 {
 	}
 
-	if idx == len(d) && d[idx] != ':' {
-		return BString(""), 0, fmt.Errorf("EOF while decoding string")
+	if idx == len(d) {
+		return BString(""), 0, syntaxError(idx, "EOF while decoding string")
 	}
 
-	strLen, err := strconv.Atoi(string(d[:idx]))
-	if err != nil {
-		return BString(""), 0, fmt.Errorf("invalid string len while decoding string")
+	prefix := d[pos:idx]
+	strLen, err := strconv.Atoi(string(prefix))
+	if err != nil || strLen < 0 {
+		return BString(""), 0, syntaxError(pos, "invalid string len while decoding string")
+	}
+
+	if !dec.opts.Lenient && strconv.Itoa(strLen) != string(prefix) {
+		return BString(""), 0, &SyntaxError{Offset: pos, Msg: fmt.Sprintf("string len %q %s", prefix, ErrNotCanonical), Err: ErrNotCanonical}
+	}
+
+	if dec.opts.MaxStringLen > 0 && strLen > dec.opts.MaxStringLen {
+		return BString(""), 0, fmt.Errorf("string len %d exceeds %d: %w", strLen, dec.opts.MaxStringLen, ErrLimitExceeded)
+	}
+
+	// compared this way round so a huge strLen can't overflow
+	if strLen > len(d)-idx-1 {
+		return BString(""), 0, syntaxError(len(d), "string exceeds bufferlen")
 	}
 
-	if len(d) < (idx + strLen + 1) {
-		return BString(""), 0, fmt.Errorf("string exceeds bufferlen")
+	start, end := idx+1, idx+1+strLen
+	if dec.opts.ZeroCopy && strLen > 0 {
+		return BString(unsafe.String(&d[start], strLen)), end, nil
 	}
 
-	return BString(strings.Clone(string(d[idx+1 : idx+strLen+1]))), idx + 1 + strLen, nil
+	return BString(strings.Clone(string(d[start:end]))), end, nil
 }
 
 func DecodeBList(d []byte) (BList, int, error) {
-	if d[0] != 'l' {
-		return nil, 0, fmt.Errorf("expected list but got something else")
+	return newDecoder(context.Background(), DefaultOptions()).decodeBList(d, 0)
+}
+
+func (dec *decoder) decodeBList(d []byte, pos int) (BList, int, error) {
+	if d[pos] != 'l' {
+		return nil, 0, syntaxError(pos, "expected list but got something else")
 	}
-	idx := 1
-	ret := make([]Bencode, 0)
+	idx := pos + 1
+	mark := len(dec.scratch)
+	defer func() { dec.scratch = dec.scratch[:mark] }()
 	for idx < len(d) && d[idx] != 'e' {
-		value, incr, err := Decode(d[idx:])
+		if err := dec.countElement(); err != nil {
+			return BList{}, 0, err
+		}
+
+		value, next, err := dec.decode(d, idx)
 		if err != nil {
 			return BList{}, 0, err
 		}
 
-		ret = append(ret, value)
-		idx += incr
+		dec.scratch = append(dec.scratch, value)
+		idx = next
 	}
 
 	if idx == len(d) || d[idx] != 'e' {
-		return BList{}, 0, fmt.Errorf("EOF while decoding Blist")
+		return BList{}, 0, syntaxError(idx, "EOF while decoding Blist")
 	}
 
-	return BList(ret), idx, nil
+	ret := make(BList, len(dec.scratch)-mark)
+	copy(ret, dec.scratch[mark:])
+	return ret, idx + 1, nil
 }
 
 func DecodeBMap(d []byte) (BMap, int, error) {
-	if d[0] != 'd' {
-		return nil, 0, fmt.Errorf("expected dict found something else")
-	}
+	return newDecoder(context.Background(), DefaultOptions()).decodeBMap(d, 0)
+}
 
-	idx := 1
+func (dec *decoder) decodeBMap(d []byte, pos int) (BMap, int, error) {
 	ret := make(map[BString]Bencode)
+	next, err := dec.decodeDict(d, pos, func(key BString, value Bencode) {
+		ret[key] = value
+	})
+	if err != nil {
+		return nil, 0, err
+	}
 
-	for idx < len(d) && d[idx] != 'e' {
-		value, incr, err := Decode(d[idx:])
+	return BMap(ret), next, nil
+}
+
+func (dec *decoder) decodeOrderedBMap(d []byte, pos int) (OrderedBMap, int, error) {
+	ret := make(OrderedBMap, 0)
+	next, err := dec.decodeDict(d, pos, func(key BString, value Bencode) {
+		ret = append(ret, KeyValue{Key: key, Value: value})
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return ret, next, nil
+}
+
+// decodeDict decodes the dict at d[pos], passing its entries to add in input
+// order.
+func (dec *decoder) decodeDict(d []byte, pos int, add func(key BString, value Bencode)) (int, error) {
+	if d[pos] != 'd' {
+		return 0, syntaxError(pos, "expected dict found something else")
+	}
+
+	idx := pos + 1
+	var prev BString
+	for first := true; idx < len(d) && d[idx] != 'e'; first = false {
+		if err := dec.countElement(); err != nil {
+			return 0, err
+		}
+
+		value, next, err := dec.decode(d, idx)
 		if err != nil {
-			return nil, 0, err
+			return 0, err
 		}
 
 		key, ok := value.(BString)
 		if !ok {
-			return nil, 0, fmt.Errorf("key not a BString")
+			return 0, syntaxError(idx, "key not a BString")
+		}
+
+		if !dec.opts.Lenient && !first && key <= prev {
+			return 0, &SyntaxError{Offset: idx, Msg: fmt.Sprintf("key %q after %q %s", key, prev, ErrNotCanonical), Err: ErrNotCanonical}
 		}
+		prev = key
 
-		idx += incr
-		value, incr, err = Decode(d[idx:])
+		idx = next
+		value, next, err = dec.decode(d, idx)
 		if err != nil {
-			return nil, 0, err
+			return 0, err
 		}
 
-		ret[BString(string(key))] = value
-		idx += incr
+		add(BString(string(key)), value)
+		idx = next
+
+	}
+
+	if idx == len(d) {
+		return 0, syntaxError(idx, "EOF while decoding BMap")
+	}
 
+	return idx + 1, nil
+}
+
+// RawDictValue returns the bytes d holds for key's value, d being an encoded
+// dict. It is how callers hash a value as it was received, e.g. the info
+// dict of a torrent decoded with Lenient. The result aliases d.
+func RawDictValue(d []byte, key BString) ([]byte, bool, error) {
+	dec := newDecoder(context.Background(), Options{Lenient: true, ZeroCopy: true})
+	if len(d) == 0 || d[0] != 'd' {
+		return nil, false, syntaxError(0, "expected dict found something else")
+	}
+
+	var ret []byte
+	found := false
+	idx := 1
+	for idx < len(d) && d[idx] != 'e' {
+		k, next, err := dec.decodeBString(d, idx)
+		if err != nil {
+			return nil, false, err
+		}
+		idx = next
+
+		if idx == len(d) {
+			break
+		}
+		_, next, err = dec.decode(d, idx)
+		if err != nil {
+			return nil, false, err
+		}
+		if k == key {
+			ret, found = d[idx:next], true
+		}
+		idx = next
 	}
 
 	if idx == len(d) {
-		return nil, 0, fmt.Errorf("EOF while decoding BMap")
+		return nil, false, syntaxError(idx, "EOF while decoding BMap")
 	}
 
-	return BMap(ret), idx, nil
+	return ret, found, nil
 }
 
 func Encode(v Bencode) ([]byte, error) {
@@ -172,6 +455,8 @@ func Encode(v Bencode) ([]byte, error) {
 		return EncodeBList(v)
 	case BMap:
 		return EncodeBMap(v)
+	case OrderedBMap:
+		return EncodeOrderedBMap(v)
 	default:
 		return nil, fmt.Errorf("invalid bencode type while encoding")
 	}
@@ -186,7 +471,7 @@ func EncodeBString(v BString) ([]byte, error) {
 }
 
 func EncodeBList(v BList) ([]byte, error) {
-	ret := make([]byte, 0)
+	ret := []byte{'l'}
 
 	for _, value := range v {
 		enc, err := Encode(value)
@@ -196,27 +481,57 @@ func EncodeBList(v BList) ([]byte, error) {
 		ret = append(ret, enc...)
 	}
 
+	ret = append(ret, 'e')
 	return ret, nil
 }
 
 func EncodeBMap(v BMap) ([]byte, error) {
-	ret := make([]byte, 0)
+	ret := []byte{'d'}
 
-	keys := make([]BString, 0)
+	for _, key := range sortedKeys(v) {
+		encKey, err := Encode(key)
+		if err != nil {
+			return nil, err
+		}
+
+		value := v[key]
+		encVal, err := Encode(value)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, encKey...)
+		ret = append(ret, encVal...)
+	}
+
+	ret = append(ret, 'e')
+	return ret, nil
+}
+
+func sortedKeys(v BMap) []BString {
+	keys := make([]BString, 0, len(v))
 	for key := range v {
 		keys = append(keys, key)
 	}
 
-	slices.Sort(keys)
+	// The spec orders keys as raw byte strings.
+	slices.SortFunc(keys, func(a, b BString) int {
+		return bytes.Compare([]byte(a), []byte(b))
+	})
+	return keys
+}
 
-	for _, key := range keys {
-		encKey, err := Encode(key)
+// EncodeOrderedBMap encodes v's entries in order, without sorting or removing
+// repeated keys.
+func EncodeOrderedBMap(v OrderedBMap) ([]byte, error) {
+	ret := []byte{'d'}
+
+	for _, kv := range v {
+		encKey, err := Encode(kv.Key)
 		if err != nil {
 			return nil, err
 		}
 
-		value := v[key]
-		encVal, err := Encode(value)
+		encVal, err := Encode(kv.Value)
 		if err != nil {
 			return nil, err
 		}
@@ -224,5 +539,6 @@ func EncodeBMap(v BMap) ([]byte, error) {
 		ret = append(ret, encVal...)
 	}
 
+	ret = append(ret, 'e')
 	return ret, nil
 }
@@ -1,10 +1,14 @@
 package bencode
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -66,13 +70,25 @@ func TestDecodeBint64(t *testing.T) {
 			name:     "test impossible value",
 			input:    "ie",
 			expected: 0,
-			err:      fmt.Errorf("shortest bint64 is of len 3, buffer len: %v", 2),
+			err:      &SyntaxError{Offset: 0, Msg: "integer has no digits", Err: ErrEmptyInteger},
+		},
+		{
+			name:     "test empty int before more data",
+			input:    "ie1:a",
+			expected: 0,
+			err:      &SyntaxError{Offset: 1, Msg: "integer has no digits", Err: ErrEmptyInteger},
+		},
+		{
+			name:     "test only minus",
+			input:    "i-e",
+			expected: 0,
+			err:      &SyntaxError{Offset: 1, Msg: "integer has no digits", Err: ErrEmptyInteger},
 		},
 		{
 			name:     "test empty string",
 			input:    "",
 			expected: 0,
-			err:      fmt.Errorf("shortest bint64 is of len 3, buffer len: %v", 0),
+			err:      &SyntaxError{Offset: 0, Msg: "shortest bint64 is of len 3, buffer len: 0"},
 		},
 	}
 
@@ -117,6 +133,22 @@ func TestDecodeBString(t *testing.T) {
 	}
 }
 
+func TestDecodeBStringMalformed(t *testing.T) {
+	inputs := []string{
+		"5",
+		"12",
+		"9223372036854775807:a",
+		"99999999999999999999:a",
+		"05:hello",
+	}
+
+	for _, input := range inputs {
+		_, _, err := DecodeWithOptions(context.Background(), []byte(input), Options{})
+		var syntaxErr *SyntaxError
+		require.ErrorAs(t, err, &syntaxErr, input)
+	}
+}
+
 func TestDecodeBList(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -140,7 +172,7 @@ func TestDecodeBList(t *testing.T) {
 			name:     "Invalid Bencoded list - no closing 'e'",
 			input:    []byte("l3:foo3:bar"),
 			expected: nil,
-			err:      fmt.Errorf("EOF while decoding Blist"),
+			err:      fmt.Errorf("EOF while decoding Blist at offset 11"),
 		},
 		{
 			name:     "Single element Bencoded list",
@@ -148,11 +180,17 @@ func TestDecodeBList(t *testing.T) {
 			expected: BList{BString("foo")}, // Single element
 			err:      nil,
 		},
+		{
+			name:     "Nested list",
+			input:    []byte("ll3:fooe3:bare"),
+			expected: BList{BList{BString("foo")}, BString("bar")},
+			err:      nil,
+		},
 		{
 			name:     "Non-list input",
 			input:    []byte("3:foo"),
 			expected: nil,
-			err:      fmt.Errorf("expected list but got something else"),
+			err:      fmt.Errorf("expected list but got something else at offset 0"),
 		},
 	}
 
@@ -179,7 +217,7 @@ func TestDecodeBMap(t *testing.T) {
 	}{
 		{
 			name:     "Valid Bencoded map",
-			input:    []byte("d3:foo3:bar3:baz3:quxe"),
+			input:    []byte("d3:baz3:qux3:foo3:bare"),
 			expected: BMap{BString("foo"): BString("bar"), BString("baz"): BString("qux")},
 			err:      nil,
 		},
@@ -193,19 +231,19 @@ func TestDecodeBMap(t *testing.T) {
 			name:     "Invalid start character (not a map)",
 			input:    []byte("l3:foo3:bar"),
 			expected: nil,
-			err:      fmt.Errorf("expected dict found something else"),
+			err:      fmt.Errorf("expected dict found something else at offset 0"),
 		},
 		{
 			name:     "Non-BString key",
 			input:    []byte("d3:foo3:bari123ee"),
 			expected: nil,
-			err:      fmt.Errorf("key not a BString"),
+			err:      fmt.Errorf("key not a BString at offset 11"),
 		},
 		{
 			name:     "Missing closing 'e'",
 			input:    []byte("d3:foo3:bar"),
 			expected: nil,
-			err:      fmt.Errorf("EOF while decoding BMap"),
+			err:      fmt.Errorf("EOF while decoding BMap at offset 11"),
 		},
 		{
 			name:     "Single key-value pair",
@@ -215,13 +253,25 @@ func TestDecodeBMap(t *testing.T) {
 		},
 		{
 			name:     "Multiple key-value pairs",
-			input:    []byte("d3:fooi123e3:baz3:quxe"),
+			input:    []byte("d3:baz3:qux3:fooi123ee"),
 			expected: BMap{BString("foo"): BInt64(123), BString("baz"): BString("qux")},
 			err:      nil,
 		},
+		{
+			name:     "Nested map",
+			input:    []byte("d3:baz3:qux3:food3:bari1eee"),
+			expected: BMap{BString("foo"): BMap{BString("bar"): BInt64(1)}, BString("baz"): BString("qux")},
+			err:      nil,
+		},
+		{
+			name:     "Empty key and empty value",
+			input:    []byte("d0:0:e"),
+			expected: BMap{BString(""): BString("")},
+			err:      nil,
+		},
 		{
 			name:     "Multiple key-value pairs with non-string values",
-			input:    []byte("d3:fooi123e3:bar3:quxe"),
+			input:    []byte("d3:bar3:qux3:fooi123ee"),
 			expected: BMap{BString("foo"): BInt64(123), BString("bar"): BString("qux")},
 			err:      nil,
 		},
@@ -240,3 +290,405 @@ func TestDecodeBMap(t *testing.T) {
 		})
 	}
 }
+
+func TestEmptyIntegerIs(t *testing.T) {
+	for _, input := range []string{"ie", "i-e", "lie", "d1:ai-ee"} {
+		_, _, err := Decode([]byte(input))
+		require.True(t, errors.Is(err, ErrEmptyInteger), input)
+	}
+}
+
+func TestEmptyKeyRoundTrip(t *testing.T) {
+	for _, input := range []string{"d0:0:e", "d0:i1e1:a0:e"} {
+		t.Run(input, func(t *testing.T) {
+			value, idx, err := Decode([]byte(input))
+			require.NoError(t, err)
+			require.Equal(t, len(input), idx)
+
+			enc, err := Encode(value)
+			require.NoError(t, err)
+			require.Equal(t, input, string(enc))
+		})
+	}
+}
+
+func TestSyntaxErrorOffset(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		offset int
+	}{
+		{"truncated list", "l3:fooi1e", 9},
+		{"truncated nested list", "d3:fool3:bar", 12},
+		{"bad token in list", "li1ex", 4},
+		{"bad int in dict", "d3:fooi1x2ee", 7},
+		{"string past end", "l3:foo10:abce", 13},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Decode([]byte(tt.input))
+
+			var syntaxErr *SyntaxError
+			require.True(t, errors.As(err, &syntaxErr))
+			require.Equal(t, tt.offset, syntaxErr.Offset)
+		})
+	}
+
+	_, err := DecodeAll([]byte("i1e4:spaml"))
+	var syntaxErr *SyntaxError
+	require.True(t, errors.As(err, &syntaxErr))
+	require.Equal(t, 10, syntaxErr.Offset)
+}
+
+func TestDecodeAll(t *testing.T) {
+	values, err := DecodeAll([]byte("i42e4:spamd3:cowl3:mooee"))
+	require.NoError(t, err)
+	require.Equal(t, []Bencode{
+		BInt64(42),
+		BString("spam"),
+		BMap{BString("cow"): BList{BString("moo")}},
+	}, values)
+
+	values, err = DecodeAll(nil)
+	require.NoError(t, err)
+	require.Empty(t, values)
+
+	_, err = DecodeAll([]byte("i42e4:spaml3:moo"))
+	require.Error(t, err)
+
+	_, err = DecodeAll([]byte("i42ex"))
+	require.Error(t, err)
+}
+
+func TestDecodeContext(t *testing.T) {
+	large := []byte("l" + strings.Repeat("i1e", 1_000_000) + "e")
+
+	t.Run("background context decodes", func(t *testing.T) {
+		value, idx, err := DecodeContext(context.Background(), large)
+		require.NoError(t, err)
+		require.Equal(t, len(large), idx)
+		require.Len(t, value, 1_000_000)
+	})
+
+	t.Run("canceled context returns early", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		start := time.Now()
+		value, _, err := DecodeContext(ctx, large)
+		require.True(t, errors.Is(err, context.Canceled))
+		require.Nil(t, value)
+		require.Less(t, time.Since(start), 100*time.Millisecond)
+	})
+
+	t.Run("canceled mid decode", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(time.Millisecond)
+			cancel()
+		}()
+
+		nested := []byte("l" + strings.Repeat("l"+strings.Repeat("i1e", 1000)+"e", 10_000) + "e")
+
+		_, _, err := DecodeContext(ctx, nested)
+		require.True(t, errors.Is(err, context.Canceled))
+	})
+}
+
+func TestDecodeWithOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		opts  Options
+		err   error
+	}{
+		{
+			name:  "string within limit",
+			input: []byte("5:hello"),
+			opts:  Options{MaxStringLen: 5},
+		},
+		{
+			name:  "string over limit",
+			input: []byte("6:hello!"),
+			opts:  Options{MaxStringLen: 5},
+			err:   ErrLimitExceeded,
+		},
+		{
+			name:  "elements within limit",
+			input: []byte("li1ei2ee"),
+			opts:  Options{MaxTotalElements: 2},
+		},
+		{
+			name:  "elements over limit",
+			input: []byte("li1eli2ei3eee"),
+			opts:  Options{MaxTotalElements: 3},
+			err:   ErrLimitExceeded,
+		},
+		{
+			name:  "zero options are unlimited",
+			input: []byte("l" + strings.Repeat("5:hello", 100) + "e"),
+			opts:  Options{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := DecodeWithOptions(context.Background(), tt.input, tt.opts)
+			if tt.err != nil {
+				require.True(t, errors.Is(err, tt.err))
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDecodeHugeStringPrefix(t *testing.T) {
+	input := []byte("1000000000:" + strings.Repeat("a", 64))
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, _, err := Decode(input)
+	runtime.ReadMemStats(&after)
+
+	require.True(t, errors.Is(err, ErrLimitExceeded))
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+}
+
+func TestDecodeZeroCopy(t *testing.T) {
+	input := []byte("d3:bazl3:quxe3:foo3:bare")
+
+	value, _, err := DecodeWithOptions(context.Background(), input, Options{ZeroCopy: true})
+	require.NoError(t, err)
+	require.Equal(t, BMap{BString("foo"): BString("bar"), BString("baz"): BList{BString("qux")}}, value)
+
+	copy(input[20:23], "BAR")
+	require.Equal(t, BString("BAR"), value.(BMap)[BString("foo")])
+}
+
+func TestBStringBytes(t *testing.T) {
+	require.Empty(t, BString("").Bytes())
+
+	for _, s := range []BString{"spam", "\x00\xff\x13binary"} {
+		enc, err := Encode(s)
+		require.NoError(t, err)
+
+		value, _, err := Decode(enc)
+		require.NoError(t, err)
+		enc2, err := Encode(BString(value.(BString).Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, enc, enc2)
+	}
+
+	input := []byte("4:spam")
+	value, _, err := DecodeWithOptions(context.Background(), input, Options{ZeroCopy: true})
+	require.NoError(t, err)
+	b := value.(BString).Bytes()
+	require.Equal(t, []byte("spam"), b)
+	require.Same(t, &input[2], &b[0])
+}
+
+func BenchmarkDecodeLargeMap(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteByte('d')
+	for i := 0; i < 10_000; i += 1 {
+		key := fmt.Sprintf("key%08d", i)
+		value := strings.Repeat("v", 256)
+		sb.WriteString(fmt.Sprintf("%d:%s%d:%s", len(key), key, len(value), value))
+	}
+	sb.WriteByte('e')
+	input := []byte(sb.String())
+
+	b.Run("clone", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i += 1 {
+			if _, _, err := DecodeWithOptions(context.Background(), input, Options{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("zero copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i += 1 {
+			if _, _, err := DecodeWithOptions(context.Background(), input, Options{ZeroCopy: true}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDecodeLongList(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteByte('l')
+	for i := 0; i < 100_000; i += 1 {
+		sb.WriteString(fmt.Sprintf("i%de", i))
+	}
+	sb.WriteByte('e')
+	input := []byte(sb.String())
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i += 1 {
+		value, n, err := Decode(input)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if n != len(input) || len(value.(BList)) != 100_000 {
+			b.Fatalf("decoded %d of %d bytes", n, len(input))
+		}
+	}
+}
+
+func TestDecodeLongList(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteByte('l')
+	for i := 0; i < 100_000; i += 1 {
+		sb.WriteString(fmt.Sprintf("d1:ki%dee", i))
+	}
+	sb.WriteByte('e')
+
+	value, n, err := Decode([]byte(sb.String()))
+	require.Nil(t, err)
+	require.Equal(t, sb.Len(), n)
+	list := value.(BList)
+	require.Len(t, list, 100_000)
+	require.Equal(t, BMap{"k": BInt64(99_999)}, list[99_999])
+
+	enc, err := Encode(value)
+	require.Nil(t, err)
+	require.Equal(t, sb.String(), string(enc))
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    Bencode
+		expected string
+	}{
+		{
+			name:     "int",
+			input:    BInt64(-42),
+			expected: "i-42e",
+		},
+		{
+			name:     "string",
+			input:    BString("spam"),
+			expected: "4:spam",
+		},
+		{
+			name:     "list",
+			input:    BList{BString("spam"), BInt64(42)},
+			expected: "l4:spami42ee",
+		},
+		{
+			name:     "empty list",
+			input:    BList{},
+			expected: "le",
+		},
+		{
+			name:     "map with sorted keys",
+			input:    BMap{BString("spam"): BList{BString("a")}, BString("cow"): BString("moo")},
+			expected: "d3:cow3:moo4:spaml1:aee",
+		},
+		{
+			name:     "empty map",
+			input:    BMap{},
+			expected: "de",
+		},
+		{
+			name:     "keys differing in high bit bytes",
+			input:    BMap{BString("a\xff"): BInt64(3), BString("a\x80"): BInt64(2), BString("a\x7f"): BInt64(1)},
+			expected: "d2:a\x7fi1e2:a\x80i2e2:a\xffi3ee",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc, err := Encode(tt.input)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, string(enc))
+
+			dec, idx, err := Decode(enc)
+			require.NoError(t, err)
+			require.Equal(t, len(enc), idx)
+			require.Equal(t, tt.input, dec)
+		})
+	}
+}
+
+func TestDecodeLenient(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected Bencode
+	}{
+		{name: "leading zero", input: "i007e", expected: BInt64(7)},
+		{name: "plus sign", input: "i+7e", expected: BInt64(7)},
+		{name: "negative zero", input: "i-0e", expected: BInt64(0)},
+		{name: "unsorted keys", input: "d1:bi1e1:ai2ee", expected: BMap{BString("a"): BInt64(2), BString("b"): BInt64(1)}},
+		{name: "repeated key", input: "d1:ai1e1:ai2ee", expected: BMap{BString("a"): BInt64(2)}},
+		{name: "nested", input: "ld1:bi1e1:ai02eee", expected: BList{BMap{BString("a"): BInt64(2), BString("b"): BInt64(1)}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Decode([]byte(tt.input))
+			require.True(t, errors.Is(err, ErrNotCanonical), "strict decode of %q: %v", tt.input, err)
+
+			value, n, err := DecodeWithOptions(context.Background(), []byte(tt.input), LenientOptions())
+			require.NoError(t, err)
+			require.Equal(t, len(tt.input), n)
+			require.Equal(t, tt.expected, value)
+		})
+	}
+}
+
+func TestRawDictValue(t *testing.T) {
+	input := []byte("d4:infod1:bi01e1:ai2ee3:zzz3:abce")
+
+	raw, ok, err := RawDictValue(input, BString("info"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "d1:bi01e1:ai2ee", string(raw))
+
+	_, ok, err = RawDictValue(input, BString("nope"))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, _, err = RawDictValue([]byte("d4:infod"), BString("info"))
+	require.Error(t, err)
+}
+
+func TestDecodePreserveOrder(t *testing.T) {
+	input := []byte("d4:name4:temp6:lengthi10e5:filesld4:pathl1:be6:lengthi1eee1:ai1ee")
+	opts := LenientOptions()
+	opts.PreserveOrder = true
+
+	value, n, err := DecodeWithOptions(context.Background(), input, opts)
+	require.NoError(t, err)
+	require.Equal(t, len(input), n)
+
+	dict, ok := value.(OrderedBMap)
+	require.True(t, ok)
+	keys := make([]BString, 0, len(dict))
+	for _, kv := range dict {
+		keys = append(keys, kv.Key)
+	}
+	require.Equal(t, []BString{"name", "length", "files", "a"}, keys)
+
+	length, ok := dict.Get(BString("length"))
+	require.True(t, ok)
+	require.Equal(t, BInt64(10), length)
+
+	enc, err := Encode(value)
+	require.NoError(t, err)
+	require.Equal(t, string(input), string(enc))
+
+	// without the option the same input re-encodes sorted
+	value, _, err = DecodeWithOptions(context.Background(), input, LenientOptions())
+	require.NoError(t, err)
+	enc, err = Encode(value)
+	require.NoError(t, err)
+	require.Equal(t, "d1:ai1e5:filesld6:lengthi1e4:pathl1:beee6:lengthi10e4:name4:tempe", string(enc))
+}
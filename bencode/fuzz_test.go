@@ -0,0 +1,47 @@
+package bencode
+
+import (
+	"context"
+	"testing"
+)
+
+func FuzzDecode(f *testing.F) {
+	for _, seed := range []string{
+		"i0e", "i-1e", "i11e", "ie", "i-e", "",
+		"4:spam", "0:", "5:hello",
+		"le", "l4:spam4:eggse", "li1eli2eee",
+		"de", "d3:bar4:spam3:fooi42ee", "d3:baz3:qux3:food3:bari1eee", "d0:0:e",
+		"d8:announce9:http://a/4:infod6:lengthi1000e4:name4:temp12:piece lengthi16e6:pieces20:aaaaaaaaaaaaaaaaaaaaee",
+		"l", "d", "d3:foo", "ld", "5", "1:",
+	} {
+		f.Add([]byte(seed), false)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, lenient bool) {
+		opts := Options{Lenient: lenient}
+		value, n, err := DecodeWithOptions(context.Background(), data, opts)
+		if err != nil {
+			return
+		}
+		if n > len(data) {
+			t.Fatalf("decoded %d bytes of %d", n, len(data))
+		}
+
+		enc, err := Encode(value)
+		if err != nil {
+			t.Fatalf("encode %#v: %v", value, err)
+		}
+		if !lenient && string(enc) != string(data[:n]) {
+			t.Fatalf("strict decode of %q encodes to %q", data[:n], enc)
+		}
+
+		again, _, err := Decode(enc)
+		if err != nil {
+			t.Fatalf("decode %q: %v", enc, err)
+		}
+		reenc, err := Encode(again)
+		if err != nil || string(reenc) != string(enc) {
+			t.Fatalf("round trip of %q gave %q, %v", enc, reenc, err)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package bencode
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultMaxPooledBuffer is the largest read buffer a Pool keeps, bigger ones
+// are left to the garbage collector so one huge input doesn't pin its memory.
+const DefaultMaxPooledBuffer = 4 << 20
+
+// Pool reuses the memory DecodeReader needs while decoding: the buffer the
+// input is read into and the scratch slice lists are collected in. A Pool is
+// safe for concurrent use and is meant to be shared by every decode on a hot
+// path.
+//
+// Values returned by DecodeReader never alias pooled memory, strings are
+// copied out of the read buffer and lists out of the scratch slice, so they
+// stay valid after the memory goes back to the pool. A buffer taken with Get
+// is only valid until it is passed to Put, neither it nor slices of its
+// Bytes may be used afterwards.
+type Pool struct {
+	// MaxBufferSize overrides DefaultMaxPooledBuffer when positive.
+	MaxBufferSize int
+
+	buffers sync.Pool
+	scratch sync.Pool
+}
+
+func NewPool() *Pool {
+	return &Pool{}
+}
+
+// Get returns an empty buffer, reusing one given back with Put if possible.
+func (p *Pool) Get() *bytes.Buffer {
+	if b, ok := p.buffers.Get().(*bytes.Buffer); ok {
+		return b
+	}
+	return new(bytes.Buffer)
+}
+
+// Put gives b back to the pool, the caller must not use it afterwards.
+func (p *Pool) Put(b *bytes.Buffer) {
+	limit := p.MaxBufferSize
+	if limit <= 0 {
+		limit = DefaultMaxPooledBuffer
+	}
+	if b == nil || b.Cap() > limit {
+		return
+	}
+
+	b.Reset()
+	p.buffers.Put(b)
+}
+
+func (p *Pool) getScratch() []Bencode {
+	if s, ok := p.scratch.Get().(*[]Bencode); ok {
+		return (*s)[:0]
+	}
+	return nil
+}
+
+func (p *Pool) putScratch(s []Bencode) {
+	// drop the references to decoded values so the pool doesn't keep them
+	// alive.
+	clear(s[:cap(s)])
+	p.scratch.Put(&s)
+}
+
+// DecodeReader reads r to EOF and decodes the single value it holds. With a
+// non nil pool the read buffer and scratch memory come from it and are given
+// back before returning, opts.ZeroCopy is ignored in that case since the
+// buffer is reused by the next decode.
+func DecodeReader(ctx context.Context, r io.Reader, opts Options, pool *Pool) (Bencode, error) {
+	var buf *bytes.Buffer
+	dec := newDecoder(ctx, opts)
+	if pool != nil {
+		buf = pool.Get()
+		defer pool.Put(buf)
+
+		dec.opts.ZeroCopy = false
+		dec.scratch = pool.getScratch()
+		defer func() { pool.putScratch(dec.scratch) }()
+	} else {
+		buf = new(bytes.Buffer)
+	}
+
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, fmt.Errorf("read bencode: %w", err)
+	}
+
+	value, n, err := dec.decode(buf.Bytes(), 0)
+	if err != nil {
+		return nil, err
+	}
+	if n != buf.Len() {
+		return nil, syntaxError(n, "trailing data after value")
+	}
+
+	return value, nil
+}
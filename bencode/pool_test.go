@@ -0,0 +1,108 @@
+package bencode
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// benchTorrent is shaped like a multi file torrent: an announce-list, a few
+// hundred files and 20 byte hashes for a 2000 piece payload.
+func benchTorrent(tb testing.TB) []byte {
+	files := make(BList, 0, 300)
+	for i := range 300 {
+		files = append(files, BMap{
+			"length": BInt64(1 << 20),
+			"path":   BList{BString("disc"), BString(fmt.Sprintf("track-%03d.flac", i))},
+		})
+	}
+
+	data, err := Encode(BMap{
+		"announce": BString("http://tracker.example.org:6969/announce"),
+		"announce-list": BList{
+			BList{BString("http://tracker.example.org:6969/announce")},
+			BList{BString("udp://backup.example.org:1337/announce")},
+		},
+		"info": BMap{
+			"files":        files,
+			"name":         BString("album"),
+			"piece length": BInt64(256 << 10),
+			"pieces":       BString(strings.Repeat("0123456789abcdefghij", 2000)),
+		},
+	})
+	require.NoError(tb, err)
+	return data
+}
+
+func TestDecodeReader(t *testing.T) {
+	require := require.New(t)
+	data := benchTorrent(t)
+
+	want, _, err := Decode(data)
+	require.NoError(err)
+
+	pool := NewPool()
+	for _, p := range []*Pool{nil, pool, pool} {
+		got, err := DecodeReader(context.Background(), bytes.NewReader(data), DefaultOptions(), p)
+		require.NoError(err)
+		require.Equal(want, got)
+	}
+
+	_, err = DecodeReader(context.Background(), strings.NewReader("i1ei2e"), DefaultOptions(), pool)
+	var syntaxErr *SyntaxError
+	require.ErrorAs(err, &syntaxErr)
+	require.Equal(3, syntaxErr.Offset)
+}
+
+func TestDecodeReaderValuesOutlivePool(t *testing.T) {
+	require := require.New(t)
+	pool := NewPool()
+	opts := DefaultOptions()
+	opts.ZeroCopy = true
+
+	first, err := DecodeReader(context.Background(), strings.NewReader("l4:spam4:eggse"), opts, pool)
+	require.NoError(err)
+
+	// the next decode reuses the read buffer and the scratch slice
+	_, err = DecodeReader(context.Background(), strings.NewReader("l4:AAAA4:BBBB4:CCCCe"), opts, pool)
+	require.NoError(err)
+
+	require.Equal(BList{BString("spam"), BString("eggs")}, first)
+}
+
+func TestPoolDropsLargeBuffers(t *testing.T) {
+	pool := &Pool{MaxBufferSize: 16}
+
+	large := pool.Get()
+	large.Grow(64)
+	pool.Put(large)
+
+	require.NotSame(t, large, pool.Get())
+}
+
+func BenchmarkDecodeReader(b *testing.B) {
+	data := benchTorrent(b)
+
+	b.Run("NoPool", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			if _, err := DecodeReader(context.Background(), bytes.NewReader(data), DefaultOptions(), nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Pool", func(b *testing.B) {
+		pool := NewPool()
+		b.ReportAllocs()
+		for range b.N {
+			if _, err := DecodeReader(context.Background(), bytes.NewReader(data), DefaultOptions(), pool); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
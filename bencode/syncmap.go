@@ -0,0 +1,58 @@
+package bencode
+
+import (
+	"maps"
+	"sync"
+)
+
+// CloneForRead returns a shallow copy of m. Once taken the copy can be read
+// while m is updated, but the values are shared so nested lists and maps must
+// not be modified in place. The clone itself must be taken while no one is
+// writing m, SyncMap does this under its lock.
+func (m BMap) CloneForRead() BMap {
+	if m == nil {
+		return nil
+	}
+	return maps.Clone(m)
+}
+
+// SyncMap is a BMap guarded by a lock, for dictionaries that are filled in by
+// one goroutine while others read them.
+type SyncMap struct {
+	mu sync.RWMutex
+	m  BMap
+}
+
+func NewSyncMap() *SyncMap {
+	return &SyncMap{m: make(BMap)}
+}
+
+func (s *SyncMap) Load(key BString) (Bencode, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	value, ok := s.m[key]
+	return value, ok
+}
+
+func (s *SyncMap) Store(key BString, value Bencode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.m[key] = value
+}
+
+func (s *SyncMap) Delete(key BString) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.m, key)
+}
+
+// Snapshot returns a copy of the map as it is now, see BMap.CloneForRead.
+func (s *SyncMap) Snapshot() BMap {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.m.CloneForRead()
+}
@@ -0,0 +1,51 @@
+package bencode
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloneForRead(t *testing.T) {
+	require.Nil(t, BMap(nil).CloneForRead())
+
+	m := BMap{"a": BInt64(1)}
+	clone := m.CloneForRead()
+	m["b"] = BInt64(2)
+	require.Equal(t, BMap{"a": BInt64(1)}, clone)
+}
+
+func TestSyncMapSnapshotWhileWriting(t *testing.T) {
+	s := NewSyncMap()
+	s.Store("name", BString("content"))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 1000 {
+			s.Store(BString(fmt.Sprintf("key%d", i)), BInt64(i))
+		}
+		s.Delete("key0")
+	}()
+
+	for range 100 {
+		snapshot := s.Snapshot()
+		require.Equal(t, BString("content"), snapshot["name"])
+		for key, value := range snapshot {
+			if key != "name" {
+				require.Equal(t, BString(fmt.Sprintf("key%d", value)), key)
+			}
+		}
+	}
+	wg.Wait()
+
+	_, ok := s.Load("key0")
+	require.False(t, ok)
+	value, ok := s.Load("key999")
+	require.True(t, ok)
+	require.Equal(t, BInt64(999), value)
+	require.Len(t, s.Snapshot(), 1000)
+}
@@ -0,0 +1,93 @@
+package bencode
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// WriteTo writes the encoding of v to w as Encode would produce it, without
+// building it in memory first. It returns the number of bytes written, like
+// io.WriterTo, along with the first write error.
+func WriteTo(w io.Writer, v Bencode) (int64, error) {
+	bw := &benWriter{w: w}
+	bw.value(v)
+	return bw.n, bw.err
+}
+
+// benWriter keeps the first error, writes after it are dropped so the
+// encoding code doesn't have to check each one.
+type benWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+	// num holds the digits of integers and string lengths
+	num [24]byte
+}
+
+func (bw *benWriter) write(p []byte) {
+	if bw.err != nil {
+		return
+	}
+	n, err := bw.w.Write(p)
+	bw.n += int64(n)
+	bw.err = err
+}
+
+func (bw *benWriter) writeString(s string) {
+	if bw.err != nil {
+		return
+	}
+	n, err := io.WriteString(bw.w, s)
+	bw.n += int64(n)
+	bw.err = err
+}
+
+func (bw *benWriter) int(prefix byte, v int64, suffix byte) {
+	b := append(bw.num[:0], prefix)
+	b = strconv.AppendInt(b, v, 10)
+	bw.write(append(b, suffix))
+}
+
+func (bw *benWriter) str(s BString) {
+	b := strconv.AppendInt(bw.num[:0], int64(len(s)), 10)
+	bw.write(append(b, ':'))
+	bw.writeString(string(s))
+}
+
+func (bw *benWriter) value(v Bencode) {
+	switch v := v.(type) {
+	case int64:
+		bw.int('i', v, 'e')
+	case string:
+		bw.str(BString(v))
+	case BInt64:
+		bw.int('i', int64(v), 'e')
+	case BString:
+		bw.str(v)
+	case BList:
+		bw.writeString("l")
+		for _, value := range v {
+			bw.value(value)
+		}
+		bw.writeString("e")
+	case BMap:
+		bw.writeString("d")
+		for _, key := range sortedKeys(v) {
+			bw.str(key)
+			bw.value(v[key])
+		}
+		bw.writeString("e")
+	case OrderedBMap:
+		bw.writeString("d")
+		for _, kv := range v {
+			bw.str(kv.Key)
+			bw.value(kv.Value)
+		}
+		bw.writeString("e")
+	default:
+		if bw.err == nil {
+			bw.err = fmt.Errorf("invalid bencode type while encoding")
+		}
+	}
+}
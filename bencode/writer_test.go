@@ -0,0 +1,59 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteTo(t *testing.T) {
+	values := []Bencode{
+		BInt64(-42),
+		int64(7),
+		BString(""),
+		"spam",
+		BList{},
+		BList{BString("spam"), BInt64(42), BList{BInt64(0)}},
+		BMap{},
+		BMap{BString("spam"): BList{BString("a")}, BString("cow"): BString("moo"), BString("a\xff"): BInt64(3)},
+		OrderedBMap{{Key: "z", Value: BInt64(1)}, {Key: "a", Value: BMap{"k": BString("v")}}},
+	}
+
+	for _, v := range values {
+		expected, err := Encode(v)
+		require.Nil(t, err)
+
+		var buf bytes.Buffer
+		n, err := WriteTo(&buf, v)
+		require.Nil(t, err)
+		require.Equal(t, string(expected), buf.String())
+		require.Equal(t, int64(len(expected)), n)
+	}
+
+	_, err := WriteTo(&bytes.Buffer{}, BList{BInt64(1), 3.5})
+	require.NotNil(t, err)
+}
+
+type limitedWriter struct {
+	left int
+}
+
+var errFull = errors.New("writer full")
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > w.left {
+		n := w.left
+		w.left = 0
+		return n, errFull
+	}
+	w.left -= len(p)
+	return len(p), nil
+}
+
+func TestWriteToStopsOnError(t *testing.T) {
+	n, err := WriteTo(&limitedWriter{left: 5}, BList{BString("spam"), BString("eggs")})
+	require.ErrorIs(t, err, errFull)
+	require.Equal(t, int64(5), n)
+}
@@ -0,0 +1,334 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/skirtan1/bittorrent-client/bencode"
+	"github.com/skirtan1/bittorrent-client/tracker"
+)
+
+const (
+	Query    = "q"
+	Response = "r"
+	Error    = "e"
+
+	MethodPing         = "ping"
+	MethodFindNode     = "find_node"
+	MethodGetPeers     = "get_peers"
+	MethodAnnouncePeer = "announce_peer"
+
+	compactNodeLen = 20 + net.IPv4len + 2
+)
+
+const (
+	ErrorGeneric       = 201
+	ErrorServer        = 202
+	ErrorProtocol      = 203
+	ErrorMethodUnknown = 204
+)
+
+var (
+	ErrMalformedMessage = errors.New("malformed krpc message")
+	ErrMalformedNodes   = errors.New("malformed compact node info")
+)
+
+// KRPCError is the body of an error message, it is also returned by queries
+// the remote node answered with an error.
+type KRPCError struct {
+	Code int
+	Msg  string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Msg)
+}
+
+// Message is a KRPC message. Y says which of the bodies is set: queries have
+// the method in Q and its arguments in A, responses carry R and errors E.
+type Message struct {
+	T string
+	Y string
+	Q string
+	A bencode.BMap
+	R bencode.BMap
+	E *KRPCError
+}
+
+func (m *Message) Encode() ([]byte, error) {
+	dict := bencode.BMap{
+		bencode.BString("t"): bencode.BString(m.T),
+		bencode.BString("y"): bencode.BString(m.Y),
+	}
+
+	switch m.Y {
+	case Query:
+		dict[bencode.BString("q")] = bencode.BString(m.Q)
+		dict[bencode.BString("a")] = m.A
+	case Response:
+		dict[bencode.BString("r")] = m.R
+	case Error:
+		if m.E == nil {
+			return nil, fmt.Errorf("encode error without body: %w", ErrMalformedMessage)
+		}
+		dict[bencode.BString("e")] = bencode.BList{bencode.BInt64(m.E.Code), bencode.BString(m.E.Msg)}
+	default:
+		return nil, fmt.Errorf("encode message type %q: %w", m.Y, ErrMalformedMessage)
+	}
+
+	return bencode.Encode(dict)
+}
+
+func DecodeMessage(b []byte) (*Message, error) {
+	benc, _, err := bencode.DecodeWithOptions(context.Background(), b, bencode.LenientOptions())
+	if err != nil {
+		return nil, fmt.Errorf("decode krpc: %w", err)
+	}
+
+	dict, ok := benc.(bencode.BMap)
+	if !ok {
+		return nil, fmt.Errorf("krpc not a dict: %w", ErrMalformedMessage)
+	}
+
+	t, ok := dict[bencode.BString("t")].(bencode.BString)
+	if !ok {
+		return nil, fmt.Errorf("krpc without transaction id: %w", ErrMalformedMessage)
+	}
+	y, _ := dict[bencode.BString("y")].(bencode.BString)
+
+	ret := Message{T: string(t), Y: string(y)}
+	switch ret.Y {
+	case Query:
+		q, ok := dict[bencode.BString("q")].(bencode.BString)
+		if !ok {
+			return nil, fmt.Errorf("query without method: %w", ErrMalformedMessage)
+		}
+		ret.Q = string(q)
+		if ret.A, ok = dict[bencode.BString("a")].(bencode.BMap); !ok {
+			return nil, fmt.Errorf("query without arguments: %w", ErrMalformedMessage)
+		}
+	case Response:
+		if ret.R, ok = dict[bencode.BString("r")].(bencode.BMap); !ok {
+			return nil, fmt.Errorf("response without values: %w", ErrMalformedMessage)
+		}
+	case Error:
+		list, ok := dict[bencode.BString("e")].(bencode.BList)
+		if !ok || len(list) != 2 {
+			return nil, fmt.Errorf("error without code and message: %w", ErrMalformedMessage)
+		}
+		code, ok := list[0].(bencode.BInt64)
+		msg, ok2 := list[1].(bencode.BString)
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("error without code and message: %w", ErrMalformedMessage)
+		}
+		ret.E = &KRPCError{Code: int(code), Msg: string(msg)}
+	default:
+		return nil, fmt.Errorf("message type %q: %w", ret.Y, ErrMalformedMessage)
+	}
+
+	return &ret, nil
+}
+
+// QueryArgs are the arguments of a query, a method only uses some of them:
+// find_node sets Target, get_peers InfoHash and announce_peer InfoHash, Port,
+// ImpliedPort and Token.
+type QueryArgs struct {
+	ID          ID
+	Target      ID
+	InfoHash    [20]byte
+	Port        int
+	ImpliedPort bool
+	Token       string
+}
+
+func NewQuery(tid string, method string, args QueryArgs) *Message {
+	a := bencode.BMap{bencode.BString("id"): bencode.BString(args.ID[:])}
+	switch method {
+	case MethodFindNode:
+		a[bencode.BString("target")] = bencode.BString(args.Target[:])
+	case MethodGetPeers:
+		a[bencode.BString("info_hash")] = bencode.BString(args.InfoHash[:])
+	case MethodAnnouncePeer:
+		implied := 0
+		if args.ImpliedPort {
+			implied = 1
+		}
+		a[bencode.BString("info_hash")] = bencode.BString(args.InfoHash[:])
+		a[bencode.BString("port")] = bencode.BInt64(args.Port)
+		a[bencode.BString("implied_port")] = bencode.BInt64(implied)
+		a[bencode.BString("token")] = bencode.BString(args.Token)
+	}
+
+	return &Message{T: tid, Y: Query, Q: method, A: a}
+}
+
+func dictID(dict bencode.BMap, key string) (ID, error) {
+	var ret ID
+	value, ok := dict[bencode.BString(key)].(bencode.BString)
+	if !ok || len(value) != len(ret) {
+		return ret, fmt.Errorf("%s not a 20 byte string: %w", key, ErrMalformedMessage)
+	}
+	copy(ret[:], value)
+	return ret, nil
+}
+
+// QueryArgs returns the arguments of a query, checking that the ones its
+// method needs are present. Unknown methods only need an id.
+func (m *Message) QueryArgs() (*QueryArgs, error) {
+	if m.Y != Query {
+		return nil, fmt.Errorf("arguments of message type %q: %w", m.Y, ErrMalformedMessage)
+	}
+
+	var err error
+	ret := QueryArgs{}
+	if ret.ID, err = dictID(m.A, "id"); err != nil {
+		return nil, err
+	}
+
+	switch m.Q {
+	case MethodFindNode:
+		if ret.Target, err = dictID(m.A, "target"); err != nil {
+			return nil, err
+		}
+	case MethodGetPeers:
+		if ret.InfoHash, err = dictID(m.A, "info_hash"); err != nil {
+			return nil, err
+		}
+	case MethodAnnouncePeer:
+		if ret.InfoHash, err = dictID(m.A, "info_hash"); err != nil {
+			return nil, err
+		}
+		port, ok := m.A[bencode.BString("port")].(bencode.BInt64)
+		if !ok {
+			return nil, fmt.Errorf("announce_peer without port: %w", ErrMalformedMessage)
+		}
+		token, ok := m.A[bencode.BString("token")].(bencode.BString)
+		if !ok {
+			return nil, fmt.Errorf("announce_peer without token: %w", ErrMalformedMessage)
+		}
+		implied, _ := m.A[bencode.BString("implied_port")].(bencode.BInt64)
+
+		ret.Port = int(port)
+		ret.Token = string(token)
+		ret.ImpliedPort = implied != 0
+	}
+
+	return &ret, nil
+}
+
+// ResponseValues are the values of a response. ping and announce_peer only
+// return an ID, find_node adds Nodes and get_peers a Token with either
+// Values, the peers it knows, or Nodes closer to the info hash.
+type ResponseValues struct {
+	ID     ID
+	Nodes  []NodeInfo
+	Values []tracker.Peer
+	Token  string
+}
+
+// NewResponse encodes nil Nodes and Values and an empty Token by leaving the
+// key out.
+func NewResponse(tid string, values ResponseValues) *Message {
+	r := bencode.BMap{bencode.BString("id"): bencode.BString(values.ID[:])}
+	if values.Nodes != nil {
+		r[bencode.BString("nodes")] = bencode.BString(CompactNodes(values.Nodes))
+	}
+	if values.Values != nil {
+		list := make(bencode.BList, 0, len(values.Values))
+		for _, p := range values.Values {
+			if compact, _ := tracker.CompactPeers([]tracker.Peer{p}); compact != nil {
+				list = append(list, bencode.BString(compact))
+			}
+		}
+		r[bencode.BString("values")] = list
+	}
+	if values.Token != "" {
+		r[bencode.BString("token")] = bencode.BString(values.Token)
+	}
+
+	return &Message{T: tid, Y: Response, R: r}
+}
+
+func (m *Message) ResponseValues() (*ResponseValues, error) {
+	if m.Y != Response {
+		return nil, fmt.Errorf("values of message type %q: %w", m.Y, ErrMalformedMessage)
+	}
+
+	var err error
+	ret := ResponseValues{}
+	if ret.ID, err = dictID(m.R, "id"); err != nil {
+		return nil, err
+	}
+
+	if nodes, ok := m.R[bencode.BString("nodes")].(bencode.BString); ok {
+		if ret.Nodes, err = ParseCompactNodes(nodes.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+
+	if values, ok := m.R[bencode.BString("values")].(bencode.BList); ok {
+		ret.Values = make([]tracker.Peer, 0, len(values))
+		for _, v := range values {
+			compact, ok := v.(bencode.BString)
+			if !ok {
+				return nil, fmt.Errorf("value not a string: %w", ErrMalformedMessage)
+			}
+			peers, err := tracker.ParseCompactPeers(compact.Bytes())
+			if err != nil {
+				return nil, fmt.Errorf("values: %w", err)
+			}
+			ret.Values = append(ret.Values, peers...)
+		}
+	}
+
+	token, _ := m.R[bencode.BString("token")].(bencode.BString)
+	ret.Token = string(token)
+
+	return &ret, nil
+}
+
+func NewError(tid string, code int, msg string) *Message {
+	return &Message{T: tid, Y: Error, E: &KRPCError{Code: code, Msg: msg}}
+}
+
+// NodeInfo is a node's ID and UDP address as exchanged in compact node info.
+type NodeInfo struct {
+	ID   ID
+	Addr *net.UDPAddr
+}
+
+func ParseCompactNodes(b []byte) ([]NodeInfo, error) {
+	if len(b)%compactNodeLen != 0 {
+		return nil, fmt.Errorf("compact nodes of len %d: %w", len(b), ErrMalformedNodes)
+	}
+
+	ret := make([]NodeInfo, 0, len(b)/compactNodeLen)
+	for i := 0; i < len(b); i += compactNodeLen {
+		n := NodeInfo{Addr: &net.UDPAddr{
+			IP:   net.IP(append([]byte(nil), b[i+20:i+24]...)),
+			Port: int(binary.BigEndian.Uint16(b[i+24 : i+26])),
+		}}
+		copy(n.ID[:], b[i:i+20])
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+// CompactNodes encodes nodes as compact node info, nodes without an IPv4
+// address are left out.
+func CompactNodes(nodes []NodeInfo) []byte {
+	ret := make([]byte, 0, len(nodes)*compactNodeLen)
+	for _, n := range nodes {
+		ip := n.Addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		ret = append(ret, n.ID[:]...)
+		ret = append(ret, ip...)
+		ret = binary.BigEndian.AppendUint16(ret, uint16(n.Addr.Port))
+	}
+	return ret
+}
@@ -0,0 +1,137 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/skirtan1/bittorrent-client/bencode"
+	"github.com/skirtan1/bittorrent-client/tracker"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	id := RandomID()
+	for _, msg := range []*Message{
+		{T: "aa", Y: Query, Q: MethodPing, A: bencode.BMap{"id": bencode.BString(id[:])}},
+		{T: "ab", Y: Response, R: bencode.BMap{"id": bencode.BString(id[:]), "nodes": bencode.BString("")}},
+		{T: "ac", Y: Error, E: &KRPCError{Code: ErrorProtocol, Msg: "bad token"}},
+	} {
+		enc, err := msg.Encode()
+		require.Nil(t, err)
+
+		got, err := DecodeMessage(enc)
+		require.Nil(t, err)
+		require.Equal(t, msg, got)
+	}
+}
+
+func TestMessageWireFormat(t *testing.T) {
+	// Examples from BEP 5.
+	msg, err := DecodeMessage([]byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"))
+	require.Nil(t, err)
+	require.Equal(t, &Message{T: "aa", Y: Query, Q: MethodPing, A: bencode.BMap{"id": bencode.BString("abcdefghij0123456789")}}, msg)
+
+	msg, err = DecodeMessage([]byte("d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee"))
+	require.Nil(t, err)
+	require.Equal(t, &KRPCError{Code: ErrorGeneric, Msg: "A Generic Error Ocurred"}, msg.E)
+
+	enc, err := (&Message{T: "aa", Y: Response, R: bencode.BMap{"id": bencode.BString("mnopqrstuvwxyz123456")}}).Encode()
+	require.Nil(t, err)
+	require.Equal(t, "d1:rd2:id20:mnopqrstuvwxyz123456e1:t2:aa1:y1:re", string(enc))
+}
+
+func TestDecodeMalformedMessage(t *testing.T) {
+	for _, input := range []string{
+		"le",
+		"d1:y1:qe",
+		"d1:t2:aa1:y1:qe",
+		"d1:t2:aa1:y1:q1:q4:pinge",
+		"d1:t2:aa1:y1:re",
+		"d1:t2:aa1:y1:e1:eli201eee",
+		"d1:t2:aa1:y1:xe",
+	} {
+		_, err := DecodeMessage([]byte(input))
+		require.True(t, errors.Is(err, ErrMalformedMessage), input)
+	}
+}
+
+func TestCompactNodesRoundTrip(t *testing.T) {
+	nodes := []NodeInfo{
+		{ID: RandomID(), Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6881}},
+		{ID: RandomID(), Addr: &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2).To4(), Port: 51413}},
+	}
+
+	compact := CompactNodes(append(nodes, NodeInfo{ID: RandomID(), Addr: &net.UDPAddr{IP: net.IPv6loopback, Port: 1}}))
+	require.Len(t, compact, 2*compactNodeLen)
+
+	got, err := ParseCompactNodes(compact)
+	require.Nil(t, err)
+	require.Equal(t, nodes, got)
+
+	_, err = ParseCompactNodes(compact[:compactNodeLen+1])
+	require.True(t, errors.Is(err, ErrMalformedNodes))
+}
+
+func TestQueryRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		args   QueryArgs
+	}{
+		{MethodPing, QueryArgs{ID: RandomID()}},
+		{MethodFindNode, QueryArgs{ID: RandomID(), Target: RandomID()}},
+		{MethodGetPeers, QueryArgs{ID: RandomID(), InfoHash: RandomID()}},
+		{MethodAnnouncePeer, QueryArgs{ID: RandomID(), InfoHash: RandomID(), Port: 6881, Token: "aoeusnth"}},
+		{MethodAnnouncePeer, QueryArgs{ID: RandomID(), InfoHash: RandomID(), ImpliedPort: true, Token: "aoeusnth"}},
+	} {
+		enc, err := NewQuery("aa", tc.method, tc.args).Encode()
+		require.Nil(t, err)
+
+		msg, err := DecodeMessage(enc)
+		require.Nil(t, err)
+		require.Equal(t, tc.method, msg.Q)
+
+		args, err := msg.QueryArgs()
+		require.Nil(t, err)
+		require.Equal(t, tc.args, *args, tc.method)
+	}
+
+	msg := &Message{T: "aa", Y: Query, Q: MethodGetPeers, A: bencode.BMap{"id": bencode.BString(strings.Repeat("a", 20))}}
+	_, err := msg.QueryArgs()
+	require.True(t, errors.Is(err, ErrMalformedMessage))
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	nodes := []NodeInfo{{ID: RandomID(), Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6881}}}
+	peers := []tracker.Peer{
+		{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 6881},
+		{IP: net.IPv4(10, 0, 0, 3).To4(), Port: 51413},
+	}
+
+	for name, values := range map[string]ResponseValues{
+		"ping":                 {ID: RandomID()},
+		"find_node":            {ID: RandomID(), Nodes: nodes},
+		"get_peers with nodes": {ID: RandomID(), Nodes: nodes, Token: "aoeusnth"},
+		"get_peers with peers": {ID: RandomID(), Values: peers, Token: "aoeusnth"},
+	} {
+		enc, err := NewResponse("aa", values).Encode()
+		require.Nil(t, err)
+
+		msg, err := DecodeMessage(enc)
+		require.Nil(t, err)
+
+		got, err := msg.ResponseValues()
+		require.Nil(t, err)
+		require.Equal(t, values, *got, name)
+	}
+
+	enc, err := NewError("aa", ErrorMethodUnknown, "method unknown").Encode()
+	require.Nil(t, err)
+	msg, err := DecodeMessage(enc)
+	require.Nil(t, err)
+	require.Equal(t, &KRPCError{Code: ErrorMethodUnknown, Msg: "method unknown"}, msg.E)
+
+	_, err = msg.ResponseValues()
+	require.True(t, errors.Is(err, ErrMalformedMessage))
+}
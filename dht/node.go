@@ -0,0 +1,448 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/tracker"
+)
+
+// DefaultBootstrapNodes are well known routers that answer find_node for
+// nodes joining the DHT.
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+const (
+	// alpha is how many queries a lookup keeps in flight.
+	alpha          = 3
+	queryTimeout   = 5 * time.Second
+	lookupTimeout  = 30 * time.Second
+	maxPacketLen   = 1 << 16
+	maxStoredPeers = 100
+)
+
+var (
+	ErrNoNodes        = errors.New("routing table is empty")
+	ErrQueryTimeout   = errors.New("dht query timed out")
+	ErrAnnounceFailed = errors.New("no node accepted the announce")
+	ErrNodeClosed     = errors.New("dht node closed")
+	errBadToken       = errors.New("bad token")
+)
+
+// Node is a DHT node listening on UDP. It answers queries from other nodes
+// and looks up peers for info hashes on behalf of the client.
+type Node struct {
+	ID    ID
+	table *RoutingTable
+	conn  net.PacketConn
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	secret [20]byte
+
+	mu      sync.Mutex
+	nextTID uint16
+	pending map[string]chan *Message
+	peers   map[[20]byte][]tracker.Peer
+}
+
+// NewNode listens on addr, e.g. ":6881", with a random node ID. Call
+// Bootstrap before looking anything up.
+func NewNode(addr string) (*Node, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("new dht node: %w", err)
+	}
+
+	id := RandomID()
+	n := &Node{
+		ID:      id,
+		table:   NewRoutingTable(id),
+		conn:    conn,
+		pending: make(map[string]chan *Message),
+		peers:   make(map[[20]byte][]tracker.Peer),
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	rand.Read(n.secret[:])
+
+	go n.readLoop()
+	return n, nil
+}
+
+func (n *Node) Addr() net.Addr {
+	return n.conn.LocalAddr()
+}
+
+// Nodes is the number of nodes in the routing table.
+func (n *Node) Nodes() int {
+	return n.table.Len()
+}
+
+func (n *Node) Close() error {
+	n.cancel()
+	return n.conn.Close()
+}
+
+func (n *Node) readLoop() {
+	buf := make([]byte, maxPacketLen)
+	for {
+		size, addr, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			if n.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		// Anyone can send us anything, malformed packets are dropped.
+		msg, err := DecodeMessage(buf[:size])
+		if err != nil {
+			continue
+		}
+
+		if msg.Y == Query {
+			n.handleQuery(msg, udpAddr)
+			continue
+		}
+
+		n.mu.Lock()
+		ch, ok := n.pending[msg.T]
+		delete(n.pending, msg.T)
+		n.mu.Unlock()
+		if ok {
+			ch <- msg
+		}
+	}
+}
+
+func (n *Node) send(msg *Message, addr *net.UDPAddr) error {
+	enc, err := msg.Encode()
+	if err != nil {
+		return err
+	}
+
+	_, err = n.conn.WriteTo(enc, addr)
+	return err
+}
+
+func (n *Node) replyError(query *Message, addr *net.UDPAddr, code int, err error) {
+	n.send(NewError(query.T, code, err.Error()), addr)
+}
+
+// token is handed out with get_peers responses and must come back with
+// announce_peer from the same IP.
+func (n *Node) token(addr *net.UDPAddr) string {
+	h := sha1.New()
+	h.Write(n.secret[:])
+	h.Write(addr.IP)
+	return string(h.Sum(nil))
+}
+
+func (n *Node) handleQuery(msg *Message, addr *net.UDPAddr) {
+	args, err := msg.QueryArgs()
+	if err != nil {
+		n.replyError(msg, addr, ErrorProtocol, err)
+		return
+	}
+	n.table.Add(NodeInfo{ID: args.ID, Addr: addr})
+
+	values := ResponseValues{ID: n.ID}
+	switch msg.Q {
+	case MethodPing:
+	case MethodFindNode:
+		values.Nodes = n.table.Closest(args.Target, K)
+	case MethodGetPeers:
+		values.Token = n.token(addr)
+		n.mu.Lock()
+		values.Values = slices.Clone(n.peers[args.InfoHash])
+		n.mu.Unlock()
+		if values.Values == nil {
+			values.Nodes = n.table.Closest(args.InfoHash, K)
+		}
+	case MethodAnnouncePeer:
+		if args.Token != n.token(addr) {
+			n.replyError(msg, addr, ErrorProtocol, errBadToken)
+			return
+		}
+		if args.ImpliedPort {
+			args.Port = addr.Port
+		}
+		n.storePeer(args.InfoHash, tracker.Peer{IP: addr.IP, Port: uint16(args.Port)})
+	default:
+		n.replyError(msg, addr, ErrorMethodUnknown, fmt.Errorf("method %q unknown", msg.Q))
+		return
+	}
+
+	n.send(NewResponse(msg.T, values), addr)
+}
+
+func (n *Node) storePeer(infoHash [20]byte, p tracker.Peer) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	peers := slices.DeleteFunc(n.peers[infoHash], func(q tracker.Peer) bool {
+		return q.String() == p.String()
+	})
+	if len(peers) >= maxStoredPeers {
+		peers = peers[1:]
+	}
+	n.peers[infoHash] = append(peers, p)
+}
+
+// query sends a query built by NewQuery to addr, filling in our ID and a
+// transaction ID, and waits for its response. The responding node is added
+// to the routing table.
+func (n *Node) query(ctx context.Context, addr *net.UDPAddr, method string, args QueryArgs) (*ResponseValues, error) {
+	args.ID = n.ID
+
+	ch := make(chan *Message, 1)
+	n.mu.Lock()
+	n.nextTID += 1
+	tid := string(binary.BigEndian.AppendUint16(nil, n.nextTID))
+	n.pending[tid] = ch
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		delete(n.pending, tid)
+		n.mu.Unlock()
+	}()
+
+	if err := n.send(NewQuery(tid, method, args), addr); err != nil {
+		return nil, fmt.Errorf("%s to %s: %w", method, addr, err)
+	}
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+
+	var resp *Message
+	select {
+	case resp = <-ch:
+	case <-timer.C:
+		return nil, fmt.Errorf("%s to %s: %w", method, addr, ErrQueryTimeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-n.ctx.Done():
+		return nil, ErrNodeClosed
+	}
+
+	if resp.Y == Error {
+		return nil, fmt.Errorf("%s to %s: %w", method, addr, resp.E)
+	}
+
+	values, err := resp.ResponseValues()
+	if err != nil {
+		return nil, fmt.Errorf("%s to %s: %w", method, addr, err)
+	}
+	n.table.Add(NodeInfo{ID: values.ID, Addr: addr})
+
+	return values, nil
+}
+
+func (n *Node) findNode(ctx context.Context, addr *net.UDPAddr, target ID) ([]NodeInfo, error) {
+	values, err := n.query(ctx, addr, MethodFindNode, QueryArgs{Target: target})
+	if err != nil {
+		return nil, err
+	}
+	return values.Nodes, nil
+}
+
+func (n *Node) getPeers(ctx context.Context, addr *net.UDPAddr, infoHash [20]byte) (*ResponseValues, error) {
+	return n.query(ctx, addr, MethodGetPeers, QueryArgs{InfoHash: infoHash})
+}
+
+func (n *Node) announcePeer(ctx context.Context, addr *net.UDPAddr, infoHash [20]byte, port int, token string) error {
+	_, err := n.query(ctx, addr, MethodAnnouncePeer, QueryArgs{InfoHash: infoHash, Port: port, Token: token})
+	return err
+}
+
+// Bootstrap joins the DHT through routers, host:port addresses such as
+// DefaultBootstrapNodes, then looks up our own ID to fill the routing table.
+func (n *Node) Bootstrap(ctx context.Context, routers []string) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	seeds := make([]NodeInfo, 0)
+	for _, router := range routers {
+		addr, err := net.ResolveUDPAddr("udp", router)
+		if err != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nodes, err := n.findNode(ctx, addr, n.ID)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			seeds = append(seeds, nodes...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	n.lookup(ctx, n.ID, seeds, nil)
+	if n.table.Len() == 0 {
+		return fmt.Errorf("bootstrap: %w", ErrNoNodes)
+	}
+	return nil
+}
+
+type lookupNode struct {
+	NodeInfo
+	queried bool
+	token   string
+}
+
+// lookup iteratively queries the nodes closest to target, alpha at a time,
+// until the K closest nodes seen have all been queried. With onPeers set it
+// sends get_peers rather than find_node and passes on the peers found. It
+// returns the closest nodes that answered.
+func (n *Node) lookup(ctx context.Context, target ID, seeds []NodeInfo, onPeers func([]tracker.Peer)) []lookupNode {
+	seen := map[ID]bool{n.ID: true}
+	shortlist := make([]*lookupNode, 0)
+	add := func(nodes []NodeInfo) {
+		for _, node := range nodes {
+			if !seen[node.ID] {
+				seen[node.ID] = true
+				shortlist = append(shortlist, &lookupNode{NodeInfo: node})
+			}
+		}
+	}
+	add(n.table.Closest(target, K))
+	add(seeds)
+
+	responded := make(map[ID]bool)
+	for ctx.Err() == nil {
+		slices.SortFunc(shortlist, func(a, b *lookupNode) int {
+			da, db := a.ID.Distance(target), b.ID.Distance(target)
+			return slices.Compare(da[:], db[:])
+		})
+
+		batch := make([]*lookupNode, 0, alpha)
+		for _, node := range shortlist[:min(K, len(shortlist))] {
+			if !node.queried && len(batch) < alpha {
+				node.queried = true
+				batch = append(batch, node)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, node := range batch {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				var nodes []NodeInfo
+				var peers []tracker.Peer
+				var token string
+				if onPeers == nil {
+					var err error
+					if nodes, err = n.findNode(ctx, node.Addr, target); err != nil {
+						return
+					}
+				} else {
+					r, err := n.getPeers(ctx, node.Addr, target)
+					if err != nil {
+						return
+					}
+					nodes, peers, token = r.Nodes, r.Values, r.Token
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				node.token = token
+				responded[node.ID] = true
+				add(nodes)
+				if len(peers) > 0 {
+					onPeers(peers)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	ret := make([]lookupNode, 0, K)
+	for _, node := range shortlist {
+		if responded[node.ID] && len(ret) < K {
+			ret = append(ret, *node)
+		}
+	}
+	return ret
+}
+
+// FindPeers looks up peers for infoHash. Peers are sent on the returned
+// channel as they are found, without duplicates, and the channel is closed
+// when the lookup ends or the node is closed.
+func (n *Node) FindPeers(infoHash [20]byte) (<-chan tracker.Peer, error) {
+	if n.table.Len() == 0 {
+		return nil, fmt.Errorf("find peers: %w", ErrNoNodes)
+	}
+
+	ch := make(chan tracker.Peer)
+	go func() {
+		defer close(ch)
+
+		ctx, cancel := context.WithTimeout(n.ctx, lookupTimeout)
+		defer cancel()
+
+		found := make(map[string]bool)
+		n.lookup(ctx, ID(infoHash), nil, func(peers []tracker.Peer) {
+			for _, p := range peers {
+				if found[p.String()] {
+					continue
+				}
+				found[p.String()] = true
+
+				select {
+				case ch <- p:
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}()
+
+	return ch, nil
+}
+
+// Announce tells the nodes closest to infoHash that we accept peers on port.
+func (n *Node) Announce(ctx context.Context, infoHash [20]byte, port int) error {
+	if n.table.Len() == 0 {
+		return fmt.Errorf("announce: %w", ErrNoNodes)
+	}
+
+	nodes := n.lookup(ctx, ID(infoHash), nil, func([]tracker.Peer) {})
+
+	announced := false
+	for _, node := range nodes {
+		if n.announcePeer(ctx, node.Addr, infoHash, port, node.token) == nil {
+			announced = true
+		}
+	}
+	if !announced {
+		return fmt.Errorf("announce: %w", ErrAnnounceFailed)
+	}
+	return nil
+}
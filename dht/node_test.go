@@ -0,0 +1,94 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/tracker"
+	"github.com/stretchr/testify/require"
+)
+
+func startTestNodes(t *testing.T, count int) []*Node {
+	t.Helper()
+
+	nodes := make([]*Node, 0, count)
+	for range count {
+		n, err := NewNode("127.0.0.1:0")
+		require.Nil(t, err)
+		t.Cleanup(func() { n.Close() })
+		nodes = append(nodes, n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, n := range nodes[1:] {
+		require.Nil(t, n.Bootstrap(ctx, []string{nodes[0].Addr().String()}))
+	}
+	return nodes
+}
+
+func TestNodeBootstrap(t *testing.T) {
+	nodes := startTestNodes(t, 6)
+	for _, n := range nodes {
+		require.Greater(t, n.Nodes(), 1)
+	}
+
+	lonely, err := NewNode("127.0.0.1:0")
+	require.Nil(t, err)
+	defer lonely.Close()
+
+	_, err = lonely.FindPeers([20]byte{1})
+	require.True(t, errors.Is(err, ErrNoNodes))
+}
+
+func TestNodeAnnounceAndFindPeers(t *testing.T) {
+	nodes := startTestNodes(t, 6)
+	infoHash := [20]byte(RandomID())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.Nil(t, nodes[1].Announce(ctx, infoHash, 6881))
+
+	peers, err := nodes[5].FindPeers(infoHash)
+	require.Nil(t, err)
+
+	found := make([]string, 0)
+	for p := range peers {
+		found = append(found, p.String())
+	}
+	require.Equal(t, []string{"127.0.0.1:6881"}, found)
+}
+
+func TestNodeRejectsBadToken(t *testing.T) {
+	nodes := startTestNodes(t, 2)
+	addr, err := resolve(nodes[0])
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = nodes[1].announcePeer(ctx, addr, [20]byte{1}, 6881, "forged")
+	var krpcErr *KRPCError
+	require.True(t, errors.As(err, &krpcErr))
+	require.Equal(t, ErrorProtocol, krpcErr.Code)
+
+	_, err = nodes[1].query(ctx, addr, "vote", QueryArgs{})
+	require.True(t, errors.As(err, &krpcErr))
+	require.Equal(t, ErrorMethodUnknown, krpcErr.Code)
+
+	r, err := nodes[1].getPeers(ctx, addr, [20]byte{1})
+	require.Nil(t, err)
+	require.Nil(t, nodes[1].announcePeer(ctx, addr, [20]byte{1}, 6881, r.Token))
+
+	r, err = nodes[1].getPeers(ctx, addr, [20]byte{1})
+	require.Nil(t, err)
+	require.Len(t, r.Values, 1)
+	require.Equal(t, tracker.Peer{IP: r.Values[0].IP, Port: 6881}, r.Values[0])
+}
+
+func resolve(n *Node) (*net.UDPAddr, error) {
+	return net.ResolveUDPAddr("udp", n.Addr().String())
+}
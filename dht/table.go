@@ -0,0 +1,126 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"math/bits"
+	"slices"
+	"sync"
+)
+
+// K is the number of nodes kept per bucket and returned by lookups.
+const K = 8
+
+type ID [20]byte
+
+func RandomID() ID {
+	var id ID
+	rand.Read(id[:])
+	return id
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Distance is the XOR metric between two IDs, compare results with Less.
+func (id ID) Distance(other ID) ID {
+	var ret ID
+	for i := range id {
+		ret[i] = id[i] ^ other[i]
+	}
+	return ret
+}
+
+func (id ID) Less(other ID) bool {
+	return bytes.Compare(id[:], other[:]) < 0
+}
+
+// commonPrefixLen is the number of leading bits id and other share, 160 when
+// they are equal.
+func (id ID) commonPrefixLen(other ID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(id) * 8
+}
+
+// RoutingTable keeps up to K nodes per bucket, bucket i holding the nodes
+// whose ID shares exactly i leading bits with ours. Nodes in a bucket are
+// ordered from least to most recently seen.
+type RoutingTable struct {
+	mu      sync.Mutex
+	self    ID
+	buckets [160][]NodeInfo
+}
+
+func NewRoutingTable(self ID) *RoutingTable {
+	return &RoutingTable{self: self}
+}
+
+// Add records that n was seen. A full bucket keeps its existing nodes, long
+// lived nodes are the most likely to stay up, and Add reports false.
+func (t *RoutingTable) Add(n NodeInfo) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := t.self.commonPrefixLen(n.ID)
+	if i == len(t.buckets) {
+		return false
+	}
+
+	bucket := t.buckets[i]
+	if j := slices.IndexFunc(bucket, func(m NodeInfo) bool { return m.ID == n.ID }); j != -1 {
+		bucket = slices.Delete(bucket, j, j+1)
+	} else if len(bucket) >= K {
+		return false
+	}
+
+	t.buckets[i] = append(bucket, n)
+	return true
+}
+
+func (t *RoutingTable) Remove(id ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := t.self.commonPrefixLen(id)
+	if i == len(t.buckets) {
+		return
+	}
+	t.buckets[i] = slices.DeleteFunc(t.buckets[i], func(m NodeInfo) bool { return m.ID == id })
+}
+
+func (t *RoutingTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ret := 0
+	for _, bucket := range t.buckets {
+		ret += len(bucket)
+	}
+	return ret
+}
+
+// Closest returns up to count nodes ordered by distance to target.
+func (t *RoutingTable) Closest(target ID, count int) []NodeInfo {
+	t.mu.Lock()
+	ret := make([]NodeInfo, 0)
+	for _, bucket := range t.buckets {
+		ret = append(ret, bucket...)
+	}
+	t.mu.Unlock()
+
+	sortByDistance(ret, target)
+	return ret[:min(count, len(ret))]
+}
+
+func sortByDistance(nodes []NodeInfo, target ID) {
+	slices.SortFunc(nodes, func(a, b NodeInfo) int {
+		da, db := a.ID.Distance(target), b.ID.Distance(target)
+		return bytes.Compare(da[:], db[:])
+	})
+}
@@ -0,0 +1,47 @@
+package dht
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func idWithPrefix(b ...byte) ID {
+	var id ID
+	copy(id[:], b)
+	return id
+}
+
+func TestCommonPrefixLen(t *testing.T) {
+	var zero ID
+	require.Equal(t, 160, zero.commonPrefixLen(zero))
+	require.Equal(t, 0, zero.commonPrefixLen(idWithPrefix(0x80)))
+	require.Equal(t, 7, zero.commonPrefixLen(idWithPrefix(0x01)))
+	require.Equal(t, 12, zero.commonPrefixLen(idWithPrefix(0x00, 0x08)))
+}
+
+func TestRoutingTable(t *testing.T) {
+	var self ID
+	table := NewRoutingTable(self)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+
+	require.False(t, table.Add(NodeInfo{ID: self, Addr: addr}))
+
+	// All of these share no leading bits with self and land in bucket 0.
+	for i := range K {
+		require.True(t, table.Add(NodeInfo{ID: idWithPrefix(0x80, byte(i)), Addr: addr}))
+	}
+	require.False(t, table.Add(NodeInfo{ID: idWithPrefix(0x80, 0xff), Addr: addr}))
+	require.True(t, table.Add(NodeInfo{ID: idWithPrefix(0x80, 0x00), Addr: addr}))
+	require.True(t, table.Add(NodeInfo{ID: idWithPrefix(0x01), Addr: addr}))
+	require.Equal(t, K+1, table.Len())
+
+	closest := table.Closest(idWithPrefix(0x80, 0x03), 3)
+	require.Equal(t, []ID{idWithPrefix(0x80, 0x03), idWithPrefix(0x80, 0x02), idWithPrefix(0x80, 0x01)},
+		[]ID{closest[0].ID, closest[1].ID, closest[2].ID})
+
+	table.Remove(idWithPrefix(0x80, 0x03))
+	require.Equal(t, K, table.Len())
+	require.Equal(t, idWithPrefix(0x01), table.Closest(self, 1)[0].ID)
+}
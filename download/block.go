@@ -0,0 +1,27 @@
+package download
+
+const DefaultBlockSize = 16384
+
+type Block struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// BlockPlan splits a piece into blocks of blockSize, the last block is
+// shortened to fit. A blockSize <= 0 uses DefaultBlockSize.
+func BlockPlan(pieceIndex int, pieceLen int64, blockSize int) []Block {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+
+	ret := make([]Block, 0, (pieceLen+int64(blockSize)-1)/int64(blockSize))
+	for begin := int64(0); begin < pieceLen; begin += int64(blockSize) {
+		length := int64(blockSize)
+		if begin+length > pieceLen {
+			length = pieceLen - begin
+		}
+		ret = append(ret, Block{Index: pieceIndex, Begin: int(begin), Length: int(length)})
+	}
+	return ret
+}
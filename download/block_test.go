@@ -0,0 +1,64 @@
+package download
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockPlan(t *testing.T) {
+	tests := []struct {
+		name      string
+		index     int
+		pieceLen  int64
+		blockSize int
+		expected  []Block
+	}{
+		{
+			name:      "divides evenly",
+			index:     3,
+			pieceLen:  4 * 16384,
+			blockSize: 16384,
+			expected: []Block{
+				{Index: 3, Begin: 0, Length: 16384},
+				{Index: 3, Begin: 16384, Length: 16384},
+				{Index: 3, Begin: 32768, Length: 16384},
+				{Index: 3, Begin: 49152, Length: 16384},
+			},
+		},
+		{
+			name:      "short final block",
+			index:     7,
+			pieceLen:  2*16384 + 100,
+			blockSize: 16384,
+			expected: []Block{
+				{Index: 7, Begin: 0, Length: 16384},
+				{Index: 7, Begin: 16384, Length: 16384},
+				{Index: 7, Begin: 32768, Length: 100},
+			},
+		},
+		{
+			name:      "piece smaller than a block",
+			index:     0,
+			pieceLen:  10,
+			blockSize: 16384,
+			expected:  []Block{{Index: 0, Begin: 0, Length: 10}},
+		},
+		{
+			name:      "default block size",
+			index:     1,
+			pieceLen:  20000,
+			blockSize: 0,
+			expected: []Block{
+				{Index: 1, Begin: 0, Length: DefaultBlockSize},
+				{Index: 1, Begin: DefaultBlockSize, Length: 20000 - DefaultBlockSize},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, BlockPlan(tt.index, tt.pieceLen, tt.blockSize))
+		})
+	}
+}
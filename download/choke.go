@@ -0,0 +1,200 @@
+package download
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/peer"
+)
+
+const (
+	DefaultUnchokeSlots = 4
+	rechokeInterval     = 10 * time.Second
+	optimisticInterval  = 30 * time.Second
+)
+
+// PeerRate is what the choker knows about a peer when it rechokes.
+type PeerRate struct {
+	ID         string
+	Interested bool
+	// DownloadRate is what the peer sends us and UploadRate what we send
+	// it, both in bytes per second.
+	DownloadRate float64
+	UploadRate   float64
+}
+
+// ChokeManager implements the tit-for-tat choker: the Slots interested peers
+// that give us the most data are unchoked, ranked by what we upload to them
+// once we are seeding, plus one optimistic unchoke rotated every 30 seconds
+// so new peers get a chance to prove themselves.
+type ChokeManager struct {
+	Slots int
+
+	optimistic     string
+	lastOptimistic time.Time
+}
+
+func NewChokeManager() *ChokeManager {
+	return &ChokeManager{Slots: DefaultUnchokeSlots}
+}
+
+// Optimistic returns the id of the current optimistic unchoke.
+func (m *ChokeManager) Optimistic() string {
+	return m.optimistic
+}
+
+// Rechoke returns the ids of the peers that should be unchoked, everyone else
+// should be choked.
+func (m *ChokeManager) Rechoke(now time.Time, peers []PeerRate, seeding bool) map[string]bool {
+	candidates := make([]PeerRate, 0, len(peers))
+	for _, p := range peers {
+		if p.Interested {
+			candidates = append(candidates, p)
+		}
+	}
+
+	rate := func(p PeerRate) float64 {
+		if seeding {
+			return p.UploadRate
+		}
+		return p.DownloadRate
+	}
+	slices.SortStableFunc(candidates, func(a, b PeerRate) int {
+		switch {
+		case rate(a) > rate(b):
+			return -1
+		case rate(a) < rate(b):
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	unchoke := make(map[string]bool)
+	for i := 0; i < len(candidates) && i < m.Slots; i += 1 {
+		unchoke[candidates[i].ID] = true
+	}
+
+	rest := candidates[min(m.Slots, len(candidates)):]
+	stillValid := slices.ContainsFunc(rest, func(p PeerRate) bool { return p.ID == m.optimistic })
+	if !stillValid || now.Sub(m.lastOptimistic) >= optimisticInterval {
+		m.optimistic = ""
+		if len(rest) > 0 {
+			m.optimistic = rest[rand.IntN(len(rest))].ID
+			m.lastOptimistic = now
+		}
+	}
+
+	if m.optimistic != "" {
+		unchoke[m.optimistic] = true
+	}
+	return unchoke
+}
+
+// connState is what the session tracks about a connection for the choker, it
+// is guarded by Session.mu. unchoked rather than Conn.AmChoking says whether
+// we choke the peer, since rechokes happen outside the connection goroutine.
+type connState struct {
+	id         string
+	interested bool
+	unchoked   bool
+	// amInterested is whether we told the peer we are interested.
+	amInterested bool
+	down         *RateMeter
+	up           *RateMeter
+}
+
+func (s *Session) addConn(id string, conn *peer.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conns[conn] = &connState{id: id, down: NewRateMeter(0), up: NewRateMeter(0)}
+}
+
+func (s *Session) removeConn(conn *peer.Conn) {
+	s.mu.Lock()
+	cs := s.conns[conn]
+	delete(s.conns, conn)
+	s.mu.Unlock()
+
+	if cs != nil && cs.unchoked {
+		s.rechoke()
+	}
+}
+
+func (s *Session) setInterested(conn *peer.Conn, interested bool) {
+	s.mu.Lock()
+	cs := s.conns[conn]
+	changed := cs != nil && cs.interested != interested
+	if changed {
+		cs.interested = interested
+	}
+	s.mu.Unlock()
+
+	if changed {
+		s.rechoke()
+	}
+}
+
+func (s *Session) isUnchoked(conn *peer.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cs := s.conns[conn]
+	return cs != nil && cs.unchoked
+}
+
+// rechoke runs the choker over the current connections and sends choke or
+// unchoke to every peer whose state changed.
+func (s *Session) rechoke() {
+	s.chokeMu.Lock()
+	defer s.chokeMu.Unlock()
+
+	now := time.Now()
+
+	s.mu.Lock()
+	peers := make([]PeerRate, 0, len(s.conns))
+	for _, cs := range s.conns {
+		peers = append(peers, PeerRate{
+			ID:           cs.id,
+			Interested:   cs.interested,
+			DownloadRate: cs.down.Rate(),
+			UploadRate:   cs.up.Rate(),
+		})
+	}
+
+	unchoke := s.choker.Rechoke(now, peers, s.finished())
+
+	changed := make(map[*peer.Conn]bool)
+	for conn, cs := range s.conns {
+		if unchoke[cs.id] != cs.unchoked {
+			cs.unchoked = unchoke[cs.id]
+			changed[conn] = cs.unchoked
+		}
+	}
+	s.mu.Unlock()
+
+	for conn, unchoked := range changed {
+		msg := &peer.Message{ID: peer.MsgChoke}
+		if unchoked {
+			msg.ID = peer.MsgUnchoke
+		}
+		conn.Send(msg)
+	}
+}
+
+func (s *Session) rechokeLoop(ctx context.Context) {
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.rechoke()
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package download
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/peer"
+	"github.com/skirtan1/bittorrent-client/torrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChokeManagerLeeching(t *testing.T) {
+	m := NewChokeManager()
+	now := time.Now()
+
+	peers := []PeerRate{
+		{ID: "a", Interested: true, DownloadRate: 500},
+		{ID: "b", Interested: true, DownloadRate: 100},
+		{ID: "c", Interested: true, DownloadRate: 400},
+		{ID: "d", Interested: true, DownloadRate: 300},
+		{ID: "e", Interested: true, DownloadRate: 200, UploadRate: 1000},
+		{ID: "f", Interested: false, DownloadRate: 1000},
+	}
+
+	unchoke := m.Rechoke(now, peers, false)
+	require.Equal(t, map[string]bool{"a": true, "c": true, "d": true, "e": true, "b": true}, unchoke)
+	require.Equal(t, "b", m.Optimistic())
+
+	// The optimistic unchoke sticks until it is due for rotation.
+	peers = append(peers, PeerRate{ID: "g", Interested: true})
+	unchoke = m.Rechoke(now.Add(rechokeInterval), peers, false)
+	require.Equal(t, map[string]bool{"a": true, "c": true, "d": true, "e": true, "b": true}, unchoke)
+
+	for i := 0; i < 100; i += 1 {
+		now = now.Add(optimisticInterval)
+		unchoke = m.Rechoke(now, peers, false)
+		require.Len(t, unchoke, 5)
+		require.Contains(t, []string{"b", "g"}, m.Optimistic())
+		if m.Optimistic() == "g" {
+			break
+		}
+	}
+	require.Equal(t, "g", m.Optimistic())
+}
+
+func TestChokeManagerSeeding(t *testing.T) {
+	m := NewChokeManager()
+	m.Slots = 2
+
+	peers := []PeerRate{
+		{ID: "a", Interested: true, DownloadRate: 500, UploadRate: 10},
+		{ID: "b", Interested: true, UploadRate: 300},
+		{ID: "c", Interested: true, UploadRate: 200},
+	}
+
+	unchoke := m.Rechoke(time.Now(), peers, true)
+	require.Equal(t, map[string]bool{"b": true, "c": true, "a": true}, unchoke)
+	require.Equal(t, "a", m.Optimistic())
+
+	// With no one left over there is no optimistic unchoke.
+	m = NewChokeManager()
+	unchoke = m.Rechoke(time.Now(), peers, true)
+	require.Len(t, unchoke, 3)
+	require.Equal(t, "", m.Optimistic())
+}
+
+func TestSessionRechokeSeeding(t *testing.T) {
+	info, _ := newTestContent(t, 2*DefaultBlockSize, 3*2*DefaultBlockSize)
+	s, err := NewSession(&torrent.MetaInfo{Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+	s.choker.Slots = 1
+
+	conns := make(map[string]*peer.Conn)
+	for _, id := range []string{"giver", "taker", "idle"} {
+		client, server := net.Pipe()
+		t.Cleanup(func() { client.Close(); server.Close() })
+		go io.Copy(io.Discard, server)
+
+		conns[id] = peer.NewConn(client)
+		s.addConn(id, conns[id])
+	}
+	s.recordDownload(conns["giver"], 1000)
+	s.recordUpload(conns["taker"], 1000)
+	for _, conn := range conns {
+		s.setInterested(conn, true)
+	}
+
+	// ranked leaves out the optimistic unchoke, which is random.
+	ranked := func() []string {
+		ids := make([]string, 0, 1)
+		for id, conn := range conns {
+			if s.isUnchoked(conn) && id != s.choker.Optimistic() {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	require.Equal(t, []string{"giver"}, ranked())
+
+	for i := range info.Pieces {
+		s.markHave(i)
+	}
+	s.rechoke()
+	require.Equal(t, []string{"taker"}, ranked())
+}
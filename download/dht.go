@@ -0,0 +1,70 @@
+package download
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/skirtan1/bittorrent-client/dht"
+	"github.com/skirtan1/bittorrent-client/tracker"
+)
+
+// DHTPeers is a PeerSource looking up a torrent's peers on the DHT. After
+// each lookup it announces port, when set, so other peers find us too. It
+// looks up once per Peers call and again on every Refresh.
+type DHTPeers struct {
+	node     *dht.Node
+	infoHash [20]byte
+	port     uint16
+	refresh  chan struct{}
+}
+
+func NewDHTPeers(node *dht.Node, infoHash [20]byte, port uint16) *DHTPeers {
+	return &DHTPeers{node: node, infoHash: infoHash, port: port, refresh: make(chan struct{}, 1)}
+}
+
+func (d *DHTPeers) Refresh() {
+	select {
+	case d.refresh <- struct{}{}:
+	default:
+	}
+}
+
+func (d *DHTPeers) Peers(ctx context.Context) <-chan tracker.Peer {
+	ch := make(chan tracker.Peer)
+	go func() {
+		defer close(ch)
+		for {
+			d.lookup(ctx, ch)
+
+			select {
+			case <-d.refresh:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func (d *DHTPeers) lookup(ctx context.Context, ch chan<- tracker.Peer) {
+	peers, err := d.node.FindPeers(d.infoHash)
+	if err != nil {
+		slog.Debug("dht lookup failed", "info hash", d.infoHash, "err", err)
+		return
+	}
+
+	for p := range peers {
+		select {
+		case ch <- p:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	if d.port == 0 {
+		return
+	}
+	if err := d.node.Announce(ctx, d.infoHash, int(d.port)); err != nil {
+		slog.Debug("dht announce failed", "info hash", d.infoHash, "err", err)
+	}
+}
@@ -0,0 +1,62 @@
+package download
+
+// eventBuffer is how many events wait for a slow reader of Events before
+// newer ones are dropped.
+const eventBuffer = 256
+
+type EventKind int
+
+const (
+	// PeerConnected: a peer finished its handshake, dialed or incoming.
+	PeerConnected EventKind = iota
+	// PieceCompleted: a piece verified and was written to storage.
+	PieceCompleted
+	// PieceFailed: a piece didn't match its hash and will be downloaded
+	// again.
+	PieceFailed
+	// TrackerAnnounced: the tracker answered an announce.
+	TrackerAnnounced
+	// DownloadComplete: every piece not skipped is downloaded.
+	DownloadComplete
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case PeerConnected:
+		return "peer connected"
+	case PieceCompleted:
+		return "piece completed"
+	case PieceFailed:
+		return "piece failed"
+	case TrackerAnnounced:
+		return "tracker announced"
+	case DownloadComplete:
+		return "download complete"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is something that happened in a Session. Peer is set for
+// PeerConnected and PieceFailed, Piece for PieceCompleted and PieceFailed and
+// Peers, the number of peers the tracker returned, for TrackerAnnounced.
+type Event struct {
+	Kind  EventKind
+	Peer  string
+	Piece int
+	Peers int
+}
+
+// Events returns the channel the session's events are sent on, it is never
+// closed. Events are dropped rather than wait for a reader that falls more
+// than a few hundred behind, so reading it can't stall the download.
+func (s *Session) Events() <-chan Event {
+	return s.events
+}
+
+func (s *Session) emit(e Event) {
+	select {
+	case s.events <- e:
+	default:
+	}
+}
@@ -0,0 +1,54 @@
+package download
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/torrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionEvents(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 3*2*DefaultBlockSize)
+	seed := startTestSeed(t, info, content, true)
+
+	mi := &torrent.MetaInfo{Announce: startTestTracker(t, seed.ln.Addr()), Info: *info}
+	s, err := NewSession(mi, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.Nil(t, startUntilComplete(ctx, s))
+
+	completed := make(map[int]bool)
+	kinds := make(map[EventKind]int)
+	for len(s.Events()) > 0 {
+		e := <-s.Events()
+		kinds[e.Kind] += 1
+		switch e.Kind {
+		case PieceCompleted:
+			completed[e.Piece] = true
+		case PeerConnected:
+			require.Equal(t, seed.ln.Addr().String(), e.Peer)
+		case TrackerAnnounced:
+			require.Equal(t, 1, e.Peers)
+		}
+	}
+
+	require.Equal(t, map[int]bool{0: true, 1: true, 2: true}, completed)
+	require.Equal(t, 1, kinds[PeerConnected])
+	require.Equal(t, 1, kinds[DownloadComplete])
+	require.Equal(t, 0, kinds[PieceFailed])
+	require.GreaterOrEqual(t, kinds[TrackerAnnounced], 1)
+}
+
+func TestSessionEventsNeverBlock(t *testing.T) {
+	s := &Session{events: make(chan Event, 1)}
+	s.emit(Event{Kind: PieceCompleted, Piece: 0})
+	s.emit(Event{Kind: PieceCompleted, Piece: 1})
+
+	require.Equal(t, Event{Kind: PieceCompleted, Piece: 0}, <-s.Events())
+	require.Len(t, s.Events(), 0)
+}
@@ -0,0 +1,125 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/skirtan1/bittorrent-client/peer"
+)
+
+// Listener accepts the connections other peers open to us and hands each to
+// the Session of the torrent its handshake asks for. Connections for torrents
+// no Session is added for are closed after reading their handshake.
+type Listener struct {
+	ln   net.Listener
+	port uint16
+	wg   sync.WaitGroup
+
+	mu       sync.Mutex
+	sessions map[[20]byte]*Session
+}
+
+// NewListener accepts peer connections on port, zero picks a free one.
+func NewListener(port int) (*Listener, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("new listener: %w", err)
+	}
+
+	l := &Listener{
+		ln:       ln,
+		port:     uint16(ln.Addr().(*net.TCPAddr).Port),
+		sessions: make(map[[20]byte]*Session),
+	}
+
+	l.wg.Add(1)
+	go l.acceptLoop()
+	return l, nil
+}
+
+// Port returns the port l accepts on.
+func (l *Listener) Port() uint16 {
+	return l.port
+}
+
+// Add routes connections for the session's torrent to s and makes s announce
+// l's port. They are only taken while s.Start runs.
+func (l *Listener) Add(s *Session) {
+	s.setPort(l.port)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sessions[s.mi.Info.InfoHash] = s
+}
+
+// Remove stops routing connections to s.
+func (l *Listener) Remove(s *Session) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.sessions[s.mi.Info.InfoHash] == s {
+		delete(l.sessions, s.mi.Info.InfoHash)
+	}
+}
+
+func (l *Listener) session(infoHash [20]byte) *Session {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.sessions[infoHash]
+}
+
+// Close stops accepting, connections already handed to a Session keep going.
+func (l *Listener) Close() error {
+	err := l.ln.Close()
+	l.wg.Wait()
+	return err
+}
+
+func (l *Listener) acceptLoop() {
+	defer l.wg.Done()
+
+	for {
+		c, err := l.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("listener accept failed", "err", err)
+			}
+			return
+		}
+
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			if err := l.handle(c); err != nil {
+				slog.Debug("incoming peer rejected", "addr", c.RemoteAddr(), "err", err)
+				c.Close()
+			}
+		}()
+	}
+}
+
+func (l *Listener) handle(c net.Conn) error {
+	var s *Session
+	conn, err := peer.Accept(c, func(infoHash [20]byte) ([20]byte, bool) {
+		s = l.session(infoHash)
+		if s == nil {
+			return [20]byte{}, false
+		}
+		return s.peerID, true
+	})
+	if err != nil {
+		return err
+	}
+
+	if !s.acceptConn(conn) {
+		// Closing only c would leave the keep-alive timer running.
+		conn.Close()
+		return fmt.Errorf("session for %s not taking peers", s.mi.Info.InfoHashHex())
+	}
+	return nil
+}
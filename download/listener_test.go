@@ -0,0 +1,106 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/peer"
+	"github.com/skirtan1/bittorrent-client/torrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerAcceptsPeers(t *testing.T) {
+	info, _ := newTestContent(t, 2*DefaultBlockSize, 4*2*DefaultBlockSize)
+
+	// a tracker with no peers keeps Start running until canceled
+	s, err := NewSession(&torrent.MetaInfo{Announce: startTestTracker(t), Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	l, err := NewListener(0)
+	require.Nil(t, err)
+	defer l.Close()
+	l.Add(s)
+	require.Equal(t, l.Port(), s.port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	started := make(chan error, 1)
+	go func() { started <- s.Start(ctx) }()
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.accepting
+	}, 5*time.Second, 10*time.Millisecond)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", l.Port())
+
+	conn, err := peer.Dial(ctx, addr, info.InfoHash, [20]byte{'r'})
+	require.Nil(t, err)
+	defer conn.Close()
+	require.Equal(t, s.peerID, conn.Remote.PeerID)
+	require.Eventually(t, func() bool { return s.Stats().ConnectedPeers == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	_, err = peer.Dial(ctx, addr, [20]byte{0xff}, [20]byte{'r'})
+	require.NotNil(t, err)
+	require.Equal(t, 1, s.Stats().ConnectedPeers)
+
+	cancel()
+	<-started
+	require.Equal(t, 0, s.Stats().ConnectedPeers)
+}
+
+func TestSessionSeedsAfterCompleting(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 4*2*DefaultBlockSize+1000)
+
+	seeder, err := NewSession(&torrent.MetaInfo{Announce: startTestTracker(t), Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer seeder.Close(context.Background())
+	for i := range info.Pieces {
+		off := int64(i) * info.PieceLength
+		require.Nil(t, seeder.storage.WritePiece(i, content[off:min(off+info.PieceLength, int64(len(content)))]))
+		seeder.markHave(i)
+	}
+
+	l, err := NewListener(0)
+	require.Nil(t, err)
+	defer l.Close()
+	l.Add(seeder)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	seeding := make(chan error, 1)
+	go func() { seeding <- seeder.Start(ctx) }()
+	require.Eventually(t, func() bool {
+		seeder.mu.Lock()
+		defer seeder.mu.Unlock()
+		return seeder.accepting
+	}, 5*time.Second, 10*time.Millisecond)
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(l.Port())}
+	dir := t.TempDir()
+	leecher, err := NewSession(&torrent.MetaInfo{Announce: startTestTracker(t, addr), Info: *info}, dir)
+	require.Nil(t, err)
+	defer leecher.Close(context.Background())
+	require.Nil(t, startUntilComplete(ctx, leecher))
+
+	a, err := os.ReadFile(filepath.Join(dir, "content", "a.bin"))
+	require.Nil(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "content", "b.bin"))
+	require.Nil(t, err)
+	require.Equal(t, content, append(a, b...))
+	require.GreaterOrEqual(t, seeder.Stats().Uploaded, int64(len(content)))
+
+	select {
+	case err := <-seeding:
+		t.Fatalf("seeder stopped early: %v", err)
+	default:
+	}
+	cancel()
+	require.Nil(t, <-seeding)
+}
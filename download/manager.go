@@ -0,0 +1,141 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/skirtan1/bittorrent-client/dht"
+	"github.com/skirtan1/bittorrent-client/ratelimit"
+	"github.com/skirtan1/bittorrent-client/torrent"
+)
+
+// Manager owns the sessions of many torrents, keyed by info hash. They share
+// one Listener, the DHT node if one is set and the rate limits, which cap
+// all of the sessions together. Start each session returned by Add yourself.
+type Manager struct {
+	// DHT, when set, finds peers for every session added after.
+	DHT *dht.Node
+	// MaxDownloadBytesPerSec and MaxUploadBytesPerSec cap the combined rate
+	// of every session, 0 means unlimited. Set them before the first Add.
+	MaxDownloadBytesPerSec int
+	MaxUploadBytesPerSec   int
+
+	baseDir  string
+	listener *Listener
+
+	mu          sync.Mutex
+	downLimiter *ratelimit.Limiter
+	upLimiter   *ratelimit.Limiter
+	sessions    map[[20]byte]*Session
+}
+
+// NewManager downloads into baseDir and accepts peers on port, zero picks a
+// free one.
+func NewManager(baseDir string, port int) (*Manager, error) {
+	l, err := NewListener(port)
+	if err != nil {
+		return nil, fmt.Errorf("new manager: %w", err)
+	}
+
+	return &Manager{
+		baseDir:  baseDir,
+		listener: l,
+		sessions: make(map[[20]byte]*Session),
+	}, nil
+}
+
+// Port returns the port every session accepts peers on.
+func (m *Manager) Port() uint16 {
+	return m.listener.Port()
+}
+
+// Add creates the session for mi, or returns the existing one if its info
+// hash was added already.
+func (m *Manager) Add(mi *torrent.MetaInfo) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.sessions[mi.Info.InfoHash]; ok {
+		return s, nil
+	}
+
+	s, err := NewSession(mi, m.baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.downLimiter == nil {
+		m.downLimiter = ratelimit.NewLimiter(m.MaxDownloadBytesPerSec)
+		m.upLimiter = ratelimit.NewLimiter(m.MaxUploadBytesPerSec)
+	}
+	s.downLimiter, s.upLimiter = m.downLimiter, m.upLimiter
+
+	m.listener.Add(s)
+	if m.DHT != nil {
+		s.AddPeerSource(NewDHTPeers(m.DHT, mi.Info.InfoHash, m.Port()))
+	}
+
+	m.sessions[mi.Info.InfoHash] = s
+	return s, nil
+}
+
+// Remove closes the session for infoHash and forgets it, it does nothing for
+// an info hash that isn't added.
+func (m *Manager) Remove(infoHash [20]byte) error {
+	m.mu.Lock()
+	s, ok := m.sessions[infoHash]
+	delete(m.sessions, infoHash)
+	m.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	m.listener.Remove(s)
+	return s.Close(context.Background())
+}
+
+// All returns the sessions, ordered by info hash.
+func (m *Manager) All() []*Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ret := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		ret = append(ret, s)
+	}
+	slices.SortFunc(ret, func(a, b *Session) int {
+		return bytes.Compare(a.mi.Info.InfoHash[:], b.mi.Info.InfoHash[:])
+	})
+	return ret
+}
+
+// Close stops accepting peers and closes every session, see Session.Close.
+// The DHT node is left to its owner.
+func (m *Manager) Close(ctx context.Context) error {
+	errs := []error{m.listener.Close()}
+
+	m.mu.Lock()
+	sessions := m.sessions
+	m.sessions = make(map[[20]byte]*Session)
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, s := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.Close(ctx)
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
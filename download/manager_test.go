@@ -0,0 +1,113 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/dht"
+	"github.com/skirtan1/bittorrent-client/torrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager(t *testing.T) {
+	first, _ := newTestContent(t, DefaultBlockSize, 4*DefaultBlockSize)
+	first.Name = "first"
+	second, _ := newTestContent(t, DefaultBlockSize, 4*DefaultBlockSize)
+	second.Name = "second"
+
+	m, err := NewManager(t.TempDir(), 0)
+	require.Nil(t, err)
+	defer m.Close(context.Background())
+	m.MaxDownloadBytesPerSec = 1 << 20
+
+	a, err := m.Add(&torrent.MetaInfo{Info: *first})
+	require.Nil(t, err)
+	b, err := m.Add(&torrent.MetaInfo{Info: *second})
+	require.Nil(t, err)
+	require.NotSame(t, a, b)
+
+	// one listener port and one set of limits for both
+	require.NotZero(t, m.Port())
+	require.Equal(t, m.Port(), a.port)
+	require.Equal(t, m.Port(), b.port)
+	require.Same(t, a.downLimiter, b.downLimiter)
+	require.Same(t, a.upLimiter, b.upLimiter)
+
+	again, err := m.Add(&torrent.MetaInfo{Info: *first})
+	require.Nil(t, err)
+	require.Same(t, a, again)
+	require.ElementsMatch(t, []*Session{a, b}, m.All())
+
+	require.Nil(t, m.Remove(first.InfoHash))
+	require.Equal(t, []*Session{b}, m.All())
+	require.Nil(t, m.listener.session(first.InfoHash))
+	require.True(t, errors.Is(a.Start(context.Background()), ErrSessionClosed))
+	require.Nil(t, m.Remove(first.InfoHash))
+}
+
+func startTestDHT(t *testing.T, count int) []*dht.Node {
+	t.Helper()
+
+	nodes := make([]*dht.Node, 0, count)
+	for range count {
+		n, err := dht.NewNode("127.0.0.1:0")
+		require.Nil(t, err)
+		t.Cleanup(func() { n.Close() })
+		nodes = append(nodes, n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, n := range nodes[1:] {
+		require.Nil(t, n.Bootstrap(ctx, []string{nodes[0].Addr().String()}))
+	}
+	return nodes
+}
+
+func TestManagerSharesDHT(t *testing.T) {
+	nodes := startTestDHT(t, 6)
+	info, _ := newTestContent(t, DefaultBlockSize, 4*DefaultBlockSize)
+
+	m, err := NewManager(t.TempDir(), 0)
+	require.Nil(t, err)
+	defer m.Close(context.Background())
+	m.DHT = nodes[1]
+
+	s, err := m.Add(&torrent.MetaInfo{Info: *info})
+	require.Nil(t, err)
+	require.Len(t, s.sources, 1)
+	src := s.sources[0].(*DHTPeers)
+	require.Same(t, nodes[1], src.node)
+	require.Equal(t, m.Port(), src.port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.Nil(t, nodes[2].Announce(ctx, info.InfoHash, 7000))
+
+	peers := src.Peers(ctx)
+	select {
+	case p := <-peers:
+		require.Equal(t, "127.0.0.1:7000", p.String())
+	case <-ctx.Done():
+		t.Fatal("no peer from the dht")
+	}
+
+	// after its lookup the source announces the manager's port
+	ours := fmt.Sprintf("127.0.0.1:%d", m.Port())
+	require.Eventually(t, func() bool {
+		found, err := nodes[5].FindPeers(info.InfoHash)
+		require.Nil(t, err)
+		announced := false
+		for p := range found {
+			announced = announced || p.String() == ours
+		}
+		return announced
+	}, 10*time.Second, 50*time.Millisecond)
+
+	cancel()
+	for range peers {
+	}
+}
@@ -0,0 +1,210 @@
+package download
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/skirtan1/bittorrent-client/peer"
+	"github.com/skirtan1/bittorrent-client/torrent"
+)
+
+const DefaultEndgameThreshold = 5
+
+type PendingRequest struct {
+	Peer  string
+	Index int
+}
+
+// PiecePicker tracks how many connected peers have each piece and picks the
+// rarest piece a peer can give us. Once fewer than EndgameThreshold pieces are
+// missing it enters endgame and hands out pieces that are already pending
+// with other peers.
+type PiecePicker struct {
+	mu           sync.Mutex
+	availability []int
+	priority     []Priority
+	pending      map[int][]string
+
+	EndgameThreshold int
+}
+
+func NewPiecePicker(numPieces int) *PiecePicker {
+	return &PiecePicker{
+		availability:     make([]int, numPieces),
+		priority:         make([]Priority, numPieces),
+		pending:          make(map[int][]string),
+		EndgameThreshold: DefaultEndgameThreshold,
+	}
+}
+
+func (p *PiecePicker) AddBitfield(bf torrent.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.availability {
+		if bf.HasPiece(i) {
+			p.availability[i] += 1
+		}
+	}
+}
+
+func (p *PiecePicker) RemoveBitfield(bf torrent.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.availability {
+		if bf.HasPiece(i) && p.availability[i] > 0 {
+			p.availability[i] -= 1
+		}
+	}
+}
+
+func (p *PiecePicker) AddHave(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if index < 0 || index >= len(p.availability) {
+		return
+	}
+	p.availability[index] += 1
+}
+
+// Update applies a have or bitfield message received from a peer, other
+// messages are ignored.
+func (p *PiecePicker) Update(msg *peer.Message) error {
+	if msg == nil {
+		return nil
+	}
+
+	switch msg.ID {
+	case peer.MsgHave:
+		index, err := peer.ParseHave(msg)
+		if err != nil {
+			return fmt.Errorf("picker update: %w", err)
+		}
+		p.AddHave(index)
+	case peer.MsgBitfield:
+		p.AddBitfield(torrent.Bitfield(msg.Payload))
+	}
+
+	return nil
+}
+
+func (p *PiecePicker) Availability(index int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if index < 0 || index >= len(p.availability) {
+		return 0
+	}
+	return p.availability[index]
+}
+
+// Availabilities returns how many peers have each piece, indexed by piece.
+// The slice is a copy the caller may keep.
+func (p *PiecePicker) Availabilities() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return slices.Clone(p.availability)
+}
+
+// SetPriority changes the priority of a piece, Skip pieces are never picked.
+func (p *PiecePicker) SetPriority(index int, priority Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if index < 0 || index >= len(p.priority) {
+		return
+	}
+	p.priority[index] = priority
+}
+
+func (p *PiecePicker) inEndgame(have torrent.Bitfield) bool {
+	missing := 0
+	for i := range p.availability {
+		if !have.HasPiece(i) && p.priority[i] != Skip {
+			missing += 1
+		}
+	}
+	return missing < p.EndgameThreshold
+}
+
+func (p *PiecePicker) pick(peerID string, have torrent.Bitfield, peerHas torrent.Bitfield) (int, bool) {
+	endgame := p.inEndgame(have)
+
+	pieceIndex := -1
+	for i, count := range p.availability {
+		if have.HasPiece(i) || !peerHas.HasPiece(i) || p.priority[i] == Skip {
+			continue
+		}
+
+		requestedBy := p.pending[i]
+		if len(requestedBy) > 0 && (!endgame || slices.Contains(requestedBy, peerID)) {
+			continue
+		}
+
+		if pieceIndex == -1 || p.priority[i] > p.priority[pieceIndex] ||
+			(p.priority[i] == p.priority[pieceIndex] && count < p.availability[pieceIndex]) {
+			pieceIndex = i
+		}
+	}
+
+	if pieceIndex == -1 {
+		return 0, false
+	}
+	return pieceIndex, true
+}
+
+// Pick returns the rarest piece of the highest priority that peerHas offers
+// and have is missing, ties go to the lowest index.
+func (p *PiecePicker) Pick(have torrent.Bitfield, peerHas torrent.Bitfield) (pieceIndex int, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.pick("", have, peerHas)
+}
+
+// PickFor is Pick that also records the piece as pending with peerID.
+func (p *PiecePicker) PickFor(peerID string, have torrent.Bitfield, peerHas torrent.Bitfield) (pieceIndex int, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pieceIndex, ok = p.pick(peerID, have, peerHas)
+	if ok {
+		p.pending[pieceIndex] = append(p.pending[pieceIndex], peerID)
+	}
+	return pieceIndex, ok
+}
+
+// MarkReceived clears the pending requests for index and returns the ones
+// made to peers other than from, which should now be canceled.
+func (p *PiecePicker) MarkReceived(index int, from string) []PendingRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ret := make([]PendingRequest, 0)
+	for _, peerID := range p.pending[index] {
+		if peerID != from {
+			ret = append(ret, PendingRequest{Peer: peerID, Index: index})
+		}
+	}
+
+	delete(p.pending, index)
+	return ret
+}
+
+// Release drops peerID's pending request for index so the piece can be
+// picked again.
+func (p *PiecePicker) Release(index int, peerID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pending[index] = slices.DeleteFunc(p.pending[index], func(id string) bool {
+		return id == peerID
+	})
+	if len(p.pending[index]) == 0 {
+		delete(p.pending, index)
+	}
+}
@@ -0,0 +1,195 @@
+package download
+
+import (
+	"testing"
+
+	"github.com/skirtan1/bittorrent-client/peer"
+	"github.com/skirtan1/bittorrent-client/torrent"
+	"github.com/stretchr/testify/require"
+)
+
+func bitfieldOf(numPieces int, pieces ...int) torrent.Bitfield {
+	bf := torrent.NewBitfield(numPieces)
+	for _, p := range pieces {
+		bf.SetPiece(p)
+	}
+	return bf
+}
+
+func TestPiecePickerRarestFirst(t *testing.T) {
+	const numPieces = 6
+
+	peerA := bitfieldOf(numPieces, 0, 1, 2, 3)
+	peerB := bitfieldOf(numPieces, 0, 1, 2)
+	peerC := bitfieldOf(numPieces, 0, 1, 4)
+
+	picker := NewPiecePicker(numPieces)
+	for _, bf := range []torrent.Bitfield{peerA, peerB, peerC} {
+		require.Nil(t, picker.Update(&peer.Message{ID: peer.MsgBitfield, Payload: bf}))
+	}
+
+	require.Equal(t, 3, picker.Availability(0))
+	require.Equal(t, 2, picker.Availability(2))
+	require.Equal(t, 1, picker.Availability(3))
+	require.Equal(t, 0, picker.Availability(5))
+
+	tests := []struct {
+		name     string
+		have     torrent.Bitfield
+		peerHas  torrent.Bitfield
+		expected int
+		ok       bool
+	}{
+		{
+			name:     "rarest piece peer a has",
+			have:     bitfieldOf(numPieces),
+			peerHas:  peerA,
+			expected: 3,
+			ok:       true,
+		},
+		{
+			name:     "rarest piece peer b has",
+			have:     bitfieldOf(numPieces),
+			peerHas:  peerB,
+			expected: 2,
+			ok:       true,
+		},
+		{
+			name:     "skip pieces we already have",
+			have:     bitfieldOf(numPieces, 4),
+			peerHas:  peerC,
+			expected: 0,
+			ok:       true,
+		},
+		{
+			name:    "nothing left from peer",
+			have:    bitfieldOf(numPieces, 0, 1, 2),
+			peerHas: peerB,
+			ok:      false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index, ok := picker.Pick(tt.have, tt.peerHas)
+			require.Equal(t, tt.ok, ok)
+			if tt.ok {
+				require.Equal(t, tt.expected, index)
+			}
+		})
+	}
+}
+
+func TestPiecePickerHaveUpdates(t *testing.T) {
+	const numPieces = 4
+
+	picker := NewPiecePicker(numPieces)
+	picker.AddBitfield(bitfieldOf(numPieces, 0, 1))
+	picker.AddBitfield(bitfieldOf(numPieces, 0, 1))
+
+	peerHas := bitfieldOf(numPieces, 0, 1)
+	index, ok := picker.Pick(bitfieldOf(numPieces), peerHas)
+	require.True(t, ok)
+	require.Equal(t, 0, index)
+
+	require.Nil(t, picker.Update(peer.NewHave(0)))
+	index, ok = picker.Pick(bitfieldOf(numPieces), peerHas)
+	require.True(t, ok)
+	require.Equal(t, 1, index)
+
+	picker.RemoveBitfield(bitfieldOf(numPieces, 0))
+	picker.RemoveBitfield(bitfieldOf(numPieces, 0))
+	index, ok = picker.Pick(bitfieldOf(numPieces), peerHas)
+	require.True(t, ok)
+	require.Equal(t, 0, index)
+
+	require.NotNil(t, picker.Update(&peer.Message{ID: peer.MsgHave, Payload: []byte{1}}))
+}
+
+func TestPiecePickerPendingNotRepicked(t *testing.T) {
+	const numPieces = 10
+
+	picker := NewPiecePicker(numPieces)
+	all := bitfieldOf(numPieces, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9)
+	picker.AddBitfield(all)
+	picker.AddBitfield(all)
+
+	first, ok := picker.PickFor("a", bitfieldOf(numPieces), all)
+	require.True(t, ok)
+
+	second, ok := picker.PickFor("b", bitfieldOf(numPieces), all)
+	require.True(t, ok)
+	require.NotEqual(t, first, second)
+}
+
+func TestPiecePickerEndgame(t *testing.T) {
+	const numPieces = 4
+
+	picker := NewPiecePicker(numPieces)
+	picker.EndgameThreshold = 2
+
+	all := bitfieldOf(numPieces, 0, 1, 2, 3)
+	picker.AddBitfield(all)
+	picker.AddBitfield(all)
+
+	have := bitfieldOf(numPieces, 0, 1, 2)
+
+	index, ok := picker.PickFor("slow", have, all)
+	require.True(t, ok)
+	require.Equal(t, 3, index)
+
+	_, ok = picker.PickFor("slow", have, all)
+	require.False(t, ok, "a peer should not be asked twice for the same piece")
+
+	index, ok = picker.PickFor("fast", have, all)
+	require.True(t, ok)
+	require.Equal(t, 3, index)
+
+	cancels := picker.MarkReceived(3, "fast")
+	require.Equal(t, []PendingRequest{{Peer: "slow", Index: 3}}, cancels)
+
+	require.Empty(t, picker.MarkReceived(3, "slow"))
+}
+
+func TestPiecePickerRelease(t *testing.T) {
+	const numPieces = 10
+
+	picker := NewPiecePicker(numPieces)
+	peerHas := bitfieldOf(numPieces, 4)
+	picker.AddBitfield(peerHas)
+
+	index, ok := picker.PickFor("a", bitfieldOf(numPieces), peerHas)
+	require.True(t, ok)
+	require.Equal(t, 4, index)
+
+	_, ok = picker.PickFor("b", bitfieldOf(numPieces), peerHas)
+	require.False(t, ok)
+
+	picker.Release(4, "a")
+	index, ok = picker.PickFor("b", bitfieldOf(numPieces), peerHas)
+	require.True(t, ok)
+	require.Equal(t, 4, index)
+}
+
+func TestPickerPriority(t *testing.T) {
+	p := NewPiecePicker(4)
+	p.EndgameThreshold = 0
+	all := bitfieldOf(4, 0, 1, 2, 3)
+	p.AddBitfield(all)
+	p.AddBitfield(bitfieldOf(4, 0, 1))
+
+	// Pieces 2 and 3 are rarer but 0 is high priority and 2 is skipped.
+	p.SetPriority(0, High)
+	p.SetPriority(2, Skip)
+
+	index, ok := p.Pick(bitfieldOf(4), all)
+	require.True(t, ok)
+	require.Equal(t, 0, index)
+
+	index, ok = p.Pick(bitfieldOf(4, 0), all)
+	require.True(t, ok)
+	require.Equal(t, 3, index)
+
+	_, ok = p.Pick(bitfieldOf(4, 0, 1, 3), all)
+	require.False(t, ok)
+}
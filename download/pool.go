@@ -0,0 +1,149 @@
+package download
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxConnections = 50
+	// minPeerAge is how long a connection gets to prove itself before the
+	// pool may drop it for a new peer, it starts out with no rate at all.
+	minPeerAge = 30 * time.Second
+)
+
+// PeerPool caps how many peer connections a Session holds. Every dial
+// reserves a slot first; once the pool is full a new peer takes the slot of
+// the connected peer with the lowest download rate, so the pool keeps churning
+// towards productive peers. It is safe for concurrent use.
+type PeerPool struct {
+	// now is overridden in tests.
+	now func() time.Time
+
+	mu      sync.Mutex
+	max     int
+	entries map[string]*poolEntry
+}
+
+type poolEntry struct {
+	// drop is nil while the peer is still being dialed.
+	drop  func()
+	since time.Time
+	down  *RateMeter
+}
+
+// NewPeerPool returns a pool holding up to maxConns connections, zero means
+// DefaultMaxConnections.
+func NewPeerPool(maxConns int) *PeerPool {
+	if maxConns <= 0 {
+		maxConns = DefaultMaxConnections
+	}
+	return &PeerPool{now: time.Now, max: maxConns, entries: make(map[string]*poolEntry)}
+}
+
+// SetMaxConnections changes the cap, connections above a lowered cap are not
+// closed but their slots aren't handed out again.
+func (p *PeerPool) SetMaxConnections(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if n <= 0 {
+		n = DefaultMaxConnections
+	}
+	p.max = n
+}
+
+// Target returns the number of connections the pool aims for.
+func (p *PeerPool) Target() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.max
+}
+
+// Len returns the number of slots in use, dials in flight included.
+func (p *PeerPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.entries)
+}
+
+// Reserve claims a slot for dialing id. If the pool is full it drops the
+// slowest connection older than minPeerAge to make room, and returns false
+// when there is none.
+func (p *PeerPool) Reserve(id string) bool {
+	p.mu.Lock()
+	if _, ok := p.entries[id]; ok {
+		p.mu.Unlock()
+		return false
+	}
+
+	var drop func()
+	if len(p.entries) >= p.max {
+		worst := p.worstLocked()
+		if worst == "" {
+			p.mu.Unlock()
+			return false
+		}
+		drop = p.entries[worst].drop
+		delete(p.entries, worst)
+	}
+
+	m := NewRateMeter(0)
+	m.now = p.now
+	p.entries[id] = &poolEntry{since: p.now(), down: m}
+	p.mu.Unlock()
+
+	if drop != nil {
+		drop()
+	}
+	return true
+}
+
+// worstLocked returns the connected peer with the lowest download rate among
+// those old enough to be dropped, or "" if there is none. p.mu must be held.
+func (p *PeerPool) worstLocked() string {
+	now := p.now()
+
+	worst, worstRate := "", 0.0
+	for id, e := range p.entries {
+		if e.drop == nil || now.Sub(e.since) < minPeerAge {
+			continue
+		}
+		if rate := e.down.Rate(); worst == "" || rate < worstRate {
+			worst, worstRate = id, rate
+		}
+	}
+	return worst
+}
+
+// Connected marks the dial for id as done, drop closes the connection if the
+// pool picks it to make room for another peer.
+func (p *PeerPool) Connected(id string, drop func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e := p.entries[id]; e != nil {
+		e.drop = drop
+		e.since = p.now()
+	}
+}
+
+// Record counts n bytes downloaded from id towards its rate.
+func (p *PeerPool) Record(id string, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e := p.entries[id]; e != nil {
+		e.down.AddBytes(n)
+	}
+}
+
+// Release frees the slot of id once its dial failed or its connection closed.
+func (p *PeerPool) Release(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.entries, id)
+}
@@ -0,0 +1,51 @@
+package download
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerPoolDropsSlowestPeer(t *testing.T) {
+	p := NewPeerPool(2)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	require.Equal(t, 2, p.Target())
+
+	dropped := make(map[string]bool)
+	connect := func(id string) {
+		require.True(t, p.Reserve(id))
+		p.Connected(id, func() { dropped[id] = true })
+	}
+	connect("fast")
+	connect("slow")
+	require.Equal(t, 2, p.Len())
+
+	for range 10 {
+		now = now.Add(time.Second)
+		p.Record("fast", 10000)
+		p.Record("slow", 100)
+	}
+
+	// Both peers are still too new to be dropped.
+	require.False(t, p.Reserve("new"))
+
+	now = now.Add(minPeerAge)
+	require.True(t, p.Reserve("new"))
+	require.Equal(t, map[string]bool{"slow": true}, dropped)
+	require.Equal(t, 2, p.Len())
+
+	// The dropped peer's connection releasing its slot late is harmless.
+	p.Release("slow")
+	require.Equal(t, 2, p.Len())
+
+	// A peer still dialing is never dropped.
+	now = now.Add(minPeerAge)
+	require.True(t, p.Reserve("newer"))
+	require.Equal(t, map[string]bool{"slow": true, "fast": true}, dropped)
+	require.False(t, p.Reserve("newest"))
+
+	p.Release("new")
+	require.True(t, p.Reserve("newest"))
+}
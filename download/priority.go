@@ -0,0 +1,63 @@
+package download
+
+import (
+	"fmt"
+)
+
+type Priority int
+
+const (
+	Skip   Priority = -1
+	Normal Priority = 0
+	High   Priority = 1
+	// urgent is what a Reader gives the pieces it is about to read, above
+	// any file priority.
+	urgent Priority = 2
+)
+
+// SetFilePriority changes the priority of a file. Pieces are downloaded at
+// the highest priority of the files they overlap, so a piece shared with a
+// wanted file is still downloaded when the file is skipped. The download is
+// complete once every piece that isn't skipped is downloaded, un-skipping a
+// file with missing pieces after that makes it incomplete again.
+func (s *Session) SetFilePriority(fileIndex int, p Priority) error {
+	if _, _, err := s.mi.Info.PiecesForFile(fileIndex); err != nil {
+		return fmt.Errorf("set file priority: %w", err)
+	}
+
+	s.mu.Lock()
+	s.filePriority[fileIndex] = p
+
+	files := s.mi.Info.Files()
+	priority := make([]Priority, len(s.mi.Info.Pieces))
+	for i := range priority {
+		priority[i] = Skip
+	}
+	for i, f := range files {
+		if f.Length == 0 {
+			continue
+		}
+
+		first, last, _ := s.mi.Info.PiecesForFile(i)
+		for piece := first; piece <= last; piece += 1 {
+			priority[piece] = max(priority[piece], s.filePriority[i])
+		}
+	}
+
+	// Pieces whose priority stays keep what a Reader set in the picker.
+	for i, p := range priority {
+		if s.priority[i] == p {
+			continue
+		}
+		s.priority[i] = p
+		s.picker.SetPriority(i, p)
+	}
+	s.checkComplete()
+	reopened := s.reopenComplete()
+	s.mu.Unlock()
+
+	if reopened {
+		s.broadcastInterest()
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package download
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RateMeter estimates a byte rate as an exponentially weighted moving
+// average: bytes seen a window ago weigh 1/e as much as bytes seen now. It is
+// safe for concurrent use.
+type RateMeter struct {
+	window time.Duration
+	// now is overridden in tests.
+	now func() time.Time
+
+	mu   sync.Mutex
+	rate float64
+	last time.Time
+}
+
+// NewRateMeter returns a meter averaging over window, zero means the window
+// SessionStats rates use.
+func NewRateMeter(window time.Duration) *RateMeter {
+	if window <= 0 {
+		window = rateWindow
+	}
+	return &RateMeter{window: window, now: time.Now}
+}
+
+// decay ages the estimate to now, m.mu must be held.
+func (m *RateMeter) decay(now time.Time) {
+	if !m.last.IsZero() {
+		m.rate *= math.Exp(-now.Sub(m.last).Seconds() / m.window.Seconds())
+	}
+	m.last = now
+}
+
+func (m *RateMeter) AddBytes(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.decay(m.now())
+	m.rate += float64(n) / m.window.Seconds()
+}
+
+// Rate returns the estimated bytes per second.
+func (m *RateMeter) Rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.decay(m.now())
+	return m.rate
+}
@@ -0,0 +1,54 @@
+package download
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateMeterConverges(t *testing.T) {
+	m := NewRateMeter(2 * time.Second)
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	require.Equal(t, float64(0), m.Rate())
+
+	// 1000 bytes every 100ms is 10000 bytes per second.
+	for range 300 {
+		now = now.Add(100 * time.Millisecond)
+		m.AddBytes(1000)
+	}
+	require.InDelta(t, 10000, m.Rate(), 500)
+
+	// Doubling the rate is picked up within a few windows.
+	for range 100 {
+		now = now.Add(100 * time.Millisecond)
+		m.AddBytes(2000)
+	}
+	require.InDelta(t, 20000, m.Rate(), 1000)
+
+	// An idle meter decays towards zero.
+	now = now.Add(10 * time.Second)
+	require.Less(t, m.Rate(), 200.0)
+}
+
+func TestRateMeterConcurrent(t *testing.T) {
+	m := NewRateMeter(0)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				m.AddBytes(10)
+				m.Rate()
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Greater(t, m.Rate(), float64(0))
+}
@@ -0,0 +1,136 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// readahead is how many pieces from the read position on a Reader makes
+// urgent.
+const readahead = 4
+
+var ErrReaderClosed = errors.New("reader closed")
+
+// Reader reads a session's content as one stream, the files one after the
+// other, while it downloads. Reads of a piece that isn't downloaded yet block
+// until it is, and the pieces at the read position are picked before any
+// other. A Reader isn't safe for concurrent use, except Close which unblocks
+// a waiting Read.
+type Reader struct {
+	s   *Session
+	off int64
+
+	boosted   []int
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewReader returns a Reader at the start of the content. Close it when done,
+// until then it keeps its pieces ahead of the rest.
+func (s *Session) NewReader() *Reader {
+	return &Reader{s: s, closed: make(chan struct{})}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	select {
+	case <-r.closed:
+		return 0, ErrReaderClosed
+	default:
+	}
+
+	info := &r.s.mi.Info
+	total := info.TotalLength()
+	if r.off >= total {
+		return 0, io.EOF
+	}
+
+	index := int(r.off / info.PieceLength)
+	if err := r.waitPiece(index); err != nil {
+		return 0, err
+	}
+
+	// only read what the piece we waited for covers
+	end := min(int64(index+1)*info.PieceLength, total)
+	p = p[:min(int64(len(p)), end-r.off)]
+	n, err := r.s.storage.ReadAt(p, r.off)
+	r.off += int64(n)
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.s.mi.Info.TotalLength()
+	default:
+		return 0, fmt.Errorf("seek whence %d: %w", whence, errors.ErrUnsupported)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek to %d: negative position", offset)
+	}
+
+	r.off = offset
+	if offset < r.s.mi.Info.TotalLength() {
+		r.boost(int(offset / r.s.mi.Info.PieceLength))
+	}
+	return offset, nil
+}
+
+// Close hands the pieces r made urgent back to their file priority and fails
+// a Read waiting for a piece with ErrReaderClosed.
+func (r *Reader) Close() error {
+	r.closeOnce.Do(func() {
+		r.boost(-1)
+		close(r.closed)
+	})
+	return nil
+}
+
+// waitPiece makes index urgent and blocks until it is downloaded.
+func (r *Reader) waitPiece(index int) error {
+	r.boost(index)
+
+	for {
+		r.s.mu.Lock()
+		have := r.s.have.HasPiece(index)
+		changed := r.s.haveChanged
+		r.s.mu.Unlock()
+
+		if have {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-r.closed:
+			return ErrReaderClosed
+		}
+	}
+}
+
+// boost makes the readahead pieces from index on urgent and resets the ones
+// boosted before, a negative index only resets.
+func (r *Reader) boost(index int) {
+	s := r.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, i := range r.boosted {
+		s.picker.SetPriority(i, s.priority[i])
+	}
+	r.boosted = r.boosted[:0]
+
+	if index < 0 {
+		return
+	}
+	for i := index; i < min(index+readahead, len(s.priority)); i += 1 {
+		if !s.have.HasPiece(i) {
+			s.picker.SetPriority(i, urgent)
+			r.boosted = append(r.boosted, i)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/torrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReaderWaitsForPieces(t *testing.T) {
+	pieceLength := int64(DefaultBlockSize)
+	info, content := newTestContent(t, pieceLength, 6*int(pieceLength)-100)
+
+	s, err := NewSession(&torrent.MetaInfo{Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	r := s.NewReader()
+	defer r.Close()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	read := make(chan result, 1)
+	go func() {
+		data, err := io.ReadAll(r)
+		read <- result{data, err}
+	}()
+
+	feed := func(index int) {
+		off := int64(index) * pieceLength
+		data := content[off:min(off+pieceLength, int64(len(content)))]
+		require.Nil(t, s.storage.WritePiece(index, data))
+		s.markHave(index)
+	}
+
+	// The reader is stuck on piece 0, which it made urgent.
+	require.Eventually(t, func() bool {
+		s.picker.mu.Lock()
+		defer s.picker.mu.Unlock()
+		return s.picker.priority[0] == urgent
+	}, time.Second, time.Millisecond)
+
+	for _, index := range []int{5, 3, 1, 4} {
+		feed(index)
+	}
+	select {
+	case <-read:
+		t.Fatal("read finished before pieces 0 and 2 arrived")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	feed(2)
+	feed(0)
+	res := <-read
+	require.Nil(t, res.err)
+	require.Equal(t, content, res.data)
+}
+
+func TestReaderSeek(t *testing.T) {
+	pieceLength := int64(DefaultBlockSize)
+	info, content := newTestContent(t, pieceLength, 8*int(pieceLength))
+
+	s, err := NewSession(&torrent.MetaInfo{Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	r := s.NewReader()
+	r.boost(0)
+
+	off, err := r.Seek(5*pieceLength+10, io.SeekStart)
+	require.Nil(t, err)
+	require.Equal(t, 5*pieceLength+10, off)
+
+	// The boost moved from the start to the seek target.
+	require.Equal(t, Normal, s.picker.priority[0])
+	for i := 5; i < 8; i += 1 {
+		require.Equal(t, urgent, s.picker.priority[i])
+	}
+
+	require.Nil(t, s.storage.WritePiece(5, content[5*pieceLength:6*pieceLength]))
+	s.markHave(5)
+	buf := make([]byte, 20)
+	n, err := io.ReadFull(r, buf)
+	require.Nil(t, err)
+	require.Equal(t, content[off:off+int64(n)], buf)
+
+	off, err = r.Seek(-10, io.SeekEnd)
+	require.Nil(t, err)
+	require.Equal(t, int64(len(content))-10, off)
+	_, err = r.Seek(-1, io.SeekStart)
+	require.NotNil(t, err)
+
+	// Close unblocks a read waiting on a missing piece and drops the boost.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		r.Close()
+	}()
+	_, err = r.Read(buf)
+	require.True(t, errors.Is(err, ErrReaderClosed))
+	require.Equal(t, Normal, s.picker.priority[7])
+}
+
+func TestReaderBoostOutlivesFilePriority(t *testing.T) {
+	pieceLength := int64(DefaultBlockSize)
+	info, _ := newTestContent(t, pieceLength, 8*int(pieceLength))
+
+	s, err := NewSession(&torrent.MetaInfo{Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	r := s.NewReader()
+	defer r.Close()
+	r.boost(0)
+
+	// b.bin starts in piece 2, pieces 0 and 1 only belong to a.bin.
+	require.Nil(t, s.SetFilePriority(1, High))
+	require.Equal(t, urgent, s.picker.priority[0])
+	require.Equal(t, urgent, s.picker.priority[1])
+	require.Equal(t, High, s.picker.priority[3])
+}
@@ -0,0 +1,201 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/skirtan1/bittorrent-client/bencode"
+	"github.com/skirtan1/bittorrent-client/torrent"
+)
+
+var (
+	ErrResumeMismatch  = errors.New("resume data is for a different torrent")
+	ErrMalformedResume = errors.New("malformed resume data")
+)
+
+type ResumeData struct {
+	InfoHash [20]byte
+	Bitfield torrent.Bitfield
+	Files    []bool
+	// Key is the session's announce key, empty in resume data saved before
+	// it was kept.
+	Key string
+}
+
+func (s *Session) resumeData() *ResumeData {
+	have := s.haveSnapshot()
+
+	infoFiles := s.mi.Info.Files()
+	files := make([]bool, len(infoFiles))
+	for i := range files {
+		files[i] = true
+		if infoFiles[i].Length == 0 {
+			continue
+		}
+
+		first, last, _ := s.mi.Info.PiecesForFile(i)
+		for p := first; p <= last; p += 1 {
+			if !have.HasPiece(p) {
+				files[i] = false
+				break
+			}
+		}
+	}
+
+	s.mu.Lock()
+	key := s.key
+	s.mu.Unlock()
+
+	return &ResumeData{InfoHash: s.mi.Info.InfoHash, Bitfield: have, Files: files, Key: key}
+}
+
+func SaveResume(w io.Writer, s *Session) error {
+	rd := s.resumeData()
+
+	files := make(bencode.BList, 0, len(rd.Files))
+	for _, complete := range rd.Files {
+		if complete {
+			files = append(files, bencode.BInt64(1))
+		} else {
+			files = append(files, bencode.BInt64(0))
+		}
+	}
+
+	_, err := bencode.WriteTo(w, bencode.BMap{
+		bencode.BString("info hash"): bencode.BString(rd.InfoHash[:]),
+		bencode.BString("bitfield"):  bencode.BString(rd.Bitfield),
+		bencode.BString("files"):     files,
+		bencode.BString("key"):       bencode.BString(rd.Key),
+	})
+	if err != nil {
+		return fmt.Errorf("save resume: %w", err)
+	}
+	return nil
+}
+
+// saveResumeFile saves resume data to path through a temporary file, so a
+// crash while writing leaves the previous data in place.
+func (s *Session) saveResumeFile(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("save resume: %w", err)
+	}
+
+	err = SaveResume(f, s)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("save resume: %w", err)
+	}
+	return nil
+}
+
+func LoadResume(r io.Reader) (*ResumeData, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("load resume: %w", err)
+	}
+
+	benc, _, err := bencode.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("load resume: %w", err)
+	}
+
+	value, ok := benc.(bencode.BMap)
+	if !ok {
+		return nil, fmt.Errorf("resume not a dict: %w", ErrMalformedResume)
+	}
+
+	infoHash, ok := value[bencode.BString("info hash")].(bencode.BString)
+	if !ok || len(infoHash) != 20 {
+		return nil, fmt.Errorf("resume info hash: %w", ErrMalformedResume)
+	}
+
+	bitfield, ok := value[bencode.BString("bitfield")].(bencode.BString)
+	if !ok {
+		return nil, fmt.Errorf("resume bitfield: %w", ErrMalformedResume)
+	}
+
+	files, ok := value[bencode.BString("files")].(bencode.BList)
+	if !ok {
+		return nil, fmt.Errorf("resume files: %w", ErrMalformedResume)
+	}
+
+	ret := ResumeData{Bitfield: torrent.Bitfield(bitfield), Files: make([]bool, 0, len(files))}
+	if key, ok := value[bencode.BString("key")]; ok {
+		key, ok := key.(bencode.BString)
+		if !ok {
+			return nil, fmt.Errorf("resume key: %w", ErrMalformedResume)
+		}
+		ret.Key = string(key)
+	}
+	copy(ret.InfoHash[:], infoHash)
+	for _, f := range files {
+		complete, ok := f.(bencode.BInt64)
+		if !ok {
+			return nil, fmt.Errorf("resume file entry: %w", ErrMalformedResume)
+		}
+		ret.Files = append(ret.Files, complete != 0)
+	}
+
+	return &ret, nil
+}
+
+// Repair hashes the pieces on disk and forgets the downloaded ones that fail,
+// so the next Start downloads exactly those again and leaves the rest alone.
+// It returns the forgotten pieces and must not be called while Start runs.
+func (s *Session) Repair() ([]int, error) {
+	corrupt, err := s.storage.CorruptPieces(&s.mi.Info)
+	if err != nil {
+		return nil, fmt.Errorf("repair: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dropped := make([]int, 0, len(corrupt))
+	for _, index := range corrupt {
+		if !s.have.HasPiece(index) {
+			continue
+		}
+		s.have.ClearPiece(index)
+		s.done -= 1
+		dropped = append(dropped, index)
+	}
+
+	s.reopenComplete()
+	return dropped, nil
+}
+
+// ApplyResume marks the pieces in rd as already downloaded without hashing
+// them again and goes on announcing with its key.
+func (s *Session) ApplyResume(rd *ResumeData) error {
+	if rd.InfoHash != s.mi.Info.InfoHash {
+		return ErrResumeMismatch
+	}
+
+	if rd.Key != "" {
+		s.mu.Lock()
+		s.key = rd.Key
+		s.mu.Unlock()
+	}
+
+	for i := range s.mi.Info.Pieces {
+		if rd.Bitfield.HasPiece(i) {
+			s.markHave(i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/skirtan1/bittorrent-client/torrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumeRoundTrip(t *testing.T) {
+	info, _ := newTestContent(t, DefaultBlockSize, 6*DefaultBlockSize)
+	mi := &torrent.MetaInfo{Info: *info}
+
+	s, err := NewSession(mi, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	for _, i := range []int{0, 1, 4} {
+		s.markHave(i)
+	}
+
+	var buf bytes.Buffer
+	require.Nil(t, SaveResume(&buf, s))
+
+	rd, err := LoadResume(&buf)
+	require.Nil(t, err)
+	require.Equal(t, info.InfoHash, rd.InfoHash)
+	require.Equal(t, s.haveSnapshot(), rd.Bitfield)
+	require.Equal(t, []bool{true, false}, rd.Files)
+	require.Equal(t, s.key, rd.Key)
+
+	restored, err := NewSession(mi, t.TempDir())
+	require.Nil(t, err)
+	defer restored.Close(context.Background())
+
+	require.Nil(t, restored.ApplyResume(rd))
+	require.Equal(t, s.haveSnapshot(), restored.haveSnapshot())
+	require.Equal(t, s.Progress(), restored.Progress())
+	require.Equal(t, s.key, restored.key)
+}
+
+func TestResumeMismatch(t *testing.T) {
+	info, _ := newTestContent(t, DefaultBlockSize, 2*DefaultBlockSize)
+
+	s, err := NewSession(&torrent.MetaInfo{Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	rd := &ResumeData{InfoHash: [20]byte{0xff}, Bitfield: torrent.NewBitfield(2)}
+	require.True(t, errors.Is(s.ApplyResume(rd), ErrResumeMismatch))
+}
+
+func TestLoadResumeMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "not a dict", input: "le"},
+		{name: "short info hash", input: "d8:bitfield0:5:filesle9:info hash3:abce"},
+		{name: "missing files", input: "d8:bitfield0:9:info hash20:aaaaaaaaaaaaaaaaaaaae"},
+		{name: "key not a string", input: "d8:bitfield0:5:filesle9:info hash20:aaaaaaaaaaaaaaaaaaaa3:keyi1ee"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadResume(bytes.NewReader([]byte(tt.input)))
+			require.True(t, errors.Is(err, ErrMalformedResume))
+		})
+	}
+}
@@ -0,0 +1,953 @@
+package download
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/peer"
+	"github.com/skirtan1/bittorrent-client/ratelimit"
+	"github.com/skirtan1/bittorrent-client/torrent"
+	"github.com/skirtan1/bittorrent-client/tracker"
+)
+
+const (
+	defaultMaxPipelinedRequests = 5
+	defaultMaxConcurrentDials   = 10
+	defaultDialTimeout          = 10 * time.Second
+	listenPort                  = 6881
+	peerIDPrefix                = "-SK0001-"
+	// eventAnnounceTimeout bounds the stopped announce, which still goes out
+	// after Start's context is canceled.
+	eventAnnounceTimeout = 5 * time.Second
+	// defaultAnnounceInterval is used when the tracker doesn't send one.
+	defaultAnnounceInterval = 30 * time.Minute
+	// announceRetryInterval is how soon a failed started announce is tried
+	// again.
+	announceRetryInterval = time.Minute
+)
+
+var (
+	ErrDownloadIncomplete = errors.New("download stopped before completion")
+	ErrSessionClosed      = errors.New("session closed")
+)
+
+// Session downloads a single torrent: it announces to the tracker, downloads
+// pieces from the returned peers and writes verified pieces to storage.
+type Session struct {
+	mi      *torrent.MetaInfo
+	storage *torrent.Storage
+	picker  *PiecePicker
+	peerID  [20]byte
+
+	// MaxDownloadBytesPerSec and MaxUploadBytesPerSec cap the combined rate
+	// of all peer connections, 0 means unlimited. Set them before Start.
+	MaxDownloadBytesPerSec int
+	MaxUploadBytesPerSec   int
+	downLimiter            *ratelimit.Limiter
+	upLimiter              *ratelimit.Limiter
+
+	// PeerConfig applies to every peer connection, set it before Start.
+	PeerConfig PeerConfig
+
+	// StallTimeout is how long a download may go without receiving a block
+	// before it counts as stalled and looks for new peers, 0 means 2
+	// minutes. Set it before Start.
+	StallTimeout time.Duration
+	reannounce   chan struct{}
+
+	// ResumeFile is where Close saves resume data, empty means it isn't
+	// saved. Set it before Close.
+	ResumeFile string
+
+	// Tracker is used for announces, nil means tracker.DefaultClient.
+	Tracker *tracker.Client
+	sources []PeerSource
+	// tiers are the BEP 12 tiers regular announces go through, AnnounceMulti
+	// reorders them in place so tiersMu serializes those announces.
+	tiersMu sync.Mutex
+	tiers   [][]string
+
+	// pool caps the connections, every dial reserves a slot in it first.
+	// dials holds a token per dial in flight.
+	pool  *PeerPool
+	dials chan struct{}
+
+	// runCtx and peers track the connections of a running Start, peers
+	// learned through PEX are dialed into the same pool. incoming tracks the
+	// connections a Listener hands over, it is only added to under mu while
+	// accepting is set so Start can wait for it.
+	runCtx   context.Context
+	peers    sync.WaitGroup
+	incoming sync.WaitGroup
+
+	duplicateBlocks atomic.Int64
+	events          chan Event
+	// pieceBufs recycles the buffers pieces are downloaded into.
+	pieceBufs sync.Pool
+
+	closeOnce sync.Once
+	closeErr  error
+
+	// chokeMu serializes rechokes, the state they act on is under mu.
+	chokeMu sync.Mutex
+	choker  *ChokeManager
+	// interestMu serializes interest updates the same way.
+	interestMu sync.Mutex
+
+	mu   sync.Mutex
+	have torrent.Bitfield
+	done int
+	// complete is closed once every wanted piece is downloaded, and replaced
+	// when a wanted piece goes missing again. completed mirrors it for
+	// readers not holding mu.
+	complete  chan struct{}
+	completed atomic.Bool
+	// haveChanged is closed and replaced whenever a piece is added to have.
+	haveChanged chan struct{}
+
+	filePriority []Priority
+	priority     []Priority
+	trackerID    string
+	port         uint16
+	accepting    bool
+	closed       bool
+	// stopRun cancels the running Start and running is closed once it
+	// returned, both are nil while Start isn't running.
+	stopRun context.CancelFunc
+	running chan struct{}
+	// key is the announce key, kept in resume data so a restart is still
+	// recognized as the same client.
+	key     string
+	known   map[string]bool
+	buffers map[int]*pieceBuffer
+
+	conns      map[*peer.Conn]*connState
+	lastBlock  time.Time
+	lastKick   time.Time
+	stalled    bool
+	downloaded int64
+	uploaded   int64
+	downRate   *RateMeter
+	upRate     *RateMeter
+}
+
+func NewSession(mi *torrent.MetaInfo, baseDir string) (*Session, error) {
+	storage, err := torrent.NewStorage(&mi.Info, baseDir, torrent.FullAllocation)
+	if err != nil {
+		return nil, fmt.Errorf("new session: %w", err)
+	}
+
+	s := &Session{
+		mi:          mi,
+		storage:     storage,
+		picker:      NewPiecePicker(len(mi.Info.Pieces)),
+		have:        torrent.NewBitfield(len(mi.Info.Pieces)),
+		complete:    make(chan struct{}),
+		haveChanged: make(chan struct{}),
+
+		filePriority: make([]Priority, len(mi.Info.Files())),
+		priority:     make([]Priority, len(mi.Info.Pieces)),
+		known:        make(map[string]bool),
+		buffers:      make(map[int]*pieceBuffer),
+		conns:        make(map[*peer.Conn]*connState),
+		choker:       NewChokeManager(),
+		pool:         NewPeerPool(DefaultMaxConnections),
+		port:         listenPort,
+		events:       make(chan Event, eventBuffer),
+		reannounce:   make(chan struct{}, 1),
+		tiers:        announceTiers(mi),
+		downRate:     NewRateMeter(0),
+		upRate:       NewRateMeter(0),
+	}
+
+	s.pieceBufs.New = func() any {
+		buf := make([]byte, mi.Info.PieceLength)
+		return &buf
+	}
+	s.checkComplete()
+
+	copy(s.peerID[:], peerIDPrefix)
+	if _, err := rand.Read(s.peerID[len(peerIDPrefix):]); err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("new session, generate peer id: %w", err)
+	}
+
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("new session, generate announce key: %w", err)
+	}
+	s.key = hex.EncodeToString(key[:])
+
+	return s, nil
+}
+
+// Availability returns, for each piece, how many connected peers have it as
+// their bitfields and haves tell. It copies the counts the picker keeps for
+// rarest first, so it is cheap enough to poll for a UI.
+func (s *Session) Availability() []int {
+	return s.picker.Availabilities()
+}
+
+// PeerPool returns the pool capping the session's connections, use it to
+// change the cap or to see how many slots are taken.
+func (s *Session) PeerPool() *PeerPool {
+	return s.pool
+}
+
+func (s *Session) Progress() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.mi.Info.Pieces) == 0 {
+		return 1
+	}
+	return float64(s.done) / float64(len(s.mi.Info.Pieces))
+}
+
+// bytesLeft is what the tracker's left parameter reports: the content size
+// minus the verified pieces, counting the last one at its short size.
+func (s *Session) bytesLeft() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.bytesLeftLocked()
+}
+
+func (s *Session) bytesLeftLocked() int64 {
+	left := s.mi.Info.TotalLength()
+	for i := range s.mi.Info.Pieces {
+		if s.have.HasPiece(i) {
+			left -= s.mi.Info.PieceSize(i)
+		}
+	}
+	return left
+}
+
+func (s *Session) haveSnapshot() torrent.Bitfield {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append(torrent.Bitfield(nil), s.have...)
+}
+
+func (s *Session) hasPiece(index int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.have.HasPiece(index)
+}
+
+// DuplicateBlocksDropped counts blocks that arrived after another peer had
+// already delivered them.
+func (s *Session) DuplicateBlocksDropped() int64 {
+	return s.duplicateBlocks.Load()
+}
+
+func (s *Session) blockReceived(index, block int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.have.HasPiece(index) {
+		return true
+	}
+	pb := s.buffers[index]
+	return pb != nil && pb.received[block]
+}
+
+// receiveBlock stores a block of a piece in its shared buffer and returns the
+// piece data once every block arrived. Blocks we already hold are dropped,
+// including those of a complete buffer still waiting for forgetBuffer.
+func (s *Session) receiveBlock(index, block, begin int, data []byte) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.have.HasPiece(index) {
+		s.duplicateBlocks.Add(1)
+		return nil, false
+	}
+
+	pb := s.buffers[index]
+	if pb == nil {
+		size := s.mi.Info.PieceSize(index)
+		n := len(BlockPlan(index, size, DefaultBlockSize))
+		pb = &pieceBuffer{buf: s.getPieceBuf(size), received: make([]bool, n), remaining: n}
+		s.buffers[index] = pb
+	}
+
+	if pb.received[block] {
+		s.duplicateBlocks.Add(1)
+		return nil, false
+	}
+
+	copy(pb.buf[begin:], data)
+	pb.received[block] = true
+	pb.remaining -= 1
+	if pb.remaining > 0 {
+		return nil, false
+	}
+	return pb.buf, true
+}
+
+// forgetBuffer drops the buffer receiveBlock completed for a piece once it is
+// verified and marked, or failed, the caller still hands the buffer back.
+func (s *Session) forgetBuffer(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.buffers, index)
+}
+
+func (s *Session) markHave(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.have.HasPiece(index) {
+		return
+	}
+
+	s.have.SetPiece(index)
+	s.done += 1
+	close(s.haveChanged)
+	s.haveChanged = make(chan struct{})
+	s.checkComplete()
+}
+
+// wantedDone reports whether every piece that isn't skipped is downloaded,
+// s.mu must be held.
+func (s *Session) wantedDone() bool {
+	for i, p := range s.priority {
+		if p != Skip && !s.have.HasPiece(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkComplete closes complete once every piece that isn't skipped is
+// downloaded, s.mu must be held.
+func (s *Session) checkComplete() {
+	if s.finished() || !s.wantedDone() {
+		return
+	}
+
+	close(s.complete)
+	s.completed.Store(true)
+	s.emit(Event{Kind: DownloadComplete})
+}
+
+// reopenComplete replaces a closed complete once a piece that isn't skipped
+// is missing again and reports whether it did, s.mu must be held.
+func (s *Session) reopenComplete() bool {
+	if !s.finished() || s.wantedDone() {
+		return false
+	}
+
+	s.complete = make(chan struct{})
+	s.completed.Store(false)
+	return true
+}
+
+// Complete returns a channel closed once every piece not skipped by
+// SetFilePriority is downloaded, Start keeps seeding after that.
+func (s *Session) Complete() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.complete
+}
+
+// finished reports whether every wanted piece is downloaded.
+func (s *Session) finished() bool {
+	return s.completed.Load()
+}
+
+// hasAll reports whether we have every piece, skipped ones included.
+func (s *Session) hasAll() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.done == len(s.mi.Info.Pieces)
+}
+
+// updateInterest tells the peer we are interested until the download
+// completes, and not interested once we only seed.
+func (s *Session) updateInterest(conn *peer.Conn) error {
+	s.interestMu.Lock()
+	defer s.interestMu.Unlock()
+
+	interested := !s.finished()
+	s.mu.Lock()
+	cs := s.conns[conn]
+	changed := cs != nil && cs.amInterested != interested
+	if changed {
+		cs.amInterested = interested
+	}
+	s.mu.Unlock()
+
+	if !changed {
+		return nil
+	}
+	msg := &peer.Message{ID: peer.MsgNotInterested}
+	if interested {
+		msg.ID = peer.MsgInterested
+	}
+	return conn.Send(msg)
+}
+
+// broadcastInterest tells every peer whether we are interested, even those
+// already told, so that workers waiting on quiet peers hear back once the
+// session wants pieces again.
+func (s *Session) broadcastInterest() {
+	s.interestMu.Lock()
+	defer s.interestMu.Unlock()
+
+	interested := !s.finished()
+	s.mu.Lock()
+	conns := make([]*peer.Conn, 0, len(s.conns))
+	for c, cs := range s.conns {
+		cs.amInterested = interested
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	msg := &peer.Message{ID: peer.MsgNotInterested}
+	if interested {
+		msg.ID = peer.MsgInterested
+	}
+	for _, c := range conns {
+		c.Send(msg)
+	}
+}
+
+// sendHaveState tells a newly connected peer which pieces we can serve.
+func (s *Session) sendHaveState(conn *peer.Conn) error {
+	s.mu.Lock()
+	have := append(torrent.Bitfield(nil), s.have...)
+	done := s.done
+	s.mu.Unlock()
+
+	switch {
+	case conn.FastEnabled() && done == 0:
+		return conn.Send(&peer.Message{ID: peer.MsgHaveNone})
+	case conn.FastEnabled() && done == len(s.mi.Info.Pieces):
+		return conn.Send(&peer.Message{ID: peer.MsgHaveAll})
+	case done == 0:
+		return nil
+	default:
+		return conn.Send(&peer.Message{ID: peer.MsgBitfield, Payload: have})
+	}
+}
+
+// broadcastHave announces a newly completed piece to every connected peer.
+// Send errors are left for each connection's own goroutine to run into.
+func (s *Session) broadcastHave(index int) {
+	s.mu.Lock()
+	conns := make([]*peer.Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	msg := peer.NewHave(index)
+	for _, c := range conns {
+		c.Send(msg)
+	}
+}
+
+// announceTiers returns the tiers of mi's announce-list, which replaces
+// announce when there is one, or a single tier holding announce.
+func announceTiers(mi *torrent.MetaInfo) [][]string {
+	tiers := make([][]string, 0, len(mi.AnnounceList))
+	for _, tier := range mi.AnnounceList {
+		if len(tier) > 0 {
+			tiers = append(tiers, slices.Clone(tier))
+		}
+	}
+	if len(tiers) == 0 && mi.Announce != "" {
+		tiers = append(tiers, []string{mi.Announce})
+	}
+	return tiers
+}
+
+func (s *Session) trackerClient() *tracker.Client {
+	if s.Tracker == nil {
+		return tracker.DefaultClient
+	}
+	return s.Tracker
+}
+
+func (s *Session) announceRequest(event tracker.Event) tracker.AnnounceRequest {
+	s.mu.Lock()
+	downloaded, uploaded := s.downloaded, s.uploaded
+	trackerID, key, port := s.trackerID, s.key, s.port
+	s.mu.Unlock()
+
+	return tracker.AnnounceRequest{
+		InfoHash:   s.mi.Info.InfoHash,
+		PeerID:     s.peerID,
+		Port:       port,
+		Uploaded:   uploaded,
+		Downloaded: downloaded,
+		Left:       s.bytesLeft(),
+		Event:      event,
+		TrackerID:  trackerID,
+		Key:        key,
+	}
+}
+
+// announce sends event to the first tracker of s.tiers that answers.
+func (s *Session) announce(ctx context.Context, event tracker.Event) (*tracker.AnnounceResponse, error) {
+	req := s.announceRequest(event)
+
+	s.tiersMu.Lock()
+	resp, err := s.trackerClient().AnnounceMulti(ctx, s.tiers, req)
+	s.tiersMu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("session announce: %w", err)
+	}
+
+	s.emit(Event{Kind: TrackerAnnounced, Peers: len(resp.Peers)})
+	if resp.Warning != "" {
+		slog.Warn("tracker warning", "info hash", s.mi.Info.InfoHashHex(), "warning", resp.Warning)
+	}
+	if resp.TrackerID != "" {
+		s.mu.Lock()
+		s.trackerID = resp.TrackerID
+		s.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// announceWait is how long to wait after resp before the next regular
+// announce: the tracker's interval, but never less than its min interval.
+func announceWait(resp *tracker.AnnounceResponse) time.Duration {
+	wait := resp.Interval
+	if wait <= 0 {
+		wait = defaultAnnounceInterval
+	}
+	return max(wait, resp.MinInterval)
+}
+
+// announceLoop re-announces on the tracker's schedule, or early when
+// s.reannounce asks and the min interval allows, and connects to any new peers
+// it returns. It sends the completed event as soon as the download completes.
+// A nil resp means the started announce failed, it is retried until it goes
+// through. It runs as one of s.peers and, unless we are seeding, gives up once
+// no peers are connected and the tracker has none we haven't tried, so Start
+// can return.
+func (s *Session) announceLoop(ctx context.Context, resp *tracker.AnnounceResponse) {
+	event := tracker.EventStarted
+	wait, minInterval := announceRetryInterval, time.Duration(0)
+	if resp != nil {
+		event = tracker.EventNone
+		wait, minInterval = announceWait(resp), resp.MinInterval
+	}
+	last := time.Now()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	// nil when complete already, the tracker was told at the start
+	var complete <-chan struct{}
+	if !s.finished() {
+		complete = s.Complete()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-complete:
+			complete = nil
+			if _, err := s.announce(ctx, tracker.EventCompleted); err != nil {
+				slog.Debug("completed announce failed", "err", err)
+			}
+			continue
+		case <-timer.C:
+		case <-s.reannounce:
+			if early := minInterval - time.Since(last); early > 0 {
+				timer.Reset(early)
+				continue
+			}
+		}
+
+		resp, err := s.announce(ctx, event)
+		last = time.Now()
+		if err != nil {
+			slog.Debug("announce failed", "event", event, "err", err)
+			timer.Reset(wait)
+			continue
+		}
+		event = tracker.EventNone
+
+		s.mu.Lock()
+		connected := len(s.conns)
+		s.mu.Unlock()
+		if s.addPeers(resp.Peers) == 0 && connected == 0 && !s.finished() {
+			return
+		}
+
+		wait, minInterval = announceWait(resp), resp.MinInterval
+		timer.Reset(wait)
+	}
+}
+
+// announceEvent tells every tracker of the torrent about a lifecycle change
+// once we are done with ctx, failures are only logged since there is nothing
+// left to retry.
+func (s *Session) announceEvent(ctx context.Context, event tracker.Event) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), eventAnnounceTimeout)
+	defer cancel()
+
+	req := s.announceRequest(event)
+	var wg sync.WaitGroup
+	for _, announce := range s.mi.AllTrackers() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.trackerClient().Announce(ctx, announce, req); err != nil {
+				slog.Debug("event announce failed", "announce", announce, "event", event, "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Start announces to the tracker and downloads from the returned peers and
+// those of the peer sources, re-announcing on the tracker's interval for more.
+// A failed first announce is retried while the sources are used. Once every
+// piece not skipped by SetFilePriority is verified and written it tells the
+// tracker and keeps seeding, serving the peers that connect, until ctx is
+// canceled. It then returns nil if the download completed, or the context
+// error if it didn't. Wait on Complete to learn when the download is done.
+func (s *Session) Start(ctx context.Context) error {
+	if s.downLimiter == nil {
+		s.downLimiter = ratelimit.NewLimiter(s.MaxDownloadBytesPerSec)
+	}
+	if s.upLimiter == nil {
+		s.upLimiter = ratelimit.NewLimiter(s.MaxUploadBytesPerSec)
+	}
+	if s.dials == nil {
+		s.dials = make(chan struct{}, s.PeerConfig.maxConcurrentDials())
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrSessionClosed
+	}
+	running := make(chan struct{})
+	s.stopRun, s.running = cancel, running
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.stopRun, s.running = nil, nil
+		s.mu.Unlock()
+		close(running)
+	}()
+
+	// Peer sources don't need a tracker, so a failed announce is only
+	// retried by announceLoop and a torrent without trackers skips it.
+	var resp *tracker.AnnounceResponse
+	if len(s.tiers) > 0 {
+		var err error
+		resp, err = s.announce(runCtx, tracker.EventStarted)
+		if err != nil {
+			slog.Warn("started announce failed", "info hash", s.mi.Info.InfoHashHex(), "err", err)
+		}
+	}
+
+	s.runCtx = runCtx
+	s.mu.Lock()
+	s.accepting = true
+	s.lastBlock = time.Now()
+	s.mu.Unlock()
+	if resp != nil {
+		s.addPeers(resp.Peers)
+	}
+	for _, src := range s.sources {
+		s.peers.Add(1)
+		go func() {
+			defer s.peers.Done()
+			s.drainSource(runCtx, src)
+		}()
+	}
+	go s.rechokeLoop(runCtx)
+	go s.stallLoop(runCtx)
+
+	if len(s.tiers) > 0 {
+		s.peers.Add(1)
+		go func() {
+			defer s.peers.Done()
+			s.announceLoop(runCtx, resp)
+		}()
+	}
+
+	peersDone := make(chan struct{})
+	go func() {
+		s.peers.Wait()
+		close(peersDone)
+	}()
+
+	select {
+	case <-peersDone:
+	case <-ctx.Done():
+	}
+	// Out of peers to dial, but seeding goes on for those that connect.
+	if s.finished() {
+		<-runCtx.Done()
+	}
+	cancel()
+	<-peersDone
+	s.mu.Lock()
+	s.accepting = false
+	s.mu.Unlock()
+	s.incoming.Wait()
+
+	s.announceEvent(ctx, tracker.EventStopped)
+
+	if s.finished() {
+		return nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.isClosed() {
+		return ErrSessionClosed
+	}
+	return ErrDownloadIncomplete
+}
+
+// addPeers connects to every peer not seen before in this session that the
+// pool has a slot for and returns how many there were. It is only called from
+// Start and from goroutines counted in s.peers, so s.peers never drains while
+// new peers are being added.
+func (s *Session) addPeers(peers []tracker.Peer) int {
+	added := 0
+	for _, p := range peers {
+		addr := p.String()
+
+		s.mu.Lock()
+		seen := s.known[addr]
+		s.known[addr] = true
+		s.mu.Unlock()
+		if seen {
+			continue
+		}
+
+		if !s.pool.Reserve(addr) {
+			// forgotten so a later announce can offer it again
+			s.mu.Lock()
+			delete(s.known, addr)
+			s.mu.Unlock()
+			continue
+		}
+
+		added += 1
+		s.peers.Add(1)
+		go func() {
+			defer s.peers.Done()
+			defer s.pool.Release(addr)
+			if err := s.runPeer(s.runCtx, addr); err != nil {
+				slog.Debug("peer stopped", "addr", addr, "err", err)
+			}
+		}()
+	}
+	return added
+}
+
+// Close shuts the session down for good. A running Start is canceled and
+// waited for, so the tracker gets its stopped announce, then pieces still
+// being downloaded are dropped, the content is synced to disk and resume data
+// is saved to ResumeFile. ctx bounds the wait for Start. Later calls return
+// the first call's result.
+func (s *Session) Close(ctx context.Context) error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.close(ctx)
+	})
+	return s.closeErr
+}
+
+func (s *Session) close(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	stop, running := s.stopRun, s.running
+	s.mu.Unlock()
+
+	var errs []error
+	if stop != nil {
+		stop()
+		select {
+		case <-running:
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf("close session, wait for start: %w", ctx.Err()))
+		}
+	}
+
+	s.dropBuffers()
+	errs = append(errs, s.storage.Sync())
+	if s.ResumeFile != "" {
+		errs = append(errs, s.saveResumeFile(s.ResumeFile))
+	}
+	errs = append(errs, s.storage.Close())
+	return errors.Join(errs...)
+}
+
+func (s *Session) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// dropBuffers gives back the buffers of pieces only partly downloaded, they
+// can't be verified so resume data doesn't keep them either. Complete ones
+// belong to the worker verifying them.
+func (s *Session) dropBuffers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for index, pb := range s.buffers {
+		if pb.remaining == 0 {
+			continue
+		}
+		s.putPieceBuf(pb.buf)
+		delete(s.buffers, index)
+	}
+}
+
+// dial connects and handshakes with addr, waiting while
+// PeerConfig.MaxConcurrentDials other dials are in flight.
+func (s *Session) dial(ctx context.Context, addr string) (*peer.Conn, error) {
+	select {
+	case s.dials <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-s.dials }()
+
+	ctx, cancel := context.WithTimeout(ctx, s.PeerConfig.dialTimeout())
+	defer cancel()
+
+	conn, err := peer.Dial(ctx, addr, s.mi.Info.InfoHash, s.peerID)
+	if err != nil {
+		slog.Debug("dial failed", "addr", addr, "err", err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// acceptConn runs a connection a peer opened to us alongside the dialed ones.
+// It returns false without taking conn if Start isn't running or the pool has
+// no slot for it.
+func (s *Session) acceptConn(conn *peer.Conn) bool {
+	addr := conn.RemoteAddr().String()
+
+	s.mu.Lock()
+	if !s.accepting {
+		s.mu.Unlock()
+		return false
+	}
+	ctx := s.runCtx
+	s.incoming.Add(1)
+	s.mu.Unlock()
+
+	if !s.pool.Reserve(addr) {
+		s.incoming.Done()
+		return false
+	}
+
+	go func() {
+		defer s.incoming.Done()
+		defer s.pool.Release(addr)
+		if err := s.servePeer(ctx, addr, conn); err != nil {
+			slog.Debug("incoming peer stopped", "addr", addr, "err", err)
+		}
+	}()
+	return true
+}
+
+// setPort changes the port announced to trackers.
+func (s *Session) setPort(port uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.port = port
+}
+
+func (s *Session) runPeer(ctx context.Context, addr string) error {
+	conn, err := s.dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	return s.servePeer(ctx, addr, conn)
+}
+
+// servePeer exchanges messages with conn until it fails, ctx is done or the
+// download finishes, and closes it.
+func (s *Session) servePeer(ctx context.Context, addr string, conn *peer.Conn) error {
+	defer conn.Close()
+	conn.SetLimiters(s.downLimiter, s.upLimiter)
+
+	s.addConn(addr, conn)
+	defer s.removeConn(conn)
+	s.pool.Connected(addr, func() { conn.Close() })
+	s.emit(Event{Kind: PeerConnected, Peer: addr})
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	w := &peerWorker{
+		s:       s,
+		conn:    conn,
+		id:      addr,
+		peerHas: torrent.NewBitfield(len(s.mi.Info.Pieces)),
+	}
+	defer w.release()
+
+	if err := conn.SendExtendedHandshake(map[string]int{peer.UTPex: peer.LocalUTPexID}); err != nil {
+		return err
+	}
+
+	if err := s.sendHaveState(conn); err != nil {
+		return err
+	}
+
+	for {
+		if err := s.updateInterest(conn); err != nil {
+			return err
+		}
+
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		if err := w.handle(msg); err != nil {
+			return err
+		}
+
+		// Two seeds have nothing to trade.
+		if s.hasAll() && w.peerSeeding() {
+			return nil
+		}
+
+		if err := w.fill(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,910 @@
+package download
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/peer"
+	"github.com/skirtan1/bittorrent-client/torrent"
+	"github.com/skirtan1/bittorrent-client/tracker"
+	"github.com/stretchr/testify/require"
+)
+
+type testSeed struct {
+	ln      net.Listener
+	info    *torrent.Info
+	content []byte
+	unchoke bool
+	pex     []net.Addr
+	// fast makes the seed announce itself with have all and reject the
+	// first request it gets.
+	fast bool
+	// truncate makes the seed answer its first request with a piece message
+	// cut short and hang up, it only sends its pex peers right before that.
+	truncate bool
+
+	mu        sync.Mutex
+	requested map[int]bool
+	accepted  int
+}
+
+func newTestContent(t testing.TB, pieceLength int64, size int) (*torrent.Info, []byte) {
+	t.Helper()
+
+	content := make([]byte, size)
+	_, err := rand.Read(content)
+	require.Nil(t, err)
+
+	info := &torrent.Info{
+		Name:        "content",
+		PieceLength: pieceLength,
+		FilesInfo: []*torrent.File{
+			{Length: int64(size / 3), Path: "a.bin"},
+			{Length: int64(size - size/3), Path: "b.bin"},
+		},
+		InfoHash: sha1.Sum(content[:64]),
+	}
+
+	for off := int64(0); off < int64(size); off += pieceLength {
+		end := min(off+pieceLength, int64(size))
+		info.Pieces = append(info.Pieces, sha1.Sum(content[off:end]))
+	}
+	return info, content
+}
+
+func startTestSeed(t *testing.T, info *torrent.Info, content []byte, unchoke bool) *testSeed {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	return serveTestSeed(t, ln, info, content, unchoke)
+}
+
+func serveTestSeed(t *testing.T, ln net.Listener, info *torrent.Info, content []byte, unchoke bool) *testSeed {
+	t.Helper()
+
+	t.Cleanup(func() { ln.Close() })
+
+	seed := &testSeed{ln: ln, info: info, content: content, unchoke: unchoke, requested: make(map[int]bool)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			seed.mu.Lock()
+			seed.accepted += 1
+			seed.mu.Unlock()
+			go seed.serve(c)
+		}
+	}()
+	return seed
+}
+
+func (s *testSeed) serve(c net.Conn) {
+	defer c.Close()
+
+	if _, err := peer.ReadHandshake(c); err != nil {
+		return
+	}
+	if _, err := c.Write(peer.NewHandshake(s.info.InfoHash, [20]byte{'s', 'e', 'e', 'd'}).Serialize()); err != nil {
+		return
+	}
+
+	have := &peer.Message{ID: peer.MsgHaveAll}
+	if !s.fast {
+		bf := torrent.NewBitfield(len(s.info.Pieces))
+		for i := range s.info.Pieces {
+			bf.SetPiece(i)
+		}
+		have = &peer.Message{ID: peer.MsgBitfield, Payload: bf}
+	}
+	if _, err := c.Write(have.Serialize()); err != nil {
+		return
+	}
+
+	rejected := !s.fast
+	var extHandshake *peer.Message
+
+	for {
+		msg, err := peer.ReadMessage(c)
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue
+		}
+
+		switch msg.ID {
+		case peer.MsgExtended:
+			if s.truncate {
+				extHandshake = msg
+				continue
+			}
+			s.sendPex(c, msg)
+		case peer.MsgInterested:
+			if s.unchoke {
+				c.Write((&peer.Message{ID: peer.MsgUnchoke}).Serialize())
+			}
+		case peer.MsgRequest:
+			index, begin, length, err := peer.ParseRequest(msg)
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.requested[index] = true
+			s.mu.Unlock()
+			if s.truncate {
+				if extHandshake != nil {
+					s.sendPex(c, extHandshake)
+				}
+				c.Write(peer.NewPiece(index, begin, make([]byte, length)).Serialize()[:100])
+				return
+			}
+			if !rejected {
+				rejected = true
+				c.Write(peer.NewReject(index, begin, length).Serialize())
+				continue
+			}
+			off := int64(index)*s.info.PieceLength + int64(begin)
+			c.Write(peer.NewPiece(index, begin, s.content[off:off+int64(length)]).Serialize())
+		}
+	}
+}
+
+func (s *testSeed) sendPex(c net.Conn, msg *peer.Message) {
+	extID, payload, err := peer.ParseExtended(msg)
+	if err != nil || extID != peer.ExtendedHandshakeID || len(s.pex) == 0 {
+		return
+	}
+
+	hs, err := peer.ParseExtendedHandshake(payload)
+	if err != nil || hs.M[peer.UTPex] == 0 {
+		return
+	}
+
+	added := make([]peer.PexPeer, 0, len(s.pex))
+	for _, p := range s.pex {
+		addr := p.(*net.TCPAddr)
+		added = append(added, peer.PexPeer{Peer: tracker.Peer{IP: addr.IP, Port: uint16(addr.Port)}})
+	}
+
+	pex, err := peer.NewPex(hs.M[peer.UTPex], added, nil)
+	if err != nil {
+		return
+	}
+	c.Write(pex.Serialize())
+}
+
+func startTestTracker(t *testing.T, peers ...net.Addr) string {
+	t.Helper()
+	return startRecordingTracker(t, nil, peers...)
+}
+
+// startRecordingTracker is startTestTracker that also passes every announce
+// request to record.
+func startRecordingTracker(t *testing.T, record func(*http.Request), peers ...net.Addr) string {
+	t.Helper()
+
+	list := make([]tracker.Peer, 0, len(peers))
+	for _, p := range peers {
+		addr := p.(*net.TCPAddr)
+		list = append(list, tracker.Peer{IP: addr.IP, Port: uint16(addr.Port)})
+	}
+	v4, v6 := tracker.CompactPeers(list)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if record != nil {
+			record(r)
+		}
+		fmt.Fprintf(w, "d8:intervali1800e5:peers%d:%s6:peers6%d:%se", len(v4), v4, len(v6), v6)
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL + "/announce"
+}
+
+// startUntilComplete runs s.Start until the download completes and returns
+// what Start returned, a complete session would otherwise keep seeding.
+func startUntilComplete(ctx context.Context, s *Session) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- s.Start(ctx) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-s.Complete():
+		cancel()
+		return <-done
+	}
+}
+
+func TestSessionDownloadsFromSeed(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 5*2*DefaultBlockSize+1000)
+	first := startTestSeed(t, info, content, true)
+	second := startTestSeed(t, info, content, true)
+
+	mi := &torrent.MetaInfo{Announce: startTestTracker(t, first.ln.Addr(), second.ln.Addr()), Info: *info}
+
+	dir := t.TempDir()
+	s, err := NewSession(mi, dir)
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	require.Equal(t, float64(0), s.Progress())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	require.Nil(t, startUntilComplete(ctx, s))
+	require.Equal(t, float64(1), s.Progress())
+
+	stats := s.Stats()
+	require.GreaterOrEqual(t, stats.Downloaded, int64(len(content)))
+	require.Equal(t, 2, stats.TotalPeers)
+	require.Equal(t, 0, stats.ConnectedPeers)
+	require.Equal(t, stats.TotalPieces, stats.PiecesCompleted)
+
+	a, err := os.ReadFile(filepath.Join(dir, "content", "a.bin"))
+	require.Nil(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "content", "b.bin"))
+	require.Nil(t, err)
+	require.Equal(t, content, append(a, b...))
+}
+
+func TestSessionDownloadsFromIPv6Seed(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+
+	info, content := newTestContent(t, 2*DefaultBlockSize, 3*2*DefaultBlockSize)
+	seed := serveTestSeed(t, ln, info, content, true)
+
+	mi := &torrent.MetaInfo{Announce: startTestTracker(t, seed.ln.Addr()), Info: *info}
+	s, err := NewSession(mi, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.Nil(t, startUntilComplete(ctx, s))
+	require.Equal(t, float64(1), s.Progress())
+}
+
+// zeroHash sums everything to zeros, so any data passes as any piece.
+type zeroHash struct{}
+
+func (zeroHash) Write(p []byte) (int, error) { return len(p), nil }
+func (zeroHash) Sum(b []byte) []byte         { return append(b, make([]byte, 20)...) }
+func (zeroHash) Reset()                      {}
+func (zeroHash) Size() int                   { return 20 }
+func (zeroHash) BlockSize() int              { return 1 }
+
+func TestSessionWithPieceHash(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 3*2*DefaultBlockSize)
+	info.PieceHash = func() hash.Hash { return zeroHash{} }
+	for i := range info.Pieces {
+		info.Pieces[i] = [20]byte{}
+	}
+
+	seed := startTestSeed(t, info, content, true)
+	mi := &torrent.MetaInfo{Announce: startTestTracker(t, seed.ln.Addr()), Info: *info}
+
+	dir := t.TempDir()
+	s, err := NewSession(mi, dir)
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.Nil(t, startUntilComplete(ctx, s))
+
+	a, err := os.ReadFile(filepath.Join(dir, "content", "a.bin"))
+	require.Nil(t, err)
+	require.Equal(t, content[:len(content)/3], a)
+}
+
+type chanSource chan tracker.Peer
+
+func (c chanSource) Peers(ctx context.Context) <-chan tracker.Peer {
+	return c
+}
+
+func TestSessionMergesPeerSources(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 4*2*DefaultBlockSize)
+	first := startTestSeed(t, info, content, true)
+	second := startTestSeed(t, info, content, true)
+
+	peerFor := func(seed *testSeed) tracker.Peer {
+		addr := seed.ln.Addr().(*net.TCPAddr)
+		return tracker.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+
+	s, err := NewSession(&torrent.MetaInfo{Announce: startTestTracker(t), Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	s.AddPeerSource(StaticPeers{peerFor(first), peerFor(second)})
+	other := make(chanSource, 3)
+	other <- peerFor(second)
+	other <- peerFor(first)
+	other <- peerFor(second)
+	close(other)
+	s.AddPeerSource(other)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.Nil(t, startUntilComplete(ctx, s))
+
+	require.Equal(t, 2, s.Stats().TotalPeers)
+	for _, seed := range []*testSeed{first, second} {
+		seed.mu.Lock()
+		require.Equal(t, 1, seed.accepted)
+		seed.mu.Unlock()
+	}
+}
+
+func TestSessionSourcesWithoutTracker(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 2*2*DefaultBlockSize)
+	seed := startTestSeed(t, info, content, true)
+	addr := seed.ln.Addr().(*net.TCPAddr)
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "d14:failure reason4:downe")
+	}))
+	defer down.Close()
+
+	for name, announce := range map[string]string{
+		"no tracker":   "",
+		"tracker down": down.URL + "/announce",
+	} {
+		s, err := NewSession(&torrent.MetaInfo{Announce: announce, Info: *info}, t.TempDir())
+		require.Nil(t, err)
+		defer s.Close(context.Background())
+		s.AddPeerSource(StaticPeers{{IP: addr.IP, Port: uint16(addr.Port)}})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		require.Nil(t, startUntilComplete(ctx, s), name)
+	}
+}
+
+func TestSessionDialsPexPeers(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 3*2*DefaultBlockSize)
+	hidden := startTestSeed(t, info, content, true)
+	choking := startTestSeed(t, info, content, false)
+	choking.pex = []net.Addr{hidden.ln.Addr()}
+
+	mi := &torrent.MetaInfo{Announce: startTestTracker(t, choking.ln.Addr()), Info: *info}
+
+	s, err := NewSession(mi, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	require.Nil(t, startUntilComplete(ctx, s))
+	require.Equal(t, float64(1), s.Progress())
+}
+
+func TestSessionDialsConcurrently(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 4*2*DefaultBlockSize)
+	seed := startTestSeed(t, info, content, true)
+
+	// Peers that accept the connection but never answer the handshake, and
+	// one that refuses it outright.
+	peers := make([]net.Addr, 0)
+	for range 4 {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				t.Cleanup(func() { c.Close() })
+			}
+		}()
+		peers = append(peers, ln.Addr())
+	}
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	closed.Close()
+	peers = append(peers, closed.Addr(), seed.ln.Addr())
+
+	mi := &torrent.MetaInfo{Announce: startTestTracker(t, peers...), Info: *info}
+	s, err := NewSession(mi, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+	s.PeerConfig = PeerConfig{MaxConcurrentDials: 2, DialTimeout: 200 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Even if every silent peer is dialed before the seed, they hold the two
+	// slots for at most two timeouts.
+	start := time.Now()
+	require.Nil(t, startUntilComplete(ctx, s))
+	require.Less(t, time.Since(start), 2*time.Second)
+	require.Equal(t, float64(1), s.Progress())
+}
+
+func TestSessionFastSeedRejects(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 3*2*DefaultBlockSize)
+	seed := startTestSeed(t, info, content, true)
+	seed.fast = true
+
+	mi := &torrent.MetaInfo{Announce: startTestTracker(t, seed.ln.Addr()), Info: *info}
+
+	s, err := NewSession(mi, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	require.Nil(t, startUntilComplete(ctx, s))
+	require.Equal(t, float64(1), s.Progress())
+}
+
+func TestSessionRecoversFromTruncatedPiece(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 3*2*DefaultBlockSize)
+	good := startTestSeed(t, info, content, true)
+	bad := startTestSeed(t, info, content, true)
+	bad.truncate = true
+	bad.pex = []net.Addr{good.ln.Addr()}
+
+	mi := &torrent.MetaInfo{Announce: startTestTracker(t, bad.ln.Addr()), Info: *info}
+
+	dir := t.TempDir()
+	s, err := NewSession(mi, dir)
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	require.Nil(t, startUntilComplete(ctx, s))
+
+	a, err := os.ReadFile(filepath.Join(dir, "content", "a.bin"))
+	require.Nil(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "content", "b.bin"))
+	require.Nil(t, err)
+	require.Equal(t, content, append(a, b...))
+}
+
+func TestSessionSkipsFiles(t *testing.T) {
+	pieceLength := int64(2 * DefaultBlockSize)
+	content := make([]byte, 190000)
+	_, err := rand.Read(content)
+	require.Nil(t, err)
+
+	info := &torrent.Info{
+		Name:        "content",
+		PieceLength: pieceLength,
+		FilesInfo: []*torrent.File{
+			{Length: 40000, Path: "a.bin"},
+			{Length: 100000, Path: "b.bin"},
+			{Length: 50000, Path: "c.bin"},
+		},
+		InfoHash: sha1.Sum(content[:64]),
+	}
+	for off := int64(0); off < int64(len(content)); off += pieceLength {
+		end := min(off+pieceLength, int64(len(content)))
+		info.Pieces = append(info.Pieces, sha1.Sum(content[off:end]))
+	}
+
+	seed := startTestSeed(t, info, content, true)
+	mi := &torrent.MetaInfo{Announce: startTestTracker(t, seed.ln.Addr()), Info: *info}
+
+	dir := t.TempDir()
+	s, err := NewSession(mi, dir)
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	require.True(t, errors.Is(s.SetFilePriority(3, Skip), torrent.ErrFileIndexOutOfRange))
+	require.Nil(t, s.SetFilePriority(1, Skip))
+	require.Nil(t, s.SetFilePriority(2, High))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.Nil(t, startUntilComplete(ctx, s))
+
+	// b.bin spans pieces 1 to 4, 1 and 4 are shared with a.bin and c.bin.
+	seed.mu.Lock()
+	require.Equal(t, map[int]bool{0: true, 1: true, 4: true, 5: true}, seed.requested)
+	seed.mu.Unlock()
+
+	a, err := os.ReadFile(filepath.Join(dir, "content", "a.bin"))
+	require.Nil(t, err)
+	require.Equal(t, content[:40000], a)
+	c, err := os.ReadFile(filepath.Join(dir, "content", "c.bin"))
+	require.Nil(t, err)
+	require.Equal(t, content[140000:], c)
+}
+
+func TestSessionUnskipsAfterComplete(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 6*2*DefaultBlockSize)
+	seed := startTestSeed(t, info, content, true)
+	mi := &torrent.MetaInfo{Announce: startTestTracker(t, seed.ln.Addr()), Info: *info}
+
+	dir := t.TempDir()
+	s, err := NewSession(mi, dir)
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+	require.Nil(t, s.SetFilePriority(1, Skip))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.Start(ctx) }()
+
+	wait := func() {
+		t.Helper()
+		select {
+		case <-s.Complete():
+		case <-ctx.Done():
+			t.Fatal("download did not complete")
+		}
+	}
+
+	// a.bin is pieces 0 and 1.
+	wait()
+	require.Equal(t, float64(2)/6, s.Progress())
+
+	require.Nil(t, s.SetFilePriority(1, Normal))
+	require.False(t, s.finished())
+	wait()
+	require.Equal(t, float64(1), s.Progress())
+
+	cancel()
+	require.Nil(t, <-done)
+
+	a, err := os.ReadFile(filepath.Join(dir, "content", "a.bin"))
+	require.Nil(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "content", "b.bin"))
+	require.Nil(t, err)
+	require.Equal(t, content, append(a, b...))
+}
+
+func TestSessionStopsOnCancel(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 4*DefaultBlockSize)
+	seed := startTestSeed(t, info, content, false)
+
+	mi := &torrent.MetaInfo{Announce: startTestTracker(t, seed.ln.Addr()), Info: *info}
+
+	s, err := NewSession(mi, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = s.Start(ctx)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	require.Less(t, time.Since(start), 2*time.Second)
+	require.Equal(t, float64(0), s.Progress())
+}
+
+func TestSessionAnnouncesEvents(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 4*DefaultBlockSize)
+
+	for name, tc := range map[string]struct {
+		unchoke bool
+		events  []string
+	}{
+		"completed": {true, []string{"started", "completed", "stopped"}},
+		"canceled":  {false, []string{"started", "stopped"}},
+	} {
+		seed := startTestSeed(t, info, content, tc.unchoke)
+
+		var mu sync.Mutex
+		events := make([]string, 0)
+		announce := startRecordingTracker(t, func(r *http.Request) {
+			mu.Lock()
+			events = append(events, r.URL.Query().Get("event"))
+			mu.Unlock()
+		}, seed.ln.Addr())
+
+		s, err := NewSession(&torrent.MetaInfo{Announce: announce, Info: *info}, t.TempDir())
+		require.Nil(t, err)
+		defer s.Close(context.Background())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		s.Start(ctx)
+
+		mu.Lock()
+		require.Equal(t, tc.events, events, name)
+		mu.Unlock()
+	}
+}
+
+func TestSessionAnnouncesBytesLeft(t *testing.T) {
+	pieceLength := int64(2 * DefaultBlockSize)
+	info, _ := newTestContent(t, pieceLength, 5*int(pieceLength)+1000)
+
+	var mu sync.Mutex
+	lefts := make([]string, 0)
+	announce := startRecordingTracker(t, func(r *http.Request) {
+		mu.Lock()
+		lefts = append(lefts, r.URL.Query().Get("left"))
+		mu.Unlock()
+	})
+
+	s, err := NewSession(&torrent.MetaInfo{Announce: announce, Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	// Half the pieces, the short last one among them, as a resume would set.
+	have := torrent.NewBitfield(len(info.Pieces))
+	for _, i := range []int{0, 2, 5} {
+		have.SetPiece(i)
+	}
+	require.Nil(t, s.ApplyResume(&ResumeData{InfoHash: info.InfoHash, Bitfield: have}))
+
+	want := info.TotalLength() - 2*pieceLength - 1000
+	require.Equal(t, want, s.bytesLeft())
+
+	_, err = s.announce(context.Background(), tracker.EventStarted)
+	require.Nil(t, err)
+	mu.Lock()
+	require.Equal(t, []string{fmt.Sprint(want)}, lefts)
+	mu.Unlock()
+}
+
+func TestSessionAnnouncesStableKey(t *testing.T) {
+	info, _ := newTestContent(t, DefaultBlockSize, 2*DefaultBlockSize)
+
+	var mu sync.Mutex
+	keys := make([]string, 0)
+	announce := startRecordingTracker(t, func(r *http.Request) {
+		mu.Lock()
+		keys = append(keys, r.URL.Query().Get("key"))
+		mu.Unlock()
+	})
+
+	s, err := NewSession(&torrent.MetaInfo{Announce: announce, Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	for _, event := range []tracker.Event{tracker.EventStarted, tracker.EventNone, tracker.EventStopped} {
+		_, err = s.announce(context.Background(), event)
+		require.Nil(t, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, keys, 3)
+	require.Len(t, keys[0], 8)
+	require.Equal(t, []string{keys[0], keys[0], keys[0]}, keys)
+}
+
+func TestAnnounceWait(t *testing.T) {
+	require.Equal(t, defaultAnnounceInterval, announceWait(&tracker.AnnounceResponse{}))
+	require.Equal(t, time.Minute, announceWait(&tracker.AnnounceResponse{Interval: time.Minute}))
+	require.Equal(t, 5*time.Minute, announceWait(&tracker.AnnounceResponse{Interval: time.Minute, MinInterval: 5 * time.Minute}))
+}
+
+func TestSessionReannounces(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 4*DefaultBlockSize)
+	seed := startTestSeed(t, info, content, false)
+	addr := seed.ln.Addr().(*net.TCPAddr)
+
+	var mu sync.Mutex
+	requests := make([]url.Values, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Query())
+		mu.Unlock()
+		fmt.Fprintf(w, "d8:intervali1e12:min intervali1e5:peers6:%s%s10:tracker id3:xyze",
+			[]byte(addr.IP.To4()), []byte{byte(addr.Port >> 8), byte(addr.Port)})
+	}))
+	defer server.Close()
+
+	s, err := NewSession(&torrent.MetaInfo{Announce: server.URL + "/announce", Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	s.Start(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, requests, 3)
+	require.Equal(t, "started", requests[0].Get("event"))
+	require.False(t, requests[0].Has("trackerid"))
+	require.False(t, requests[1].Has("event"))
+	require.Equal(t, "xyz", requests[1].Get("trackerid"))
+	require.Equal(t, "stopped", requests[2].Get("event"))
+}
+
+func TestSessionDownloadRateLimit(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 10*2*DefaultBlockSize)
+	first := startTestSeed(t, info, content, true)
+	second := startTestSeed(t, info, content, true)
+
+	mi := &torrent.MetaInfo{Announce: startTestTracker(t, first.ln.Addr(), second.ln.Addr()), Info: *info}
+
+	s, err := NewSession(mi, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+	s.MaxDownloadBytesPerSec = 200_000
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	require.Nil(t, startUntilComplete(ctx, s))
+
+	expected := float64(len(content)-s.MaxDownloadBytesPerSec) / float64(s.MaxDownloadBytesPerSec)
+	require.GreaterOrEqual(t, time.Since(start).Seconds(), expected*0.8)
+}
+
+func TestSessionRepairsCorruptPieces(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 5*2*DefaultBlockSize+1000)
+	seed := startTestSeed(t, info, content, true)
+	mi := &torrent.MetaInfo{Announce: startTestTracker(t, seed.ln.Addr()), Info: *info}
+
+	dir := t.TempDir()
+	s, err := NewSession(mi, dir)
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.Nil(t, startUntilComplete(ctx, s))
+	rd := s.resumeData()
+	require.Nil(t, s.Close(context.Background()))
+
+	for _, piece := range []int{1, 3} {
+		fileIndex, fileOff, err := info.FileAtOffset(int64(piece)*info.PieceLength + 10)
+		require.Nil(t, err)
+		f, err := os.OpenFile(filepath.Join(dir, "content", info.Files()[fileIndex].Path), os.O_WRONLY, 0)
+		require.Nil(t, err)
+		_, err = f.WriteAt([]byte("corrupt"), fileOff)
+		require.Nil(t, err)
+		require.Nil(t, f.Close())
+	}
+
+	reseed := startTestSeed(t, info, content, true)
+	mi.Announce = startTestTracker(t, reseed.ln.Addr())
+
+	s, err = NewSession(mi, dir)
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+	require.Nil(t, s.ApplyResume(rd))
+	require.Equal(t, float64(1), s.Progress())
+
+	corrupt, err := s.Repair()
+	require.Nil(t, err)
+	require.Equal(t, []int{1, 3}, corrupt)
+	require.Equal(t, float64(4)/6, s.Progress())
+
+	require.Nil(t, startUntilComplete(ctx, s))
+	reseed.mu.Lock()
+	require.Equal(t, map[int]bool{1: true, 3: true}, reseed.requested)
+	reseed.mu.Unlock()
+
+	a, err := os.ReadFile(filepath.Join(dir, "content", "a.bin"))
+	require.Nil(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "content", "b.bin"))
+	require.Nil(t, err)
+	require.Equal(t, content, append(a, b...))
+}
+
+func TestSessionCloseAnnouncesStopped(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 4*2*DefaultBlockSize)
+	// never unchokes, so Start only ends through Close
+	seed := startTestSeed(t, info, content, false)
+
+	var mu sync.Mutex
+	events := make([]string, 0)
+	announce := startRecordingTracker(t, func(r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		mu.Unlock()
+	}, seed.ln.Addr())
+
+	s, err := NewSession(&torrent.MetaInfo{Announce: announce, Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	s.ResumeFile = filepath.Join(t.TempDir(), "resume")
+	s.markHave(1)
+	s.receiveBlock(2, 0, 0, content[2*info.PieceLength:][:DefaultBlockSize])
+
+	done := make(chan error, 1)
+	go func() { done <- s.Start(context.Background()) }()
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Nil(t, s.Close(context.Background()))
+	require.True(t, errors.Is(<-done, ErrSessionClosed))
+
+	mu.Lock()
+	require.Equal(t, []string{"started", "stopped"}, events)
+	mu.Unlock()
+	require.Empty(t, s.buffers)
+
+	f, err := os.Open(s.ResumeFile)
+	require.Nil(t, err)
+	defer f.Close()
+	rd, err := LoadResume(f)
+	require.Nil(t, err)
+	require.Equal(t, info.InfoHash, rd.InfoHash)
+	require.Equal(t, s.haveSnapshot(), rd.Bitfield)
+
+	// closing again changes nothing and a closed session doesn't start
+	require.Nil(t, s.Close(context.Background()))
+	require.True(t, errors.Is(s.Start(context.Background()), ErrSessionClosed))
+	mu.Lock()
+	require.Len(t, events, 2)
+	mu.Unlock()
+}
+
+func TestSessionAnnouncesToEveryTier(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 2*2*DefaultBlockSize)
+	seed := startTestSeed(t, info, content, true)
+
+	var mu sync.Mutex
+	events := make(map[string][]string)
+	record := func(name string) func(*http.Request) {
+		return func(r *http.Request) {
+			mu.Lock()
+			events[name] = append(events[name], r.URL.Query().Get("event"))
+			mu.Unlock()
+		}
+	}
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record("down")(r)
+		fmt.Fprint(w, "d14:failure reason4:downe")
+	}))
+	defer down.Close()
+	up := startRecordingTracker(t, record("up"), seed.ln.Addr())
+
+	mi := &torrent.MetaInfo{
+		Announce:     down.URL + "/announce",
+		AnnounceList: [][]string{{down.URL + "/announce"}, {up}},
+		Info:         *info,
+	}
+	s, err := NewSession(mi, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.Nil(t, startUntilComplete(ctx, s))
+
+	// The first tier fails, so the download found its peers through the
+	// second, and both hear that we stopped.
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, "started", events["down"][0])
+	require.Equal(t, "started", events["up"][0])
+	require.Equal(t, "stopped", events["down"][len(events["down"])-1])
+	require.Equal(t, "stopped", events["up"][len(events["up"])-1])
+}
@@ -0,0 +1,48 @@
+package download
+
+import (
+	"context"
+
+	"github.com/skirtan1/bittorrent-client/tracker"
+)
+
+// PeerSource is somewhere other than the tracker that a Session learns peers
+// from, such as the DHT, LSD or a fixed list. Peers sends peers until the
+// source runs out or ctx is done and then closes the channel. It must close
+// it once ctx is done, because Start waits for that.
+type PeerSource interface {
+	Peers(ctx context.Context) <-chan tracker.Peer
+}
+
+// Refresher is a PeerSource that can look for peers again on demand, like a
+// DHT lookup. Sessions call Refresh when the download stalls.
+type Refresher interface {
+	Refresh()
+}
+
+// StaticPeers is a PeerSource handing out a fixed list of peers.
+type StaticPeers []tracker.Peer
+
+func (p StaticPeers) Peers(ctx context.Context) <-chan tracker.Peer {
+	ch := make(chan tracker.Peer, len(p))
+	for _, peer := range p {
+		ch <- peer
+	}
+	close(ch)
+	return ch
+}
+
+// AddPeerSource makes Start dial the peers src finds alongside the tracker's.
+// A peer is only dialed once however many sources return it. Add sources
+// before Start.
+func (s *Session) AddPeerSource(src PeerSource) {
+	s.sources = append(s.sources, src)
+}
+
+// drainSource dials the peers src sends. It runs as one of s.peers, so Start
+// keeps waiting for peers while a source is open.
+func (s *Session) drainSource(ctx context.Context, src PeerSource) {
+	for p := range src.Peers(ctx) {
+		s.addPeers([]tracker.Peer{p})
+	}
+}
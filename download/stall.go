@@ -0,0 +1,59 @@
+package download
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+const defaultStallTimeout = 2 * time.Minute
+
+func (s *Session) stallTimeout() time.Duration {
+	if s.StallTimeout <= 0 {
+		return defaultStallTimeout
+	}
+	return s.StallTimeout
+}
+
+func (s *Session) stallLoop(ctx context.Context) {
+	timeout := s.stallTimeout()
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.checkStall(now, timeout)
+		}
+	}
+}
+
+// checkStall marks the session stalled once no block arrived for timeout, and
+// then asks the tracker and every Refresher source for peers, again every
+// timeout for as long as the stall lasts.
+func (s *Session) checkStall(now time.Time, timeout time.Duration) {
+	s.mu.Lock()
+	s.stalled = !s.finished() && now.Sub(s.lastBlock) >= timeout
+	kick := s.stalled && now.Sub(s.lastKick) >= timeout
+	if kick {
+		s.lastKick = now
+	}
+	s.mu.Unlock()
+
+	if !kick {
+		return
+	}
+
+	slog.Info("download stalled, looking for peers", "info hash", s.mi.Info.InfoHashHex())
+	select {
+	case s.reannounce <- struct{}{}:
+	default:
+	}
+	for _, src := range s.sources {
+		if r, ok := src.(Refresher); ok {
+			r.Refresh()
+		}
+	}
+}
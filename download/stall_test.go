@@ -0,0 +1,148 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/torrent"
+	"github.com/skirtan1/bittorrent-client/tracker"
+	"github.com/stretchr/testify/require"
+)
+
+type refreshingSource struct {
+	StaticPeers
+	refreshes atomic.Int32
+}
+
+func (r *refreshingSource) Refresh() {
+	r.refreshes.Add(1)
+}
+
+func TestSessionReannouncesWhenStalled(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 4*DefaultBlockSize)
+	// connects but never unchokes us, so no block ever arrives
+	seed := startTestSeed(t, info, content, false)
+
+	var mu sync.Mutex
+	events := make([]string, 0)
+	announce := startRecordingTracker(t, func(r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		mu.Unlock()
+	}, seed.ln.Addr())
+
+	s, err := NewSession(&torrent.MetaInfo{Announce: announce, Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+	s.StallTimeout = 100 * time.Millisecond
+	src := &refreshingSource{}
+	s.AddPeerSource(src)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Start(ctx) }()
+
+	// The tracker's interval is half an hour, only the stall announces again.
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events) >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, s.Stats().Stalled)
+	require.GreaterOrEqual(t, src.refreshes.Load(), int32(1))
+
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"started", ""}, events[:2])
+}
+
+func TestCheckStall(t *testing.T) {
+	info, _ := newTestContent(t, DefaultBlockSize, 2*DefaultBlockSize)
+	s, err := NewSession(&torrent.MetaInfo{Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	now := time.Now()
+	s.lastBlock = now
+
+	s.checkStall(now.Add(time.Second), time.Minute)
+	require.False(t, s.Stats().Stalled)
+	require.Len(t, s.reannounce, 0)
+
+	s.checkStall(now.Add(time.Minute), time.Minute)
+	require.True(t, s.Stats().Stalled)
+	require.Len(t, s.reannounce, 1)
+	<-s.reannounce
+
+	// no second kick until another timeout passed
+	s.checkStall(now.Add(90*time.Second), time.Minute)
+	require.Len(t, s.reannounce, 0)
+	s.checkStall(now.Add(2*time.Minute), time.Minute)
+	require.Len(t, s.reannounce, 1)
+
+	// a block ends the stall
+	s.recordDownload(nil, 10)
+	require.False(t, s.Stats().Stalled)
+}
+
+func TestAnnounceLoopRespectsMinInterval(t *testing.T) {
+	info, _ := newTestContent(t, DefaultBlockSize, 2*DefaultBlockSize)
+
+	var announces atomic.Int32
+	announce := startRecordingTracker(t, func(*http.Request) { announces.Add(1) })
+	s, err := NewSession(&torrent.MetaInfo{Announce: announce, Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+	s.conns[nil] = &connState{} // keeps the loop from giving up
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.announceLoop(ctx, &tracker.AnnounceResponse{Interval: time.Hour, MinInterval: 200 * time.Millisecond})
+
+	s.reannounce <- struct{}{}
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, int32(0), announces.Load())
+	require.Eventually(t, func() bool { return announces.Load() == 1 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestAnnounceLoopRetriesStarted(t *testing.T) {
+	info, _ := newTestContent(t, DefaultBlockSize, 2*DefaultBlockSize)
+
+	var mu sync.Mutex
+	events := make([]string, 0)
+	announce := startRecordingTracker(t, func(r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		mu.Unlock()
+	})
+	s, err := NewSession(&torrent.MetaInfo{Announce: announce, Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+	s.conns[nil] = &connState{} // keeps the loop from giving up
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// nil as if the started announce had failed
+	go s.announceLoop(ctx, nil)
+
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events)
+	}
+	s.reannounce <- struct{}{}
+	require.Eventually(t, func() bool { return count() == 1 }, 2*time.Second, 10*time.Millisecond)
+	s.reannounce <- struct{}{}
+	require.Eventually(t, func() bool { return count() == 2 }, 2*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"started", ""}, events)
+}
@@ -0,0 +1,89 @@
+package download
+
+import (
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/peer"
+)
+
+const rateWindow = 5 * time.Second
+
+// SessionStats is a point in time view of a Session.
+type SessionStats struct {
+	Downloaded int64
+	Uploaded   int64
+
+	// DownloadRate and UploadRate are bytes per second averaged over the
+	// last few seconds.
+	DownloadRate float64
+	UploadRate   float64
+
+	ConnectedPeers int
+	TotalPeers     int
+
+	PiecesCompleted int
+	TotalPieces     int
+	Progress        float64
+
+	// ETA is the time left at the current download rate, zero when the
+	// download is complete or nothing is being downloaded.
+	ETA time.Duration
+
+	// Stalled is set while no block arrived for Session.StallTimeout.
+	Stalled bool
+}
+
+func (s *Session) recordDownload(conn *peer.Conn, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.lastBlock = now
+	s.stalled = false
+	s.downloaded += int64(n)
+	s.downRate.AddBytes(n)
+	if cs := s.conns[conn]; cs != nil {
+		cs.down.AddBytes(n)
+		s.pool.Record(cs.id, n)
+	}
+}
+
+func (s *Session) recordUpload(conn *peer.Conn, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.uploaded += int64(n)
+	s.upRate.AddBytes(n)
+	if cs := s.conns[conn]; cs != nil {
+		cs.up.AddBytes(n)
+	}
+}
+
+func (s *Session) Stats() SessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := SessionStats{
+		Downloaded:      s.downloaded,
+		Uploaded:        s.uploaded,
+		DownloadRate:    s.downRate.Rate(),
+		UploadRate:      s.upRate.Rate(),
+		ConnectedPeers:  len(s.conns),
+		TotalPeers:      len(s.known),
+		PiecesCompleted: s.done,
+		TotalPieces:     len(s.mi.Info.Pieces),
+		Progress:        1,
+		Stalled:         s.stalled,
+	}
+
+	if stats.TotalPieces > 0 {
+		stats.Progress = float64(s.done) / float64(stats.TotalPieces)
+	}
+
+	left := s.bytesLeftLocked()
+	if left > 0 && stats.DownloadRate > 0 {
+		stats.ETA = time.Duration(float64(left) / stats.DownloadRate * float64(time.Second))
+	}
+
+	return stats
+}
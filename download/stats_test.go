@@ -0,0 +1,42 @@
+package download
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/torrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionStats(t *testing.T) {
+	info, _ := newTestContent(t, 2*DefaultBlockSize, 4*2*DefaultBlockSize)
+
+	s, err := NewSession(&torrent.MetaInfo{Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	stats := s.Stats()
+	require.Equal(t, SessionStats{TotalPieces: 4}, stats)
+
+	now := time.Now()
+	s.downRate.now = func() time.Time { return now }
+
+	s.recordDownload(nil, 3*DefaultBlockSize)
+	s.recordDownload(nil, DefaultBlockSize)
+	s.markHave(0)
+	s.markHave(1)
+	s.known["127.0.0.1:1"] = true
+
+	stats = s.Stats()
+	require.Equal(t, int64(4*DefaultBlockSize), stats.Downloaded)
+	require.Equal(t, int64(0), stats.Uploaded)
+	require.Equal(t, 2, stats.PiecesCompleted)
+	require.Equal(t, 0.5, stats.Progress)
+	require.Equal(t, 1, stats.TotalPeers)
+	require.Equal(t, 0, stats.ConnectedPeers)
+	require.Equal(t, 4*DefaultBlockSize/rateWindow.Seconds(), stats.DownloadRate)
+
+	// Half the content is left at 4 blocks per window.
+	require.Equal(t, rateWindow, stats.ETA)
+}
@@ -0,0 +1,377 @@
+package download
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/peer"
+	"github.com/skirtan1/bittorrent-client/torrent"
+	"github.com/skirtan1/bittorrent-client/tracker"
+)
+
+// PeerConfig tunes how peers are dialed and the request loop of each peer
+// connection.
+type PeerConfig struct {
+	// MaxPipelinedRequests is how many block requests are kept outstanding
+	// per peer, 0 means a default of 5.
+	MaxPipelinedRequests int
+	// MaxConcurrentDials is how many peers are dialed at once, 0 means a
+	// default of 10. DialTimeout bounds each connect and handshake, 0 means
+	// a default of 10 seconds.
+	MaxConcurrentDials int
+	DialTimeout        time.Duration
+}
+
+func (c PeerConfig) maxPipelinedRequests() int {
+	if c.MaxPipelinedRequests <= 0 {
+		return defaultMaxPipelinedRequests
+	}
+	return c.MaxPipelinedRequests
+}
+
+func (c PeerConfig) maxConcurrentDials() int {
+	if c.MaxConcurrentDials <= 0 {
+		return defaultMaxConcurrentDials
+	}
+	return c.MaxConcurrentDials
+}
+
+func (c PeerConfig) dialTimeout() time.Duration {
+	if c.DialTimeout <= 0 {
+		return defaultDialTimeout
+	}
+	return c.DialTimeout
+}
+
+// maxRequestLength is the largest block we serve.
+const maxRequestLength = 1 << 17
+
+// pieceBuffer collects the blocks of a piece being downloaded, it is shared
+// by every worker requesting the piece so each block is only kept once.
+type pieceBuffer struct {
+	buf       []byte
+	received  []bool
+	remaining int
+}
+
+// getPieceBuf returns a buffer for a piece of size bytes. It is cut from a
+// PieceLength buffer out of s.pieceBufs, so the short last piece uses the
+// same buffers as the rest.
+func (s *Session) getPieceBuf(size int64) []byte {
+	return (*s.pieceBufs.Get().(*[]byte))[:size]
+}
+
+// putPieceBuf hands back a buffer from getPieceBuf once nothing reads it.
+func (s *Session) putPieceBuf(buf []byte) {
+	buf = buf[:cap(buf)]
+	s.pieceBufs.Put(&buf)
+}
+
+// pieceState is one worker's progress requesting the blocks of a piece.
+type pieceState struct {
+	index   int
+	blocks  []Block
+	next    int
+	retry   []int
+	pending map[int]bool
+}
+
+func newPieceState(index int, size int64) *pieceState {
+	return &pieceState{
+		index:   index,
+		blocks:  BlockPlan(index, size, DefaultBlockSize),
+		pending: make(map[int]bool),
+	}
+}
+
+// peerWorker holds the download state for one peer connection, it is only
+// used from that connection's goroutine.
+type peerWorker struct {
+	s       *Session
+	conn    *peer.Conn
+	id      string
+	peerHas torrent.Bitfield
+	piece   *pieceState
+}
+
+func (w *peerWorker) handle(msg *peer.Message) error {
+	if msg == nil {
+		return nil
+	}
+
+	switch msg.ID {
+	case peer.MsgBitfield, peer.MsgHaveAll, peer.MsgHaveNone:
+		bf, err := peer.PeerBitfield(msg, len(w.s.mi.Info.Pieces))
+		if err != nil {
+			return err
+		}
+		w.s.picker.RemoveBitfield(w.peerHas)
+		w.peerHas = bf
+		w.s.picker.AddBitfield(w.peerHas)
+	case peer.MsgHave:
+		index, err := peer.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		if !w.peerHas.HasPiece(index) {
+			w.peerHas.SetPiece(index)
+			w.s.picker.AddHave(index)
+		}
+	case peer.MsgChoke:
+		// The peer dropped our requests, hand the piece back so other peers
+		// can fetch the blocks still missing. With the fast extension the
+		// peer rejects each request it won't serve instead.
+		if w.piece != nil && !w.conn.FastEnabled() {
+			w.s.picker.Release(w.piece.index, w.id)
+			w.piece = nil
+		}
+	case peer.MsgRejectRequest:
+		return w.handleReject(msg)
+	case peer.MsgInterested:
+		w.s.setInterested(w.conn, true)
+	case peer.MsgNotInterested:
+		w.s.setInterested(w.conn, false)
+	case peer.MsgRequest:
+		return w.handleRequest(msg)
+	case peer.MsgPiece:
+		return w.handlePiece(msg)
+	case peer.MsgExtended:
+		return w.handleExtended(msg)
+	}
+
+	return nil
+}
+
+func (w *peerWorker) handleExtended(msg *peer.Message) error {
+	extID, payload, err := peer.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+
+	if extID == peer.ExtendedHandshakeID || int(extID) != w.conn.LocalExtensions[peer.UTPex] {
+		return nil
+	}
+
+	pex, err := peer.ParsePex(payload)
+	if err != nil {
+		slog.Debug("ignoring malformed pex", "peer", w.id, "err", err)
+		return nil
+	}
+
+	peers := make([]tracker.Peer, 0, len(pex.Added))
+	for _, p := range pex.Added {
+		peers = append(peers, p.Peer)
+	}
+	w.s.addPeers(peers)
+	return nil
+}
+
+// handleRequest serves a block we have to a peer the choker unchoked, other requests
+// are rejected if the fast extension allows it and ignored otherwise.
+func (w *peerWorker) handleRequest(msg *peer.Message) error {
+	index, begin, length, err := peer.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+
+	info := &w.s.mi.Info
+	if !w.s.isUnchoked(w.conn) || !w.s.hasPiece(index) || length <= 0 || length > maxRequestLength ||
+		int64(begin)+int64(length) > info.PieceSize(index) {
+		if w.conn.FastEnabled() {
+			return w.conn.Send(peer.NewReject(index, begin, length))
+		}
+		return nil
+	}
+
+	block := make([]byte, length)
+	if _, err := w.s.storage.ReadAt(block, int64(index)*info.PieceLength+int64(begin)); err != nil {
+		return fmt.Errorf("serve request: %w", err)
+	}
+
+	if err := w.conn.Send(peer.NewPiece(index, begin, block)); err != nil {
+		return err
+	}
+	w.s.recordUpload(w.conn, length)
+	return nil
+}
+
+func (w *peerWorker) handleReject(msg *peer.Message) error {
+	index, begin, _, err := peer.ParseReject(msg)
+	if err != nil {
+		return err
+	}
+
+	p := w.piece
+	if p == nil || index != p.index || begin%DefaultBlockSize != 0 {
+		return nil
+	}
+
+	b := begin / DefaultBlockSize
+	if !p.pending[b] {
+		return nil
+	}
+
+	delete(p.pending, b)
+	p.retry = append(p.retry, b)
+	return nil
+}
+
+func (w *peerWorker) handlePiece(msg *peer.Message) error {
+	index, begin, block, err := peer.ParsePiece(msg)
+	if err != nil {
+		return err
+	}
+	w.s.recordDownload(w.conn, len(block))
+
+	p := w.piece
+	if p == nil || index != p.index {
+		// Late answers to requests we canceled after another peer
+		// completed the piece.
+		if w.s.hasPiece(index) {
+			w.s.duplicateBlocks.Add(1)
+		}
+		return nil
+	}
+
+	if begin%DefaultBlockSize != 0 {
+		return nil
+	}
+
+	b := begin / DefaultBlockSize
+	if b >= len(p.blocks) || len(block) != p.blocks[b].Length {
+		return nil
+	}
+
+	delete(p.pending, b)
+	data, complete := w.s.receiveBlock(index, b, begin, block)
+	if complete {
+		return w.completePiece(index, data)
+	}
+	return nil
+}
+
+func (w *peerWorker) completePiece(index int, data []byte) error {
+	w.piece = nil
+	defer w.s.putPieceBuf(data)
+	// The buffer is forgotten only after markHave, so a late copy of one of
+	// its blocks is dropped instead of starting a new buffer.
+	defer w.s.forgetBuffer(index)
+
+	if !w.s.mi.Info.VerifyPiece(index, data) {
+		slog.Warn("piece failed verification", "index", index, "peer", w.id)
+		w.s.emit(Event{Kind: PieceFailed, Peer: w.id, Piece: index})
+		w.s.picker.Release(index, w.id)
+		return nil
+	}
+
+	w.s.picker.MarkReceived(index, w.id)
+	if w.s.hasPiece(index) {
+		return nil
+	}
+
+	if err := w.s.storage.WritePiece(index, data); err != nil {
+		return fmt.Errorf("complete piece: %w", err)
+	}
+
+	w.s.markHave(index)
+	w.s.emit(Event{Kind: PieceCompleted, Piece: index})
+	w.s.broadcastHave(index)
+	return nil
+}
+
+// abandon drops the current piece once another peer completed it, canceling
+// whatever we still have requested.
+func (w *peerWorker) abandon() error {
+	p := w.piece
+	w.piece = nil
+
+	for b := range p.pending {
+		block := p.blocks[b]
+		if err := w.conn.Send(peer.NewCancel(block.Index, block.Begin, block.Length)); err != nil {
+			return err
+		}
+	}
+	w.s.picker.Release(p.index, w.id)
+	return nil
+}
+
+// fill picks a piece when idle and keeps up to PeerConfig.MaxPipelinedRequests
+// block requests in flight while the peer has us unchoked.
+func (w *peerWorker) fill() error {
+	if w.conn.PeerChoking {
+		return nil
+	}
+
+	if w.piece != nil && w.s.hasPiece(w.piece.index) {
+		if err := w.abandon(); err != nil {
+			return err
+		}
+	}
+
+	if w.piece == nil {
+		index, ok := w.s.picker.PickFor(w.id, w.s.haveSnapshot(), w.peerHas)
+		if !ok {
+			return nil
+		}
+		w.piece = newPieceState(index, w.s.mi.Info.PieceSize(index))
+	}
+
+	p := w.piece
+	for b := range p.pending {
+		if !w.s.blockReceived(p.index, b) {
+			continue
+		}
+
+		block := p.blocks[b]
+		if err := w.conn.Send(peer.NewCancel(block.Index, block.Begin, block.Length)); err != nil {
+			return err
+		}
+		delete(p.pending, b)
+	}
+
+	// Every block was requested and answered but the piece is still
+	// missing, e.g. it failed verification at another peer, so start over.
+	if p.next == len(p.blocks) && len(p.retry) == 0 && len(p.pending) == 0 {
+		p.next = 0
+	}
+
+	limit := w.s.PeerConfig.maxPipelinedRequests()
+	for len(p.pending) < limit && (len(p.retry) > 0 || p.next < len(p.blocks)) {
+		var b int
+		if len(p.retry) > 0 {
+			b, p.retry = p.retry[0], p.retry[1:]
+		} else {
+			b = p.next
+			p.next += 1
+		}
+		if p.pending[b] || w.s.blockReceived(p.index, b) {
+			continue
+		}
+
+		block := p.blocks[b]
+		if err := w.conn.Send(peer.NewRequest(block.Index, block.Begin, block.Length)); err != nil {
+			return err
+		}
+		p.pending[b] = true
+	}
+
+	return nil
+}
+
+// peerSeeding reports whether the peer has every piece.
+func (w *peerWorker) peerSeeding() bool {
+	for i := range w.s.mi.Info.Pieces {
+		if !w.peerHas.HasPiece(i) {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *peerWorker) release() {
+	w.s.picker.RemoveBitfield(w.peerHas)
+	if w.piece != nil {
+		w.s.picker.Release(w.piece.index, w.id)
+	}
+}
@@ -0,0 +1,321 @@
+package download
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/peer"
+	"github.com/skirtan1/bittorrent-client/torrent"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestWorker returns a worker unchoked by a peer that has every piece,
+// the messages it sends are delivered on the returned channel.
+func newTestWorker(t *testing.T, s *Session, id string) (*peerWorker, <-chan *peer.Message) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	sent := make(chan *peer.Message, 64)
+	go func() {
+		for {
+			msg, err := peer.ReadMessage(server)
+			if err != nil {
+				return
+			}
+			if msg != nil {
+				sent <- msg
+			}
+		}
+	}()
+
+	conn := peer.NewConn(client)
+	conn.PeerChoking = false
+
+	w := &peerWorker{
+		s:       s,
+		conn:    conn,
+		id:      id,
+		peerHas: torrent.NewBitfield(len(s.mi.Info.Pieces)),
+	}
+	for i := range s.mi.Info.Pieces {
+		w.peerHas.SetPiece(i)
+	}
+	s.picker.AddBitfield(w.peerHas)
+	s.addConn(id, conn)
+	return w, sent
+}
+
+// receiveMessages collects messages until none arrive for a short while,
+// keeping only the given ids if any are passed.
+func receiveMessages(sent <-chan *peer.Message, ids ...peer.MessageID) []*peer.Message {
+	var ret []*peer.Message
+	for {
+		select {
+		case msg := <-sent:
+			if len(ids) == 0 || slices.Contains(ids, msg.ID) {
+				ret = append(ret, msg)
+			}
+		case <-time.After(50 * time.Millisecond):
+			return ret
+		}
+	}
+}
+
+func TestSessionAvailability(t *testing.T) {
+	info, _ := newTestContent(t, DefaultBlockSize, 4*DefaultBlockSize)
+	s, err := NewSession(&torrent.MetaInfo{Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	worker := func(msgs ...*peer.Message) *peerWorker {
+		w := &peerWorker{s: s, peerHas: torrent.NewBitfield(4)}
+		for _, msg := range msgs {
+			require.Nil(t, w.handle(msg))
+		}
+		return w
+	}
+
+	require.Equal(t, []int{0, 0, 0, 0}, s.Availability())
+
+	seed := worker(&peer.Message{ID: peer.MsgHaveAll})
+	worker(&peer.Message{ID: peer.MsgBitfield, Payload: bitfieldOf(4, 0, 1)})
+	leech := worker(&peer.Message{ID: peer.MsgHaveNone}, peer.NewHave(3), peer.NewHave(0))
+	require.Equal(t, []int{3, 2, 1, 2}, s.Availability())
+
+	// a repeated have doesn't count twice
+	require.Nil(t, leech.handle(peer.NewHave(3)))
+	require.Equal(t, []int{3, 2, 1, 2}, s.Availability())
+
+	// disconnected peers no longer count
+	seed.release()
+	leech.release()
+	require.Equal(t, []int{1, 1, 0, 0}, s.Availability())
+
+	// the result is a copy
+	s.Availability()[0] = 10
+	require.Equal(t, 1, s.picker.Availability(0))
+}
+
+func TestWorkerPipelineCap(t *testing.T) {
+	info, content := newTestContent(t, 8*DefaultBlockSize, 2*8*DefaultBlockSize)
+
+	s, err := NewSession(&torrent.MetaInfo{Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+	s.PeerConfig = PeerConfig{MaxPipelinedRequests: 3}
+
+	w, requests := newTestWorker(t, s, "test")
+
+	require.Nil(t, w.fill())
+	outstanding := receiveMessages(requests, peer.MsgRequest)
+	require.Len(t, outstanding, 3)
+
+	for len(outstanding) > 0 {
+		index, begin, length, err := peer.ParseRequest(outstanding[0])
+		require.Nil(t, err)
+		outstanding = outstanding[1:]
+
+		off := int64(index)*info.PieceLength + int64(begin)
+		require.Nil(t, w.handle(peer.NewPiece(index, begin, content[off:off+int64(length)])))
+		require.Nil(t, w.fill())
+
+		outstanding = append(outstanding, receiveMessages(requests, peer.MsgRequest)...)
+		require.LessOrEqual(t, len(outstanding), 3)
+	}
+
+	require.Equal(t, float64(1), s.Progress())
+}
+
+func TestWorkerDropsDuplicateBlocks(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 2*2*DefaultBlockSize)
+
+	s, err := NewSession(&torrent.MetaInfo{Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	a, requestsA := newTestWorker(t, s, "a")
+	b, requestsB := newTestWorker(t, s, "b")
+
+	// Two pieces left is endgame, so both peers are asked for piece 0.
+	require.Nil(t, a.fill())
+	require.Nil(t, b.fill())
+	require.Len(t, receiveMessages(requestsA, peer.MsgRequest), 2)
+	require.Len(t, receiveMessages(requestsB, peer.MsgRequest, peer.MsgCancel), 2)
+
+	deliver := func(w *peerWorker, begin int) {
+		t.Helper()
+		require.Nil(t, w.handle(peer.NewPiece(0, begin, content[begin:begin+DefaultBlockSize])))
+	}
+
+	deliver(a, 0)
+	deliver(b, 0)
+	require.Equal(t, int64(1), s.DuplicateBlocksDropped())
+
+	deliver(a, DefaultBlockSize)
+	require.True(t, s.hasPiece(0))
+	require.Equal(t, 0.5, s.Progress())
+
+	// b gives up on piece 0, canceling the block a already delivered, and
+	// moves on to piece 1.
+	require.Nil(t, b.fill())
+	sent := receiveMessages(requestsB, peer.MsgRequest, peer.MsgCancel)
+	require.Len(t, sent, 3)
+	require.Equal(t, peer.NewCancel(0, DefaultBlockSize, DefaultBlockSize), sent[0])
+	require.Equal(t, peer.MsgRequest, sent[1].ID)
+	require.Equal(t, 1, b.piece.index)
+
+	deliver(b, DefaultBlockSize)
+	require.Equal(t, int64(2), s.DuplicateBlocksDropped())
+
+	data, err := s.storage.ReadPiece(0)
+	require.Nil(t, err)
+	require.Equal(t, content[:2*DefaultBlockSize], data)
+}
+
+func TestSessionDropsBlocksOfCompletingPiece(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 2*2*DefaultBlockSize)
+
+	s, err := NewSession(&torrent.MetaInfo{Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	w, _ := newTestWorker(t, s, "a")
+
+	_, complete := s.receiveBlock(0, 0, 0, content[:DefaultBlockSize])
+	require.False(t, complete)
+	data, complete := s.receiveBlock(0, 1, DefaultBlockSize, content[DefaultBlockSize:2*DefaultBlockSize])
+	require.True(t, complete)
+
+	// A copy of a block arriving while the piece is verified and written.
+	_, complete = s.receiveBlock(0, 1, DefaultBlockSize, content[DefaultBlockSize:2*DefaultBlockSize])
+	require.False(t, complete)
+	require.Equal(t, int64(1), s.DuplicateBlocksDropped())
+
+	require.Nil(t, w.completePiece(0, data))
+	require.True(t, s.hasPiece(0))
+	require.Empty(t, s.buffers)
+}
+
+func TestWorkerChokeRequeuesPiece(t *testing.T) {
+	info, content := newTestContent(t, 4*DefaultBlockSize, 4*DefaultBlockSize)
+
+	s, err := NewSession(&torrent.MetaInfo{Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+	s.picker.EndgameThreshold = 0
+
+	a, requestsA := newTestWorker(t, s, "a")
+	b, requestsB := newTestWorker(t, s, "b")
+
+	require.Nil(t, a.fill())
+	require.Len(t, receiveMessages(requestsA), 4)
+	require.Nil(t, a.handle(peer.NewPiece(0, 0, content[:DefaultBlockSize])))
+
+	// The only piece is pending at a.
+	require.Nil(t, b.fill())
+	require.Empty(t, receiveMessages(requestsB))
+
+	a.conn.PeerChoking = true
+	require.Nil(t, a.handle(&peer.Message{ID: peer.MsgChoke}))
+	require.Nil(t, a.piece)
+
+	// b picks the piece up and only asks for the blocks a didn't get.
+	require.Nil(t, b.fill())
+	var begins []int
+	for _, msg := range receiveMessages(requestsB) {
+		index, begin, _, err := peer.ParseRequest(msg)
+		require.Nil(t, err)
+		require.Equal(t, 0, index)
+		begins = append(begins, begin)
+	}
+	require.Equal(t, []int{DefaultBlockSize, 2 * DefaultBlockSize, 3 * DefaultBlockSize}, begins)
+}
+
+func TestWorkerServesRequests(t *testing.T) {
+	info, content := newTestContent(t, 2*DefaultBlockSize, 2*2*DefaultBlockSize)
+
+	s, err := NewSession(&torrent.MetaInfo{Info: *info}, t.TempDir())
+	require.Nil(t, err)
+	defer s.Close(context.Background())
+
+	require.Nil(t, s.storage.WritePiece(0, content[:2*DefaultBlockSize]))
+	s.markHave(0)
+
+	w, sent := newTestWorker(t, s, "a")
+
+	// Requests while we choke the peer are ignored.
+	require.Nil(t, w.handle(peer.NewRequest(0, 0, DefaultBlockSize)))
+	require.Empty(t, receiveMessages(sent))
+
+	require.Nil(t, w.handle(&peer.Message{ID: peer.MsgInterested}))
+	require.Equal(t, []*peer.Message{{ID: peer.MsgUnchoke, Payload: []byte{}}}, receiveMessages(sent))
+	require.True(t, s.isUnchoked(w.conn))
+
+	require.Nil(t, w.handle(peer.NewRequest(0, DefaultBlockSize+100, 1000)))
+	got := receiveMessages(sent)
+	require.Len(t, got, 1)
+	index, begin, block, err := peer.ParsePiece(got[0])
+	require.Nil(t, err)
+	require.Equal(t, 0, index)
+	require.Equal(t, DefaultBlockSize+100, begin)
+	require.Equal(t, content[DefaultBlockSize+100:DefaultBlockSize+1100], block)
+	require.Equal(t, int64(1000), s.Stats().Uploaded)
+
+	// Pieces we don't have and blocks past the end of the piece.
+	require.Nil(t, w.handle(peer.NewRequest(1, 0, DefaultBlockSize)))
+	require.Nil(t, w.handle(peer.NewRequest(0, DefaultBlockSize, DefaultBlockSize+1)))
+	require.Empty(t, receiveMessages(sent))
+
+	w.conn.Remote.SetFast()
+	require.Nil(t, w.handle(peer.NewRequest(1, 0, DefaultBlockSize)))
+	require.Equal(t, []*peer.Message{peer.NewReject(1, 0, DefaultBlockSize)}, receiveMessages(sent))
+}
+
+// BenchmarkReceivePieces downloads every piece of a torrent block by block
+// into the shared piece buffers. Without handing completed buffers back every
+// piece allocates a new one, as it did before pieceBufs.
+func BenchmarkReceivePieces(b *testing.B) {
+	const pieceLength = 16 * DefaultBlockSize
+	info, content := newTestContent(b, pieceLength, 64*pieceLength-1000)
+
+	s, err := NewSession(&torrent.MetaInfo{Info: *info}, b.TempDir())
+	require.Nil(b, err)
+	defer s.Close(context.Background())
+
+	download := func(put bool) {
+		for index := range info.Pieces {
+			for i, block := range BlockPlan(index, info.PieceSize(index), DefaultBlockSize) {
+				off := int64(index)*pieceLength + int64(block.Begin)
+				data, complete := s.receiveBlock(index, i, block.Begin, content[off:off+int64(block.Length)])
+				if !complete {
+					continue
+				}
+				s.forgetBuffer(index)
+				if put {
+					s.putPieceBuf(data)
+				}
+			}
+		}
+	}
+
+	for _, bm := range []struct {
+		name string
+		put  bool
+	}{{"pooled", true}, {"unpooled", false}} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(content)))
+			for range b.N {
+				download(bm.put)
+			}
+		})
+	}
+}
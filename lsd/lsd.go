@@ -0,0 +1,231 @@
+// Package lsd finds peers on the local network with BEP 14 Local Service
+// Discovery: clients multicast the info hashes they are active in and the
+// port they accept peers on.
+package lsd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/tracker"
+)
+
+const (
+	MulticastAddr   = "239.192.152.143:6771"
+	DefaultInterval = 5 * time.Minute
+
+	maxPacketLen = 1400
+	// maxHashesPerMessage keeps announcements under maxPacketLen.
+	maxHashesPerMessage = 20
+	subscriberBuffer    = 16
+)
+
+var ErrServiceClosed = errors.New("lsd service closed")
+
+// Service announces the info hashes it is told about to the multicast group
+// every Interval and hands out the peers other clients announce through
+// Source.
+type Service struct {
+	// Interval between announcements, set it before the first Announce.
+	Interval time.Duration
+
+	port   int
+	cookie string
+	group  *net.UDPAddr
+	conn   *net.UDPConn
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	active map[[20]byte]bool
+	subs   map[[20]byte]map[chan tracker.Peer]bool
+	timer  *time.Timer
+}
+
+// NewService joins the BEP 14 multicast group, port is where we accept peer
+// connections.
+func NewService(port int) (*Service, error) {
+	group, err := net.ResolveUDPAddr("udp4", MulticastAddr)
+	if err != nil {
+		return nil, fmt.Errorf("new lsd service: %w", err)
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, fmt.Errorf("new lsd service: %w", err)
+	}
+
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+
+	s := &Service{
+		Interval: DefaultInterval,
+		port:     port,
+		cookie:   hex.EncodeToString(cookie),
+		group:    group,
+		conn:     conn,
+		active:   make(map[[20]byte]bool),
+		subs:     make(map[[20]byte]map[chan tracker.Peer]bool),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	go s.readLoop()
+	return s, nil
+}
+
+func (s *Service) Close() error {
+	s.cancel()
+
+	s.mu.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.mu.Unlock()
+
+	return s.conn.Close()
+}
+
+// Announce starts announcing infoHash, the first announcement goes out right
+// away.
+func (s *Service) Announce(infoHash [20]byte) error {
+	if s.ctx.Err() != nil {
+		return ErrServiceClosed
+	}
+
+	s.mu.Lock()
+	s.active[infoHash] = true
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.Interval, s.announceAll)
+	}
+	s.mu.Unlock()
+
+	return s.send([][20]byte{infoHash})
+}
+
+// Stop stops announcing infoHash.
+func (s *Service) Stop(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.active, infoHash)
+}
+
+func (s *Service) announceAll() {
+	s.mu.Lock()
+	hashes := make([][20]byte, 0, len(s.active))
+	for ih := range s.active {
+		hashes = append(hashes, ih)
+	}
+	s.mu.Unlock()
+
+	for len(hashes) > 0 {
+		n := min(len(hashes), maxHashesPerMessage)
+		if err := s.send(hashes[:n]); err != nil {
+			slog.Debug("lsd announce failed", "err", err)
+		}
+		hashes = hashes[n:]
+	}
+
+	s.mu.Lock()
+	if s.ctx.Err() == nil {
+		s.timer.Reset(s.Interval)
+	}
+	s.mu.Unlock()
+}
+
+func (s *Service) send(hashes [][20]byte) error {
+	a := Announcement{Port: s.port, InfoHashes: hashes, Cookie: s.cookie}
+	if _, err := s.conn.WriteToUDP(a.Marshal(MulticastAddr), s.group); err != nil {
+		return fmt.Errorf("lsd announce: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) readLoop() {
+	buf := make([]byte, maxPacketLen)
+	for {
+		size, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if s.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		s.handlePacket(buf[:size], addr)
+	}
+}
+
+// handlePacket passes the peer behind an announcement to the subscribers of
+// its info hashes. Our own announcements and malformed packets are dropped.
+func (s *Service) handlePacket(b []byte, from *net.UDPAddr) {
+	a, err := ParseAnnouncement(b)
+	if err != nil || a.Cookie == s.cookie {
+		return
+	}
+
+	p := tracker.Peer{IP: from.IP, Port: uint16(a.Port)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ih := range a.InfoHashes {
+		for ch := range s.subs[ih] {
+			// LSD repeats itself, a slow subscriber misses nothing for
+			// long.
+			select {
+			case ch <- p:
+			default:
+			}
+		}
+	}
+}
+
+// Source returns the peers announcing infoHash as a download.PeerSource.
+func (s *Service) Source(infoHash [20]byte) *Source {
+	return &Source{s: s, infoHash: infoHash}
+}
+
+type Source struct {
+	s        *Service
+	infoHash [20]byte
+}
+
+// Peers sends the peers announcing the info hash from now on, until ctx is
+// done or the service is closed.
+func (src *Source) Peers(ctx context.Context) <-chan tracker.Peer {
+	s := src.s
+	ch := make(chan tracker.Peer, subscriberBuffer)
+
+	s.mu.Lock()
+	if s.subs[src.infoHash] == nil {
+		s.subs[src.infoHash] = make(map[chan tracker.Peer]bool)
+	}
+	s.subs[src.infoHash][ch] = true
+	s.mu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.ctx.Done():
+		}
+
+		s.mu.Lock()
+		delete(s.subs[src.infoHash], ch)
+		if len(s.subs[src.infoHash]) == 0 {
+			delete(s.subs, src.infoHash)
+		}
+		close(ch)
+		s.mu.Unlock()
+	}()
+
+	return ch
+}
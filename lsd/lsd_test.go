@@ -0,0 +1,55 @@
+package lsd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/download"
+	"github.com/skirtan1/bittorrent-client/tracker"
+	"github.com/stretchr/testify/require"
+)
+
+var _ download.PeerSource = (*Source)(nil)
+
+func newTestService(t *testing.T) *Service {
+	t.Helper()
+
+	s := &Service{
+		port:   6881,
+		cookie: "ours",
+		active: make(map[[20]byte]bool),
+		subs:   make(map[[20]byte]map[chan tracker.Peer]bool),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	t.Cleanup(s.cancel)
+	return s
+}
+
+func TestServiceSourcePeers(t *testing.T) {
+	s := newTestService(t)
+	infoHash := [20]byte{1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	peers := s.Source(infoHash).Peers(ctx)
+
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 7), Port: 6771}
+	own := &Announcement{Port: 6881, InfoHashes: [][20]byte{infoHash}, Cookie: "ours"}
+	s.handlePacket(own.Marshal(MulticastAddr), from)
+	other := &Announcement{Port: 51413, InfoHashes: [][20]byte{{2}}, Cookie: "theirs"}
+	s.handlePacket(other.Marshal(MulticastAddr), from)
+	wanted := &Announcement{Port: 51413, InfoHashes: [][20]byte{{2}, infoHash}, Cookie: "theirs"}
+	s.handlePacket(wanted.Marshal(MulticastAddr), from)
+
+	select {
+	case p := <-peers:
+		require.Equal(t, "192.168.1.7:51413", p.String())
+	case <-time.After(time.Second):
+		t.Fatal("no peer from announcement")
+	}
+
+	cancel()
+	_, open := <-peers
+	require.False(t, open)
+}
@@ -0,0 +1,73 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const searchMethod = "BT-SEARCH"
+
+var ErrMalformedAnnouncement = errors.New("malformed lsd announcement")
+
+// Announcement is a BEP 14 message: a peer listening on Port that wants
+// peers for InfoHashes. Cookie lets a client recognize its own messages
+// when the group loops them back.
+type Announcement struct {
+	Port       int
+	InfoHashes [][20]byte
+	Cookie     string
+}
+
+// Marshal encodes a as the HTTP-over-UDP request BEP 14 describes, with host
+// being the multicast group it is sent to.
+func (a *Announcement) Marshal(host string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s * HTTP/1.1\r\n", searchMethod)
+	fmt.Fprintf(&b, "Host: %s\r\n", host)
+	fmt.Fprintf(&b, "Port: %d\r\n", a.Port)
+	for _, ih := range a.InfoHashes {
+		fmt.Fprintf(&b, "Infohash: %s\r\n", hex.EncodeToString(ih[:]))
+	}
+	if a.Cookie != "" {
+		fmt.Fprintf(&b, "cookie: %s\r\n", a.Cookie)
+	}
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+func ParseAnnouncement(b []byte) (*Announcement, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return nil, fmt.Errorf("parse announcement: %w: %w", ErrMalformedAnnouncement, err)
+	}
+	if req.Method != searchMethod {
+		return nil, fmt.Errorf("method %q: %w", req.Method, ErrMalformedAnnouncement)
+	}
+
+	port, err := strconv.Atoi(req.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 0xffff {
+		return nil, fmt.Errorf("port %q: %w", req.Header.Get("Port"), ErrMalformedAnnouncement)
+	}
+
+	ret := Announcement{Port: port, Cookie: req.Header.Get("Cookie")}
+	for _, value := range req.Header.Values("Infohash") {
+		var ih [20]byte
+		decoded, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(decoded) != len(ih) {
+			return nil, fmt.Errorf("infohash %q: %w", value, ErrMalformedAnnouncement)
+		}
+		copy(ih[:], decoded)
+		ret.InfoHashes = append(ret.InfoHashes, ih)
+	}
+	if len(ret.InfoHashes) == 0 {
+		return nil, fmt.Errorf("no infohash: %w", ErrMalformedAnnouncement)
+	}
+
+	return &ret, nil
+}
@@ -0,0 +1,57 @@
+package lsd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnouncementRoundTrip(t *testing.T) {
+	a := &Announcement{
+		Port:       6881,
+		InfoHashes: [][20]byte{{0xab, 0xcd}, {0x01}},
+		Cookie:     "c00k1e",
+	}
+
+	msg := a.Marshal(MulticastAddr)
+	require.Equal(t, "BT-SEARCH * HTTP/1.1\r\n"+
+		"Host: 239.192.152.143:6771\r\n"+
+		"Port: 6881\r\n"+
+		"Infohash: abcd000000000000000000000000000000000000\r\n"+
+		"Infohash: 0100000000000000000000000000000000000000\r\n"+
+		"cookie: c00k1e\r\n"+
+		"\r\n\r\n", string(msg))
+
+	parsed, err := ParseAnnouncement(msg)
+	require.Nil(t, err)
+	require.Equal(t, a, parsed)
+}
+
+func TestParseAnnouncementUpperCaseHash(t *testing.T) {
+	msg := "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 51413\r\nInfohash: " +
+		strings.Repeat("AB", 20) + "\r\n\r\n\r\n"
+
+	a, err := ParseAnnouncement([]byte(msg))
+	require.Nil(t, err)
+	require.Equal(t, 51413, a.Port)
+	require.Equal(t, byte(0xab), a.InfoHashes[0][19])
+	require.Equal(t, "", a.Cookie)
+}
+
+func TestParseAnnouncementMalformed(t *testing.T) {
+	tests := map[string]string{
+		"not http":     "hello",
+		"wrong method": "GET * HTTP/1.1\r\nPort: 1\r\nInfohash: " + strings.Repeat("ab", 20) + "\r\n\r\n",
+		"no port":      "BT-SEARCH * HTTP/1.1\r\nInfohash: " + strings.Repeat("ab", 20) + "\r\n\r\n",
+		"bad port":     "BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: " + strings.Repeat("ab", 20) + "\r\n\r\n",
+		"short hash":   "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: abcd\r\n\r\n",
+		"no hash":      "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\n\r\n",
+	}
+
+	for name, msg := range tests {
+		_, err := ParseAnnouncement([]byte(msg))
+		require.True(t, errors.Is(err, ErrMalformedAnnouncement), name)
+	}
+}
@@ -0,0 +1,205 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/ratelimit"
+)
+
+const (
+	DefaultKeepAliveInterval = 2 * time.Minute
+	DefaultReadTimeout       = 3 * time.Minute
+)
+
+var ErrPeerTimeout = errors.New("peer sent nothing before the read timeout")
+
+type Conn struct {
+	conn      net.Conn
+	r         io.Reader
+	w         io.Writer
+	wmu       sync.Mutex
+	keepAlive *time.Timer
+	closed    atomic.Bool
+	Remote    Handshake
+
+	// KeepAliveInterval is how long the connection may go without us sending
+	// anything before a keep-alive goes out. ReadTimeout is how long it may
+	// go without the peer sending anything before it is closed and reads fail
+	// with ErrPeerTimeout. Zero disables either.
+	KeepAliveInterval time.Duration
+	ReadTimeout       time.Duration
+
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
+
+	// Extensions maps the extension names the peer advertised to the ids it
+	// expects us to send them with, LocalExtensions are the ones we sent.
+	Extensions      map[string]int
+	LocalExtensions map[string]int
+	MetadataSize    int
+}
+
+func NewConn(c net.Conn) *Conn {
+	ret := &Conn{
+		conn:              c,
+		w:                 c,
+		KeepAliveInterval: DefaultKeepAliveInterval,
+		ReadTimeout:       DefaultReadTimeout,
+		AmChoking:         true,
+		PeerChoking:       true,
+	}
+	ret.r = connReader{ret}
+	ret.keepAlive = time.AfterFunc(ret.KeepAliveInterval, ret.sendKeepAlive)
+	return ret
+}
+
+// connReader pushes the read deadline back before every read, so only a peer
+// that goes quiet for ReadTimeout trips it.
+type connReader struct {
+	c *Conn
+}
+
+func (r connReader) Read(p []byte) (int, error) {
+	timeout := r.c.ReadTimeout
+	if timeout > 0 {
+		r.c.conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+
+	n, err := r.c.conn.Read(p)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		r.c.conn.Close()
+		return n, fmt.Errorf("nothing read for %s: %w", timeout, ErrPeerTimeout)
+	}
+	return n, err
+}
+
+// SetLimiters throttles reads with down and writes with up, either may be
+// nil for no limit.
+func (c *Conn) SetLimiters(down, up *ratelimit.Limiter) {
+	c.r = down.Reader(connReader{c})
+	c.w = up.Writer(c.conn)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Send writes a message to the peer, it is safe to call from several
+// goroutines. The state flags are not, only the goroutine reading from the
+// connection should change them.
+func (c *Conn) Send(m *Message) error {
+	return c.send(m)
+}
+
+func (c *Conn) send(m *Message) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.resetKeepAlive()
+	_, err := c.w.Write(m.Serialize())
+	return err
+}
+
+// resetKeepAlive pushes the next keep-alive back, it is called with wmu held
+// on every send.
+func (c *Conn) resetKeepAlive() {
+	if c.KeepAliveInterval > 0 && !c.closed.Load() {
+		c.keepAlive.Reset(c.KeepAliveInterval)
+	}
+}
+
+// sendKeepAlive runs once we have sent nothing for KeepAliveInterval.
+func (c *Conn) sendKeepAlive() {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.KeepAliveInterval <= 0 || c.closed.Load() {
+		return
+	}
+
+	c.resetKeepAlive()
+	c.w.Write((*Message)(nil).Serialize())
+}
+
+func (c *Conn) SendChoke() error {
+	if err := c.send(&Message{ID: MsgChoke}); err != nil {
+		return err
+	}
+	c.AmChoking = true
+	return nil
+}
+
+func (c *Conn) SendUnchoke() error {
+	if err := c.send(&Message{ID: MsgUnchoke}); err != nil {
+		return err
+	}
+	c.AmChoking = false
+	return nil
+}
+
+func (c *Conn) SendInterested() error {
+	if err := c.send(&Message{ID: MsgInterested}); err != nil {
+		return err
+	}
+	c.AmInterested = true
+	return nil
+}
+
+func (c *Conn) SendNotInterested() error {
+	if err := c.send(&Message{ID: MsgNotInterested}); err != nil {
+		return err
+	}
+	c.AmInterested = false
+	return nil
+}
+
+// ReadMessage reads the next message from the peer and applies any choke or
+// interest change it carries before returning it.
+func (c *Conn) ReadMessage() (*Message, error) {
+	msg, err := ReadMessage(c.r)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg == nil {
+		return nil, nil
+	}
+
+	switch msg.ID {
+	case MsgChoke:
+		c.PeerChoking = true
+	case MsgUnchoke:
+		c.PeerChoking = false
+	case MsgInterested:
+		c.PeerInterested = true
+	case MsgNotInterested:
+		c.PeerInterested = false
+	case MsgExtended:
+		if err := c.handleExtended(msg); err != nil {
+			return nil, err
+		}
+	case MsgSuggest, MsgHaveAll, MsgHaveNone, MsgRejectRequest, MsgAllowedFast:
+		if !c.FastEnabled() {
+			return nil, fmt.Errorf("fast message %d without fast extension: %w", msg.ID, ErrUnexpectedMessage)
+		}
+	}
+
+	slog.Debug("peer message", "addr", c.conn.RemoteAddr(), "id", msg.ID)
+	return msg, nil
+}
+
+func (c *Conn) Close() error {
+	c.closed.Store(true)
+	c.keepAlive.Stop()
+	return c.conn.Close()
+}
@@ -0,0 +1,150 @@
+package peer
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnDefaults(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	c := NewConn(client)
+	defer c.Close()
+
+	require.True(t, c.AmChoking)
+	require.False(t, c.AmInterested)
+	require.True(t, c.PeerChoking)
+	require.False(t, c.PeerInterested)
+}
+
+func TestConnReadMessageUpdatesPeerState(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	c := NewConn(client)
+	defer c.Close()
+
+	script := []MessageID{MsgUnchoke, MsgInterested, MsgChoke, MsgNotInterested, MsgUnchoke}
+	go func() {
+		for _, id := range script {
+			server.Write((&Message{ID: id}).Serialize())
+		}
+	}()
+
+	expected := []struct {
+		peerChoking    bool
+		peerInterested bool
+	}{
+		{peerChoking: false, peerInterested: false},
+		{peerChoking: false, peerInterested: true},
+		{peerChoking: true, peerInterested: true},
+		{peerChoking: true, peerInterested: false},
+		{peerChoking: false, peerInterested: false},
+	}
+
+	for i, want := range expected {
+		msg, err := c.ReadMessage()
+		require.Nil(t, err)
+		require.Equal(t, script[i], msg.ID)
+		require.Equal(t, want.peerChoking, c.PeerChoking)
+		require.Equal(t, want.peerInterested, c.PeerInterested)
+	}
+
+	require.True(t, c.AmChoking)
+	require.False(t, c.AmInterested)
+}
+
+func TestConnSendUpdatesLocalState(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	c := NewConn(client)
+	defer c.Close()
+
+	received := make(chan MessageID, 4)
+	go func() {
+		for i := 0; i < 4; i += 1 {
+			msg, err := ReadMessage(server)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- msg.ID
+		}
+	}()
+
+	require.Nil(t, c.SendInterested())
+	require.Equal(t, MsgInterested, <-received)
+	require.True(t, c.AmInterested)
+
+	require.Nil(t, c.SendUnchoke())
+	require.Equal(t, MsgUnchoke, <-received)
+	require.False(t, c.AmChoking)
+
+	require.Nil(t, c.SendNotInterested())
+	require.Equal(t, MsgNotInterested, <-received)
+	require.False(t, c.AmInterested)
+
+	require.Nil(t, c.SendChoke())
+	require.Equal(t, MsgChoke, <-received)
+	require.True(t, c.AmChoking)
+
+	require.False(t, c.PeerInterested)
+	require.True(t, c.PeerChoking)
+}
+
+func TestConnReadTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	c := NewConn(client)
+	c.ReadTimeout = 50 * time.Millisecond
+	defer c.Close()
+
+	// Traffic keeps pushing the deadline back, the stall after it doesn't.
+	go func() {
+		for range 3 {
+			time.Sleep(30 * time.Millisecond)
+			server.Write((*Message)(nil).Serialize())
+		}
+	}()
+
+	for range 3 {
+		msg, err := c.ReadMessage()
+		require.Nil(t, err)
+		require.Nil(t, msg)
+	}
+
+	_, err := c.ReadMessage()
+	require.True(t, errors.Is(err, ErrPeerTimeout))
+
+	_, err = server.Write([]byte{0})
+	require.True(t, errors.Is(err, io.ErrClosedPipe))
+}
+
+func TestConnKeepAlive(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	c := NewConn(client)
+	c.KeepAliveInterval = 20 * time.Millisecond
+	defer c.Close()
+
+	go c.SendInterested()
+
+	msg, err := ReadMessage(server)
+	require.Nil(t, err)
+	require.Equal(t, MsgInterested, msg.ID)
+
+	for range 2 {
+		msg, err = ReadMessage(server)
+		require.Nil(t, err)
+		require.Nil(t, msg)
+	}
+}
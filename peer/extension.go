@@ -0,0 +1,130 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/skirtan1/bittorrent-client/bencode"
+)
+
+const (
+	MsgExtended MessageID = 20
+
+	ExtendedHandshakeID = 0
+
+	extensionReservedByte = 5
+	extensionReservedBit  = 0x10
+)
+
+func (h *Handshake) SetExtensions() {
+	h.Reserved[extensionReservedByte] |= extensionReservedBit
+}
+
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[extensionReservedByte]&extensionReservedBit != 0
+}
+
+func NewExtended(extID byte, payload []byte) *Message {
+	return &Message{ID: MsgExtended, Payload: append([]byte{extID}, payload...)}
+}
+
+func ParseExtended(m *Message) (extID byte, payload []byte, err error) {
+	if m.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("expected extended, got %d: %w", m.ID, ErrUnexpectedMessage)
+	}
+
+	if len(m.Payload) < 1 {
+		return 0, nil, fmt.Errorf("extended payload of len %d: %w", len(m.Payload), ErrMalformedPayload)
+	}
+
+	return m.Payload[0], m.Payload[1:], nil
+}
+
+func NewExtendedHandshake(extensions map[string]int) (*Message, error) {
+	m := bencode.BMap{}
+	for name, id := range extensions {
+		m[bencode.BString(name)] = bencode.BInt64(id)
+	}
+
+	enc, err := bencode.Encode(bencode.BMap{bencode.BString("m"): m})
+	if err != nil {
+		return nil, fmt.Errorf("encode extended handshake: %w", err)
+	}
+
+	return NewExtended(ExtendedHandshakeID, enc), nil
+}
+
+type ExtendedHandshake struct {
+	M            map[string]int
+	MetadataSize int
+}
+
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	benc, _, err := bencode.DecodeWithOptions(context.Background(), payload, bencode.LenientOptions())
+	if err != nil {
+		return nil, fmt.Errorf("decode extended handshake: %w", err)
+	}
+
+	dict, ok := benc.(bencode.BMap)
+	if !ok {
+		return nil, fmt.Errorf("extended handshake not a dict: %w", ErrMalformedPayload)
+	}
+
+	m, ok := dict[bencode.BString("m")].(bencode.BMap)
+	if !ok {
+		return nil, fmt.Errorf("extended handshake m: %w", ErrMalformedPayload)
+	}
+
+	ret := ExtendedHandshake{M: make(map[string]int)}
+	for name, v := range m {
+		// an id of 0 means the peer disabled the extension
+		id, ok := v.(bencode.BInt64)
+		if !ok || id <= 0 || id > 255 {
+			continue
+		}
+		ret.M[string(name)] = int(id)
+	}
+
+	if size, ok := dict[bencode.BString("metadata_size")].(bencode.BInt64); ok && size > 0 {
+		ret.MetadataSize = int(size)
+	}
+	return &ret, nil
+}
+
+// SendExtendedHandshake advertises our extensions when the peer set the
+// extension protocol bit in its handshake.
+func (c *Conn) SendExtendedHandshake(extensions map[string]int) error {
+	if !c.Remote.SupportsExtensions() {
+		return nil
+	}
+
+	msg, err := NewExtendedHandshake(extensions)
+	if err != nil {
+		return err
+	}
+
+	if err := c.send(msg); err != nil {
+		return err
+	}
+	c.LocalExtensions = extensions
+	return nil
+}
+
+func (c *Conn) handleExtended(msg *Message) error {
+	extID, payload, err := ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+
+	if extID != ExtendedHandshakeID {
+		return nil
+	}
+
+	hs, err := ParseExtendedHandshake(payload)
+	if err != nil {
+		return err
+	}
+	c.Extensions = hs.M
+	c.MetadataSize = hs.MetadataSize
+	return nil
+}
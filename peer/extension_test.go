@@ -0,0 +1,118 @@
+package peer
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshakeExtensionBit(t *testing.T) {
+	h := NewHandshake([20]byte{}, [20]byte{})
+	require.True(t, h.SupportsExtensions())
+	require.Equal(t, byte(0x10), h.Serialize()[20+extensionReservedByte])
+
+	require.False(t, (&Handshake{}).SupportsExtensions())
+}
+
+func TestExtendedHandshakeRoundTrip(t *testing.T) {
+	msg, err := NewExtendedHandshake(map[string]int{"ut_metadata": 1, "ut_pex": 2})
+	require.Nil(t, err)
+
+	extID, payload, err := ParseExtended(msg)
+	require.Nil(t, err)
+	require.Equal(t, byte(ExtendedHandshakeID), extID)
+	require.Equal(t, "d1:md11:ut_metadatai1e6:ut_pexi2eee", string(payload))
+
+	hs, err := ParseExtendedHandshake(payload)
+	require.Nil(t, err)
+	require.Equal(t, map[string]int{"ut_metadata": 1, "ut_pex": 2}, hs.M)
+}
+
+func TestParseExtendedHandshake(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected *ExtendedHandshake
+		err      error
+	}{
+		{
+			name:     "disabled extension is dropped",
+			input:    "d1:md11:ut_metadatai0e6:ut_pexi2eee",
+			expected: &ExtendedHandshake{M: map[string]int{"ut_pex": 2}},
+		},
+		{
+			name:     "metadata size and extra keys",
+			input:    "d1:md11:ut_metadatai1ee13:metadata_sizei100e1:v4:teste",
+			expected: &ExtendedHandshake{M: map[string]int{"ut_metadata": 1}, MetadataSize: 100},
+		},
+		{
+			name:  "missing m",
+			input: "d1:v4:teste",
+			err:   ErrMalformedPayload,
+		},
+		{
+			name:  "not a dict",
+			input: "le",
+			err:   ErrMalformedPayload,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hs, err := ParseExtendedHandshake([]byte(tt.input))
+			if tt.err != nil {
+				require.True(t, errors.Is(err, tt.err))
+			} else {
+				require.Nil(t, err)
+				require.Equal(t, tt.expected, hs)
+			}
+		})
+	}
+}
+
+func TestConnExtendedHandshake(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	c := NewConn(client)
+	defer c.Close()
+	c.Remote.SetExtensions()
+
+	local := map[string]int{"ut_metadata": 3}
+	go func() {
+		msg, err := ReadMessage(server)
+		if err != nil || msg.ID != MsgExtended {
+			return
+		}
+
+		remote, _ := NewExtendedHandshake(map[string]int{"ut_metadata": 1, "ut_pex": 2})
+		server.Write(remote.Serialize())
+		server.Write(NewExtended(42, []byte("unknown extension")).Serialize())
+	}()
+
+	require.Nil(t, c.SendExtendedHandshake(local))
+	require.Equal(t, local, c.LocalExtensions)
+
+	msg, err := c.ReadMessage()
+	require.Nil(t, err)
+	require.Equal(t, MsgExtended, msg.ID)
+	require.Equal(t, map[string]int{"ut_metadata": 1, "ut_pex": 2}, c.Extensions)
+
+	msg, err = c.ReadMessage()
+	require.Nil(t, err)
+	require.Equal(t, MsgExtended, msg.ID)
+	require.Equal(t, map[string]int{"ut_metadata": 1, "ut_pex": 2}, c.Extensions)
+}
+
+func TestSendExtendedHandshakeWithoutSupport(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	c := NewConn(client)
+	defer c.Close()
+
+	require.Nil(t, c.SendExtendedHandshake(map[string]int{"ut_pex": 1}))
+	require.Nil(t, c.LocalExtensions)
+}
@@ -0,0 +1,79 @@
+package peer
+
+import (
+	"fmt"
+
+	"github.com/skirtan1/bittorrent-client/torrent"
+)
+
+const (
+	MsgSuggest       MessageID = 0x0D
+	MsgHaveAll       MessageID = 0x0E
+	MsgHaveNone      MessageID = 0x0F
+	MsgRejectRequest MessageID = 0x10
+	MsgAllowedFast   MessageID = 0x11
+
+	fastReservedByte = 7
+	fastReservedBit  = 0x04
+)
+
+func (h *Handshake) SetFast() {
+	h.Reserved[fastReservedByte] |= fastReservedBit
+}
+
+func (h *Handshake) SupportsFast() bool {
+	return h.Reserved[fastReservedByte]&fastReservedBit != 0
+}
+
+// FastEnabled reports whether both sides negotiated the fast extension, we
+// always advertise it so only the remote bit matters.
+func (c *Conn) FastEnabled() bool {
+	return c.Remote.SupportsFast()
+}
+
+func NewSuggest(index int) *Message {
+	return newIndexMessage(MsgSuggest, index)
+}
+
+func ParseSuggest(m *Message) (int, error) {
+	return parseIndexMessage(m, MsgSuggest, "suggest")
+}
+
+func NewAllowedFast(index int) *Message {
+	return newIndexMessage(MsgAllowedFast, index)
+}
+
+func ParseAllowedFast(m *Message) (int, error) {
+	return parseIndexMessage(m, MsgAllowedFast, "allowed fast")
+}
+
+func NewReject(index, begin, length int) *Message {
+	return newBlockMessage(MsgRejectRequest, index, begin, length)
+}
+
+func ParseReject(m *Message) (index, begin, length int, err error) {
+	return parseBlockMessage(m, MsgRejectRequest, "reject request")
+}
+
+// PeerBitfield returns the pieces announced by a bitfield, have all or have
+// none message for a torrent of numPieces pieces.
+func PeerBitfield(m *Message, numPieces int) (torrent.Bitfield, error) {
+	bf := torrent.NewBitfield(numPieces)
+
+	switch m.ID {
+	case MsgBitfield:
+		if len(m.Payload) != len(bf) {
+			return nil, fmt.Errorf("bitfield of len %d for %d pieces: %w", len(m.Payload), numPieces, ErrMalformedPayload)
+		}
+		copy(bf, m.Payload)
+	case MsgHaveAll:
+		for i := 0; i < numPieces; i += 1 {
+			bf.SetPiece(i)
+		}
+	case MsgHaveNone:
+	default:
+		return nil, fmt.Errorf("expected bitfield, got %d: %w", m.ID, ErrUnexpectedMessage)
+	}
+
+	return bf, nil
+}
@@ -0,0 +1,108 @@
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/skirtan1/bittorrent-client/torrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshakeFastBit(t *testing.T) {
+	h := NewHandshake([20]byte{}, [20]byte{})
+	require.True(t, h.SupportsFast())
+	require.Equal(t, byte(0x04), h.Serialize()[20+fastReservedByte])
+
+	require.False(t, (&Handshake{}).SupportsFast())
+}
+
+func TestFastIndexMessagesRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		new   func(int) *Message
+		parse func(*Message) (int, error)
+		id    MessageID
+	}{
+		{"suggest", NewSuggest, ParseSuggest, MsgSuggest},
+		{"allowed fast", NewAllowedFast, ParseAllowedFast, MsgAllowedFast},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.new(42)
+			require.Equal(t, tt.id, msg.ID)
+
+			index, err := tt.parse(msg)
+			require.Nil(t, err)
+			require.Equal(t, 42, index)
+
+			_, err = tt.parse(&Message{ID: tt.id, Payload: []byte{1}})
+			require.True(t, errors.Is(err, ErrMalformedPayload))
+
+			_, err = tt.parse(&Message{ID: MsgHave, Payload: []byte{0, 0, 0, 1}})
+			require.True(t, errors.Is(err, ErrUnexpectedMessage))
+		})
+	}
+}
+
+func TestRejectRoundTrip(t *testing.T) {
+	msg := NewReject(3, 16384, 16384)
+	require.Equal(t, MsgRejectRequest, msg.ID)
+
+	index, begin, length, err := ParseReject(msg)
+	require.Nil(t, err)
+	require.Equal(t, []int{3, 16384, 16384}, []int{index, begin, length})
+
+	_, _, _, err = ParseReject(NewRequest(3, 0, 1))
+	require.True(t, errors.Is(err, ErrUnexpectedMessage))
+}
+
+func TestHaveAllHaveNoneRoundTrip(t *testing.T) {
+	for _, id := range []MessageID{MsgHaveAll, MsgHaveNone} {
+		msg, err := ReadMessage(bytes.NewReader((&Message{ID: id}).Serialize()))
+		require.Nil(t, err)
+		require.Equal(t, id, msg.ID)
+		require.Empty(t, msg.Payload)
+	}
+}
+
+func TestPeerBitfield(t *testing.T) {
+	bf, err := PeerBitfield(&Message{ID: MsgHaveAll}, 10)
+	require.Nil(t, err)
+	require.Equal(t, torrent.Bitfield{0xff, 0xc0}, bf)
+	for i := 0; i < 10; i += 1 {
+		require.True(t, bf.HasPiece(i))
+	}
+
+	bf, err = PeerBitfield(&Message{ID: MsgHaveNone}, 10)
+	require.Nil(t, err)
+	require.Equal(t, torrent.Bitfield{0, 0}, bf)
+
+	bf, err = PeerBitfield(&Message{ID: MsgBitfield, Payload: []byte{0x80, 0x40}}, 10)
+	require.Nil(t, err)
+	require.True(t, bf.HasPiece(0))
+	require.True(t, bf.HasPiece(9))
+
+	_, err = PeerBitfield(&Message{ID: MsgBitfield, Payload: []byte{0x80}}, 10)
+	require.True(t, errors.Is(err, ErrMalformedPayload))
+}
+
+func TestConnFastMessagesNeedNegotiation(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	c := NewConn(client)
+	defer c.Close()
+
+	go server.Write((&Message{ID: MsgHaveAll}).Serialize())
+	_, err := c.ReadMessage()
+	require.True(t, errors.Is(err, ErrUnexpectedMessage))
+
+	c.Remote.SetFast()
+	go server.Write((&Message{ID: MsgHaveAll}).Serialize())
+	msg, err := c.ReadMessage()
+	require.Nil(t, err)
+	require.Equal(t, MsgHaveAll, msg.ID)
+}
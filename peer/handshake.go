@@ -0,0 +1,142 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	protocolID       = "BitTorrent protocol"
+	handshakeLen     = 49 + len(protocolID)
+	handshakeTimeout = 10 * time.Second
+)
+
+var (
+	ErrInvalidHandshake = errors.New("invalid handshake")
+	ErrInfoHashMismatch = errors.New("peer info hash does not match")
+	ErrUnknownInfoHash  = errors.New("no torrent for the peer's info hash")
+)
+
+type Handshake struct {
+	Reserved [8]byte
+	InfoHash [20]byte
+	PeerID   [20]byte
+}
+
+func NewHandshake(infoHash, peerID [20]byte) *Handshake {
+	h := &Handshake{InfoHash: infoHash, PeerID: peerID}
+	h.SetExtensions()
+	h.SetFast()
+	return h
+}
+
+func (h *Handshake) Serialize() []byte {
+	buf := make([]byte, 0, handshakeLen)
+	buf = append(buf, byte(len(protocolID)))
+	buf = append(buf, protocolID...)
+	buf = append(buf, h.Reserved[:]...)
+	buf = append(buf, h.InfoHash[:]...)
+	buf = append(buf, h.PeerID[:]...)
+	return buf
+}
+
+func ReadHandshake(r io.Reader) (*Handshake, error) {
+	buf := make([]byte, handshakeLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	if int(buf[0]) != len(protocolID) || !bytes.Equal(buf[1:1+len(protocolID)], []byte(protocolID)) {
+		return nil, fmt.Errorf("unknown protocol: %w", ErrInvalidHandshake)
+	}
+
+	h := Handshake{}
+	idx := 1 + len(protocolID)
+	idx += copy(h.Reserved[:], buf[idx:])
+	idx += copy(h.InfoHash[:], buf[idx:])
+	copy(h.PeerID[:], buf[idx:])
+	return &h, nil
+}
+
+// Connect sends our handshake on c, reads the peer's and checks that both
+// are for the same torrent.
+func Connect(c net.Conn, h *Handshake) (*Conn, error) {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	if _, err := c.Write(h.Serialize()); err != nil {
+		return nil, fmt.Errorf("send handshake: %w", err)
+	}
+
+	remote, err := ReadHandshake(c)
+	if err != nil {
+		return nil, fmt.Errorf("read handshake: %w", err)
+	}
+
+	if remote.InfoHash != h.InfoHash {
+		return nil, ErrInfoHashMismatch
+	}
+
+	conn := NewConn(c)
+	conn.Remote = *remote
+	return conn, nil
+}
+
+// Accept runs the handshake on a connection the peer opened: it reads the
+// peer's handshake first, asks peerID which id to answer with for its info
+// hash and sends ours back. Info hashes peerID doesn't know fail with
+// ErrUnknownInfoHash before we send anything.
+func Accept(c net.Conn, peerID func(infoHash [20]byte) ([20]byte, bool)) (*Conn, error) {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	remote, err := ReadHandshake(c)
+	if err != nil {
+		return nil, fmt.Errorf("read handshake: %w", err)
+	}
+
+	id, ok := peerID(remote.InfoHash)
+	if !ok {
+		return nil, fmt.Errorf("info hash %x: %w", remote.InfoHash, ErrUnknownInfoHash)
+	}
+
+	if _, err := c.Write(NewHandshake(remote.InfoHash, id).Serialize()); err != nil {
+		return nil, fmt.Errorf("send handshake: %w", err)
+	}
+
+	conn := NewConn(c)
+	conn.Remote = *remote
+	return conn, nil
+}
+
+func Dial(ctx context.Context, addr string, infoHash, peerID [20]byte) (*Conn, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial peer %s: %w", addr, err)
+	}
+
+	// ctx bounds the handshake too, not just the TCP connect.
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	conn, err := Connect(c, NewHandshake(infoHash, peerID))
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		// ctx may have expired after the handshake went through, the Conn
+		// has to stop its keep-alive timer then.
+		if conn != nil {
+			conn.Close()
+		} else {
+			c.Close()
+		}
+		return nil, fmt.Errorf("handshake with %s: %w", addr, err)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,130 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	h := NewHandshake([20]byte{1, 2, 3}, [20]byte{'-', 'S', 'K'})
+	h.Reserved[5] = 0x10
+
+	buf := h.Serialize()
+	require.Len(t, buf, 68)
+	require.Equal(t, byte(19), buf[0])
+
+	got, err := ReadHandshake(bytes.NewReader(buf))
+	require.Nil(t, err)
+	require.Equal(t, h, got)
+}
+
+func TestReadHandshakeInvalidProtocol(t *testing.T) {
+	buf := NewHandshake([20]byte{}, [20]byte{}).Serialize()
+	copy(buf[1:], "NotTorrent protocol")
+
+	_, err := ReadHandshake(bytes.NewReader(buf))
+	require.True(t, errors.Is(err, ErrInvalidHandshake))
+}
+
+func TestConnect(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteHash [20]byte
+		err        error
+	}{
+		{
+			name:       "matching info hash",
+			remoteHash: [20]byte{1},
+		},
+		{
+			name:       "mismatched info hash",
+			remoteHash: [20]byte{2},
+			err:        ErrInfoHashMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			go func() {
+				if _, err := ReadHandshake(server); err != nil {
+					return
+				}
+				server.Write(NewHandshake(tt.remoteHash, [20]byte{'r'}).Serialize())
+			}()
+
+			conn, err := Connect(client, NewHandshake([20]byte{1}, [20]byte{'l'}))
+			if tt.err != nil {
+				require.True(t, errors.Is(err, tt.err))
+			} else {
+				require.Nil(t, err)
+				require.Equal(t, [20]byte{'r'}, conn.Remote.PeerID)
+			}
+		})
+	}
+}
+
+func TestAccept(t *testing.T) {
+	known := func(infoHash [20]byte) ([20]byte, bool) {
+		return [20]byte{'l'}, infoHash == [20]byte{1}
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	dialed := make(chan *Conn, 1)
+	go func() {
+		conn, _ := Connect(client, NewHandshake([20]byte{1}, [20]byte{'r'}))
+		dialed <- conn
+	}()
+
+	conn, err := Accept(server, known)
+	require.Nil(t, err)
+	require.Equal(t, [20]byte{'r'}, conn.Remote.PeerID)
+	remote := <-dialed
+	require.NotNil(t, remote)
+	require.Equal(t, [20]byte{'l'}, remote.Remote.PeerID)
+
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+	defer server2.Close()
+
+	go client2.Write(NewHandshake([20]byte{2}, [20]byte{'r'}).Serialize())
+	_, err = Accept(server2, known)
+	require.True(t, errors.Is(err, ErrUnknownInfoHash))
+}
+
+func TestDialHandshakeTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	// accepts the connection but never answers the handshake
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(io.Discard, c)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = Dial(ctx, ln.Addr().String(), [20]byte{1}, [20]byte{'l'})
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	require.Less(t, time.Since(start), handshakeTimeout)
+}
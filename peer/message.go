@@ -0,0 +1,167 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type MessageID uint8
+
+const (
+	MsgChoke         MessageID = 0
+	MsgUnchoke       MessageID = 1
+	MsgInterested    MessageID = 2
+	MsgNotInterested MessageID = 3
+	MsgHave          MessageID = 4
+	MsgBitfield      MessageID = 5
+	MsgRequest       MessageID = 6
+	MsgPiece         MessageID = 7
+	MsgCancel        MessageID = 8
+)
+
+const MaxMessageLen = 1 << 20
+
+var (
+	ErrMessageTooLong    = errors.New("message length exceeds max message length")
+	ErrUnexpectedMessage = errors.New("unexpected message id")
+	ErrMalformedPayload  = errors.New("malformed message payload")
+)
+
+type Message struct {
+	ID      MessageID
+	Payload []byte
+}
+
+// Serialize encodes a message as <length prefix><id><payload>, a nil message
+// is a keep-alive.
+func (m *Message) Serialize() []byte {
+	if m == nil {
+		return make([]byte, 4)
+	}
+
+	length := uint32(len(m.Payload) + 1)
+	buf := make([]byte, 4+length)
+	binary.BigEndian.PutUint32(buf[0:4], length)
+	buf[4] = byte(m.ID)
+	copy(buf[5:], m.Payload)
+	return buf
+}
+
+// ReadMessage reads one message from r, it returns a nil message for a
+// keep-alive and io.ErrUnexpectedEOF if r ends inside a message.
+func ReadMessage(r io.Reader) (*Message, error) {
+	lengthBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, lengthBuf); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(lengthBuf)
+	if length == 0 {
+		return nil, nil
+	}
+
+	if length > MaxMessageLen {
+		return nil, fmt.Errorf("read message of len %d: %w", length, ErrMessageTooLong)
+	}
+
+	// The peer promised length bytes, so running out early is never a clean
+	// EOF.
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return &Message{ID: MessageID(buf[0]), Payload: buf[1:]}, nil
+}
+
+func newIndexMessage(id MessageID, index int) *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &Message{ID: id, Payload: payload}
+}
+
+func parseIndexMessage(m *Message, id MessageID, name string) (int, error) {
+	if m.ID != id {
+		return 0, fmt.Errorf("expected %s, got %d: %w", name, m.ID, ErrUnexpectedMessage)
+	}
+
+	if len(m.Payload) != 4 {
+		return 0, fmt.Errorf("%s payload of len %d: %w", name, len(m.Payload), ErrMalformedPayload)
+	}
+
+	return int(binary.BigEndian.Uint32(m.Payload)), nil
+}
+
+func newBlockMessage(id MessageID, index, begin, length int) *Message {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return &Message{ID: id, Payload: payload}
+}
+
+func parseBlockMessage(m *Message, id MessageID, name string) (index, begin, length int, err error) {
+	if m.ID != id {
+		return 0, 0, 0, fmt.Errorf("expected %s, got %d: %w", name, m.ID, ErrUnexpectedMessage)
+	}
+
+	if len(m.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("%s payload of len %d: %w", name, len(m.Payload), ErrMalformedPayload)
+	}
+
+	index = int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(m.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+func NewHave(index int) *Message {
+	return newIndexMessage(MsgHave, index)
+}
+
+func ParseHave(m *Message) (int, error) {
+	return parseIndexMessage(m, MsgHave, "have")
+}
+
+func NewRequest(index, begin, length int) *Message {
+	return newBlockMessage(MsgRequest, index, begin, length)
+}
+
+func ParseRequest(m *Message) (index, begin, length int, err error) {
+	return parseBlockMessage(m, MsgRequest, "request")
+}
+
+func NewCancel(index, begin, length int) *Message {
+	return newBlockMessage(MsgCancel, index, begin, length)
+}
+
+func ParseCancel(m *Message) (index, begin, length int, err error) {
+	return parseBlockMessage(m, MsgCancel, "cancel")
+}
+
+func NewPiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
+func ParsePiece(m *Message) (index, begin int, block []byte, err error) {
+	if m.ID != MsgPiece {
+		return 0, 0, nil, fmt.Errorf("expected piece, got %d: %w", m.ID, ErrUnexpectedMessage)
+	}
+
+	if len(m.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("piece payload of len %d: %w", len(m.Payload), ErrMalformedPayload)
+	}
+
+	index = int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	return index, begin, m.Payload[8:], nil
+}
@@ -0,0 +1,184 @@
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageSerialize(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    *Message
+		expected []byte
+	}{
+		{
+			name:     "keep alive",
+			input:    nil,
+			expected: []byte{0, 0, 0, 0},
+		},
+		{
+			name:     "choke",
+			input:    &Message{ID: MsgChoke},
+			expected: []byte{0, 0, 0, 1, 0},
+		},
+		{
+			name:     "have",
+			input:    &Message{ID: MsgHave, Payload: []byte{0, 0, 0, 7}},
+			expected: []byte{0, 0, 0, 5, 4, 0, 0, 0, 7},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, tt.input.Serialize())
+		})
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []byte
+		expected *Message
+		err      error
+	}{
+		{
+			name:     "keep alive",
+			input:    []byte{0, 0, 0, 0},
+			expected: nil,
+		},
+		{
+			name:     "have",
+			input:    []byte{0, 0, 0, 5, 4, 0, 0, 0, 7},
+			expected: &Message{ID: MsgHave, Payload: []byte{0, 0, 0, 7}},
+		},
+		{
+			name:  "too long",
+			input: []byte{0xff, 0xff, 0xff, 0xff, 7},
+			err:   ErrMessageTooLong,
+		},
+		{
+			name:  "truncated length",
+			input: []byte{0, 0},
+			err:   io.ErrUnexpectedEOF,
+		},
+		{
+			name:  "empty reader",
+			input: []byte{},
+			err:   io.EOF,
+		},
+		{
+			name:  "length without body",
+			input: []byte{0, 0, 0, 13},
+			err:   io.ErrUnexpectedEOF,
+		},
+		{
+			name:  "truncated piece",
+			input: []byte{0, 0, 0, 13, 7, 0, 0, 0, 1, 0, 0},
+			err:   io.ErrUnexpectedEOF,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := ReadMessage(bytes.NewReader(tt.input))
+			if tt.err != nil {
+				require.True(t, errors.Is(err, tt.err))
+			} else {
+				require.Nil(t, err)
+				require.Equal(t, tt.expected, msg)
+			}
+		})
+	}
+}
+
+func TestReadMessageTruncatedOverPipe(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		server.Write([]byte{0, 0, 0x40, 9})
+		server.Write([]byte{byte(MsgPiece), 0, 0, 0, 1})
+		server.Close()
+	}()
+
+	_, err := ReadMessage(client)
+	require.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+}
+
+func TestParseHave(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    *Message
+		expected int
+		err      error
+	}{
+		{
+			name:     "valid have",
+			input:    NewHave(1337),
+			expected: 1337,
+		},
+		{
+			name:  "wrong id",
+			input: &Message{ID: MsgPiece, Payload: []byte{0, 0, 0, 1}},
+			err:   ErrUnexpectedMessage,
+		},
+		{
+			name:  "short payload",
+			input: &Message{ID: MsgHave, Payload: []byte{0, 1}},
+			err:   ErrMalformedPayload,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index, err := ParseHave(tt.input)
+			if tt.err != nil {
+				require.True(t, errors.Is(err, tt.err))
+			} else {
+				require.Nil(t, err)
+				require.Equal(t, tt.expected, index)
+			}
+		})
+	}
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	index, begin, length, err := ParseRequest(NewRequest(4, 16384, 100))
+	require.Nil(t, err)
+	require.Equal(t, []int{4, 16384, 100}, []int{index, begin, length})
+
+	_, _, _, err = ParseRequest(&Message{ID: MsgRequest, Payload: []byte{1, 2}})
+	require.True(t, errors.Is(err, ErrMalformedPayload))
+
+	_, _, _, err = ParseRequest(NewHave(1))
+	require.True(t, errors.Is(err, ErrUnexpectedMessage))
+}
+
+func TestCancelRoundTrip(t *testing.T) {
+	msg := NewCancel(4, 16384, 100)
+	require.Equal(t, MsgCancel, msg.ID)
+
+	index, begin, length, err := ParseCancel(msg)
+	require.Nil(t, err)
+	require.Equal(t, []int{4, 16384, 100}, []int{index, begin, length})
+
+	_, _, _, err = ParseCancel(NewRequest(4, 16384, 100))
+	require.True(t, errors.Is(err, ErrUnexpectedMessage))
+}
+
+func TestPieceRoundTrip(t *testing.T) {
+	index, begin, block, err := ParsePiece(NewPiece(2, 32768, []byte("data")))
+	require.Nil(t, err)
+	require.Equal(t, 2, index)
+	require.Equal(t, 32768, begin)
+	require.Equal(t, []byte("data"), block)
+
+	_, _, _, err = ParsePiece(&Message{ID: MsgPiece, Payload: []byte{1}})
+	require.True(t, errors.Is(err, ErrMalformedPayload))
+}
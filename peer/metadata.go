@@ -0,0 +1,168 @@
+package peer
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+
+	"github.com/skirtan1/bittorrent-client/bencode"
+	"github.com/skirtan1/bittorrent-client/torrent"
+)
+
+const (
+	UTMetadata         = "ut_metadata"
+	localUTMetadataID  = 1
+	metadataPieceLen   = 16384
+	maxMetadataSize    = 16 << 20
+	metadataMsgRequest = 0
+	metadataMsgData    = 1
+	metadataMsgReject  = 2
+)
+
+var (
+	ErrMetadataNotSupported = errors.New("peer does not support ut_metadata")
+	ErrMetadataRejected     = errors.New("peer rejected metadata request")
+	ErrMetadataHashMismatch = errors.New("metadata does not match info hash")
+)
+
+func newMetadataRequest(extID int, piece int) (*Message, error) {
+	enc, err := bencode.Encode(bencode.BMap{
+		bencode.BString("msg_type"): bencode.BInt64(metadataMsgRequest),
+		bencode.BString("piece"):    bencode.BInt64(piece),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewExtended(byte(extID), enc), nil
+}
+
+func parseMetadataPiece(payload []byte) (piece int, data []byte, err error) {
+	benc, idx, err := bencode.DecodeWithOptions(context.Background(), payload, bencode.LenientOptions())
+	if err != nil {
+		return 0, nil, fmt.Errorf("decode metadata message: %w", err)
+	}
+
+	dict, ok := benc.(bencode.BMap)
+	if !ok {
+		return 0, nil, fmt.Errorf("metadata message not a dict: %w", ErrMalformedPayload)
+	}
+
+	msgType, ok := dict[bencode.BString("msg_type")].(bencode.BInt64)
+	if !ok {
+		return 0, nil, fmt.Errorf("metadata msg_type: %w", ErrMalformedPayload)
+	}
+
+	p, ok := dict[bencode.BString("piece")].(bencode.BInt64)
+	if !ok {
+		return 0, nil, fmt.Errorf("metadata piece: %w", ErrMalformedPayload)
+	}
+
+	switch msgType {
+	case metadataMsgData:
+		return int(p), payload[idx:], nil
+	case metadataMsgReject:
+		return int(p), nil, fmt.Errorf("metadata piece %d: %w", p, ErrMetadataRejected)
+	default:
+		return int(p), nil, fmt.Errorf("metadata msg_type %d: %w", msgType, ErrUnexpectedMessage)
+	}
+}
+
+// readMetadataPiece reads messages until the next ut_metadata message and
+// returns its payload, other messages are applied to conn and dropped.
+func readMetadataPiece(conn *Conn) (int, []byte, error) {
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if msg == nil || msg.ID != MsgExtended {
+			continue
+		}
+
+		extID, payload, err := ParseExtended(msg)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if int(extID) == conn.LocalExtensions[UTMetadata] {
+			return parseMetadataPiece(payload)
+		}
+	}
+}
+
+// RequestMetadata downloads the info dict from a peer with ut_metadata
+// (BEP 9) and checks it against infoHash before decoding it.
+func RequestMetadata(conn *Conn, infoHash [20]byte) (*torrent.Info, error) {
+	if conn.LocalExtensions[UTMetadata] == 0 {
+		if !conn.Remote.SupportsExtensions() {
+			return nil, ErrMetadataNotSupported
+		}
+
+		local := map[string]int{UTMetadata: localUTMetadataID}
+		for name, id := range conn.LocalExtensions {
+			local[name] = id
+		}
+		if err := conn.SendExtendedHandshake(local); err != nil {
+			return nil, fmt.Errorf("request metadata: %w", err)
+		}
+	}
+
+	for conn.Extensions == nil {
+		if _, err := conn.ReadMessage(); err != nil {
+			return nil, fmt.Errorf("request metadata, wait for extended handshake: %w", err)
+		}
+	}
+
+	remoteID, ok := conn.Extensions[UTMetadata]
+	if !ok || conn.MetadataSize <= 0 {
+		return nil, ErrMetadataNotSupported
+	}
+
+	if conn.MetadataSize > maxMetadataSize {
+		return nil, fmt.Errorf("metadata size %d: %w", conn.MetadataSize, ErrMalformedPayload)
+	}
+
+	metadata := make([]byte, conn.MetadataSize)
+	numPieces := (conn.MetadataSize + metadataPieceLen - 1) / metadataPieceLen
+	for i := 0; i < numPieces; i += 1 {
+		req, err := newMetadataRequest(remoteID, i)
+		if err != nil {
+			return nil, fmt.Errorf("request metadata: %w", err)
+		}
+
+		if err := conn.send(req); err != nil {
+			return nil, fmt.Errorf("request metadata piece %d: %w", i, err)
+		}
+
+		piece, data, err := readMetadataPiece(conn)
+		if err != nil {
+			return nil, fmt.Errorf("request metadata piece %d: %w", i, err)
+		}
+
+		expectedLen := min(metadataPieceLen, conn.MetadataSize-i*metadataPieceLen)
+		if piece != i || len(data) != expectedLen {
+			return nil, fmt.Errorf("metadata piece %d of len %d: %w", piece, len(data), ErrMalformedPayload)
+		}
+		copy(metadata[i*metadataPieceLen:], data)
+	}
+
+	if sha1.Sum(metadata) != infoHash {
+		return nil, ErrMetadataHashMismatch
+	}
+
+	benc, _, err := bencode.DecodeWithOptions(context.Background(), metadata, bencode.LenientOptions())
+	if err != nil {
+		return nil, fmt.Errorf("decode metadata: %w", err)
+	}
+
+	info, err := torrent.DecodeInfoFromBencode(benc)
+	if err != nil {
+		return nil, fmt.Errorf("decode metadata: %w", err)
+	}
+	// Re-encoding a non canonical dict, as DecodeInfoFromBencode does to hash
+	// it, gives other bytes than the ones we checked.
+	info.InfoHash = infoHash
+	return info, nil
+}
@@ -0,0 +1,165 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/skirtan1/bittorrent-client/bencode"
+	"github.com/stretchr/testify/require"
+)
+
+func testInfoDict(t *testing.T) []byte {
+	t.Helper()
+
+	enc, err := bencode.Encode(bencode.BMap{
+		bencode.BString("name"):         bencode.BString("metadata.bin"),
+		bencode.BString("piece length"): bencode.BInt64(16384),
+		bencode.BString("pieces"):       bencode.BString(strings.Repeat("p", 20*1000)),
+		bencode.BString("length"):       bencode.BInt64(16384 * 1000),
+	})
+	require.Nil(t, err)
+	return enc
+}
+
+// serveMetadata plays the remote side: it answers our extended handshake and
+// serves metadata in ut_metadata pieces.
+func serveMetadata(server net.Conn, metadata []byte) {
+	const remoteID = 7
+
+	msg, err := ReadMessage(server)
+	if err != nil || msg.ID != MsgExtended {
+		return
+	}
+
+	_, payload, _ := ParseExtended(msg)
+	ours, err := ParseExtendedHandshake(payload)
+	if err != nil {
+		return
+	}
+
+	server.Write((&Message{ID: MsgUnchoke}).Serialize())
+	hs := fmt.Sprintf("d1:md11:ut_metadatai%dee13:metadata_sizei%dee", remoteID, len(metadata))
+	server.Write(NewExtended(ExtendedHandshakeID, []byte(hs)).Serialize())
+
+	for {
+		msg, err := ReadMessage(server)
+		if err != nil {
+			return
+		}
+
+		extID, payload, err := ParseExtended(msg)
+		if err != nil || extID != remoteID {
+			return
+		}
+
+		benc, _, _ := bencode.Decode(payload)
+		piece := int(benc.(bencode.BMap)[bencode.BString("piece")].(bencode.BInt64))
+
+		start := piece * metadataPieceLen
+		end := min(start+metadataPieceLen, len(metadata))
+		header := fmt.Sprintf("d8:msg_typei1e5:piecei%de10:total_sizei%dee", piece, len(metadata))
+		reply := append([]byte(header), metadata[start:end]...)
+		server.Write(NewExtended(byte(ours.M[UTMetadata]), reply).Serialize())
+	}
+}
+
+func TestRequestMetadata(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	metadata := testInfoDict(t)
+	require.Greater(t, len(metadata), metadataPieceLen)
+	require.LessOrEqual(t, len(metadata), 2*metadataPieceLen)
+
+	tests := []struct {
+		name     string
+		infoHash [20]byte
+		err      error
+	}{
+		{
+			name:     "matching info hash",
+			infoHash: sha1.Sum(metadata),
+		},
+		{
+			name:     "mismatched info hash",
+			infoHash: [20]byte{1},
+			err:      ErrMetadataHashMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+
+			conn := NewConn(client)
+			defer conn.Close()
+			conn.Remote.SetExtensions()
+
+			go serveMetadata(server, metadata)
+
+			info, err := RequestMetadata(conn, tt.infoHash)
+			if tt.err != nil {
+				require.True(t, errors.Is(err, tt.err))
+				return
+			}
+
+			require.Nil(t, err)
+			require.Equal(t, "metadata.bin", info.Name)
+			require.Len(t, info.Pieces, 1000)
+			require.Equal(t, tt.infoHash, info.InfoHash)
+			require.False(t, conn.PeerChoking)
+		})
+	}
+}
+
+func TestRequestMetadataNonCanonical(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// keys out of order and a zero padded int, a lenient decode takes both
+	metadata := []byte("d4:name12:metadata.bin6:lengthi016384e12:piece lengthi16384e6:pieces20:" + strings.Repeat("p", 20) + "e")
+	infoHash := sha1.Sum(metadata)
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	conn := NewConn(client)
+	defer conn.Close()
+	conn.Remote.SetExtensions()
+
+	go serveMetadata(server, metadata)
+
+	info, err := RequestMetadata(conn, infoHash)
+	require.Nil(t, err)
+	require.Equal(t, "metadata.bin", info.Name)
+	require.Equal(t, infoHash, info.InfoHash)
+}
+
+func TestRequestMetadataNotSupported(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	conn := NewConn(client)
+	defer conn.Close()
+
+	_, err := RequestMetadata(conn, [20]byte{})
+	require.True(t, errors.Is(err, ErrMetadataNotSupported))
+}
+
+func TestParseMetadataPiece(t *testing.T) {
+	piece, data, err := parseMetadataPiece([]byte("d8:msg_typei1e5:piecei3eeDATA"))
+	require.Nil(t, err)
+	require.Equal(t, 3, piece)
+	require.Equal(t, []byte("DATA"), data)
+
+	_, _, err = parseMetadataPiece([]byte("d8:msg_typei2e5:piecei3ee"))
+	require.True(t, errors.Is(err, ErrMetadataRejected))
+
+	_, _, err = parseMetadataPiece([]byte("d5:piecei3ee"))
+	require.True(t, errors.Is(err, ErrMalformedPayload))
+}
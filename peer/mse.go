@@ -0,0 +1,377 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// Message stream encryption, the obfuscation handshake many clients require
+// before the BitTorrent handshake. Both sides agree on a Diffie-Hellman secret
+// S, the initiator proves it knows the info hash without sending it in the
+// clear and the rest of the stream is RC4 keyed by S and the info hash.
+
+const (
+	CryptoPlaintext = 0x01
+	CryptoRC4       = 0x02
+
+	mseKeyLen    = 96
+	mseMaxPadLen = 512
+	// rc4Discard is how much keystream both sides throw away before use.
+	rc4Discard = 1024
+)
+
+var (
+	ErrMSEHandshake     = errors.New("encryption handshake failed")
+	ErrNoCryptoSelected = errors.New("no common crypto method")
+
+	mseP, _ = new(big.Int).SetString(
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+			"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+			"4FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseG = big.NewInt(2)
+
+	mseVC = make([]byte, 8)
+)
+
+type mseKey struct {
+	private *big.Int
+	public  []byte
+}
+
+func newMSEKey() (*mseKey, error) {
+	priv := make([]byte, 20)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, err
+	}
+	return mseKeyFromPrivate(new(big.Int).SetBytes(priv)), nil
+}
+
+func mseKeyFromPrivate(private *big.Int) *mseKey {
+	return &mseKey{private: private, public: padKey(new(big.Int).Exp(mseG, private, mseP))}
+}
+
+// padKey encodes n big endian in exactly mseKeyLen bytes.
+func padKey(n *big.Int) []byte {
+	return n.FillBytes(make([]byte, mseKeyLen))
+}
+
+// secret is S, the shared secret for the remote public key.
+func (k *mseKey) secret(remote []byte) []byte {
+	y := new(big.Int).SetBytes(remote)
+	return padKey(new(big.Int).Exp(y, k.private, mseP))
+}
+
+func mseHash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// mseCipher returns the RC4 stream for one direction, name is "keyA" for the
+// initiator's writes and "keyB" for the responder's.
+func mseCipher(name string, secret []byte, infoHash [20]byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(mseHash([]byte(name), secret, infoHash[:]))
+	discard := make([]byte, rc4Discard)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+func randomPad() ([]byte, error) {
+	n := make([]byte, 2)
+	if _, err := rand.Read(n); err != nil {
+		return nil, err
+	}
+
+	pad := make([]byte, int(binary.BigEndian.Uint16(n))%(mseMaxPadLen+1))
+	_, err := rand.Read(pad)
+	return pad, err
+}
+
+// encryptedConn is what the handshake hands back, reads go through the
+// buffered reader used during the handshake so nothing it read ahead is lost.
+// ia is the initiator's initial payload, already decrypted.
+type encryptedConn struct {
+	net.Conn
+	r   *bufio.Reader
+	ia  []byte
+	dec *rc4.Cipher
+	wmu sync.Mutex
+	enc *rc4.Cipher
+}
+
+func (c *encryptedConn) Read(p []byte) (int, error) {
+	if len(c.ia) > 0 {
+		n := copy(p, c.ia)
+		c.ia = c.ia[n:]
+		return n, nil
+	}
+
+	n, err := c.r.Read(p)
+	if c.dec != nil {
+		c.dec.XORKeyStream(p[:n], p[:n])
+	}
+	return n, err
+}
+
+func (c *encryptedConn) Write(p []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(p)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	buf := make([]byte, len(p))
+	c.enc.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
+
+// readUntil consumes r up to and including pattern, giving up once more than
+// max bytes were read without finding it.
+func readUntil(r *bufio.Reader, pattern []byte, max int) error {
+	window := make([]byte, 0, max)
+	for len(window) < max {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("sync pattern not found: %w", ErrMSEHandshake)
+}
+
+func readFull(r io.Reader, dec *rc4.Cipher, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if dec != nil {
+		dec.XORKeyStream(buf, buf)
+	}
+	return buf, nil
+}
+
+func selectCrypto(provided, allowed uint32) (uint32, error) {
+	switch {
+	case provided&allowed&CryptoRC4 != 0:
+		return CryptoRC4, nil
+	case provided&allowed&CryptoPlaintext != 0:
+		return CryptoPlaintext, nil
+	default:
+		return 0, ErrNoCryptoSelected
+	}
+}
+
+func (c *encryptedConn) use(crypto uint32) net.Conn {
+	if crypto == CryptoPlaintext {
+		c.enc, c.dec = nil, nil
+	}
+	return c
+}
+
+// InitiateEncrypted runs the initiator's side of the handshake on c, offering
+// the crypto methods in provide. The returned conn carries the BitTorrent
+// handshake and everything after it.
+func InitiateEncrypted(c net.Conn, infoHash [20]byte, provide uint32) (net.Conn, error) {
+	key, err := newMSEKey()
+	if err != nil {
+		return nil, err
+	}
+	return initiateEncrypted(c, infoHash, provide, key)
+}
+
+func initiateEncrypted(c net.Conn, infoHash [20]byte, provide uint32, key *mseKey) (net.Conn, error) {
+	padA, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(append(key.public, padA...)); err != nil {
+		return nil, fmt.Errorf("send public key: %w", err)
+	}
+
+	r := bufio.NewReader(c)
+	remote, err := readFull(r, nil, mseKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("read public key: %w", err)
+	}
+	secret := key.secret(remote)
+
+	ret := &encryptedConn{
+		Conn: c,
+		r:    r,
+		enc:  mseCipher("keyA", secret, infoHash),
+		dec:  mseCipher("keyB", secret, infoHash),
+	}
+
+	req := mseHash([]byte("req1"), secret)
+	req2 := mseHash([]byte("req2"), infoHash[:])
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range req2 {
+		req = append(req, req2[i]^req3[i])
+	}
+
+	// VC, crypto_provide, len(PadC) and len(IA), both pads and IA are empty.
+	body := make([]byte, 0, 16)
+	body = append(body, mseVC...)
+	body = binary.BigEndian.AppendUint32(body, provide)
+	body = binary.BigEndian.AppendUint16(body, 0)
+	body = binary.BigEndian.AppendUint16(body, 0)
+	ret.enc.XORKeyStream(body, body)
+	if _, err := c.Write(append(req, body...)); err != nil {
+		return nil, fmt.Errorf("send crypto provide: %w", err)
+	}
+
+	// The responder's VC is the first thing under keyB, we find where PadB
+	// ends by looking for it.
+	encVC := make([]byte, len(mseVC))
+	ret.dec.XORKeyStream(encVC, mseVC)
+	if err := readUntil(r, encVC, mseMaxPadLen+len(encVC)); err != nil {
+		return nil, err
+	}
+
+	reply, err := readFull(r, ret.dec, 6)
+	if err != nil {
+		return nil, fmt.Errorf("read crypto select: %w", err)
+	}
+	selected := binary.BigEndian.Uint32(reply)
+	if selected&provide == 0 || (selected != CryptoPlaintext && selected != CryptoRC4) {
+		return nil, fmt.Errorf("peer selected %#x: %w", selected, ErrNoCryptoSelected)
+	}
+	if _, err := readFull(r, ret.dec, int(binary.BigEndian.Uint16(reply[4:]))); err != nil {
+		return nil, fmt.Errorf("read pad: %w", err)
+	}
+
+	return ret.use(selected), nil
+}
+
+// AcceptEncrypted runs the responder's side of the handshake on an incoming
+// connection for infoHash, picking RC4 over plaintext among the methods in
+// allow that the initiator offers.
+func AcceptEncrypted(c net.Conn, infoHash [20]byte, allow uint32) (net.Conn, error) {
+	key, err := newMSEKey()
+	if err != nil {
+		return nil, err
+	}
+	return acceptEncrypted(c, infoHash, allow, key)
+}
+
+func acceptEncrypted(c net.Conn, infoHash [20]byte, allow uint32, key *mseKey) (net.Conn, error) {
+	r := bufio.NewReader(c)
+	remote, err := readFull(r, nil, mseKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("read public key: %w", err)
+	}
+	secret := key.secret(remote)
+
+	padB, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(append(key.public, padB...)); err != nil {
+		return nil, fmt.Errorf("send public key: %w", err)
+	}
+
+	req1 := mseHash([]byte("req1"), secret)
+	if err := readUntil(r, req1, mseMaxPadLen+len(req1)); err != nil {
+		return nil, err
+	}
+
+	skey, err := readFull(r, nil, sha1.Size)
+	if err != nil {
+		return nil, fmt.Errorf("read info hash: %w", err)
+	}
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range skey {
+		skey[i] ^= req3[i]
+	}
+	if !bytes.Equal(skey, mseHash([]byte("req2"), infoHash[:])) {
+		return nil, ErrInfoHashMismatch
+	}
+
+	ret := &encryptedConn{
+		Conn: c,
+		r:    r,
+		enc:  mseCipher("keyB", secret, infoHash),
+		dec:  mseCipher("keyA", secret, infoHash),
+	}
+
+	head, err := readFull(r, ret.dec, len(mseVC)+6)
+	if err != nil {
+		return nil, fmt.Errorf("read crypto provide: %w", err)
+	}
+	if !bytes.Equal(head[:len(mseVC)], mseVC) {
+		return nil, fmt.Errorf("bad verification constant: %w", ErrMSEHandshake)
+	}
+	provided := binary.BigEndian.Uint32(head[8:])
+	if _, err := readFull(r, ret.dec, int(binary.BigEndian.Uint16(head[12:]))); err != nil {
+		return nil, fmt.Errorf("read pad: %w", err)
+	}
+
+	// The initial payload is part of the stream, whatever the crypto choice
+	// it was sent encrypted.
+	iaLen, err := readFull(r, ret.dec, 2)
+	if err != nil {
+		return nil, fmt.Errorf("read initial payload: %w", err)
+	}
+	ia, err := readFull(r, ret.dec, int(binary.BigEndian.Uint16(iaLen)))
+	if err != nil {
+		return nil, fmt.Errorf("read initial payload: %w", err)
+	}
+
+	selected, err := selectCrypto(provided, allow)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 0, 14)
+	reply = append(reply, mseVC...)
+	reply = binary.BigEndian.AppendUint32(reply, selected)
+	reply = binary.BigEndian.AppendUint16(reply, 0)
+	ret.enc.XORKeyStream(reply, reply)
+	if _, err := c.Write(reply); err != nil {
+		return nil, fmt.Errorf("send crypto select: %w", err)
+	}
+
+	ret.ia = ia
+	return ret.use(selected), nil
+}
+
+// DialEncrypted connects to addr and runs the encryption handshake, offering
+// RC4 only. Pass the result to Connect for the BitTorrent handshake.
+func DialEncrypted(addr string, infoHash [20]byte) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial peer %s: %w", addr, err)
+	}
+
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	conn, err := InitiateEncrypted(c, infoHash, CryptoRC4)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("encryption handshake with %s: %w", addr, err)
+	}
+	return conn, nil
+}
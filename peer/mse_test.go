@@ -0,0 +1,175 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	require.Nil(t, err)
+	return b
+}
+
+func TestMSEKeyExchange(t *testing.T) {
+	a := mseKeyFromPrivate(new(big.Int).SetBytes(mustHex(t, "1234567890abcdef1234567890abcdef12345678")))
+	b := mseKeyFromPrivate(new(big.Int).SetBytes(mustHex(t, "fedcba0987654321fedcba0987654321fedcba09")))
+
+	require.Equal(t, mustHex(t, "c44386497c31c0f76d76479d03a6f40c0cdac6c9a709f493da2c7aa8adb2cbfa"+
+		"fe6b7833c0ded4ab5a310db1c2473066f1d3ef0a9e89f1093e7902f72337396d"+
+		"ab1d1276ab9e6d447b62e57de71ec5b528209d8fadff8cb9b0d393131aa4a722"), a.public)
+
+	secret := a.secret(b.public)
+	require.Equal(t, secret, b.secret(a.public))
+	require.Equal(t, mustHex(t, "7c1798a6ebab579cdd77e332bbab0901538801b6c73ec83c02a470e4d766ae98"+
+		"d8294d822827ecbac1c0bb7c6c7dea25eb6304393ac9c64e7963ef10cdb532c8"+
+		"9da9695e550ced358895ad66b16fae3831b600b2d0e0c032203962b5140224b8"), secret)
+
+	// Small keys keep the public key short, it is still padded to 96 bytes.
+	small := mseKeyFromPrivate(big.NewInt(3))
+	require.Len(t, small.public, mseKeyLen)
+	require.Equal(t, byte(8), small.public[mseKeyLen-1])
+}
+
+func TestMSEKeyDerivation(t *testing.T) {
+	secret := mseKeyFromPrivate(big.NewInt(3)).secret(mseKeyFromPrivate(big.NewInt(5)).public)
+	require.Equal(t, padKey(big.NewInt(1<<15)), secret)
+
+	var infoHash [20]byte
+	for i := range infoHash {
+		infoHash[i] = byte(i)
+	}
+
+	require.Equal(t, mustHex(t, "a61844364039cfe0feab10278ec6eb4e4f02e7e8"), mseHash([]byte("req1"), secret))
+	require.Equal(t, mustHex(t, "6e8d0e277529f137cefb993795a218527420a0ac"), mseHash([]byte("keyA"), secret, infoHash[:]))
+	require.Equal(t, mustHex(t, "e8b9afaa832c77f45befa958173ff8e543707924"), mseHash([]byte("keyB"), secret, infoHash[:]))
+
+	// The keystream right after the discarded 1024 bytes, which is what the
+	// verification constant is encrypted with.
+	for name, expected := range map[string]string{"keyA": "6e7003e10a32dc64", "keyB": "aed022087fd6eb89"} {
+		vc := make([]byte, len(mseVC))
+		mseCipher(name, secret, infoHash).XORKeyStream(vc, mseVC)
+		require.Equal(t, mustHex(t, expected), vc, name)
+	}
+}
+
+// tappedConn records what is written on the wire.
+type tappedConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *tappedConn) Write(p []byte) (int, error) {
+	c.written.Write(p)
+	return c.Conn.Write(p)
+}
+
+func runEncryptedHandshake(t *testing.T, infoHash, acceptHash [20]byte, provide, allow uint32) (net.Conn, net.Conn, *tappedConn, error, error) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	tap := &tappedConn{Conn: client}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := AcceptEncrypted(server, acceptHash, allow)
+		if err != nil {
+			server.Close()
+		}
+		accepted <- result{conn, err}
+	}()
+
+	conn, err := InitiateEncrypted(tap, infoHash, provide)
+	if err != nil {
+		client.Close()
+	}
+	r := <-accepted
+	return conn, r.conn, tap, err, r.err
+}
+
+func TestEncryptedHandshake(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	handshake := NewHandshake(infoHash, [20]byte{4, 5, 6}).Serialize()
+
+	for name, tc := range map[string]struct {
+		provide, allow uint32
+		encrypted      bool
+	}{
+		"rc4":                {CryptoRC4, CryptoRC4 | CryptoPlaintext, true},
+		"prefers rc4":        {CryptoRC4 | CryptoPlaintext, CryptoRC4 | CryptoPlaintext, true},
+		"plaintext selected": {CryptoRC4 | CryptoPlaintext, CryptoPlaintext, false},
+	} {
+		a, b, tap, errA, errB := runEncryptedHandshake(t, infoHash, infoHash, tc.provide, tc.allow)
+		require.Nil(t, errA, name)
+		require.Nil(t, errB, name)
+
+		tap.written.Reset()
+		go a.Write(handshake)
+		got := make([]byte, len(handshake))
+		_, err := io.ReadFull(b, got)
+		require.Nil(t, err)
+		require.Equal(t, handshake, got, name)
+		require.Equal(t, tc.encrypted, !bytes.Equal(handshake, tap.written.Bytes()), name)
+
+		go b.Write([]byte("pong"))
+		got = make([]byte, 4)
+		_, err = io.ReadFull(a, got)
+		require.Nil(t, err)
+		require.Equal(t, "pong", string(got), name)
+	}
+}
+
+func TestEncryptedHandshakeFailures(t *testing.T) {
+	_, _, _, _, err := runEncryptedHandshake(t, [20]byte{1}, [20]byte{2}, CryptoRC4, CryptoRC4)
+	require.True(t, errors.Is(err, ErrInfoHashMismatch))
+
+	_, _, _, _, err = runEncryptedHandshake(t, [20]byte{1}, [20]byte{1}, CryptoPlaintext, CryptoRC4)
+	require.True(t, errors.Is(err, ErrNoCryptoSelected))
+}
+
+func TestDialEncrypted(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	infoHash := [20]byte{7}
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		conn, err := AcceptEncrypted(c, infoHash, CryptoRC4)
+		if err != nil {
+			return
+		}
+		h, err := ReadHandshake(conn)
+		if err != nil {
+			return
+		}
+		conn.Write(NewHandshake(h.InfoHash, [20]byte{9}).Serialize())
+		io.Copy(io.Discard, conn)
+	}()
+
+	c, err := DialEncrypted(ln.Addr().String(), infoHash)
+	require.Nil(t, err)
+	defer c.Close()
+
+	conn, err := Connect(c, NewHandshake(infoHash, [20]byte{8}))
+	require.Nil(t, err)
+	require.Equal(t, [20]byte{9}, conn.Remote.PeerID)
+}
@@ -0,0 +1,124 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/skirtan1/bittorrent-client/bencode"
+	"github.com/skirtan1/bittorrent-client/tracker"
+)
+
+const (
+	UTPex        = "ut_pex"
+	LocalUTPexID = 2
+)
+
+type PexPeer struct {
+	tracker.Peer
+	Flags byte
+}
+
+type Pex struct {
+	Added   []PexPeer
+	Dropped []tracker.Peer
+}
+
+func pexPeers(dict bencode.BMap, key string, parse func([]byte) ([]tracker.Peer, error)) ([]PexPeer, error) {
+	compact, ok := dict[bencode.BString(key)].(bencode.BString)
+	if !ok {
+		return nil, nil
+	}
+
+	peers, err := parse(compact.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("pex %s: %w", key, err)
+	}
+
+	flags, _ := dict[bencode.BString(key+".f")].(bencode.BString)
+	ret := make([]PexPeer, 0, len(peers))
+	for i, p := range peers {
+		pp := PexPeer{Peer: p}
+		if i < len(flags) {
+			pp.Flags = flags[i]
+		}
+		ret = append(ret, pp)
+	}
+	return ret, nil
+}
+
+func ParsePex(payload []byte) (*Pex, error) {
+	benc, _, err := bencode.DecodeWithOptions(context.Background(), payload, bencode.LenientOptions())
+	if err != nil {
+		return nil, fmt.Errorf("decode pex: %w", err)
+	}
+
+	dict, ok := benc.(bencode.BMap)
+	if !ok {
+		return nil, fmt.Errorf("pex not a dict: %w", ErrMalformedPayload)
+	}
+
+	ret := Pex{}
+	for _, f := range []struct {
+		key   string
+		parse func([]byte) ([]tracker.Peer, error)
+	}{
+		{"added", tracker.ParseCompactPeers},
+		{"added6", tracker.ParseCompactPeers6},
+	} {
+		peers, err := pexPeers(dict, f.key, f.parse)
+		if err != nil {
+			return nil, err
+		}
+		ret.Added = append(ret.Added, peers...)
+	}
+
+	for _, f := range []struct {
+		key   string
+		parse func([]byte) ([]tracker.Peer, error)
+	}{
+		{"dropped", tracker.ParseCompactPeers},
+		{"dropped6", tracker.ParseCompactPeers6},
+	} {
+		peers, err := pexPeers(dict, f.key, f.parse)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range peers {
+			ret.Dropped = append(ret.Dropped, p.Peer)
+		}
+	}
+
+	return &ret, nil
+}
+
+func NewPex(extID int, added []PexPeer, dropped []tracker.Peer) (*Message, error) {
+	// Each flag goes in with its peer, so peers CompactPeers leaves out
+	// don't shift the flags of the ones after them.
+	var added4, added6, flags4, flags6 []byte
+	for _, p := range added {
+		v4, v6 := tracker.CompactPeers([]tracker.Peer{p.Peer})
+		if len(v4) > 0 {
+			added4 = append(added4, v4...)
+			flags4 = append(flags4, p.Flags)
+		} else if len(v6) > 0 {
+			added6 = append(added6, v6...)
+			flags6 = append(flags6, p.Flags)
+		}
+	}
+
+	dropped4, dropped6 := tracker.CompactPeers(dropped)
+
+	enc, err := bencode.Encode(bencode.BMap{
+		bencode.BString("added"):    bencode.BString(added4),
+		bencode.BString("added.f"):  bencode.BString(flags4),
+		bencode.BString("added6"):   bencode.BString(added6),
+		bencode.BString("added6.f"): bencode.BString(flags6),
+		bencode.BString("dropped"):  bencode.BString(dropped4),
+		bencode.BString("dropped6"): bencode.BString(dropped6),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encode pex: %w", err)
+	}
+
+	return NewExtended(byte(extID), enc), nil
+}
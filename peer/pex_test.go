@@ -0,0 +1,92 @@
+package peer
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/skirtan1/bittorrent-client/tracker"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePex(t *testing.T) {
+	added := "\x0a\x00\x00\x01\x1a\xe1" + "\xc0\xa8\x01\x02\x00\x50"
+	added6 := "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\xc8\xd5"
+	dropped := "\x0a\x00\x00\x09\x1a\xe1"
+	payload := "d5:added12:" + added + "7:added.f2:\x12\x00" +
+		"6:added618:" + added6 + "8:added6.f1:\x01" +
+		"7:dropped6:" + dropped + "e"
+
+	pex, err := ParsePex([]byte(payload))
+	require.Nil(t, err)
+
+	require.Len(t, pex.Added, 3)
+	require.Equal(t, "10.0.0.1:6881", pex.Added[0].String())
+	require.Equal(t, byte(0x12), pex.Added[0].Flags)
+	require.Equal(t, "192.168.1.2:80", pex.Added[1].String())
+	require.Equal(t, byte(0x00), pex.Added[1].Flags)
+	require.Equal(t, "[2001:db8::1]:51413", pex.Added[2].String())
+	require.Equal(t, byte(0x01), pex.Added[2].Flags)
+
+	require.Len(t, pex.Dropped, 1)
+	require.Equal(t, "10.0.0.9:6881", pex.Dropped[0].String())
+}
+
+func TestParsePexMalformed(t *testing.T) {
+	_, err := ParsePex([]byte("d5:added5:abcdee"))
+	require.True(t, errors.Is(err, tracker.ErrMalformedPeers))
+
+	_, err = ParsePex([]byte("le"))
+	require.True(t, errors.Is(err, ErrMalformedPayload))
+}
+
+func TestPexRoundTrip(t *testing.T) {
+	added := []PexPeer{
+		{Peer: tracker.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}, Flags: 0x10},
+		{Peer: tracker.Peer{IP: net.ParseIP("2001:db8::1"), Port: 51413}, Flags: 0x02},
+	}
+	dropped := []tracker.Peer{{IP: net.IP{10, 0, 0, 9}, Port: 6881}}
+
+	msg, err := NewPex(LocalUTPexID, added, dropped)
+	require.Nil(t, err)
+
+	extID, payload, err := ParseExtended(msg)
+	require.Nil(t, err)
+	require.Equal(t, byte(LocalUTPexID), extID)
+
+	pex, err := ParsePex(payload)
+	require.Nil(t, err)
+	require.Len(t, pex.Added, 2)
+	require.Equal(t, "10.0.0.1:6881", pex.Added[0].String())
+	require.Equal(t, byte(0x10), pex.Added[0].Flags)
+	require.Equal(t, "[2001:db8::1]:51413", pex.Added[1].String())
+	require.Equal(t, byte(0x02), pex.Added[1].Flags)
+	require.Len(t, pex.Dropped, 1)
+	require.Equal(t, "10.0.0.9:6881", pex.Dropped[0].String())
+}
+
+func TestPexSkipsInvalidPeers(t *testing.T) {
+	added := []PexPeer{
+		{Peer: tracker.Peer{IP: nil, Port: 1}, Flags: 0x01},
+		{Peer: tracker.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}, Flags: 0x10},
+		{Peer: tracker.Peer{IP: net.IP{1, 2, 3}, Port: 2}, Flags: 0x04},
+		{Peer: tracker.Peer{IP: net.ParseIP("2001:db8::1"), Port: 51413}, Flags: 0x02},
+		{Peer: tracker.Peer{IP: net.ParseIP("2001:db8::2"), Port: 51414}, Flags: 0x08},
+	}
+
+	msg, err := NewPex(LocalUTPexID, added, nil)
+	require.Nil(t, err)
+
+	_, payload, err := ParseExtended(msg)
+	require.Nil(t, err)
+	pex, err := ParsePex(payload)
+	require.Nil(t, err)
+
+	require.Len(t, pex.Added, 3)
+	require.Equal(t, "10.0.0.1:6881", pex.Added[0].String())
+	require.Equal(t, byte(0x10), pex.Added[0].Flags)
+	require.Equal(t, "[2001:db8::1]:51413", pex.Added[1].String())
+	require.Equal(t, byte(0x02), pex.Added[1].Flags)
+	require.Equal(t, "[2001:db8::2]:51414", pex.Added[2].String())
+	require.Equal(t, byte(0x08), pex.Added[2].Flags)
+}
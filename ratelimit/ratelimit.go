@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket refilled at a fixed number of bytes per second
+// with a burst of one second. A nil Limiter or a rate of 0 is unlimited, and
+// one Limiter can be shared by any number of readers and writers.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(bytesPerSec int) *Limiter {
+	return &Limiter{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// WaitN blocks until n bytes may be transferred or ctx is done.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || l.rate <= 0 || n <= 0 {
+		return nil
+	}
+
+	wait := l.reserve(n)
+	if wait == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type reader struct {
+	r io.Reader
+	l *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if waitErr := r.l.WaitN(context.Background(), n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+type writer struct {
+	w io.Writer
+	l *Limiter
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.l.WaitN(context.Background(), len(p)); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	if l == nil || l.rate <= 0 {
+		return r
+	}
+	return &reader{r: r, l: l}
+}
+
+func (l *Limiter) Writer(w io.Writer) io.Writer {
+	if l == nil || l.rate <= 0 {
+		return w
+	}
+	return &writer{w: w, l: l}
+}
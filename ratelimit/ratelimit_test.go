@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitedWriterRate(t *testing.T) {
+	const rate = 200_000
+
+	l := NewLimiter(rate)
+	w := l.Writer(io.Discard)
+
+	chunk := make([]byte, 10_000)
+	start := time.Now()
+	for i := 0; i < 40; i += 1 {
+		_, err := w.Write(chunk)
+		require.Nil(t, err)
+	}
+	elapsed := time.Since(start)
+
+	expected := time.Second
+	require.InDelta(t, expected.Seconds(), elapsed.Seconds(), 0.2)
+}
+
+func TestLimiterSharedAcrossWriters(t *testing.T) {
+	const rate = 200_000
+
+	l := NewLimiter(rate)
+	chunk := make([]byte, 10_000)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := l.Writer(io.Discard)
+			for j := 0; j < 10; j += 1 {
+				w.Write(chunk)
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.InDelta(t, 1.0, time.Since(start).Seconds(), 0.2)
+}
+
+func TestLimitedReader(t *testing.T) {
+	l := NewLimiter(100_000)
+	r := l.Reader(bytes.NewReader(make([]byte, 150_000)))
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, r)
+	require.Nil(t, err)
+	require.Equal(t, int64(150_000), n)
+	require.InDelta(t, 0.5, time.Since(start).Seconds(), 0.2)
+}
+
+func TestUnlimited(t *testing.T) {
+	var buf bytes.Buffer
+	require.Equal(t, io.Writer(&buf), NewLimiter(0).Writer(&buf))
+
+	var l *Limiter
+	require.Equal(t, io.Writer(&buf), l.Writer(&buf))
+	require.Nil(t, l.WaitN(context.Background(), 1<<30))
+}
+
+func TestWaitNCanceled(t *testing.T) {
+	l := NewLimiter(10)
+	require.Nil(t, l.WaitN(context.Background(), 10))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := l.WaitN(ctx, 1000)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+}
@@ -0,0 +1,34 @@
+package torrent
+
+type Bitfield []byte
+
+func NewBitfield(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
+func (bf Bitfield) HasPiece(index int) bool {
+	byteIndex := index / 8
+	offset := index % 8
+	if index < 0 || byteIndex >= len(bf) {
+		return false
+	}
+	return bf[byteIndex]>>(7-offset)&1 != 0
+}
+
+func (bf Bitfield) SetPiece(index int) {
+	byteIndex := index / 8
+	offset := index % 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] |= 1 << (7 - offset)
+}
+
+func (bf Bitfield) ClearPiece(index int) {
+	byteIndex := index / 8
+	offset := index % 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] &^= 1 << (7 - offset)
+}
@@ -0,0 +1,26 @@
+package torrent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitfield(t *testing.T) {
+	bf := NewBitfield(10)
+	require.Len(t, bf, 2)
+
+	for _, i := range []int{0, 7, 9} {
+		bf.SetPiece(i)
+	}
+
+	require.Equal(t, Bitfield{0b10000001, 0b01000000}, bf)
+	for i := 0; i < 10; i += 1 {
+		require.Equal(t, i == 0 || i == 7 || i == 9, bf.HasPiece(i), "piece %d", i)
+	}
+
+	require.False(t, bf.HasPiece(-1))
+	require.False(t, bf.HasPiece(16))
+	bf.SetPiece(16)
+	require.Equal(t, Bitfield{0b10000001, 0b01000000}, bf)
+}
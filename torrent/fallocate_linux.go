@@ -0,0 +1,10 @@
+package torrent
+
+import (
+	"os"
+	"syscall"
+)
+
+func fallocate(file *os.File, length int64) error {
+	return syscall.Fallocate(int(file.Fd()), 0, 0, length)
+}
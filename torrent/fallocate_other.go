@@ -0,0 +1,12 @@
+//go:build !linux
+
+package torrent
+
+import (
+	"errors"
+	"os"
+)
+
+func fallocate(file *os.File, length int64) error {
+	return errors.ErrUnsupported
+}
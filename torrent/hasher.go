@@ -0,0 +1,130 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// PieceHasher hashes a piece as its blocks arrive, so the piece never has to
+// be held in memory whole. Blocks must be written in order.
+type PieceHasher struct {
+	h hash.Hash
+}
+
+func NewPieceHasher() *PieceHasher {
+	return &PieceHasher{h: sha1.New()}
+}
+
+// PieceHasher returns a hasher using the info's PieceHash.
+func (i Info) PieceHasher() *PieceHasher {
+	return &PieceHasher{h: i.newPieceHash()}
+}
+
+func (p *PieceHasher) Write(b []byte) (int, error) {
+	return p.h.Write(b)
+}
+
+// Verify reports whether everything written since the last Reset hashes to
+// expected.
+func (p *PieceHasher) Verify(expected [20]byte) bool {
+	return bytes.Equal(p.h.Sum(nil), expected[:])
+}
+
+// Reset clears the hasher for the next piece.
+func (p *PieceHasher) Reset() {
+	p.h.Reset()
+}
+
+// HashPieces reads r to the end and returns the SHA-1 of every pieceLength
+// chunk of it, the last one possibly short. It is the slow part of creating a
+// torrent from large files: r is read sequentially while up to GOMAXPROCS
+// pieces are hashed at once, holding at most twice that many pieces in memory.
+func HashPieces(r io.Reader, pieceLength int64) ([][20]byte, error) {
+	if pieceLength <= 0 {
+		return nil, fmt.Errorf("piece length %d: %w", pieceLength, ErrPieceLengthOutOfRange)
+	}
+
+	type job struct {
+		index int
+		buf   []byte
+	}
+	type result struct {
+		index int
+		sum   [20]byte
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	maxBuffers := 2 * workers
+	// every buffer ever allocated fits, so returning one never blocks
+	free := make(chan []byte, maxBuffers)
+	jobs := make(chan job)
+	results := make(chan result, workers)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results <- result{index: j.index, sum: sha1.Sum(j.buf)}
+				free <- j.buf[:cap(j.buf)]
+			}
+		}()
+	}
+
+	var ret [][20]byte
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for r := range results {
+			if r.index >= len(ret) {
+				ret = append(ret, make([][20]byte, r.index+1-len(ret))...)
+			}
+			ret[r.index] = r.sum
+		}
+	}()
+
+	var readErr error
+	allocated := 0
+	for index := 0; ; index += 1 {
+		var buf []byte
+		select {
+		case buf = <-free:
+		default:
+			if allocated < maxBuffers {
+				buf = make([]byte, pieceLength)
+				allocated += 1
+			} else {
+				buf = <-free
+			}
+		}
+
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			jobs <- job{index: index, buf: buf[:n]}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			readErr = fmt.Errorf("hash pieces: %w", err)
+			break
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+	close(results)
+	<-collected
+
+	if readErr != nil {
+		return nil, readErr
+	}
+	return ret, nil
+}
@@ -0,0 +1,136 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"hash"
+	"io"
+	"math/rand/v2"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPieceHasher(t *testing.T) {
+	piece := bytes.Repeat([]byte("0123456789"), 5000)
+	expected := sha1.Sum(piece)
+
+	h := NewPieceHasher()
+	for _, block := range [][]byte{piece[:16384], piece[16384:32768], piece[32768:]} {
+		n, err := h.Write(block)
+		require.Nil(t, err)
+		require.Equal(t, len(block), n)
+	}
+	require.True(t, h.Verify(expected))
+	// Verify doesn't consume the state.
+	require.True(t, h.Verify(expected))
+
+	h.Reset()
+	h.Write(piece[1:])
+	require.False(t, h.Verify(expected))
+
+	h.Reset()
+	h.Write(piece)
+	require.True(t, h.Verify(expected))
+}
+
+// xorHash folds its input into 20 bytes, so swapping bytes 20 apart keeps
+// the sum, which makes colliding pieces easy to build.
+type xorHash struct {
+	sum [20]byte
+	n   int
+}
+
+func (h *xorHash) Write(p []byte) (int, error) {
+	for _, b := range p {
+		h.sum[h.n%len(h.sum)] ^= b
+		h.n += 1
+	}
+	return len(p), nil
+}
+
+func (h *xorHash) Sum(b []byte) []byte { return append(b, h.sum[:]...) }
+func (h *xorHash) Reset()              { *h = xorHash{} }
+func (h *xorHash) Size() int           { return len(h.sum) }
+func (h *xorHash) BlockSize() int      { return 1 }
+
+func TestPieceHash(t *testing.T) {
+	piece := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	h := &xorHash{}
+	h.Write(piece)
+
+	info := Info{Pieces: [][20]byte{[20]byte(h.Sum(nil))}, PieceHash: func() hash.Hash { return &xorHash{} }}
+	require.True(t, info.VerifyPiece(0, piece))
+
+	// Bytes 0 and 20 trade places, SHA-1 would notice but the xor sum can't.
+	collision := bytes.Clone(piece)
+	collision[0], collision[20] = collision[20], collision[0]
+	require.True(t, info.VerifyPiece(0, collision))
+	require.False(t, info.VerifyPiece(0, piece[1:]))
+
+	hasher := info.PieceHasher()
+	hasher.Write(collision[:10])
+	hasher.Write(collision[10:])
+	require.True(t, hasher.Verify(info.Pieces[0]))
+
+	info.PieceHash = nil
+	require.False(t, info.VerifyPiece(0, piece))
+}
+
+func hashPiecesSequential(data []byte, pieceLength int) [][20]byte {
+	var ret [][20]byte
+	for off := 0; off < len(data); off += pieceLength {
+		ret = append(ret, sha1.Sum(data[off:min(off+pieceLength, len(data))]))
+	}
+	return ret
+}
+
+func TestHashPieces(t *testing.T) {
+	const pieceLength = 16384
+
+	data := make([]byte, 40*pieceLength+1000)
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range data {
+		data[i] = byte(rng.Uint32())
+	}
+
+	for _, size := range []int{0, 1, pieceLength, 40 * pieceLength, len(data)} {
+		// short reads must not split pieces
+		got, err := HashPieces(iotest.HalfReader(bytes.NewReader(data[:size])), pieceLength)
+		require.Nil(t, err)
+		require.Equal(t, hashPiecesSequential(data[:size], pieceLength), got)
+	}
+
+	_, err := HashPieces(bytes.NewReader(data), 0)
+	require.True(t, errors.Is(err, ErrPieceLengthOutOfRange))
+
+	readErr := errors.New("disk gone")
+	_, err = HashPieces(io.MultiReader(bytes.NewReader(data[:3*pieceLength]), &failingReader{readErr}), pieceLength)
+	require.True(t, errors.Is(err, readErr))
+}
+
+type failingReader struct{ err error }
+
+func (r *failingReader) Read([]byte) (int, error) { return 0, r.err }
+
+func BenchmarkHashPieces(b *testing.B) {
+	const pieceLength = 256 << 10
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<20/16)
+
+	b.Run("parallel", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for range b.N {
+			if _, err := HashPieces(bytes.NewReader(data), pieceLength); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("sequential", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for range b.N {
+			hashPiecesSequential(data, pieceLength)
+		}
+	})
+}
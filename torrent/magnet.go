@@ -0,0 +1,79 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const btihPrefix = "urn:btih:"
+
+var (
+	ErrInvalidMagnet   = errors.New("not a bittorrent magnet link")
+	ErrInvalidInfoHash = errors.New("info hash should be 40 hex or 32 base32 characters")
+)
+
+// Magnet is what a magnet link says about a torrent, enough to fetch its info
+// dict from peers. Check the fetched info with VerifyInfoHash.
+type Magnet struct {
+	InfoHash [20]byte
+	// Name is the display name, empty when the link has none.
+	Name     string
+	Trackers []string
+}
+
+// ParseMagnet parses a magnet link with a v1 "urn:btih:" exact topic, the
+// info hash in either its hex or its base32 form.
+func ParseMagnet(link string) (*Magnet, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, fmt.Errorf("parse magnet: %w: %w", ErrInvalidMagnet, err)
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("scheme %q: %w", u.Scheme, ErrInvalidMagnet)
+	}
+
+	params := u.Query()
+	ret := Magnet{Name: params.Get("dn"), Trackers: params["tr"]}
+
+	// Links for hybrid torrents carry a btmh topic too, only btih is used.
+	for _, xt := range params["xt"] {
+		if len(xt) < len(btihPrefix) || !strings.EqualFold(xt[:len(btihPrefix)], btihPrefix) {
+			continue
+		}
+
+		ret.InfoHash, err = ParseInfoHash(xt[len(btihPrefix):])
+		if err != nil {
+			return nil, fmt.Errorf("parse magnet: %w", err)
+		}
+		return &ret, nil
+	}
+
+	return nil, fmt.Errorf("no btih exact topic: %w", ErrInvalidMagnet)
+}
+
+// ParseInfoHash decodes an info hash written as 40 hex characters or as 32
+// base32 characters, either case.
+func ParseInfoHash(s string) ([20]byte, error) {
+	var ret [20]byte
+
+	var decoded []byte
+	var err error
+	switch len(s) {
+	case hex.EncodedLen(len(ret)):
+		decoded, err = hex.DecodeString(s)
+	case base32.StdEncoding.EncodedLen(len(ret)):
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return ret, fmt.Errorf("info hash %q has %d characters: %w", s, len(s), ErrInvalidInfoHash)
+	}
+	if err != nil {
+		return ret, fmt.Errorf("info hash %q: %w", s, ErrInvalidInfoHash)
+	}
+
+	copy(ret[:], decoded)
+	return ret, nil
+}
@@ -0,0 +1,60 @@
+package torrent
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMagnet(t *testing.T) {
+	expected := [20]byte{0xc9, 0xe1, 0x57, 0x63, 0xf7, 0x22, 0xf2, 0x3e, 0x98, 0xa2, 0x9d, 0xec, 0xdf, 0xae, 0x34, 0x1b, 0x98, 0xd5, 0x30, 0x56}
+
+	tests := []struct {
+		name string
+		link string
+		err  error
+	}{
+		{name: "hex", link: "magnet:?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056"},
+		{name: "upper case hex", link: "magnet:?xt=urn:btih:C9E15763F722F23E98A29DECDFAE341B98D53056"},
+		{name: "base32", link: "magnet:?xt=urn:btih:ZHQVOY7XELZD5GFCTXWN7LRUDOMNKMCW"},
+		{name: "lower case base32", link: "magnet:?xt=urn:btih:zhqvoy7xelzd5gfctxwn7lrudomnkmcw"},
+		{name: "truncated hex", link: "magnet:?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d5305", err: ErrInvalidInfoHash},
+		{name: "too long hex", link: "magnet:?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d5305600", err: ErrInvalidInfoHash},
+		{name: "non hex", link: "magnet:?xt=urn:btih:g9e15763f722f23e98a29decdfae341b98d53056", err: ErrInvalidInfoHash},
+		{name: "non base32", link: "magnet:?xt=urn:btih:1HQVOY7XELZD5GFCTXWN7LRUDOMNKMC0", err: ErrInvalidInfoHash},
+		{name: "garbage", link: "magnet:?xt=urn:btih:not-an-info-hash", err: ErrInvalidInfoHash},
+		{name: "empty hash", link: "magnet:?xt=urn:btih:", err: ErrInvalidInfoHash},
+		{name: "no btih", link: "magnet:?xt=urn:sha1:c9e15763f722f23e98a29decdfae341b98d53056", err: ErrInvalidMagnet},
+		{name: "not a magnet", link: "http://example.com/?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056", err: ErrInvalidMagnet},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := ParseMagnet(tt.link)
+			if tt.err != nil {
+				require.True(t, errors.Is(err, tt.err), "%v", err)
+				return
+			}
+			require.Nil(t, err)
+			require.Equal(t, expected, m.InfoHash)
+		})
+	}
+}
+
+func TestParseMagnetParams(t *testing.T) {
+	m, err := ParseMagnet("magnet:?xt=urn:btmh:1220abcd&xt=urn:btih:000102030405060708090a0b0c0d0e0f10111213" +
+		"&dn=some+name&tr=http%3A%2F%2Ftracker.example%2Fannounce&tr=udp%3A%2F%2Fother.example%3A80")
+	require.Nil(t, err)
+	require.Equal(t, [20]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}, m.InfoHash)
+	require.Equal(t, "some name", m.Name)
+	require.Equal(t, []string{"http://tracker.example/announce", "udp://other.example:80"}, m.Trackers)
+
+	// both encodings of the same hash agree
+	info := Info{InfoHash: m.InfoHash}
+	fromHex, err := ParseInfoHash(info.InfoHashHex())
+	require.Nil(t, err)
+	fromBase32, err := ParseInfoHash(info.InfoHashBase32())
+	require.Nil(t, err)
+	require.Equal(t, fromHex, fromBase32)
+}
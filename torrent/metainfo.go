@@ -1,24 +1,81 @@
 package torrent
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log/slog"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/skirtan1/bittorrent-client/bencode"
 )
 
 type MetaInfo struct {
 	Announce string
-	Info     Info
+	// AnnounceList holds the BEP 12 tiers of trackers, nil when the torrent
+	// only has Announce.
+	AnnounceList [][]string
+	Info         Info
+	Nodes        []NodeAddr
+}
+
+// AllTrackers returns Announce followed by every tracker of AnnounceList in
+// tier order, without duplicates or empty URLs.
+func (m MetaInfo) AllTrackers() []string {
+	seen := make(map[string]bool)
+	ret := make([]string, 0)
+	add := func(url string) {
+		if url == "" || seen[url] {
+			return
+		}
+		seen[url] = true
+		ret = append(ret, url)
+	}
+
+	add(m.Announce)
+	for _, tier := range m.AnnounceList {
+		for _, url := range tier {
+			add(url)
+		}
+	}
+	return ret
+}
+
+// SameContent reports whether other describes the same content, whatever its
+// trackers, nodes or other fields outside the info dict say. Infos without an
+// info hash are never the same content.
+func (m MetaInfo) SameContent(other *MetaInfo) bool {
+	return other != nil && m.Info.InfoHash != [20]byte{} && m.Info.InfoHash == other.Info.InfoHash
+}
+
+// Equal reports whether other has the same trackers, nodes and info as m.
+func (m MetaInfo) Equal(other *MetaInfo) bool {
+	return other != nil &&
+		m.Announce == other.Announce &&
+		slices.EqualFunc(m.AnnounceList, other.AnnounceList, slices.Equal) &&
+		slices.Equal(m.Nodes, other.Nodes) &&
+		m.Info.Equal(&other.Info)
+}
+
+type NodeAddr struct {
+	Host string
+	Port int
 }
 
 type File struct {
 	Length int64
 	Path   string
+	MD5Sum string
 }
 
 type Info struct {
@@ -28,17 +85,253 @@ type Info struct {
 	Length      int64
 	FilesInfo   []*File
 	InfoHash    [20]byte
+	// MetaVersion is 2 for hybrid torrents, the ones with a BEP 52 file
+	// tree. Their files and pieces are still read from the v1 keys.
+	MetaVersion int
+	UTF8Name    string
+	// Source is the tracker tag some private trackers add to the info dict,
+	// it changes InfoHash so the same content can't be cross-seeded.
+	Source string
+
+	// PieceHash builds the hash pieces are checked against, nil means SHA-1
+	// as the spec requires. Tests can set a trivial hash to craft pieces.
+	PieceHash func() hash.Hash
+
+	// fileOffsets caches FileOffsets for infos built by DecodeInfoFromBencode.
+	fileOffsets []int64
+}
+
+// Equal reports whether other has the same fields as i. PieceHash can't be
+// compared and is ignored.
+func (i Info) Equal(other *Info) bool {
+	return other != nil &&
+		i.Name == other.Name &&
+		i.PieceLength == other.PieceLength &&
+		slices.Equal(i.Pieces, other.Pieces) &&
+		i.Length == other.Length &&
+		slices.EqualFunc(i.FilesInfo, other.FilesInfo, func(a, b *File) bool { return *a == *b }) &&
+		i.InfoHash == other.InfoHash &&
+		i.MetaVersion == other.MetaVersion &&
+		i.UTF8Name == other.UTF8Name &&
+		i.Source == other.Source
+}
+
+func (i Info) IsMultiFile() bool {
+	return len(i.FilesInfo) > 0
+}
+
+func (i Info) Files() []File {
+	if !i.IsMultiFile() {
+		return []File{{Length: i.Length, Path: i.Name}}
+	}
+
+	ret := make([]File, 0, len(i.FilesInfo))
+	for _, f := range i.FilesInfo {
+		ret = append(ret, *f)
+	}
+	return ret
+}
+
+// FileOffsets returns the offset in the torrent's content at which each file
+// of Files starts. Decoded infos compute it once and share the slice, callers
+// must not modify it.
+func (i Info) FileOffsets() []int64 {
+	if i.fileOffsets != nil {
+		return i.fileOffsets
+	}
+	return i.computeFileOffsets()
+}
+
+// FileAtOffset returns the file holding the byte at off in the torrent's
+// content and off relative to the start of that file. Zero length files hold
+// no bytes so they are never returned, the file after them is.
+func (i Info) FileAtOffset(off int64) (fileIndex int, fileOff int64, err error) {
+	if off < 0 || off >= i.TotalLength() {
+		return 0, 0, fmt.Errorf("file at offset %d: %w", off, ErrOutOfBounds)
+	}
+
+	// zero length files start where the next file does, the last file
+	// starting at or before off is the one holding it.
+	offsets := i.FileOffsets()
+	fileIndex = sort.Search(len(offsets), func(j int) bool { return offsets[j] > off }) - 1
+	return fileIndex, off - offsets[fileIndex], nil
+}
+
+func (i Info) computeFileOffsets() []int64 {
+	files := i.Files()
+	ret := make([]int64, len(files))
+	for j := 1; j < len(files); j += 1 {
+		ret[j] = ret[j-1] + files[j-1].Length
+	}
+	return ret
+}
+
+func (i Info) TotalLength() int64 {
+	var total int64
+	for _, f := range i.Files() {
+		total += f.Length
+	}
+	return total
+}
+
+func (i Info) PieceSize(index int) int64 {
+	if index < 0 || index >= len(i.Pieces) {
+		return 0
+	}
+
+	if index == len(i.Pieces)-1 {
+		return i.TotalLength() - int64(index)*i.PieceLength
+	}
+	return i.PieceLength
+}
+
+func (i Info) newPieceHash() hash.Hash {
+	if i.PieceHash == nil {
+		return sha1.New()
+	}
+	return i.PieceHash()
+}
+
+func (i Info) VerifyPiece(index int, data []byte) bool {
+	if index < 0 || index >= len(i.Pieces) {
+		return false
+	}
+
+	h := i.newPieceHash()
+	h.Write(data)
+	return bytes.Equal(h.Sum(nil), i.Pieces[index][:])
+}
+
+// PiecesForFile returns the range of pieces holding the file's data. A zero
+// length file has none, the piece at its offset is returned and may be past
+// the last piece when the file ends the torrent.
+func (i Info) PiecesForFile(fileIndex int) (firstPiece, lastPiece int, err error) {
+	files := i.Files()
+	if fileIndex < 0 || fileIndex >= len(files) {
+		return 0, 0, fmt.Errorf("file index %d, files %d: %w", fileIndex, len(files), ErrFileIndexOutOfRange)
+	}
+
+	start := i.FileOffsets()[fileIndex]
+	end := start + files[fileIndex].Length
+
+	firstPiece = int(start / i.PieceLength)
+	lastPiece = firstPiece
+	if end > start {
+		lastPiece = int((end - 1) / i.PieceLength)
+	}
+
+	return firstPiece, lastPiece, nil
+}
+
+func (i Info) NameUTF8() (string, error) {
+	name := i.Name
+	if i.UTF8Name != "" {
+		name = i.UTF8Name
+	}
+
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("name %q: %w", name, ErrInvalidUTF8)
+	}
+	return name, nil
+}
+
+func (i Info) PiecesFlat() []byte {
+	ret := make([]byte, 0, len(i.Pieces)*20)
+	for _, p := range i.Pieces {
+		ret = append(ret, p[:]...)
+	}
+	return ret
+}
+
+// VerifyInfoHash checks that info, as decoded from metadata fetched for a
+// magnet link, is the one the magnet's info hash names. Never use metadata
+// that fails it, a peer could have sent any torrent.
+func VerifyInfoHash(info *Info, expected [20]byte) error {
+	if info.InfoHash != expected {
+		return fmt.Errorf("got %x, want %x: %w", info.InfoHash, expected, ErrInfoHashMismatch)
+	}
+	return nil
+}
+
+func (i Info) InfoHashHex() string {
+	return hex.EncodeToString(i.InfoHash[:])
+}
+
+// InfoHashBase32 returns the info hash in the unpadded upper case base32 form
+// some magnet links use for btih.
+func (i Info) InfoHashBase32() string {
+	return base32.StdEncoding.EncodeToString(i.InfoHash[:])
+}
+
+func PiecesFromBytes(b []byte) ([][20]byte, error) {
+	if len(b)%20 != 0 {
+		return nil, ErrPieceNotCorrentLen
+	}
+
+	var ret [][20]byte
+	var temp [20]byte
+	for i := 0; i < len(b); i += 20 {
+		copy(temp[:], b[i:i+20])
+		ret = append(ret, temp)
+	}
+	return ret, nil
 }
 
 var (
+	ErrInfoHashMismatch         = errors.New("info dict does not match info hash")
+	ErrNoPieces                 = errors.New("info dict has no pieces")
+	ErrPieceLengthOutOfRange    = errors.New("piece length out of range")
 	ErrTypeAssertionFromBencode = errors.New("cannot convert to expected B type from Bencode")
 	ErrKeyNotPresent            = errors.New("key not present in bmap")
 	ErrZeroLengthFilePathList   = errors.New("path in files.path is of zero length")
 	ErrNeitherLengthOrFile      = errors.New("neither length or file present in info dict")
 	ErrPieceNotCorrentLen       = errors.New("pieces should be a multiple of 20")
 	ErrEmptyFilesInfo           = errors.New("files info should not be empty")
+	ErrMalformedNode            = errors.New("node should be a list of host and port")
+	ErrUnsupportedMetaVersion   = errors.New("unsupported meta version, v2 only torrents are not supported")
+	ErrFileIndexOutOfRange      = errors.New("file index out of range")
+	ErrUnsafeName               = errors.New("name should be a single non empty path component")
+	ErrEmptyName                = errors.New("name is empty or only whitespace")
+	ErrInvalidMD5Sum            = errors.New("md5sum should be 32 hex characters")
+	ErrInvalidUTF8              = errors.New("string is not valid utf-8")
+	ErrMetaInfoTooLarge         = errors.New("metainfo exceeds max size")
+	ErrNotAMetainfo             = errors.New("not a metainfo, top-level value should be a dict")
 )
 
+// bencodeKind names the type of a decoded value for error messages.
+func bencodeKind(b bencode.Bencode) string {
+	switch b.(type) {
+	case bencode.BInt64:
+		return "int"
+	case bencode.BString:
+		return "string"
+	case bencode.BList:
+		return "list"
+	case bencode.BMap:
+		return "dict"
+	default:
+		return fmt.Sprintf("%T", b)
+	}
+}
+
+func validatePathComponent(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid name %q: %w", name, ErrUnsafeName)
+	}
+
+	return nil
+}
+
+// validateName checks the torrent's name, which becomes the download's file
+// or directory: on top of being a safe path component it must have something
+// besides whitespace. ErrEmptyName errors are ErrUnsafeName errors too.
+func validateName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("name %q: %w: %w", name, ErrEmptyName, ErrUnsafeName)
+	}
+	return validatePathComponent(name)
+}
+
 func DecodeFilesFromBencode(b bencode.Bencode) (*File, error) {
 	value, ok := b.(bencode.BMap)
 
@@ -57,15 +350,30 @@ func DecodeFilesFromBencode(b bencode.Bencode) (*File, error) {
 		return nil, err
 	}
 
-	ret.Length = int64(length.(bencode.BInt64))
-	list, ok := value[bencode.BString("path")]
+	fileLength, ok := length.(bencode.BInt64)
+	if !ok {
+		err := fmt.Errorf("length in file dict not an int: %w", ErrTypeAssertionFromBencode)
+		slog.Error("decode file info error", "err", err)
+		return nil, err
+	}
+	ret.Length = int64(fileLength)
+
+	list, ok := value[bencode.BString("path.utf-8")]
+	if !ok {
+		list, ok = value[bencode.BString("path")]
+	}
 	if !ok {
 		err := fmt.Errorf("cannot get path key in file dict: %w", ErrKeyNotPresent)
 		slog.Error("decode file info error", "err", err)
 		return nil, err
 	}
 
-	pathlist := list.(bencode.BList)
+	pathlist, ok := list.(bencode.BList)
+	if !ok {
+		err := fmt.Errorf("path in file dict not a list: %w", ErrTypeAssertionFromBencode)
+		slog.Error("decode file info error", "err", err)
+		return nil, err
+	}
 	if len(pathlist) == 0 {
 		slog.Error("decode file info error", "err", ErrZeroLengthFilePathList)
 		return nil, ErrZeroLengthFilePathList
@@ -73,11 +381,38 @@ func DecodeFilesFromBencode(b bencode.Bencode) (*File, error) {
 
 	path := make([]string, 0)
 	for _, value := range pathlist {
-		val := value.(bencode.BString)
+		val, ok := value.(bencode.BString)
+		if !ok {
+			err := fmt.Errorf("path component not a string: %w", ErrTypeAssertionFromBencode)
+			slog.Error("decode file info error", "err", err)
+			return nil, err
+		}
+		if err := validatePathComponent(string(val)); err != nil {
+			slog.Error("decode file info error", "err", err)
+			return nil, err
+		}
 		path = append(path, string(val))
 	}
 
 	ret.Path = filepath.Join(path...)
+
+	md5sum, ok := value[bencode.BString("md5sum")]
+	if ok {
+		sum, ok := md5sum.(bencode.BString)
+		if !ok || len(sum) != 32 {
+			err := fmt.Errorf("md5sum in file dict: %w", ErrInvalidMD5Sum)
+			slog.Error("decode file info error", "err", err)
+			return nil, err
+		}
+
+		if _, err := hex.DecodeString(string(sum)); err != nil {
+			err := fmt.Errorf("md5sum in file dict: %w", ErrInvalidMD5Sum)
+			slog.Error("decode file info error", "err", err)
+			return nil, err
+		}
+		ret.MD5Sum = string(sum)
+	}
+
 	return &ret, nil
 }
 
@@ -93,9 +428,7 @@ func DecodeFilesInfoFromBencode(b bencode.Bencode) ([]*File, error) {
 
 	ret := make([]*File, 0)
 	for _, v := range value {
-		val := v.(bencode.BMap)
-
-		finfo, err := DecodeFilesFromBencode(val)
+		finfo, err := DecodeFilesFromBencode(v)
 		if err != nil {
 			return nil, fmt.Errorf("decode file info error: %w", err)
 		}
@@ -104,7 +437,32 @@ func DecodeFilesInfoFromBencode(b bencode.Bencode) ([]*File, error) {
 	return ret, nil
 }
 
+const (
+	DefaultMinPieceLength = 16 << 10
+	DefaultMaxPieceLength = 128 << 20
+)
+
+// InfoOptions bounds what DecodeInfoFromBencodeWithOptions accepts. Piece
+// buffers are sized from the piece length, so the upper bound caps the memory
+// a torrent can make us allocate per piece. A zero MaxPieceLength means
+// unlimited, piece lengths below one are always rejected.
+type InfoOptions struct {
+	MinPieceLength int64
+	MaxPieceLength int64
+	// AllowEmpty accepts a torrent whose files add up to zero bytes, and so
+	// has no pieces. Content with no pieces is always rejected.
+	AllowEmpty bool
+}
+
+func DefaultInfoOptions() InfoOptions {
+	return InfoOptions{MinPieceLength: DefaultMinPieceLength, MaxPieceLength: DefaultMaxPieceLength}
+}
+
 func DecodeInfoFromBencode(b bencode.Bencode) (*Info, error) {
+	return DecodeInfoFromBencodeWithOptions(b, DefaultInfoOptions())
+}
+
+func DecodeInfoFromBencodeWithOptions(b bencode.Bencode, opts InfoOptions) (*Info, error) {
 	value, ok := b.(bencode.BMap)
 
 	ret := Info{}
@@ -121,7 +479,43 @@ func DecodeInfoFromBencode(b bencode.Bencode) (*Info, error) {
 		return nil, err
 	}
 
-	ret.Name = string(name.(bencode.BString))
+	nameStr, ok := name.(bencode.BString)
+	if !ok {
+		err := fmt.Errorf("name not a string: %w", ErrTypeAssertionFromBencode)
+		slog.Error("decode info error", "err", err)
+		return nil, err
+	}
+	ret.Name = string(nameStr)
+	if err := validateName(ret.Name); err != nil {
+		slog.Error("decode info error", "err", err)
+		return nil, err
+	}
+
+	utf8Name, ok := value[bencode.BString("name.utf-8")]
+	if ok {
+		v, ok := utf8Name.(bencode.BString)
+		if !ok {
+			err := fmt.Errorf("name.utf-8 not a string: %w", ErrTypeAssertionFromBencode)
+			slog.Error("decode info error", "err", err)
+			return nil, err
+		}
+		ret.UTF8Name = string(v)
+		if err := validateName(ret.UTF8Name); err != nil {
+			slog.Error("decode info error", "err", err)
+			return nil, err
+		}
+	}
+
+	source, ok := value[bencode.BString("source")]
+	if ok {
+		v, ok := source.(bencode.BString)
+		if !ok {
+			err := fmt.Errorf("source not a string: %w", ErrTypeAssertionFromBencode)
+			slog.Error("decode info error", "err", err)
+			return nil, err
+		}
+		ret.Source = string(v)
+	}
 
 	pieceslength, ok := value[bencode.BString("piece length")]
 	if !ok {
@@ -130,26 +524,62 @@ func DecodeInfoFromBencode(b bencode.Bencode) (*Info, error) {
 		return nil, err
 	}
 
-	ret.PieceLength = int64(pieceslength.(bencode.BInt64))
+	pieceLength, ok := pieceslength.(bencode.BInt64)
+	if !ok {
+		err := fmt.Errorf("piece length not an int: %w", ErrTypeAssertionFromBencode)
+		slog.Error("decode info error", "err", err)
+		return nil, err
+	}
+	ret.PieceLength = int64(pieceLength)
+	if ret.PieceLength <= 0 {
+		err := fmt.Errorf("piece length %d: %w", ret.PieceLength, ErrInvalidPieceLength)
+		slog.Error("decode info error", "err", err)
+		return nil, err
+	}
+	if ret.PieceLength < opts.MinPieceLength || (opts.MaxPieceLength > 0 && ret.PieceLength > opts.MaxPieceLength) {
+		err := fmt.Errorf("piece length %d not in [%d, %d]: %w", ret.PieceLength, opts.MinPieceLength, opts.MaxPieceLength, ErrPieceLengthOutOfRange)
+		slog.Error("decode info error", "err", err)
+		return nil, err
+	}
+
+	metaVersion, ok := value[bencode.BString("meta version")]
+	if ok {
+		v, ok := metaVersion.(bencode.BInt64)
+		if !ok {
+			err := fmt.Errorf("meta version not an int: %w", ErrTypeAssertionFromBencode)
+			slog.Error("decode info error", "err", err)
+			return nil, err
+		}
+		ret.MetaVersion = int(v)
+	}
+	if _, ok := value[bencode.BString("file tree")]; ok {
+		ret.MetaVersion = 2
+	}
 
 	pieces, ok := value[bencode.BString("pieces")]
+	if !ok && ret.MetaVersion == 2 {
+		err := fmt.Errorf("info dict has meta version 2 and no pieces: %w", ErrUnsupportedMetaVersion)
+		slog.Error("decode info error", "err", err)
+		return nil, err
+	}
 	if !ok {
 		err := fmt.Errorf("unable to get pieces from info bencode: %w", ErrKeyNotPresent)
 		slog.Error("decode info error", "err", err)
 		return nil, err
 	}
 
-	if len(pieces.(bencode.BString))%20 != 0 {
-		slog.Error("decode info error", "err", ErrPieceNotCorrentLen)
-		return nil, ErrPieceNotCorrentLen
+	piecesStr, ok := pieces.(bencode.BString)
+	if !ok {
+		err := fmt.Errorf("pieces not a string: %w", ErrTypeAssertionFromBencode)
+		slog.Error("decode info error", "err", err)
+		return nil, err
 	}
-
-	picesBytes := []byte(pieces.(bencode.BString))
-	var temp [20]byte
-	for i := 0; i < len(picesBytes); i += 20 {
-		copy(temp[:], picesBytes[i:i+20])
-		ret.Pieces = append(ret.Pieces, temp)
+	piecesHashes, err := PiecesFromBytes(piecesStr.Bytes())
+	if err != nil {
+		slog.Error("decode info error", "err", err)
+		return nil, err
 	}
+	ret.Pieces = piecesHashes
 
 	length, ok := value[bencode.BString("length")]
 	if !ok {
@@ -167,7 +597,19 @@ func DecodeInfoFromBencode(b bencode.Bencode) (*Info, error) {
 		}
 		ret.FilesInfo = inf
 	} else {
-		ret.Length = int64(length.(bencode.BInt64))
+		v, ok := length.(bencode.BInt64)
+		if !ok {
+			err := fmt.Errorf("length not an int: %w", ErrTypeAssertionFromBencode)
+			slog.Error("decode info error", "err", err)
+			return nil, err
+		}
+		ret.Length = int64(v)
+	}
+
+	if len(ret.Pieces) == 0 && (ret.TotalLength() > 0 || !opts.AllowEmpty) {
+		err := fmt.Errorf("%d bytes of content: %w", ret.TotalLength(), ErrNoPieces)
+		slog.Error("decode info error", "err", err)
+		return nil, err
 	}
 
 	enc, err := bencode.Encode(b)
@@ -176,15 +618,72 @@ func DecodeInfoFromBencode(b bencode.Bencode) (*Info, error) {
 	}
 
 	ret.InfoHash = sha1.Sum(enc)
+	ret.fileOffsets = ret.computeFileOffsets()
 	return &ret, nil
 }
 
+func DecodeNodesFromBencode(b bencode.Bencode) ([]NodeAddr, error) {
+	value, ok := b.(bencode.BList)
+	if !ok {
+		return nil, fmt.Errorf("decode nodes, not a list: %w", ErrTypeAssertionFromBencode)
+	}
+
+	ret := make([]NodeAddr, 0)
+	for i, v := range value {
+		pair, ok := v.(bencode.BList)
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("decode nodes, entry %d: %w", i, ErrMalformedNode)
+		}
+
+		host, ok := pair[0].(bencode.BString)
+		if !ok {
+			return nil, fmt.Errorf("decode nodes, entry %d host not a string: %w", i, ErrMalformedNode)
+		}
+
+		port, ok := pair[1].(bencode.BInt64)
+		if !ok {
+			return nil, fmt.Errorf("decode nodes, entry %d port not an int: %w", i, ErrMalformedNode)
+		}
+
+		ret = append(ret, NodeAddr{Host: string(host), Port: int(port)})
+	}
+
+	return ret, nil
+}
+
+func DecodeAnnounceListFromBencode(b bencode.Bencode) ([][]string, error) {
+	value, ok := b.(bencode.BList)
+	if !ok {
+		return nil, fmt.Errorf("decode announce-list, not a list: %w", ErrTypeAssertionFromBencode)
+	}
+
+	ret := make([][]string, 0, len(value))
+	for i, v := range value {
+		tier, ok := v.(bencode.BList)
+		if !ok {
+			return nil, fmt.Errorf("decode announce-list, tier %d not a list: %w", i, ErrTypeAssertionFromBencode)
+		}
+
+		urls := make([]string, 0, len(tier))
+		for j, u := range tier {
+			url, ok := u.(bencode.BString)
+			if !ok {
+				return nil, fmt.Errorf("decode announce-list, tier %d entry %d not a string: %w", i, j, ErrTypeAssertionFromBencode)
+			}
+			urls = append(urls, string(url))
+		}
+		ret = append(ret, urls)
+	}
+
+	return ret, nil
+}
+
 func DecodeMetaInfoFromBencode(b bencode.Bencode) (*MetaInfo, error) {
 	value, ok := b.(bencode.BMap)
 
 	ret := MetaInfo{}
 	if !ok {
-		err := fmt.Errorf("unable to construct bmap from bencode: %w", ErrTypeAssertionFromBencode)
+		err := fmt.Errorf("got %s: %w: %w", bencodeKind(b), ErrNotAMetainfo, ErrTypeAssertionFromBencode)
 		slog.Error("decode metainfo error", "err", err)
 		return nil, err
 	}
@@ -196,7 +695,22 @@ func DecodeMetaInfoFromBencode(b bencode.Bencode) (*MetaInfo, error) {
 		return nil, err
 	}
 
-	ret.Announce = string(announce.(bencode.BString))
+	announceStr, ok := announce.(bencode.BString)
+	if !ok {
+		err := fmt.Errorf("announce not a string: %w", ErrTypeAssertionFromBencode)
+		slog.Error("decode metainfo error", "err", err)
+		return nil, err
+	}
+	ret.Announce = string(announceStr)
+
+	if announceList, ok := value[bencode.BString("announce-list")]; ok {
+		tiers, err := DecodeAnnounceListFromBencode(announceList)
+		if err != nil {
+			slog.Error("decode metainfo error", "err", err)
+			return nil, fmt.Errorf("decode metainfo error: %w", err)
+		}
+		ret.AnnounceList = tiers
+	}
 
 	infobencode, ok := value[bencode.BString("info")]
 	if !ok {
@@ -211,17 +725,55 @@ func DecodeMetaInfoFromBencode(b bencode.Bencode) (*MetaInfo, error) {
 	}
 
 	ret.Info = *info
+
+	nodes, ok := value[bencode.BString("nodes")]
+	if ok {
+		n, err := DecodeNodesFromBencode(nodes)
+		if err != nil {
+			slog.Error("decode metainfo error", "err", err)
+			return nil, fmt.Errorf("decode metainfo error: %w", err)
+		}
+		ret.Nodes = n
+	}
+
 	return &ret, nil
 }
 
-func GetMetaInfoFromTorrentFile(r io.Reader) (*MetaInfo, error) {
+// MaxMetaInfoSize caps how much DecodeMetaInfo reads from a stream.
+const MaxMetaInfoSize = 16 << 20
 
-	data, err := io.ReadAll(r)
-	if err != nil {
+// readPool holds the buffers torrent files are read into, DecodeMetaInfo is
+// called for every torrent a client loads.
+var readPool = &bencode.Pool{MaxBufferSize: MaxMetaInfoSize + 1}
+
+// DecodeMetaInfo reads a .torrent from r, streams larger than
+// MaxMetaInfoSize are rejected with ErrMetaInfoTooLarge. Torrents that aren't
+// canonical bencode are rejected too, see DecodeMetaInfoWithOptions.
+func DecodeMetaInfo(r io.Reader) (*MetaInfo, error) {
+	return DecodeMetaInfoWithOptions(r, bencode.DefaultOptions())
+}
+
+// DecodeMetaInfoWithOptions is DecodeMetaInfo decoding with opts. With
+// opts.Lenient the info hash is taken over the info dict as it appears in r,
+// re-encoding a non canonical dict would give a different hash.
+// opts.ZeroCopy is ignored, r is read into a pooled buffer.
+func DecodeMetaInfoWithOptions(r io.Reader, opts bencode.Options) (*MetaInfo, error) {
+
+	buf := readPool.Get()
+	defer readPool.Put(buf)
+
+	if _, err := buf.ReadFrom(io.LimitReader(r, MaxMetaInfoSize+1)); err != nil {
 		return nil, fmt.Errorf("error building metainfo from torrentfile: %w", err)
 	}
 
-	benc, _, err := bencode.Decode(data)
+	if buf.Len() > MaxMetaInfoSize {
+		return nil, fmt.Errorf("more than %d bytes: %w", MaxMetaInfoSize, ErrMetaInfoTooLarge)
+	}
+
+	// buf goes back to readPool, so strings must be copied out of it for
+	// nothing decoded to outlive it.
+	opts.ZeroCopy = false
+	benc, _, err := bencode.DecodeWithOptions(context.Background(), buf.Bytes(), opts)
 	if err != nil {
 		return nil, fmt.Errorf("error decoding bencode from torrent file: %w", err)
 	}
@@ -231,5 +783,43 @@ func GetMetaInfoFromTorrentFile(r io.Reader) (*MetaInfo, error) {
 		return nil, fmt.Errorf("error geting metainfo from benc: %w", err)
 	}
 
+	if opts.Lenient {
+		raw, _, err := bencode.RawDictValue(buf.Bytes(), bencode.BString("info"))
+		if err != nil {
+			return nil, fmt.Errorf("error finding info dict in torrent file: %w", err)
+		}
+		minfo.Info.InfoHash = sha1.Sum(raw)
+	}
+
 	return minfo, nil
 }
+
+// DecodeInfoOnly decodes just the info dict of the torrent in data, for tools
+// that need no more than the info hash and files. Nothing else in data is
+// checked beyond being bencode, so a torrent without announce is fine. The
+// info hash is taken over the info dict as it appears in data.
+func DecodeInfoOnly(data []byte) (*Info, error) {
+	raw, ok, err := bencode.RawDictValue(data, bencode.BString("info"))
+	if err != nil {
+		return nil, fmt.Errorf("error finding info dict in torrent file: %w", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("info dict not present in metainfo: %w", ErrKeyNotPresent)
+	}
+
+	benc, _, err := bencode.DecodeWithOptions(context.Background(), raw, bencode.DefaultOptions())
+	if err != nil {
+		return nil, fmt.Errorf("error decoding info dict: %w", err)
+	}
+
+	info, err := DecodeInfoFromBencode(benc)
+	if err != nil {
+		return nil, err
+	}
+	info.InfoHash = sha1.Sum(raw)
+	return info, nil
+}
+
+func GetMetaInfoFromTorrentFile(r io.Reader) (*MetaInfo, error) {
+	return DecodeMetaInfo(r)
+}
@@ -3,6 +3,7 @@ package torrent
 import (
 	"bytes"
 	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -33,13 +34,13 @@ func TestDecodeFilesFromBencode(t *testing.T) {
 		{
 			name:     "valid value",
 			input:    getBencStringForFile(t, 255, []string{"hello.txt"}),
-			expected: File{255, filepath.Join("hello.txt")},
+			expected: File{Length: 255, Path: filepath.Join("hello.txt")},
 			err:      nil,
 		},
 		{
 			name:     "multiple path values",
 			input:    getBencStringForFile(t, 255, []string{"dir1", "hello.txt"}),
-			expected: File{255, filepath.Join("dir1", "hello.txt")},
+			expected: File{Length: 255, Path: filepath.Join("dir1", "hello.txt")},
 			err:      nil,
 		},
 		{
@@ -57,6 +58,41 @@ func TestDecodeFilesFromBencode(t *testing.T) {
 			input: "d6:lengthi20e4:pathlee",
 			err:   ErrZeroLengthFilePathList,
 		},
+		{
+			name:     "path.utf-8 preferred over path",
+			input:    "d6:lengthi20e4:pathl7:old.txte10:path.utf-8l3:dir7:new.txtee",
+			expected: File{Length: 20, Path: filepath.Join("dir", "new.txt")},
+		},
+		{
+			name:     "only path.utf-8",
+			input:    "d6:lengthi20e10:path.utf-8l7:new.txtee",
+			expected: File{Length: 20, Path: "new.txt"},
+		},
+		{
+			name:  "unsafe path component",
+			input: "d6:lengthi20e4:pathl2:..6:passwdee",
+			err:   ErrUnsafeName,
+		},
+		{
+			name:  "unsafe path.utf-8 component",
+			input: "d6:lengthi20e4:pathl7:old.txte10:path.utf-8l10:etc/shadowee",
+			err:   ErrUnsafeName,
+		},
+		{
+			name:     "valid md5sum",
+			input:    "d6:lengthi20e6:md5sum32:0123456789abcdef0123456789ABCDEF4:pathl9:hello.txtee",
+			expected: File{Length: 20, Path: "hello.txt", MD5Sum: "0123456789abcdef0123456789ABCDEF"},
+		},
+		{
+			name:  "md5sum of invalid length",
+			input: "d6:lengthi20e6:md5sum6:abcdef4:pathl9:hello.txtee",
+			err:   ErrInvalidMD5Sum,
+		},
+		{
+			name:  "md5sum not hex",
+			input: "d6:lengthi20e6:md5sum32:zz23456789abcdef0123456789abcdef4:pathl9:hello.txtee",
+			err:   ErrInvalidMD5Sum,
+		},
 		{
 			name:  "bencode not a dictionary",
 			input: "le",
@@ -97,7 +133,7 @@ func TestDecodeFilesInfoFromBencode(t *testing.T) {
 			input: getBencFilelist(t, []string{
 				getBencStringForFile(t, 255, []string{"hello.txt"}),
 				getBencStringForFile(t, 255, []string{"hello.txt"})}),
-			expected: File{255, filepath.Join("hello.txt")},
+			expected: File{Length: 255, Path: filepath.Join("hello.txt")},
 			err:      nil,
 		},
 		{
@@ -105,7 +141,7 @@ func TestDecodeFilesInfoFromBencode(t *testing.T) {
 			input: getBencFilelist(t, []string{
 				getBencStringForFile(t, 255, []string{"dir1", "hello.txt"}),
 				getBencStringForFile(t, 255, []string{"dir1", "hello.txt"})}),
-			expected: File{255, filepath.Join("dir1", "hello.txt")},
+			expected: File{Length: 255, Path: filepath.Join("dir1", "hello.txt")},
 			err:      nil,
 		},
 		{
@@ -179,7 +215,8 @@ func TestDecodeInfoFromBencode(t *testing.T) {
 				Pieces: [][20]byte{{'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a',
 					'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a'}, {'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a',
 					'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a'}},
-				Length: 212314 * 2,
+				Length:      212314 * 2,
+				fileOffsets: []int64{0},
 			},
 		},
 		{
@@ -228,7 +265,8 @@ func TestDecodeInfoFromBencode(t *testing.T) {
 				Pieces: [][20]byte{{'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a',
 					'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a'}, {'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a',
 					'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a'}},
-				FilesInfo: []*File{{Path: "file1.txt", Length: 1000}, {Path: "file2.txt", Length: 2000}},
+				FilesInfo:   []*File{{Path: "file1.txt", Length: 1000}, {Path: "file2.txt", Length: 2000}},
+				fileOffsets: []int64{0, 1000},
 			},
 		},
 		{
@@ -241,6 +279,121 @@ func TestDecodeInfoFromBencode(t *testing.T) {
 			},
 			err: ErrPieceNotCorrentLen,
 		},
+		{
+			name: "Meta version 2 without pieces",
+			bencodeInput: bencode.BMap{
+				bencode.BString("name"):         bencode.BString("temp"),
+				bencode.BString("piece length"): bencode.BInt64(262144),
+				bencode.BString("meta version"): bencode.BInt64(2),
+				bencode.BString("file tree"): bencode.BMap{
+					bencode.BString("file1.txt"): bencode.BMap{
+						bencode.BString(""): bencode.BMap{
+							bencode.BString("length"): bencode.BInt64(1000),
+						},
+					},
+				},
+			},
+			err: ErrUnsupportedMetaVersion,
+		},
+		{
+			name: "Hybrid v1 and v2",
+			bencodeInput: bencode.BMap{
+				bencode.BString("name"):         bencode.BString("temp"),
+				bencode.BString("piece length"): bencode.BInt64(262144),
+				bencode.BString("pieces"):       bencode.BString(strings.Repeat("a", 20)),
+				bencode.BString("files"): bencode.BList{
+					bencode.BMap{
+						bencode.BString("path"):   bencode.BList{bencode.BString("file1.txt")},
+						bencode.BString("length"): bencode.BInt64(1000),
+					},
+				},
+				bencode.BString("file tree"): bencode.BMap{
+					bencode.BString("file1.txt"): bencode.BMap{
+						bencode.BString(""): bencode.BMap{
+							bencode.BString("length"):      bencode.BInt64(1000),
+							bencode.BString("pieces root"): bencode.BString(strings.Repeat("r", 32)),
+						},
+					},
+				},
+			},
+			expectedInfo: &Info{
+				Name:        "temp",
+				PieceLength: 262144,
+				Pieces: [][20]byte{{'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a',
+					'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a'}},
+				FilesInfo:   []*File{{Path: "file1.txt", Length: 1000}},
+				MetaVersion: 2,
+				fileOffsets: []int64{0},
+			},
+		},
+		{
+			name: "V2 only without meta version",
+			bencodeInput: bencode.BMap{
+				bencode.BString("name"):         bencode.BString("temp"),
+				bencode.BString("piece length"): bencode.BInt64(262144),
+				bencode.BString("file tree"):    bencode.BMap{},
+			},
+			err: ErrUnsupportedMetaVersion,
+		},
+		{
+			name: "Meta version 1",
+			bencodeInput: bencode.BMap{
+				bencode.BString("name"):         bencode.BString("temp"),
+				bencode.BString("piece length"): bencode.BInt64(262144),
+				bencode.BString("meta version"): bencode.BInt64(1),
+				bencode.BString("pieces"):       bencode.BString(strings.Repeat("a", 20)),
+				bencode.BString("length"):       bencode.BInt64(1000),
+			},
+			expectedInfo: &Info{
+				Name:        "temp",
+				PieceLength: 262144,
+				Pieces: [][20]byte{{'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a',
+					'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a'}},
+				Length:      1000,
+				MetaVersion: 1,
+				fileOffsets: []int64{0},
+			},
+		},
+		{
+			name: "Absolute name",
+			bencodeInput: bencode.BMap{
+				bencode.BString("name"):         bencode.BString("/etc/passwd"),
+				bencode.BString("piece length"): bencode.BInt64(262144),
+				bencode.BString("pieces"):       bencode.BString(strings.Repeat("a", 20)),
+				bencode.BString("length"):       bencode.BInt64(1000),
+			},
+			err: ErrUnsafeName,
+		},
+		{
+			name: "Name with slashes",
+			bencodeInput: bencode.BMap{
+				bencode.BString("name"):         bencode.BString("../../x"),
+				bencode.BString("piece length"): bencode.BInt64(262144),
+				bencode.BString("pieces"):       bencode.BString(strings.Repeat("a", 20)),
+				bencode.BString("length"):       bencode.BInt64(1000),
+			},
+			err: ErrUnsafeName,
+		},
+		{
+			name: "Name is dot dot",
+			bencodeInput: bencode.BMap{
+				bencode.BString("name"):         bencode.BString(".."),
+				bencode.BString("piece length"): bencode.BInt64(262144),
+				bencode.BString("pieces"):       bencode.BString(strings.Repeat("a", 20)),
+				bencode.BString("length"):       bencode.BInt64(1000),
+			},
+			err: ErrUnsafeName,
+		},
+		{
+			name: "Empty name",
+			bencodeInput: bencode.BMap{
+				bencode.BString("name"):         bencode.BString(""),
+				bencode.BString("piece length"): bencode.BInt64(262144),
+				bencode.BString("pieces"):       bencode.BString(strings.Repeat("a", 20)),
+				bencode.BString("length"):       bencode.BInt64(1000),
+			},
+			err: ErrEmptyName,
+		},
 		{
 			name:         "Invalid Bencode type",
 			bencodeInput: bencode.BString("invalid"),
@@ -268,6 +421,576 @@ func TestDecodeInfoFromBencode(t *testing.T) {
 	}
 }
 
+func TestInfoFiles(t *testing.T) {
+	tests := []struct {
+		name      string
+		info      Info
+		multiFile bool
+		expected  []File
+	}{
+		{
+			name: "single file",
+			info: Info{
+				Name:   "debian.iso",
+				Length: 351272960,
+			},
+			multiFile: false,
+			expected:  []File{{Length: 351272960, Path: "debian.iso"}},
+		},
+		{
+			name: "multi file",
+			info: Info{
+				Name: "temp",
+				FilesInfo: []*File{
+					{Length: 1000, Path: "file1.txt"},
+					{Length: 2000, Path: filepath.Join("dir", "file2.txt")},
+				},
+			},
+			multiFile: true,
+			expected: []File{
+				{Length: 1000, Path: "file1.txt"},
+				{Length: 2000, Path: filepath.Join("dir", "file2.txt")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.multiFile, tt.info.IsMultiFile())
+			require.Equal(t, tt.expected, tt.info.Files())
+		})
+	}
+}
+
+func TestDecodeInfoEmptyName(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "", err: ErrEmptyName},
+		{name: " \t\n", err: ErrEmptyName},
+		{name: "\u00a0", err: ErrEmptyName},
+		{name: "debian.iso"},
+		{name: " padded name "},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q", tt.name), func(t *testing.T) {
+			info, err := DecodeInfoFromBencode(bencode.BMap{
+				bencode.BString("name"):         bencode.BString(tt.name),
+				bencode.BString("piece length"): bencode.BInt64(16384),
+				bencode.BString("pieces"):       bencode.BString(strings.Repeat("a", 20)),
+				bencode.BString("length"):       bencode.BInt64(1000),
+			})
+			if tt.err != nil {
+				require.True(t, errors.Is(err, tt.err))
+				require.True(t, errors.Is(err, ErrUnsafeName))
+				return
+			}
+			require.Nil(t, err)
+			require.Equal(t, tt.name, info.Name)
+		})
+	}
+
+	_, err := DecodeInfoFromBencode(bencode.BMap{
+		bencode.BString("name"):         bencode.BString("debian.iso"),
+		bencode.BString("name.utf-8"):   bencode.BString("  "),
+		bencode.BString("piece length"): bencode.BInt64(16384),
+		bencode.BString("pieces"):       bencode.BString(strings.Repeat("a", 20)),
+		bencode.BString("length"):       bencode.BInt64(1000),
+	})
+	require.True(t, errors.Is(err, ErrEmptyName))
+}
+
+func TestDecodeInfoPieceLengthRange(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	infoWithPieceLength := func(pieceLength int64) bencode.BMap {
+		return bencode.BMap{
+			bencode.BString("name"):         bencode.BString("temp"),
+			bencode.BString("piece length"): bencode.BInt64(pieceLength),
+			bencode.BString("pieces"):       bencode.BString(strings.Repeat("a", 20)),
+			bencode.BString("length"):       bencode.BInt64(1000),
+		}
+	}
+
+	tests := []struct {
+		name        string
+		pieceLength int64
+		opts        InfoOptions
+		err         error
+	}{
+		{name: "low bound", pieceLength: 16 << 10, opts: DefaultInfoOptions()},
+		{name: "normal", pieceLength: 256 << 10, opts: DefaultInfoOptions()},
+		{name: "high bound", pieceLength: 128 << 20, opts: DefaultInfoOptions()},
+		{name: "below low bound", pieceLength: 16<<10 - 1, opts: DefaultInfoOptions(), err: ErrPieceLengthOutOfRange},
+		{name: "absurd", pieceLength: 1 << 40, opts: DefaultInfoOptions(), err: ErrPieceLengthOutOfRange},
+		{name: "zero", pieceLength: 0, opts: InfoOptions{}, err: ErrInvalidPieceLength},
+		{name: "zero with default bounds", pieceLength: 0, opts: DefaultInfoOptions(), err: ErrInvalidPieceLength},
+		{name: "negative", pieceLength: -1, opts: InfoOptions{}, err: ErrInvalidPieceLength},
+		{name: "negative with default bounds", pieceLength: -16384, opts: DefaultInfoOptions(), err: ErrInvalidPieceLength},
+		{name: "absurd without limit", pieceLength: 1 << 40, opts: InfoOptions{}},
+		{name: "custom bound", pieceLength: 1024, opts: InfoOptions{MinPieceLength: 1024, MaxPieceLength: 4096}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := DecodeInfoFromBencodeWithOptions(infoWithPieceLength(tt.pieceLength), tt.opts)
+			if tt.err != nil {
+				require.True(t, errors.Is(err, tt.err))
+				return
+			}
+			require.Nil(t, err)
+			require.Equal(t, tt.pieceLength, info.PieceLength)
+		})
+	}
+}
+
+func TestDecodeInfoNoPieces(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	infoWithLength := func(length int64) bencode.BMap {
+		return bencode.BMap{
+			bencode.BString("name"):         bencode.BString("temp"),
+			bencode.BString("piece length"): bencode.BInt64(16384),
+			bencode.BString("pieces"):       bencode.BString(""),
+			bencode.BString("length"):       bencode.BInt64(length),
+		}
+	}
+
+	_, err := DecodeInfoFromBencode(infoWithLength(1000))
+	require.True(t, errors.Is(err, ErrNoPieces))
+
+	opts := DefaultInfoOptions()
+	opts.AllowEmpty = true
+	_, err = DecodeInfoFromBencodeWithOptions(infoWithLength(1000), opts)
+	require.True(t, errors.Is(err, ErrNoPieces))
+
+	_, err = DecodeInfoFromBencode(infoWithLength(0))
+	require.True(t, errors.Is(err, ErrNoPieces))
+
+	info, err := DecodeInfoFromBencodeWithOptions(infoWithLength(0), opts)
+	require.Nil(t, err)
+	require.Empty(t, info.Pieces)
+	require.Equal(t, int64(0), info.TotalLength())
+}
+
+func TestFileOffsets(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	info, err := DecodeInfoFromBencode(bencode.BMap{
+		bencode.BString("name"):         bencode.BString("temp"),
+		bencode.BString("piece length"): bencode.BInt64(16384),
+		bencode.BString("pieces"):       bencode.BString(strings.Repeat("a", 20)),
+		bencode.BString("files"): bencode.BList{
+			bencode.BMap{bencode.BString("length"): bencode.BInt64(1000), bencode.BString("path"): bencode.BList{bencode.BString("a")}},
+			bencode.BMap{bencode.BString("length"): bencode.BInt64(0), bencode.BString("path"): bencode.BList{bencode.BString("b")}},
+			bencode.BMap{bencode.BString("length"): bencode.BInt64(5000), bencode.BString("path"): bencode.BList{bencode.BString("c")}},
+		},
+	})
+	require.Nil(t, err)
+	require.Equal(t, []int64{0, 1000, 1000}, info.FileOffsets())
+
+	built := Info{FilesInfo: []*File{{Length: 1000}, {Length: 0}, {Length: 5000}}}
+	require.Equal(t, []int64{0, 1000, 1000}, built.FileOffsets())
+
+	require.Equal(t, []int64{0}, Info{Name: "single", Length: 5000}.FileOffsets())
+}
+
+func TestFileAtOffset(t *testing.T) {
+	info := Info{FilesInfo: []*File{{Length: 1000}, {Length: 0}, {Length: 0}, {Length: 5000}, {Length: 0}}}
+
+	tests := []struct {
+		off       int64
+		fileIndex int
+		fileOff   int64
+		err       error
+	}{
+		{off: 0, fileIndex: 0, fileOff: 0},
+		{off: 999, fileIndex: 0, fileOff: 999},
+		{off: 1000, fileIndex: 3, fileOff: 0},
+		{off: 5999, fileIndex: 3, fileOff: 4999},
+		{off: 6000, err: ErrOutOfBounds},
+		{off: -1, err: ErrOutOfBounds},
+	}
+
+	for _, tt := range tests {
+		fileIndex, fileOff, err := info.FileAtOffset(tt.off)
+		if tt.err != nil {
+			require.True(t, errors.Is(err, tt.err), tt.off)
+			continue
+		}
+		require.Nil(t, err)
+		require.Equal(t, tt.fileIndex, fileIndex, tt.off)
+		require.Equal(t, tt.fileOff, fileOff, tt.off)
+	}
+}
+
+func TestPiecesForFile(t *testing.T) {
+	multi := Info{
+		Name:        "temp",
+		PieceLength: 100,
+		FilesInfo: []*File{
+			{Length: 150, Path: "a"},
+			{Length: 100, Path: "b"},
+			{Length: 50, Path: "c"},
+		},
+	}
+
+	single := Info{
+		Name:        "temp",
+		PieceLength: 100,
+		Length:      250,
+	}
+
+	tests := []struct {
+		name      string
+		info      Info
+		fileIndex int
+		first     int
+		last      int
+		err       error
+	}{
+		{
+			name:      "file ends mid piece",
+			info:      multi,
+			fileIndex: 0,
+			first:     0,
+			last:      1,
+		},
+		{
+			name:      "file starts and ends mid piece",
+			info:      multi,
+			fileIndex: 1,
+			first:     1,
+			last:      2,
+		},
+		{
+			name:      "file starts mid piece and ends on last byte",
+			info:      multi,
+			fileIndex: 2,
+			first:     2,
+			last:      2,
+		},
+		{
+			name:      "single file spans all pieces",
+			info:      single,
+			fileIndex: 0,
+			first:     0,
+			last:      2,
+		},
+		{
+			name:      "negative index",
+			info:      multi,
+			fileIndex: -1,
+			err:       ErrFileIndexOutOfRange,
+		},
+		{
+			name:      "index past last file",
+			info:      single,
+			fileIndex: 1,
+			err:       ErrFileIndexOutOfRange,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, last, err := tt.info.PiecesForFile(tt.fileIndex)
+			if tt.err != nil {
+				require.Error(t, err)
+				require.True(t, errors.Is(err, tt.err))
+			} else {
+				require.Nil(t, err)
+				require.Equal(t, tt.first, first)
+				require.Equal(t, tt.last, last)
+			}
+		})
+	}
+}
+
+func TestInfoNameUTF8(t *testing.T) {
+	tests := []struct {
+		name     string
+		info     Info
+		expected string
+		err      error
+	}{
+		{
+			name:     "valid utf-8 name",
+			info:     Info{Name: "débian-ünïcode"},
+			expected: "débian-ünïcode",
+		},
+		{
+			name: "invalid byte sequence",
+			info: Info{Name: "bad\xff\xfename"},
+			err:  ErrInvalidUTF8,
+		},
+		{
+			name:     "name.utf-8 overrides name",
+			info:     Info{Name: "bad\xffname", UTF8Name: "good-名前"},
+			expected: "good-名前",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, err := tt.info.NameUTF8()
+			if tt.err != nil {
+				require.True(t, errors.Is(err, tt.err))
+			} else {
+				require.Nil(t, err)
+				require.Equal(t, tt.expected, name)
+			}
+		})
+	}
+
+	t.Run("decode name.utf-8 key", func(t *testing.T) {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+		info, err := DecodeInfoFromBencode(bencode.BMap{
+			bencode.BString("name"):         bencode.BString("bad\xffname"),
+			bencode.BString("name.utf-8"):   bencode.BString("good-名前"),
+			bencode.BString("piece length"): bencode.BInt64(262144),
+			bencode.BString("pieces"):       bencode.BString(strings.Repeat("\xff", 20)),
+			bencode.BString("length"):       bencode.BInt64(1000),
+		})
+		require.Nil(t, err)
+
+		name, err := info.NameUTF8()
+		require.Nil(t, err)
+		require.Equal(t, "good-名前", name)
+		require.Equal(t, []byte(strings.Repeat("\xff", 20)), info.PiecesFlat())
+	})
+}
+
+func TestDecodeInfoWrongTypes(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	file := func(key string, value bencode.Bencode) bencode.BList {
+		f := bencode.BMap{
+			bencode.BString("length"): bencode.BInt64(1000),
+			bencode.BString("path"):   bencode.BList{bencode.BString("a.bin")},
+		}
+		f[bencode.BString(key)] = value
+		return bencode.BList{f}
+	}
+
+	tests := []struct {
+		name  string
+		key   string
+		value bencode.Bencode
+	}{
+		{name: "name.utf-8 int", key: "name.utf-8", value: bencode.BInt64(1)},
+		{name: "name.utf-8 list", key: "name.utf-8", value: bencode.BList{bencode.BString("a")}},
+		{name: "name.utf-8 dict", key: "name.utf-8", value: bencode.BMap{}},
+		{name: "name int", key: "name", value: bencode.BInt64(1)},
+		{name: "pieces list", key: "pieces", value: bencode.BList{}},
+		{name: "length string", key: "length", value: bencode.BString("1000")},
+		{name: "files entry not a dict", key: "files", value: bencode.BList{bencode.BString("a.bin")}},
+		{name: "file length string", key: "files", value: file("length", bencode.BString("1000"))},
+		{name: "file path string", key: "files", value: file("path", bencode.BString("a.bin"))},
+		{name: "file path entry int", key: "files", value: file("path", bencode.BList{bencode.BInt64(1)})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := bencode.BMap{
+				bencode.BString("name"):         bencode.BString("temp"),
+				bencode.BString("piece length"): bencode.BInt64(262144),
+				bencode.BString("pieces"):       bencode.BString(strings.Repeat("a", 20)),
+				bencode.BString("length"):       bencode.BInt64(1000),
+			}
+			if tt.key == "files" {
+				delete(info, bencode.BString("length"))
+			}
+			info[bencode.BString(tt.key)] = tt.value
+
+			_, err := DecodeInfoFromBencode(info)
+			require.True(t, errors.Is(err, ErrTypeAssertionFromBencode), "%v", err)
+		})
+	}
+
+	_, err := DecodeMetaInfoFromBencode(bencode.BMap{
+		bencode.BString("announce"): bencode.BInt64(1),
+		bencode.BString("info"):     bencode.BMap{},
+	})
+	require.True(t, errors.Is(err, ErrTypeAssertionFromBencode))
+}
+
+func TestInfoSource(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	info := bencode.BMap{
+		bencode.BString("name"):         bencode.BString("temp"),
+		bencode.BString("piece length"): bencode.BInt64(262144),
+		bencode.BString("pieces"):       bencode.BString(strings.Repeat("a", 20)),
+		bencode.BString("length"):       bencode.BInt64(1000),
+	}
+
+	plain, err := DecodeInfoFromBencode(info)
+	require.Nil(t, err)
+	require.Equal(t, "", plain.Source)
+
+	info[bencode.BString("source")] = bencode.BString("PTP")
+	tagged, err := DecodeInfoFromBencode(info)
+	require.Nil(t, err)
+	require.Equal(t, "PTP", tagged.Source)
+	require.NotEqual(t, plain.InfoHash, tagged.InfoHash)
+
+	info[bencode.BString("source")] = bencode.BInt64(1)
+	_, err = DecodeInfoFromBencode(info)
+	require.True(t, errors.Is(err, ErrTypeAssertionFromBencode))
+}
+
+func TestPiecesFlat(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		err   error
+	}{
+		{
+			name:  "no pieces",
+			input: []byte{},
+		},
+		{
+			name:  "single piece",
+			input: []byte(strings.Repeat("a", 20)),
+		},
+		{
+			name:  "multiple distinct pieces",
+			input: []byte(strings.Repeat("a", 20) + strings.Repeat("b", 20) + strings.Repeat("c", 20)),
+		},
+		{
+			name:  "not a multiple of 20",
+			input: []byte(strings.Repeat("a", 21)),
+			err:   ErrPieceNotCorrentLen,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pieces, err := PiecesFromBytes(tt.input)
+			if tt.err != nil {
+				require.True(t, errors.Is(err, tt.err))
+				return
+			}
+
+			require.Nil(t, err)
+			require.Len(t, pieces, len(tt.input)/20)
+			for i, p := range pieces {
+				require.Equal(t, tt.input[i*20:(i+1)*20], p[:])
+			}
+
+			info := Info{Pieces: pieces}
+			require.Equal(t, tt.input, info.PiecesFlat())
+		})
+	}
+}
+
+func TestVerifyInfoHash(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	raw := "d6:lengthi1000e4:name4:temp12:piece lengthi16384e6:pieces20:" + strings.Repeat("a", 20) + "e"
+	benc, _, err := bencode.Decode([]byte(raw))
+	require.Nil(t, err)
+	info, err := DecodeInfoFromBencode(benc)
+	require.Nil(t, err)
+
+	require.Nil(t, VerifyInfoHash(info, sha1.Sum([]byte(raw))))
+
+	other := sha1.Sum([]byte("something else"))
+	require.True(t, errors.Is(VerifyInfoHash(info, other), ErrInfoHashMismatch))
+}
+
+func TestInfoHashStrings(t *testing.T) {
+	tests := []struct {
+		name   string
+		hash   string
+		hex    string
+		base32 string
+	}{
+		{
+			name:   "sequential bytes",
+			hash:   "000102030405060708090a0b0c0d0e0f10111213",
+			hex:    "000102030405060708090a0b0c0d0e0f10111213",
+			base32: "AAAQEAYEAUDAOCAJBIFQYDIOB4IBCEQT",
+		},
+		{
+			name:   "upper case input",
+			hash:   "C9E15763F722F23E98A29DECDFAE341B98D53056",
+			hex:    "c9e15763f722f23e98a29decdfae341b98d53056",
+			base32: "ZHQVOY7XELZD5GFCTXWN7LRUDOMNKMCW",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := hex.DecodeString(tt.hash)
+			require.Nil(t, err)
+
+			info := Info{}
+			copy(info.InfoHash[:], b)
+			require.Equal(t, tt.hex, info.InfoHashHex())
+			require.Len(t, info.InfoHashHex(), 40)
+			require.Equal(t, tt.base32, info.InfoHashBase32())
+			require.Len(t, info.InfoHashBase32(), 32)
+		})
+	}
+}
+
+func TestDecodeNodesFromBencode(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tests := []struct {
+		name     string
+		input    string
+		expected []NodeAddr
+		err      error
+	}{
+		{
+			name:  "two valid nodes",
+			input: "ll9:127.0.0.1i6881eel15:router.utorrenti6881eee",
+			expected: []NodeAddr{
+				{Host: "127.0.0.1", Port: 6881},
+				{Host: "router.utorrent", Port: 6881},
+			},
+		},
+		{
+			name:  "single element entry",
+			input: "ll9:127.0.0.1ee",
+			err:   ErrMalformedNode,
+		},
+		{
+			name:  "port not an int",
+			input: "ll9:127.0.0.14:6881ee",
+			err:   ErrMalformedNode,
+		},
+		{
+			name:  "nodes not a list",
+			input: "de",
+			err:   ErrTypeAssertionFromBencode,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			benc, _, err := bencode.Decode([]byte(tt.input))
+			require.Nil(t, err)
+
+			nodes, err := DecodeNodesFromBencode(benc)
+			if tt.err != nil {
+				require.Error(t, err)
+				require.True(t, errors.Is(err, tt.err))
+			} else {
+				require.Nil(t, err)
+				require.Equal(t, tt.expected, nodes)
+			}
+		})
+	}
+}
+
 func TestDecodeMetaInfo(t *testing.T) {
 	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
 
@@ -317,6 +1040,61 @@ func TestDecodeMetaInfo(t *testing.T) {
 				Info:     *infoStruct,
 			},
 		},
+		{
+			name: "metainfo with nodes",
+			bencodeInput: bencode.BMap{
+				bencode.BString("announce"): bencode.BString("here i come"),
+				bencode.BString("info"):     info,
+				bencode.BString("nodes"): bencode.BList{
+					bencode.BList{bencode.BString("127.0.0.1"), bencode.BInt64(6881)},
+					bencode.BList{bencode.BString("10.0.0.1"), bencode.BInt64(6882)},
+				},
+			},
+			expectedMeta: &MetaInfo{
+				Announce: "here i come",
+				Info:     *infoStruct,
+				Nodes: []NodeAddr{
+					{Host: "127.0.0.1", Port: 6881},
+					{Host: "10.0.0.1", Port: 6882},
+				},
+			},
+		},
+		{
+			name: "metainfo with announce-list",
+			bencodeInput: bencode.BMap{
+				bencode.BString("announce"): bencode.BString("here i come"),
+				bencode.BString("info"):     info,
+				bencode.BString("announce-list"): bencode.BList{
+					bencode.BList{bencode.BString("http://a"), bencode.BString("http://b")},
+					bencode.BList{bencode.BString("udp://c")},
+				},
+			},
+			expectedMeta: &MetaInfo{
+				Announce:     "here i come",
+				AnnounceList: [][]string{{"http://a", "http://b"}, {"udp://c"}},
+				Info:         *infoStruct,
+			},
+		},
+		{
+			name: "metainfo with malformed announce-list",
+			bencodeInput: bencode.BMap{
+				bencode.BString("announce"):      bencode.BString("here i come"),
+				bencode.BString("info"):          info,
+				bencode.BString("announce-list"): bencode.BList{bencode.BString("http://a")},
+			},
+			err: ErrTypeAssertionFromBencode,
+		},
+		{
+			name: "metainfo with malformed node",
+			bencodeInput: bencode.BMap{
+				bencode.BString("announce"): bencode.BString("here i come"),
+				bencode.BString("info"):     info,
+				bencode.BString("nodes"): bencode.BList{
+					bencode.BList{bencode.BString("127.0.0.1")},
+				},
+			},
+			err: ErrMalformedNode,
+		},
 		{
 			name:         "not a bmap metainfo",
 			bencodeInput: bencode.BList{},
@@ -354,6 +1132,67 @@ func TestDecodeMetaInfo(t *testing.T) {
 	}
 }
 
+func TestAllTrackers(t *testing.T) {
+	mi := MetaInfo{
+		Announce: "http://b",
+		AnnounceList: [][]string{
+			{"http://a", "http://b", ""},
+			{"udp://c", "http://a", "udp://d"},
+		},
+	}
+	require.Equal(t, []string{"http://b", "http://a", "udp://c", "udp://d"}, mi.AllTrackers())
+
+	require.Equal(t, []string{}, MetaInfo{}.AllTrackers())
+}
+
+func TestMetaInfoSameContent(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	decode := func(input string) *MetaInfo {
+		mi, err := DecodeMetaInfo(strings.NewReader(input))
+		require.Nil(t, err)
+		return mi
+	}
+	info := "4:infod6:lengthi1000e4:name4:temp12:piece lengthi16384e6:pieces20:" + strings.Repeat("a", 20) + "e"
+
+	a := decode("d8:announce8:http://a7:comment3:one" + info + "e")
+	b := decode("d8:announce8:http://b" + info + "e")
+	require.True(t, a.SameContent(b))
+	require.False(t, a.Equal(b))
+
+	require.True(t, a.Equal(decode("d8:announce8:http://a7:comment3:one"+info+"e")))
+
+	c := decode("d8:announce8:http://a4:infod6:lengthi1000e4:name5:other12:piece lengthi16384e6:pieces20:" + strings.Repeat("a", 20) + "ee")
+	require.False(t, a.SameContent(c))
+	require.False(t, a.Equal(c))
+
+	require.False(t, a.SameContent(nil))
+	require.False(t, MetaInfo{}.SameContent(&MetaInfo{}))
+}
+
+func TestDecodeInfoOnly(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	info := "d6:lengthi1000e4:name4:temp12:piece lengthi16384e6:pieces20:" + strings.Repeat("a", 20) + "e"
+
+	// no announce, and top level keys neither sorted nor of known types
+	data := "d4:zzzzi-0e4:info" + info + "3:agel1:xee"
+	_, err := DecodeMetaInfo(strings.NewReader(data))
+	require.NotNil(t, err)
+
+	got, err := DecodeInfoOnly([]byte(data))
+	require.Nil(t, err)
+	require.Equal(t, "temp", got.Name)
+	require.Equal(t, int64(1000), got.TotalLength())
+	require.Equal(t, sha1.Sum([]byte(info)), got.InfoHash)
+
+	_, err = DecodeInfoOnly([]byte("d8:announce8:http://ae"))
+	require.True(t, errors.Is(err, ErrKeyNotPresent))
+
+	_, err = DecodeInfoOnly([]byte("le"))
+	require.NotNil(t, err)
+}
+
 func TestGetMetaInfoFromTorrentFile(t *testing.T) {
 	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
 
@@ -363,6 +1202,7 @@ func TestGetMetaInfoFromTorrentFile(t *testing.T) {
 			Name:        "debian-10.2.0-amd64-netinst.iso",
 			Length:      351272960,
 			PieceLength: 262144,
+			fileOffsets: []int64{0},
 		},
 	}
 
@@ -420,6 +1260,78 @@ func TestGetMetaInfoFromTorrentFile(t *testing.T) {
 	}
 }
 
+func TestDecodeMetaInfoFromReader(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	meta, err := DecodeMetaInfo(bytes.NewReader(torrentFile))
+	require.Nil(t, err)
+	require.Equal(t, "http://bttracker.debian.org:6969/announce", meta.Announce)
+	require.Equal(t, "debian-10.2.0-amd64-netinst.iso", meta.Info.Name)
+
+	_, err = DecodeMetaInfo(io.MultiReader(bytes.NewReader(torrentFile), bytes.NewReader(make([]byte, MaxMetaInfoSize))))
+	require.True(t, errors.Is(err, ErrMetaInfoTooLarge))
+}
+
+func TestDecodeMetaInfoNotADict(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	_, err := GetMetaInfoFromTorrentFile(strings.NewReader("i5e"))
+	require.True(t, errors.Is(err, ErrNotAMetainfo))
+	require.ErrorContains(t, err, "got int")
+
+	_, err = GetMetaInfoFromTorrentFile(strings.NewReader("le"))
+	require.True(t, errors.Is(err, ErrNotAMetainfo))
+	require.ErrorContains(t, err, "got list")
+}
+
+func TestDecodeMetaInfoLenient(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// name before length and a zero padded piece length, both seen in
+	// torrents made by old tools.
+	rawInfo := "d4:name4:temp6:lengthi1000e12:piece lengthi0262144e6:pieces20:" + strings.Repeat("a", 20) + "e"
+	data := []byte("d8:announce9:http://a/4:info" + rawInfo + "e")
+
+	_, err := DecodeMetaInfo(bytes.NewReader(data))
+	require.True(t, errors.Is(err, bencode.ErrNotCanonical))
+
+	meta, err := DecodeMetaInfoWithOptions(bytes.NewReader(data), bencode.LenientOptions())
+	require.Nil(t, err)
+	require.Equal(t, int64(262144), meta.Info.PieceLength)
+	require.Equal(t, sha1.Sum([]byte(rawInfo)), meta.Info.InfoHash)
+}
+
+func TestDecodeMetaInfoZeroCopyIgnored(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	torrentNamed := func(name string) []byte {
+		return []byte("d8:announce9:http://a/4:infod6:lengthi1000e4:name4:" + name +
+			"12:piece lengthi262144e6:pieces20:" + strings.Repeat("a", 20) + "ee")
+	}
+	opts := bencode.DefaultOptions()
+	opts.ZeroCopy = true
+
+	first, err := DecodeMetaInfoWithOptions(bytes.NewReader(torrentNamed("aaaa")), opts)
+	require.Nil(t, err)
+	// the second torrent is read into the pooled buffer the first used
+	_, err = DecodeMetaInfoWithOptions(bytes.NewReader(torrentNamed("bbbb")), opts)
+	require.Nil(t, err)
+
+	require.Equal(t, "aaaa", first.Info.Name)
+	require.Equal(t, "http://a/", first.Announce)
+}
+
+func TestInfoHashMatchesRawInfoBytes(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	meta, err := GetMetaInfoFromTorrentFile(bytes.NewReader(torrentFile))
+	require.Nil(t, err)
+
+	start := bytes.Index(torrentFile, []byte("4:infod")) + len("4:info")
+	raw := torrentFile[start : len(torrentFile)-1]
+	require.Equal(t, sha1.Sum(raw), meta.Info.InfoHash)
+}
+
 func getBencStringForFile(t *testing.T, length int64, filepath []string) string {
 	t.Helper()
 
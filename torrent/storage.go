@@ -0,0 +1,200 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const zeroChunkLen = 1 << 20
+
+var (
+	ErrOutOfBounds = errors.New("offset is outside torrent content")
+)
+
+// Allocation selects how NewStorage sizes the files on disk.
+type Allocation int
+
+const (
+	// FullAllocation reserves every block up front so later writes can't fail
+	// for lack of space.
+	FullAllocation Allocation = iota
+	// SparseAllocation only sets the file size, blocks are allocated as data
+	// is written.
+	SparseAllocation
+)
+
+type storageFile struct {
+	file   *os.File
+	offset int64
+	length int64
+}
+
+// Storage maps the torrent's logical content, the files concatenated in
+// order, onto the files under baseDir.
+type Storage struct {
+	info  *Info
+	files []storageFile
+}
+
+func NewStorage(info *Info, baseDir string, alloc Allocation) (*Storage, error) {
+	if err := info.checkFilePaths(); err != nil {
+		return nil, fmt.Errorf("new storage: %w", err)
+	}
+
+	root := storageRoot(info, baseDir)
+
+	ret := &Storage{info: info}
+	offsets := info.FileOffsets()
+	for i, f := range info.Files() {
+		path := filepath.Join(root, f.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			ret.Close()
+			return nil, fmt.Errorf("new storage, create dir: %w", err)
+		}
+
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			ret.Close()
+			return nil, fmt.Errorf("new storage, open file: %w", err)
+		}
+		ret.files = append(ret.files, storageFile{file: file, offset: offsets[i], length: f.Length})
+
+		if err := allocate(file, f.Length, alloc); err != nil {
+			ret.Close()
+			return nil, fmt.Errorf("new storage, allocate %s: %w", path, err)
+		}
+	}
+
+	return ret, nil
+}
+
+// storageRoot is the directory the paths of info's files are relative to.
+func storageRoot(info *Info, baseDir string) string {
+	if info.IsMultiFile() {
+		return filepath.Join(baseDir, info.Name)
+	}
+	return baseDir
+}
+
+func allocate(file *os.File, length int64, alloc Allocation) error {
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() >= length {
+		return nil
+	}
+
+	if alloc == SparseAllocation {
+		return file.Truncate(length)
+	}
+	if fallocate(file, length) == nil {
+		return nil
+	}
+
+	zeros := make([]byte, zeroChunkLen)
+	for off := stat.Size(); off < length; off += zeroChunkLen {
+		n := min(int64(zeroChunkLen), length-off)
+		if _, err := file.WriteAt(zeros[:n], off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) span(p []byte, off int64, fn func(f storageFile, p []byte, fileOff int64) error) error {
+	if off < 0 || off+int64(len(p)) > s.info.TotalLength() {
+		return fmt.Errorf("offset %d len %d: %w", off, len(p), ErrOutOfBounds)
+	}
+
+	for _, f := range s.files {
+		if len(p) == 0 {
+			break
+		}
+
+		if off >= f.offset+f.length || f.length == 0 {
+			continue
+		}
+
+		fileOff := off - f.offset
+		n := min(int64(len(p)), f.length-fileOff)
+		if err := fn(f, p[:n], fileOff); err != nil {
+			return err
+		}
+
+		p = p[n:]
+		off += n
+	}
+
+	return nil
+}
+
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	err := s.span(p, off, func(f storageFile, p []byte, fileOff int64) error {
+		n, err := f.file.ReadAt(p, fileOff)
+		if err == io.EOF {
+			clear(p[n:])
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	err := s.span(p, off, func(f storageFile, p []byte, fileOff int64) error {
+		_, err := f.file.WriteAt(p, fileOff)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *Storage) ReadPiece(index int) ([]byte, error) {
+	size := s.info.PieceSize(index)
+	if size == 0 {
+		return nil, fmt.Errorf("read piece %d: %w", index, ErrOutOfBounds)
+	}
+
+	buf := make([]byte, size)
+	if _, err := s.ReadAt(buf, int64(index)*s.info.PieceLength); err != nil {
+		return nil, fmt.Errorf("read piece %d: %w", index, err)
+	}
+	return buf, nil
+}
+
+func (s *Storage) WritePiece(index int, data []byte) error {
+	if int64(len(data)) != s.info.PieceSize(index) {
+		return fmt.Errorf("write piece %d of len %d: %w", index, len(data), ErrOutOfBounds)
+	}
+
+	if _, err := s.WriteAt(data, int64(index)*s.info.PieceLength); err != nil {
+		return fmt.Errorf("write piece %d: %w", index, err)
+	}
+	return nil
+}
+
+// Sync commits the written content of every file to disk.
+func (s *Storage) Sync() error {
+	var errs []error
+	for _, f := range s.files {
+		errs = append(errs, f.file.Sync())
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Storage) Close() error {
+	var errs []error
+	for _, f := range s.files {
+		errs = append(errs, f.file.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,141 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func infoForContent(t *testing.T, name string, pieceLength int64, content []byte, files []*File) *Info {
+	t.Helper()
+
+	info := &Info{Name: name, PieceLength: pieceLength, FilesInfo: files}
+	if len(files) == 0 {
+		info.Length = int64(len(content))
+	}
+
+	for off := int64(0); off < int64(len(content)); off += pieceLength {
+		end := min(off+pieceLength, int64(len(content)))
+		info.Pieces = append(info.Pieces, sha1.Sum(content[off:end]))
+	}
+	return info
+}
+
+func TestStorageMultiFile(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	info := infoForContent(t, "temp", 32, content, []*File{
+		{Length: 30, Path: "a.txt"},
+		{Length: 50, Path: filepath.Join("dir", "b.txt")},
+		{Length: 20, Path: "c.txt"},
+	})
+
+	dir := t.TempDir()
+	s, err := NewStorage(info, dir, FullAllocation)
+	require.Nil(t, err)
+
+	for i := range info.Pieces {
+		off := int64(i) * info.PieceLength
+		require.Nil(t, s.WritePiece(i, content[off:off+info.PieceSize(i)]))
+	}
+
+	for i := range info.Pieces {
+		piece, err := s.ReadPiece(i)
+		require.Nil(t, err)
+		require.True(t, info.VerifyPiece(i, piece))
+	}
+	require.Nil(t, s.Close())
+
+	a, err := os.ReadFile(filepath.Join(dir, "temp", "a.txt"))
+	require.Nil(t, err)
+	require.Equal(t, content[:30], a)
+
+	b, err := os.ReadFile(filepath.Join(dir, "temp", "dir", "b.txt"))
+	require.Nil(t, err)
+	require.Equal(t, content[30:80], b)
+
+	c, err := os.ReadFile(filepath.Join(dir, "temp", "c.txt"))
+	require.Nil(t, err)
+	require.Equal(t, content[80:], c)
+}
+
+func TestStorageZeroLengthFile(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 4)
+	info := infoForContent(t, "temp", 16, content, []*File{
+		{Length: 25, Path: "a.txt"},
+		{Length: 0, Path: "placeholder"},
+		{Length: 15, Path: "c.txt"},
+	})
+	require.Equal(t, []int64{0, 25, 25}, info.FileOffsets())
+
+	dir := t.TempDir()
+	s, err := NewStorage(info, dir, FullAllocation)
+	require.Nil(t, err)
+
+	for i := range info.Pieces {
+		off := int64(i) * info.PieceLength
+		require.Nil(t, s.WritePiece(i, content[off:off+info.PieceSize(i)]))
+	}
+	for i := range info.Pieces {
+		piece, err := s.ReadPiece(i)
+		require.Nil(t, err)
+		require.True(t, info.VerifyPiece(i, piece))
+	}
+	require.Nil(t, s.Close())
+
+	a, err := os.ReadFile(filepath.Join(dir, "temp", "a.txt"))
+	require.Nil(t, err)
+	require.Equal(t, content[:25], a)
+
+	stat, err := os.Stat(filepath.Join(dir, "temp", "placeholder"))
+	require.Nil(t, err)
+	require.Equal(t, int64(0), stat.Size())
+
+	c, err := os.ReadFile(filepath.Join(dir, "temp", "c.txt"))
+	require.Nil(t, err)
+	require.Equal(t, content[25:], c)
+}
+
+func TestStorageDuplicateFilePath(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 4)
+	info := infoForContent(t, "temp", 16, content, []*File{
+		{Length: 20, Path: filepath.Join("dir", "a.txt")},
+		{Length: 20, Path: filepath.Join("dir", ".", "a.txt")},
+	})
+
+	dir := t.TempDir()
+	_, err := NewStorage(info, dir, FullAllocation)
+	require.True(t, errors.Is(err, ErrDuplicateFilePath))
+
+	_, err = os.Stat(filepath.Join(dir, "temp"))
+	require.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestStorageSingleFile(t *testing.T) {
+	content := bytes.Repeat([]byte("abc"), 11)
+	info := infoForContent(t, "single.bin", 16, content, nil)
+
+	dir := t.TempDir()
+	s, err := NewStorage(info, dir, FullAllocation)
+	require.Nil(t, err)
+	defer s.Close()
+
+	stat, err := os.Stat(filepath.Join(dir, "single.bin"))
+	require.Nil(t, err)
+	require.Equal(t, int64(len(content)), stat.Size())
+
+	require.Nil(t, s.WritePiece(2, content[32:]))
+	piece, err := s.ReadPiece(2)
+	require.Nil(t, err)
+	require.Equal(t, content[32:], piece)
+
+	err = s.WritePiece(2, content[:16])
+	require.True(t, errors.Is(err, ErrOutOfBounds))
+
+	_, err = s.ReadPiece(3)
+	require.True(t, errors.Is(err, ErrOutOfBounds))
+}
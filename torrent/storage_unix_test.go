@@ -0,0 +1,30 @@
+//go:build linux || darwin
+
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageSparseAllocation(t *testing.T) {
+	const length = 8 << 20
+	info := &Info{Name: "sparse.bin", PieceLength: 1 << 20, Length: length, Pieces: make([][20]byte, 8)}
+
+	dir := t.TempDir()
+	s, err := NewStorage(info, dir, SparseAllocation)
+	require.Nil(t, err)
+	defer s.Close()
+
+	stat, err := os.Stat(filepath.Join(dir, "sparse.bin"))
+	require.Nil(t, err)
+	require.Equal(t, int64(length), stat.Size())
+
+	// Blocks is counted in 512 byte units whatever the filesystem block size.
+	blocks := stat.Sys().(*syscall.Stat_t).Blocks
+	require.Less(t, blocks*512, int64(length))
+}
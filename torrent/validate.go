@@ -0,0 +1,71 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"path/filepath"
+)
+
+var (
+	ErrInvalidPieceLength = errors.New("piece length should be positive")
+	ErrPieceCountMismatch = errors.New("number of pieces does not match total length")
+	ErrDuplicateFilePath  = errors.New("two files share a path")
+)
+
+// Warning is a quality issue in a torrent that other clients may trip over
+// but that doesn't stop us from downloading it.
+type Warning struct {
+	Field   string
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Field, w.Message)
+}
+
+// checkFilePaths returns ErrDuplicateFilePath when two files would be created
+// at the same place on disk, the later one overwriting the other's data.
+func (i Info) checkFilePaths() error {
+	seen := make(map[string]int)
+	for index, f := range i.Files() {
+		path := filepath.Clean(f.Path)
+		if first, ok := seen[path]; ok {
+			return fmt.Errorf("files %d and %d at %q: %w", first, index, path, ErrDuplicateFilePath)
+		}
+		seen[path] = index
+	}
+	return nil
+}
+
+func (i Info) PieceLengthIsPowerOfTwo() bool {
+	return i.PieceLength > 0 && bits.OnesCount64(uint64(i.PieceLength)) == 1
+}
+
+// Validate checks the info dict for inconsistencies, it returns an error for
+// anything that makes the torrent unusable and warnings for the rest.
+func (i Info) Validate() ([]Warning, error) {
+	if i.PieceLength <= 0 {
+		return nil, fmt.Errorf("piece length %d: %w", i.PieceLength, ErrInvalidPieceLength)
+	}
+
+	total := i.TotalLength()
+	expected := (total + i.PieceLength - 1) / i.PieceLength
+	if int64(len(i.Pieces)) != expected {
+		return nil, fmt.Errorf("%d pieces for %d bytes, expected %d: %w", len(i.Pieces), total, expected, ErrPieceCountMismatch)
+	}
+
+	if err := i.checkFilePaths(); err != nil {
+		return nil, err
+	}
+
+	var warnings []Warning
+	if !i.PieceLengthIsPowerOfTwo() {
+		warnings = append(warnings, Warning{
+			Field:   "piece length",
+			Message: fmt.Sprintf("%d is not a power of two", i.PieceLength),
+		})
+	}
+
+	return warnings, nil
+}
@@ -0,0 +1,79 @@
+package torrent
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPieceLengthIsPowerOfTwo(t *testing.T) {
+	tests := []struct {
+		pieceLength int64
+		expected    bool
+	}{
+		{262144, true},
+		{16384, true},
+		{1, true},
+		{300000, false},
+		{0, false},
+		{-262144, false},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.expected, Info{PieceLength: tt.pieceLength}.PieceLengthIsPowerOfTwo(), tt.pieceLength)
+	}
+}
+
+func TestInfoValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		info     Info
+		warnings []Warning
+		err      error
+	}{
+		{
+			name: "power of two piece length",
+			info: Info{PieceLength: 262144, Length: 262144*2 + 10, Pieces: make([][20]byte, 3)},
+		},
+		{
+			name: "non power of two piece length",
+			info: Info{PieceLength: 300000, Length: 300000, Pieces: make([][20]byte, 1)},
+			warnings: []Warning{
+				{Field: "piece length", Message: "300000 is not a power of two"},
+			},
+		},
+		{
+			name: "zero piece length",
+			info: Info{Length: 10, Pieces: make([][20]byte, 1)},
+			err:  ErrInvalidPieceLength,
+		},
+		{
+			name: "too few pieces",
+			info: Info{PieceLength: 262144, Length: 262144 + 1, Pieces: make([][20]byte, 1)},
+			err:  ErrPieceCountMismatch,
+		},
+		{
+			name: "multi file lengths are summed",
+			info: Info{PieceLength: 16, FilesInfo: []*File{{Length: 10, Path: "a"}, {Length: 10, Path: "b"}}, Pieces: make([][20]byte, 2)},
+		},
+		{
+			name: "duplicate file path",
+			info: Info{PieceLength: 16, FilesInfo: []*File{{Length: 10, Path: "dir/a"}, {Length: 0, Path: "b"}, {Length: 10, Path: "dir//a"}}, Pieces: make([][20]byte, 2)},
+			err:  ErrDuplicateFilePath,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warnings, err := tt.info.Validate()
+			if tt.err != nil {
+				require.True(t, errors.Is(err, tt.err))
+				return
+			}
+
+			require.Nil(t, err)
+			require.Equal(t, tt.warnings, warnings)
+		})
+	}
+}
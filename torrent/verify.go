@@ -0,0 +1,146 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+var errMissingFile = errors.New("file missing")
+
+// VerifyExisting hashes the pieces of a download already under baseDir. Pieces
+// that match are set in good, the rest are listed in bad in increasing order.
+// A missing or short file makes the pieces it covers bad rather than failing,
+// err is only set when a file can't be opened or read for another reason.
+func VerifyExisting(info *Info, baseDir string) (good Bitfield, bad []int, err error) {
+	return VerifyExistingCtx(context.Background(), info, baseDir, nil)
+}
+
+// VerifyExistingCtx is VerifyExisting calling progress, when not nil, as each
+// piece is checked. Calls aren't concurrent but come in no particular order.
+// Once ctx is done it stops promptly and returns ctx's error along with the
+// pieces checked so far, the others are in neither good nor bad.
+func VerifyExistingCtx(ctx context.Context, info *Info, baseDir string, progress func(pieceIndex int, ok bool)) (good Bitfield, bad []int, err error) {
+	root := storageRoot(info, baseDir)
+
+	s := &Storage{info: info}
+	defer s.Close()
+
+	offsets := info.FileOffsets()
+	for i, f := range info.Files() {
+		path := filepath.Join(root, f.Path)
+		file, err := os.Open(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, fmt.Errorf("verify existing, open file: %w", err)
+		}
+		s.files = append(s.files, storageFile{file: file, offset: offsets[i], length: f.Length})
+	}
+
+	indexes := make(chan int)
+	ok := make([]bool, len(info.Pieces))
+	checked := make([]bool, len(info.Pieces))
+	errs := make([]error, len(info.Pieces))
+
+	var progressMu sync.Mutex
+	var wg sync.WaitGroup
+	for range runtime.GOMAXPROCS(0) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				if ctx.Err() != nil {
+					continue
+				}
+
+				ok[index], errs[index] = s.verifyPiece(info, index)
+				checked[index] = errs[index] == nil
+				if progress != nil && checked[index] {
+					progressMu.Lock()
+					progress(index, ok[index])
+					progressMu.Unlock()
+				}
+			}
+		}()
+	}
+feed:
+	for index := range info.Pieces {
+		select {
+		case indexes <- index:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, nil, fmt.Errorf("verify existing: %w", err)
+	}
+
+	good = NewBitfield(len(info.Pieces))
+	bad = make([]int, 0)
+	for index, valid := range ok {
+		if !checked[index] {
+			continue
+		}
+		if valid {
+			good.SetPiece(index)
+		} else {
+			bad = append(bad, index)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return good, bad, fmt.Errorf("verify existing: %w", err)
+	}
+	return good, bad, nil
+}
+
+// CorruptPieces hashes every piece of info held in s and returns the ones
+// that don't match in increasing order. info must describe the same content
+// as the Info s was created with, it may differ in the hashes.
+func (s *Storage) CorruptPieces(info *Info) ([]int, error) {
+	if info.TotalLength() != s.info.TotalLength() || info.PieceLength != s.info.PieceLength {
+		return nil, fmt.Errorf("corrupt pieces, info doesn't match storage: %w", ErrOutOfBounds)
+	}
+
+	ret := make([]int, 0)
+	for index := range info.Pieces {
+		ok, err := s.verifyPiece(info, index)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt pieces: %w", err)
+		}
+		if !ok {
+			ret = append(ret, index)
+		}
+	}
+	return ret, nil
+}
+
+func (s *Storage) verifyPiece(info *Info, index int) (bool, error) {
+	buf := make([]byte, info.PieceSize(index))
+	err := s.span(buf, int64(index)*info.PieceLength, func(f storageFile, p []byte, fileOff int64) error {
+		if f.file == nil {
+			return errMissingFile
+		}
+
+		n, err := f.file.ReadAt(p, fileOff)
+		if err == io.EOF && n < len(p) {
+			return errMissingFile
+		}
+		return err
+	})
+	if errors.Is(err, errMissingFile) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("piece %d: %w", index, err)
+	}
+
+	return info.VerifyPiece(index, buf), nil
+}
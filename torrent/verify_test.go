@@ -0,0 +1,116 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyExisting(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	info := infoForContent(t, "temp", 16, content, []*File{
+		{Length: 30, Path: "a.txt"},
+		{Length: 50, Path: "b.txt"},
+		{Length: 20, Path: "c.txt"},
+	})
+
+	dir := t.TempDir()
+	s, err := NewStorage(info, dir, FullAllocation)
+	require.Nil(t, err)
+	for i := range info.Pieces {
+		off := int64(i) * info.PieceLength
+		require.Nil(t, s.WritePiece(i, content[off:off+info.PieceSize(i)]))
+	}
+	require.Nil(t, s.Close())
+
+	good, bad, err := VerifyExisting(info, dir)
+	require.Nil(t, err)
+	require.Empty(t, bad)
+	for i := range info.Pieces {
+		require.True(t, good.HasPiece(i))
+	}
+
+	// Offset 50 falls in piece 3, inside b.txt.
+	f, err := os.OpenFile(filepath.Join(dir, "temp", "b.txt"), os.O_WRONLY, 0)
+	require.Nil(t, err)
+	_, err = f.WriteAt([]byte("x"), 20)
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	good, bad, err = VerifyExisting(info, dir)
+	require.Nil(t, err)
+	require.Equal(t, []int{3}, bad)
+	require.False(t, good.HasPiece(3))
+	require.True(t, good.HasPiece(2))
+
+	// c.txt covers the last 20 bytes, pieces 5 and 6.
+	require.Nil(t, os.Remove(filepath.Join(dir, "temp", "c.txt")))
+	_, bad, err = VerifyExisting(info, dir)
+	require.Nil(t, err)
+	require.Equal(t, []int{3, 5, 6}, bad)
+}
+
+func TestVerifyExistingCtxCancel(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 512)
+	info := infoForContent(t, "single.bin", 16, content, nil)
+
+	dir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "single.bin"), content, 0o644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	good, bad, err := VerifyExistingCtx(ctx, info, dir, func(pieceIndex int, ok bool) {
+		require.True(t, ok)
+		calls += 1
+		if calls == 3 {
+			cancel()
+		}
+	})
+	require.True(t, errors.Is(err, context.Canceled))
+	require.Less(t, calls, len(info.Pieces)/2)
+	require.Empty(t, bad)
+
+	checked := 0
+	for i := range info.Pieces {
+		if good.HasPiece(i) {
+			checked += 1
+		}
+	}
+	require.Equal(t, calls, checked)
+}
+
+func TestCorruptPieces(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	info := infoForContent(t, "temp", 16, content, []*File{
+		{Length: 30, Path: "a.txt"},
+		{Length: 70, Path: "b.txt"},
+	})
+
+	s, err := NewStorage(info, t.TempDir(), FullAllocation)
+	require.Nil(t, err)
+	defer s.Close()
+
+	for i := range info.Pieces {
+		off := int64(i) * info.PieceLength
+		require.Nil(t, s.WritePiece(i, content[off:off+info.PieceSize(i)]))
+	}
+	corrupt, err := s.CorruptPieces(info)
+	require.Nil(t, err)
+	require.Empty(t, corrupt)
+
+	_, err = s.WriteAt([]byte("x"), 20)
+	require.Nil(t, err)
+	_, err = s.WriteAt([]byte("x"), 70)
+	require.Nil(t, err)
+
+	corrupt, err = s.CorruptPieces(info)
+	require.Nil(t, err)
+	require.Equal(t, []int{1, 4}, corrupt)
+}
@@ -0,0 +1,535 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/bencode"
+	"github.com/skirtan1/bittorrent-client/torrent"
+)
+
+const (
+	maxResponseLen = 1 << 20
+	maxRedirects   = 5
+	// maxBodySnippet is how much of a body that isn't bencode goes into the
+	// decode error, enough to tell which error page a tracker sent.
+	maxBodySnippet = 128
+	trackerTimeout = 15 * time.Second
+
+	DefaultUserAgent = "SK/0001"
+)
+
+var (
+	ErrTrackerFailure     = errors.New("tracker returned a failure reason")
+	ErrMalformedPeers     = errors.New("malformed peers")
+	ErrAllTrackersFailed  = errors.New("no tracker responded")
+	ErrScrapeNotSupported = errors.New("tracker does not support scrape")
+)
+
+type Peer struct {
+	IP   net.IP
+	Port uint16
+	ID   [20]byte
+}
+
+func (p Peer) String() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
+
+// Event tells the tracker why we are announcing, EventNone is a regular
+// periodic announce.
+type Event int
+
+const (
+	EventNone Event = iota
+	EventStarted
+	EventStopped
+	EventCompleted
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	case EventCompleted:
+		return "completed"
+	default:
+		return ""
+	}
+}
+
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+	// TrackerID echoes the tracker id from an earlier response, if any.
+	TrackerID string
+	// ExternalIP is the address peers should reach us on when it isn't the
+	// one the tracker sees the request come from, e.g. behind NAT. It is sent
+	// as ip or ipv6 depending on its family, invalid addresses are left out.
+	ExternalIP net.IP
+	// IPv6 advertises an address peers can reach us on besides the one the
+	// tracker sees the request come from. It is only sent when ExternalIP
+	// isn't an IPv6 address, an IPv6 ExternalIP wins.
+	IPv6 net.IP
+	// NoPeerID asks the tracker to leave peer ids out of dictionary model
+	// peers, compact peers never have them.
+	NoPeerID bool
+	// Key lets the tracker recognize us when our IP changes, it must stay the
+	// same across every announce for a torrent.
+	Key string
+	// NoCompact leaves out compact=1, Client.Announce sets it itself when a
+	// tracker refuses compact responses.
+	NoCompact bool
+}
+
+type AnnounceResponse struct {
+	Peers []Peer
+	// Interval is how often the tracker wants to hear from us, we must never
+	// announce more often than MinInterval. Either is zero when not sent.
+	Interval    time.Duration
+	MinInterval time.Duration
+	TrackerID   string
+	// Warning is the tracker's "warning message". Unlike a failure reason
+	// the announce still went through and Peers is good to use.
+	Warning string
+}
+
+func (r AnnounceRequest) URL(announce string) (string, error) {
+	base, err := url.Parse(announce)
+	if err != nil {
+		return "", fmt.Errorf("parse announce url: %w", err)
+	}
+
+	params := base.Query()
+	params.Set("info_hash", string(r.InfoHash[:]))
+	params.Set("peer_id", string(r.PeerID[:]))
+	params.Set("port", strconv.Itoa(int(r.Port)))
+	params.Set("uploaded", strconv.FormatInt(r.Uploaded, 10))
+	params.Set("downloaded", strconv.FormatInt(r.Downloaded, 10))
+	params.Set("left", strconv.FormatInt(r.Left, 10))
+	if !r.NoCompact {
+		params.Set("compact", "1")
+	}
+	if r.Event != EventNone {
+		params.Set("event", r.Event.String())
+	}
+	if r.TrackerID != "" {
+		params.Set("trackerid", r.TrackerID)
+	}
+	if ip := r.ExternalIP; ip.To4() != nil {
+		params.Set("ip", ip.To4().String())
+	} else if len(ip) == net.IPv6len {
+		params.Set("ipv6", ip.String())
+	}
+	if !params.Has("ipv6") && len(r.IPv6) == net.IPv6len && r.IPv6.To4() == nil {
+		params.Set("ipv6", r.IPv6.String())
+	}
+	if r.NoPeerID {
+		params.Set("no_peer_id", "1")
+	}
+	if r.Key != "" {
+		params.Set("key", r.Key)
+	}
+	base.RawQuery = params.Encode()
+
+	return base.String(), nil
+}
+
+func parseCompact(b []byte, ipLen int) ([]Peer, error) {
+	peerLen := ipLen + 2
+	if len(b)%peerLen != 0 {
+		return nil, fmt.Errorf("compact peers of len %d: %w", len(b), ErrMalformedPeers)
+	}
+
+	ret := make([]Peer, 0, len(b)/peerLen)
+	for i := 0; i < len(b); i += peerLen {
+		ret = append(ret, Peer{
+			IP:   net.IP(append([]byte(nil), b[i:i+ipLen]...)),
+			Port: binary.BigEndian.Uint16(b[i+ipLen : i+peerLen]),
+		})
+	}
+	return ret, nil
+}
+
+func ParseCompactPeers(b []byte) ([]Peer, error) {
+	return parseCompact(b, net.IPv4len)
+}
+
+func ParseCompactPeers6(b []byte) ([]Peer, error) {
+	return parseCompact(b, net.IPv6len)
+}
+
+func CompactPeers(peers []Peer) (v4 []byte, v6 []byte) {
+	for _, p := range peers {
+		port := binary.BigEndian.AppendUint16(nil, p.Port)
+		if ip := p.IP.To4(); ip != nil {
+			v4 = append(append(v4, ip...), port...)
+		} else if ip := p.IP.To16(); ip != nil {
+			v6 = append(append(v6, ip...), port...)
+		}
+	}
+	return v4, v6
+}
+
+func decodePeerDicts(list bencode.BList) ([]Peer, error) {
+	ret := make([]Peer, 0, len(list))
+	for i, v := range list {
+		dict, ok := v.(bencode.BMap)
+		if !ok {
+			return nil, fmt.Errorf("peer %d not a dict: %w", i, ErrMalformedPeers)
+		}
+
+		ip, ok := dict[bencode.BString("ip")].(bencode.BString)
+		if !ok {
+			return nil, fmt.Errorf("peer %d ip: %w", i, ErrMalformedPeers)
+		}
+
+		port, ok := dict[bencode.BString("port")].(bencode.BInt64)
+		if !ok {
+			return nil, fmt.Errorf("peer %d port: %w", i, ErrMalformedPeers)
+		}
+
+		peer := Peer{IP: net.ParseIP(string(ip)), Port: uint16(port)}
+
+		// trackers honoring no_peer_id leave it out, the ID stays zero.
+		if id, ok := dict[bencode.BString("peer id")]; ok {
+			id, ok := id.(bencode.BString)
+			if !ok || len(id) != len(peer.ID) {
+				return nil, fmt.Errorf("peer %d peer id: %w", i, ErrMalformedPeers)
+			}
+			copy(peer.ID[:], id)
+		}
+		ret = append(ret, peer)
+	}
+	return ret, nil
+}
+
+func DecodeAnnounceResponse(b bencode.Bencode) (*AnnounceResponse, error) {
+	value, ok := b.(bencode.BMap)
+	if !ok {
+		return nil, fmt.Errorf("announce response not a dict: %w", torrent.ErrTypeAssertionFromBencode)
+	}
+
+	if reason, ok := value[bencode.BString("failure reason")]; ok {
+		return nil, fmt.Errorf("%w: %v", ErrTrackerFailure, reason)
+	}
+
+	ret := AnnounceResponse{}
+	if warning, ok := value[bencode.BString("warning message")].(bencode.BString); ok {
+		ret.Warning = string(warning)
+	}
+
+	peers, ok := value[bencode.BString("peers")]
+	peers6, ok6 := value[bencode.BString("peers6")]
+	if !ok && !ok6 {
+		return nil, fmt.Errorf("announce response peers: %w", torrent.ErrKeyNotPresent)
+	}
+
+	switch peers := peers.(type) {
+	case nil:
+	case bencode.BString:
+		p, err := ParseCompactPeers(peers.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		ret.Peers = p
+	case bencode.BList:
+		p, err := decodePeerDicts(peers)
+		if err != nil {
+			return nil, err
+		}
+		ret.Peers = p
+	default:
+		return nil, fmt.Errorf("announce response peers: %w", torrent.ErrTypeAssertionFromBencode)
+	}
+
+	// BEP 7 peers6 is always compact, 16 byte addresses and a port.
+	if ok6 {
+		compact, ok := peers6.(bencode.BString)
+		if !ok {
+			return nil, fmt.Errorf("announce response peers6: %w", torrent.ErrTypeAssertionFromBencode)
+		}
+		p, err := ParseCompactPeers6(compact.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		ret.Peers = append(ret.Peers, p...)
+	}
+
+	for key, interval := range map[string]*time.Duration{
+		"interval":     &ret.Interval,
+		"min interval": &ret.MinInterval,
+	} {
+		if secs, ok := value[bencode.BString(key)].(bencode.BInt64); ok && secs > 0 {
+			*interval = time.Duration(secs) * time.Second
+		}
+	}
+
+	if id, ok := value[bencode.BString("tracker id")].(bencode.BString); ok {
+		ret.TrackerID = string(id)
+	}
+
+	return &ret, nil
+}
+
+// Dialer opens the connections a Client makes, it matches net.Dialer and
+// proxy dialers such as golang.org/x/net/proxy's SOCKS5.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Client talks to trackers. HTTPClient is used as is when set, otherwise
+// requests go through an http.Client dialing with Dialer, or the default
+// transport when neither is set, following up to 5 redirects. The zero value
+// is ready to use.
+type Client struct {
+	HTTPClient *http.Client
+	Dialer     Dialer
+	// UserAgent is sent with every request, empty means DefaultUserAgent.
+	// Some trackers refuse requests without one.
+	UserAgent string
+
+	once    sync.Once
+	ownHTTP *http.Client
+}
+
+var DefaultClient = &Client{}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+
+	c.once.Do(func() {
+		c.ownHTTP = &http.Client{CheckRedirect: checkRedirect}
+		if c.Dialer != nil {
+			c.ownHTTP.Transport = &http.Transport{DialContext: c.Dialer.DialContext}
+		}
+	})
+	return c.ownHTTP
+}
+
+// checkRedirect caps redirects at maxRedirects and carries the announce
+// parameters over to a Location that drops them.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if req.URL.RawQuery == "" {
+		req.URL.RawQuery = via[0].URL.RawQuery
+	}
+	return nil
+}
+
+func (c *Client) userAgent() string {
+	if c.UserAgent == "" {
+		return DefaultUserAgent
+	}
+	return c.UserAgent
+}
+
+func (c *Client) get(ctx context.Context, u string) (bencode.Bencode, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("tracker request: %w", err)
+	}
+	httpReq.Header.Set("User-Agent", c.userAgent())
+
+	resp, err := c.httpClient().Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseLen))
+	if err != nil {
+		return nil, fmt.Errorf("read tracker response: %w", err)
+	}
+
+	// Content-Type is ignored, trackers label bencode as anything from
+	// text/plain to text/html.
+	benc, _, err := bencode.DecodeWithOptions(context.Background(), body, bencode.LenientOptions())
+	if err != nil {
+		return nil, fmt.Errorf("decode tracker response (%s, body %q): %w", resp.Status, bodySnippet(body), err)
+	}
+	return benc, nil
+}
+
+// bodySnippet returns the start of body, cut at maxBodySnippet bytes.
+func bodySnippet(body []byte) string {
+	if len(body) <= maxBodySnippet {
+		return string(body)
+	}
+	return strings.ToValidUTF8(string(body[:maxBodySnippet]), "") + "..."
+}
+
+func (c *Client) Announce(ctx context.Context, announce string, req AnnounceRequest) (*AnnounceResponse, error) {
+	u, err := req.URL(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	benc, err := c.get(ctx, u)
+	if err != nil {
+		return nil, fmt.Errorf("announce to %s: %w", announce, err)
+	}
+
+	resp, err := DecodeAnnounceResponse(benc)
+	if err != nil && !req.NoCompact && rejectsCompact(benc) {
+		req.NoCompact = true
+		return c.Announce(ctx, announce, req)
+	}
+	return resp, err
+}
+
+// rejectsCompact reports whether a tracker response is a failure over the
+// compact parameter, some old trackers refuse it.
+func rejectsCompact(b bencode.Bencode) bool {
+	value, _ := b.(bencode.BMap)
+	reason, _ := value[bencode.BString("failure reason")].(bencode.BString)
+	return strings.Contains(strings.ToLower(string(reason)), "compact")
+}
+
+func Announce(ctx context.Context, announce string, req AnnounceRequest) (*AnnounceResponse, error) {
+	return DefaultClient.Announce(ctx, announce, req)
+}
+
+// AnnounceMulti announces to the trackers of a BEP 12 announce-list, trying
+// each tier in order and each tracker within a tier in order. The tracker
+// that answers is moved to the front of its tier in place, so passing the
+// same tiers again tries it first.
+func (c *Client) AnnounceMulti(ctx context.Context, tiers [][]string, req AnnounceRequest) (*AnnounceResponse, error) {
+	var errs []error
+	for _, tier := range tiers {
+		for i, announce := range tier {
+			trackerCtx, cancel := context.WithTimeout(ctx, trackerTimeout)
+			resp, err := c.Announce(trackerCtx, announce, req)
+			cancel()
+
+			if err == nil {
+				copy(tier[1:i+1], tier[:i])
+				tier[0] = announce
+				return resp, nil
+			}
+
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %w", ErrAllTrackersFailed, errors.Join(errs...))
+}
+
+func AnnounceMulti(ctx context.Context, tiers [][]string, req AnnounceRequest) (*AnnounceResponse, error) {
+	return DefaultClient.AnnounceMulti(ctx, tiers, req)
+}
+
+type ScrapeStats struct {
+	Complete   int
+	Downloaded int
+	Incomplete int
+}
+
+// ScrapeURL derives the scrape url from an announce url, trackers only
+// support scrape when the last path element starts with "announce".
+func ScrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", fmt.Errorf("parse announce url: %w", err)
+	}
+
+	idx := strings.LastIndex(u.Path, "/")
+	if !strings.HasPrefix(u.Path[idx+1:], "announce") {
+		return "", fmt.Errorf("announce url %s: %w", announce, ErrScrapeNotSupported)
+	}
+
+	u.Path = u.Path[:idx+1] + "scrape" + strings.TrimPrefix(u.Path[idx+1:], "announce")
+	return u.String(), nil
+}
+
+func DecodeScrapeResponse(b bencode.Bencode) (map[[20]byte]ScrapeStats, error) {
+	value, ok := b.(bencode.BMap)
+	if !ok {
+		return nil, fmt.Errorf("scrape response not a dict: %w", torrent.ErrTypeAssertionFromBencode)
+	}
+
+	if reason, ok := value[bencode.BString("failure reason")]; ok {
+		return nil, fmt.Errorf("%w: %v", ErrTrackerFailure, reason)
+	}
+
+	files, ok := value[bencode.BString("files")].(bencode.BMap)
+	if !ok {
+		return nil, fmt.Errorf("scrape response files: %w", torrent.ErrKeyNotPresent)
+	}
+
+	ret := make(map[[20]byte]ScrapeStats, len(files))
+	for hash, v := range files {
+		stats, ok := v.(bencode.BMap)
+		if !ok || len(hash) != 20 {
+			return nil, fmt.Errorf("scrape response file %x: %w", hash, torrent.ErrTypeAssertionFromBencode)
+		}
+
+		var infoHash [20]byte
+		copy(infoHash[:], hash)
+
+		complete, _ := stats[bencode.BString("complete")].(bencode.BInt64)
+		downloaded, _ := stats[bencode.BString("downloaded")].(bencode.BInt64)
+		incomplete, _ := stats[bencode.BString("incomplete")].(bencode.BInt64)
+		ret[infoHash] = ScrapeStats{
+			Complete:   int(complete),
+			Downloaded: int(downloaded),
+			Incomplete: int(incomplete),
+		}
+	}
+	return ret, nil
+}
+
+// Scrape asks the tracker behind announce for the swarm size of each info
+// hash.
+func (c *Client) Scrape(ctx context.Context, announce string, infoHashes ...[20]byte) (map[[20]byte]ScrapeStats, error) {
+	scrape, err := ScrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(scrape)
+	if err != nil {
+		return nil, fmt.Errorf("parse scrape url: %w", err)
+	}
+
+	params := u.Query()
+	for _, h := range infoHashes {
+		params.Add("info_hash", string(h[:]))
+	}
+	u.RawQuery = params.Encode()
+
+	benc, err := c.get(ctx, u.String())
+	if err != nil {
+		return nil, fmt.Errorf("scrape %s: %w", scrape, err)
+	}
+
+	return DecodeScrapeResponse(benc)
+}
+
+func Scrape(ctx context.Context, announce string, infoHashes ...[20]byte) (map[[20]byte]ScrapeStats, error) {
+	return DefaultClient.Scrape(ctx, announce, infoHashes...)
+}
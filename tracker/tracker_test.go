@@ -0,0 +1,543 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skirtan1/bittorrent-client/bencode"
+	"github.com/skirtan1/bittorrent-client/torrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnounceRequestURL(t *testing.T) {
+	req := AnnounceRequest{
+		InfoHash: [20]byte{0xde, 0xad, 0xbe, 0xef},
+		PeerID:   [20]byte{'-', 'S', 'K'},
+		Port:     6881,
+		Left:     1000,
+	}
+
+	u, err := req.URL("http://tracker.example/announce?passkey=abc")
+	require.Nil(t, err)
+
+	parsed, err := url.Parse(u)
+	require.Nil(t, err)
+
+	query := parsed.Query()
+	require.Equal(t, "abc", query.Get("passkey"))
+	require.Equal(t, string(req.InfoHash[:]), query.Get("info_hash"))
+	require.Equal(t, string(req.PeerID[:]), query.Get("peer_id"))
+	require.Equal(t, "6881", query.Get("port"))
+	require.Equal(t, "0", query.Get("uploaded"))
+	require.Equal(t, "0", query.Get("downloaded"))
+	require.Equal(t, "1000", query.Get("left"))
+	require.Equal(t, "1", query.Get("compact"))
+	require.False(t, query.Has("event"))
+	require.False(t, query.Has("no_peer_id"))
+	require.False(t, query.Has("key"))
+
+	req.NoPeerID = true
+	req.Key = "1a2b3c4d"
+	u, err = req.URL("http://tracker.example/announce")
+	require.Nil(t, err)
+	parsed, err = url.Parse(u)
+	require.Nil(t, err)
+	require.Equal(t, "1", parsed.Query().Get("no_peer_id"))
+	require.Equal(t, "1a2b3c4d", parsed.Query().Get("key"))
+	req.NoPeerID = false
+	req.Key = ""
+
+	for event, expected := range map[Event]string{
+		EventStarted:   "started",
+		EventStopped:   "stopped",
+		EventCompleted: "completed",
+	} {
+		req.Event = event
+		u, err := req.URL("http://tracker.example/announce")
+		require.Nil(t, err)
+
+		parsed, err := url.Parse(u)
+		require.Nil(t, err)
+		require.Equal(t, expected, parsed.Query().Get("event"))
+	}
+}
+
+func TestDecodeAnnounceResponseIntervals(t *testing.T) {
+	benc, _, err := bencode.Decode([]byte("d8:intervali1800e12:min intervali300e5:peers0:10:tracker id5:abc12e"))
+	require.Nil(t, err)
+
+	resp, err := DecodeAnnounceResponse(benc)
+	require.Nil(t, err)
+	require.Equal(t, 30*time.Minute, resp.Interval)
+	require.Equal(t, 5*time.Minute, resp.MinInterval)
+	require.Equal(t, "abc12", resp.TrackerID)
+
+	u, err := AnnounceRequest{TrackerID: resp.TrackerID}.URL("http://tracker.example/announce")
+	require.Nil(t, err)
+	parsed, err := url.Parse(u)
+	require.Nil(t, err)
+	require.Equal(t, "abc12", parsed.Query().Get("trackerid"))
+	require.False(t, parsed.Query().Has("ipv6"))
+
+	u, err = AnnounceRequest{IPv6: net.ParseIP("2001:db8::2")}.URL("http://tracker.example/announce")
+	require.Nil(t, err)
+	parsed, err = url.Parse(u)
+	require.Nil(t, err)
+	require.Equal(t, "2001:db8::2", parsed.Query().Get("ipv6"))
+}
+
+func TestAnnounceRequestExternalIP(t *testing.T) {
+	query := func(ip net.IP) url.Values {
+		u, err := AnnounceRequest{ExternalIP: ip}.URL("http://tracker.example/announce")
+		require.Nil(t, err)
+		parsed, err := url.Parse(u)
+		require.Nil(t, err)
+		return parsed.Query()
+	}
+
+	q := query(net.ParseIP("203.0.113.7"))
+	require.Equal(t, "203.0.113.7", q.Get("ip"))
+	require.False(t, q.Has("ipv6"))
+
+	q = query(net.IP{203, 0, 113, 8})
+	require.Equal(t, "203.0.113.8", q.Get("ip"))
+
+	q = query(net.ParseIP("2001:db8::7"))
+	require.Equal(t, "2001:db8::7", q.Get("ipv6"))
+	require.False(t, q.Has("ip"))
+
+	for _, ip := range []net.IP{nil, {1, 2, 3}, net.ParseIP("not an ip")} {
+		q = query(ip)
+		require.False(t, q.Has("ip"), "%v", ip)
+		require.False(t, q.Has("ipv6"), "%v", ip)
+	}
+
+	both := func(external, v6 string) url.Values {
+		u, err := AnnounceRequest{ExternalIP: net.ParseIP(external), IPv6: net.ParseIP(v6)}.URL("http://tracker.example/announce")
+		require.Nil(t, err)
+		parsed, err := url.Parse(u)
+		require.Nil(t, err)
+		return parsed.Query()
+	}
+
+	// An IPv6 ExternalIP wins over IPv6.
+	q = both("2001:db8::7", "2001:db8::8")
+	require.Equal(t, "2001:db8::7", q.Get("ipv6"))
+	require.False(t, q.Has("ip"))
+
+	q = both("203.0.113.7", "2001:db8::8")
+	require.Equal(t, "203.0.113.7", q.Get("ip"))
+	require.Equal(t, "2001:db8::8", q.Get("ipv6"))
+}
+
+func TestParseCompactPeers(t *testing.T) {
+	peers, err := ParseCompactPeers([]byte{127, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2})
+	require.Nil(t, err)
+	require.Equal(t, []string{"127.0.0.1:6881", "10.0.0.2:6882"}, []string{peers[0].String(), peers[1].String()})
+
+	_, err = ParseCompactPeers([]byte{127, 0, 0, 1, 0x1a})
+	require.True(t, errors.Is(err, ErrMalformedPeers))
+}
+
+func TestCompactPeersRoundTrip(t *testing.T) {
+	peers := []Peer{
+		{IP: net.IP{10, 0, 0, 1}, Port: 6881},
+		{IP: net.ParseIP("2001:db8::1"), Port: 51413},
+		{IP: net.ParseIP("192.168.1.2"), Port: 80},
+	}
+
+	v4, v6 := CompactPeers(peers)
+	require.Len(t, v4, 12)
+	require.Len(t, v6, 18)
+
+	got4, err := ParseCompactPeers(v4)
+	require.Nil(t, err)
+	require.Equal(t, []string{"10.0.0.1:6881", "192.168.1.2:80"}, []string{got4[0].String(), got4[1].String()})
+
+	got6, err := ParseCompactPeers6(v6)
+	require.Nil(t, err)
+	require.Equal(t, "[2001:db8::1]:51413", got6[0].String())
+
+	_, err = ParseCompactPeers6(v6[:17])
+	require.True(t, errors.Is(err, ErrMalformedPeers))
+}
+
+func TestDecodeAnnounceResponse(t *testing.T) {
+	peerID := strings.Repeat("p", 20)
+
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+		err      error
+	}{
+		{
+			name:     "compact peers",
+			input:    "d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe1e",
+			expected: []string{"127.0.0.1:6881"},
+		},
+		{
+			name:     "dictionary peers",
+			input:    fmt.Sprintf("d8:intervali1800e5:peersld2:ip8:10.0.0.17:peer id20:%s4:porti6882eeee", peerID),
+			expected: []string{"10.0.0.1:6882"},
+		},
+		{
+			name:     "compact peers and peers6",
+			input:    "d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe16:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe2e",
+			expected: []string{"127.0.0.1:6881", "[2001:db8::1]:6882"},
+		},
+		{
+			name:     "only peers6",
+			input:    "d8:intervali1800e6:peers618:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e",
+			expected: []string{"[::1]:6881"},
+		},
+		{
+			name:  "malformed peers6",
+			input: "d8:intervali1800e6:peers63:abce",
+			err:   ErrMalformedPeers,
+		},
+		{
+			name:  "failure reason",
+			input: "d14:failure reason12:unregisterede",
+			err:   ErrTrackerFailure,
+		},
+		{
+			name:  "missing peers",
+			input: "d8:intervali1800ee",
+			err:   torrent.ErrKeyNotPresent,
+		},
+		{
+			name:  "peers of the wrong type",
+			input: "d8:intervali1800e5:peersi7ee",
+			err:   torrent.ErrTypeAssertionFromBencode,
+		},
+		{
+			name:     "dictionary peer without peer id",
+			input:    "d8:intervali1800e5:peersld2:ip8:10.0.0.14:porti6882eeee",
+			expected: []string{"10.0.0.1:6882"},
+		},
+		{
+			name:  "dictionary peer with short peer id",
+			input: "d8:intervali1800e5:peersld2:ip8:10.0.0.17:peer id3:abc4:porti6882eeee",
+			err:   ErrMalformedPeers,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			benc, _, err := bencode.Decode([]byte(tt.input))
+			require.Nil(t, err)
+
+			resp, err := DecodeAnnounceResponse(benc)
+			if tt.err != nil {
+				require.True(t, errors.Is(err, tt.err))
+				return
+			}
+
+			require.Nil(t, err)
+			got := make([]string, 0)
+			for _, p := range resp.Peers {
+				got = append(got, p.String())
+			}
+			require.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestDecodeAnnounceResponseNoPeerID(t *testing.T) {
+	peerID := strings.Repeat("p", 20)
+	input := fmt.Sprintf("d8:intervali1800e5:peersld2:ip8:10.0.0.14:porti6881eed2:ip8:10.0.0.27:peer id20:%s4:porti6882eeee", peerID)
+
+	benc, _, err := bencode.Decode([]byte(input))
+	require.Nil(t, err)
+	resp, err := DecodeAnnounceResponse(benc)
+	require.Nil(t, err)
+
+	require.Len(t, resp.Peers, 2)
+	require.Equal(t, "10.0.0.1:6881", resp.Peers[0].String())
+	require.Equal(t, [20]byte{}, resp.Peers[0].ID)
+	require.Equal(t, peerID, string(resp.Peers[1].ID[:]))
+}
+
+func TestDecodeAnnounceResponseWarning(t *testing.T) {
+	input := "d8:intervali1800e5:peers6:\x0a\x00\x00\x01\x1a\xe115:warning message9:slow downe"
+
+	benc, _, err := bencode.Decode([]byte(input))
+	require.Nil(t, err)
+	resp, err := DecodeAnnounceResponse(benc)
+	require.Nil(t, err)
+
+	require.Equal(t, "slow down", resp.Warning)
+	require.Len(t, resp.Peers, 1)
+	require.Equal(t, "10.0.0.1:6881", resp.Peers[0].String())
+
+	// a failure reason wins over a warning and any peers sent with it.
+	input = "d14:failure reason12:unregistered8:intervali1800e5:peers0:15:warning message9:slow downe"
+	benc, _, err = bencode.Decode([]byte(input))
+	require.Nil(t, err)
+	resp, err = DecodeAnnounceResponse(benc)
+	require.Nil(t, resp)
+	require.True(t, errors.Is(err, ErrTrackerFailure))
+	require.Contains(t, err.Error(), "unregistered")
+}
+
+func TestAnnounce(t *testing.T) {
+	var infoHash string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		infoHash = r.URL.Query().Get("info_hash")
+		w.Write([]byte("d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer server.Close()
+
+	resp, err := Announce(context.Background(), server.URL+"/announce", AnnounceRequest{InfoHash: [20]byte{1, 2, 3}})
+	require.Nil(t, err)
+	require.Equal(t, []Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881}}, resp.Peers)
+	require.Equal(t, string([]byte{1, 2, 3}), strings.TrimRight(infoHash, "\x00"))
+}
+
+func TestAnnounceIgnoresContentType(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer server.Close()
+
+	resp, err := Announce(context.Background(), server.URL+"/announce", AnnounceRequest{})
+	require.Nil(t, err)
+	require.Len(t, resp.Peers, 1)
+}
+
+func TestAnnounceErrorPageSnippet(t *testing.T) {
+	page := "<html><head><title>502 Bad Gateway</title></head><body>" + strings.Repeat("x", 500) + "</body></html>"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(page))
+	}))
+	defer server.Close()
+
+	_, err := Announce(context.Background(), server.URL+"/announce", AnnounceRequest{})
+	var syntaxErr *bencode.SyntaxError
+	require.True(t, errors.As(err, &syntaxErr))
+	require.Contains(t, err.Error(), "502 Bad Gateway")
+	require.Contains(t, err.Error(), "<html><head><title>")
+	// only the start of the page
+	require.NotContains(t, err.Error(), "</html>")
+}
+
+func TestAnnounceRetriesWithoutCompact(t *testing.T) {
+	var mu sync.Mutex
+	var compacts []string
+	tracker := func(failure string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			compacts = append(compacts, r.URL.Query().Get("compact"))
+			mu.Unlock()
+			if r.URL.Query().Has("compact") {
+				fmt.Fprintf(w, "d14:failure reason%d:%se", len(failure), failure)
+				return
+			}
+			w.Write([]byte("d8:intervali1800e5:peersld2:ip8:10.0.0.14:porti6881eeee"))
+		}))
+	}
+
+	server := tracker("compact responses unsupported")
+	defer server.Close()
+
+	resp, err := Announce(context.Background(), server.URL+"/announce", AnnounceRequest{Port: 6881})
+	require.Nil(t, err)
+	require.Len(t, resp.Peers, 1)
+	mu.Lock()
+	require.Equal(t, []string{"1", ""}, compacts)
+	compacts = nil
+	mu.Unlock()
+
+	// other failures aren't retried
+	other := tracker("unregistered torrent")
+	defer other.Close()
+
+	_, err = Announce(context.Background(), other.URL+"/announce", AnnounceRequest{Port: 6881})
+	require.True(t, errors.Is(err, ErrTrackerFailure))
+	mu.Lock()
+	require.Equal(t, []string{"1"}, compacts)
+	mu.Unlock()
+}
+
+func TestAnnounceMulti(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason4:gonee"))
+	}))
+	defer failing.Close()
+
+	var hits int
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits += 1
+		w.Write([]byte("d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer working.Close()
+
+	unused := "http://127.0.0.1:1/announce"
+	tiers := [][]string{
+		{failing.URL + "/announce", working.URL + "/announce", unused},
+		{unused},
+	}
+
+	resp, err := AnnounceMulti(context.Background(), tiers, AnnounceRequest{})
+	require.Nil(t, err)
+	require.Equal(t, []Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881}}, resp.Peers)
+	require.Equal(t, 1, hits)
+	require.Equal(t, [][]string{
+		{working.URL + "/announce", failing.URL + "/announce", unused},
+		{unused},
+	}, tiers)
+}
+
+func TestAnnounceMultiAllFail(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason4:gonee"))
+	}))
+	defer failing.Close()
+
+	tiers := [][]string{{failing.URL + "/announce"}, {failing.URL + "/other"}}
+	_, err := AnnounceMulti(context.Background(), tiers, AnnounceRequest{})
+	require.True(t, errors.Is(err, ErrAllTrackersFailed))
+	require.True(t, errors.Is(err, ErrTrackerFailure))
+
+	_, err = AnnounceMulti(context.Background(), nil, AnnounceRequest{})
+	require.True(t, errors.Is(err, ErrAllTrackersFailed))
+}
+
+type countingTransport struct {
+	calls int
+}
+
+func (t *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.calls += 1
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+type countingDialer struct {
+	net.Dialer
+	calls int
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.calls += 1
+	return d.Dialer.DialContext(ctx, network, addr)
+}
+
+func TestClientUsesCustomTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer server.Close()
+
+	transport := &countingTransport{}
+	client := &Client{HTTPClient: &http.Client{Transport: transport}}
+	_, err := client.Announce(context.Background(), server.URL+"/announce", AnnounceRequest{})
+	require.Nil(t, err)
+	require.Equal(t, 1, transport.calls)
+
+	dialer := &countingDialer{}
+	client = &Client{Dialer: dialer}
+	_, err = client.Announce(context.Background(), server.URL+"/announce", AnnounceRequest{})
+	require.Nil(t, err)
+	require.Equal(t, 1, dialer.calls)
+}
+
+func TestAnnounceFollowsRedirect(t *testing.T) {
+	var mu sync.Mutex
+	var agents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		agents = append(agents, r.UserAgent())
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/old/announce":
+			// the new location drops the query, it must be carried over
+			http.Redirect(w, r, "/announce", http.StatusMovedPermanently)
+		case "/announce":
+			if r.URL.Query().Get("port") != "6881" {
+				w.Write([]byte("d14:failure reason12:missing porte"))
+				return
+			}
+			w.Write([]byte("d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	resp, err := Announce(context.Background(), server.URL+"/old/announce", AnnounceRequest{Port: 6881})
+	require.Nil(t, err)
+	require.Len(t, resp.Peers, 1)
+	mu.Lock()
+	require.Equal(t, []string{DefaultUserAgent, DefaultUserAgent}, agents)
+	agents = nil
+	mu.Unlock()
+
+	client := &Client{UserAgent: "custom/1.0"}
+	_, err = client.Announce(context.Background(), server.URL+"/announce", AnnounceRequest{Port: 6881})
+	require.Nil(t, err)
+	mu.Lock()
+	require.Equal(t, []string{"custom/1.0"}, agents)
+	mu.Unlock()
+
+	_, err = Announce(context.Background(), server.URL+"/loop", AnnounceRequest{Port: 6881})
+	require.NotNil(t, err)
+}
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct {
+		announce string
+		expected string
+		err      error
+	}{
+		{"http://example.com/announce", "http://example.com/scrape", nil},
+		{"http://example.com/x/announce", "http://example.com/x/scrape", nil},
+		{"http://example.com/announce.php", "http://example.com/scrape.php", nil},
+		{"http://example.com/announce?passkey=abc", "http://example.com/scrape?passkey=abc", nil},
+		{"http://example.com/a", "", ErrScrapeNotSupported},
+		{"http://example.com/announce/x", "", ErrScrapeNotSupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.announce, func(t *testing.T) {
+			u, err := ScrapeURL(tt.announce)
+			if tt.err != nil {
+				require.True(t, errors.Is(err, tt.err))
+				return
+			}
+			require.Nil(t, err)
+			require.Equal(t, tt.expected, u)
+		})
+	}
+}
+
+func TestScrape(t *testing.T) {
+	hash := [20]byte{1, 2, 3}
+	var path string
+	var hashes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		hashes = r.URL.Query()["info_hash"]
+		fmt.Fprintf(w, "d5:filesd20:%sd8:completei5e10:downloadedi50e10:incompletei10eeee", hash[:])
+	}))
+	defer server.Close()
+
+	stats, err := Scrape(context.Background(), server.URL+"/announce", hash)
+	require.Nil(t, err)
+	require.Equal(t, "/scrape", path)
+	require.Equal(t, []string{string(hash[:])}, hashes)
+	require.Equal(t, map[[20]byte]ScrapeStats{hash: {Complete: 5, Downloaded: 50, Incomplete: 10}}, stats)
+}